@@ -11,6 +11,7 @@ class JoinScreen :
     ### __init__ - initialize and return a GameScreen
     def __init__(self) :
         self.first = True
+        self.status = ''
 
     ### set - set the background in the canvas
     def set(self, canvas) :
@@ -25,6 +26,15 @@ class JoinScreen :
         self.title  = canvas.create_text(X_CENTER, Y_CENTER, text = 'Please wait while a\ngame is formed...',
                                         font = ('Courier', M_TEXT_SIZE))
 
+        self.statusText = canvas.create_text(X_CENTER, Y_2THIRD, text = self.status,
+                                        font = ('Courier', S_TEXT_SIZE), width = CANVAS_WIDTH - 4*X_MARGIN)
+
+    ### setStatus - show progress or an error from the bootstrap client
+    def setStatus(self, canvas, status) :
+        self.status = status
+        if not self.first :
+            canvas.itemconfig(self.statusText, text = status)
+
     ### draw -  manages the drawing of the background
     def draw(self, canvas) :
         if(self.first) :
@@ -611,6 +611,11 @@ def react(canvas, received) :
             if content[MsgIndex.CON_CHECK_TYPE] == MsgPayload.SYNC_ERR_DN_EXECUTE :
                 canvas.data['artificalSync'] = True
 
+    # MSG_JOIN_STATUS - progress or trouble while a game is formed
+    elif kind == MsgType.MSG_JOIN_STATUS :
+        print('Join status: ' + content[MsgIndex.JOIN_STATUS_TEXT])
+        canvas.data['joinScreen'].setStatus(canvas, content[MsgIndex.JOIN_STATUS_TEXT])
+
     # MSG_UNICORN
     elif kind == MsgType.MSG_UNICORN :
         canvas.data['unicorn'] = content[MsgIndex.UNICORN_UNICORN]
@@ -1129,7 +1134,9 @@ def runUI(cmd_line_args) :
     root.bind('<Key>', keyPressed)
 
     # get the GoBridge
-    canvas.data['bridge'] = GoBridge(cmd_line_args[1]);
+    # an optional CA file enables TLS to the Go bridge (-uitls)
+    caFile = cmd_line_args[2] if len(cmd_line_args) > 2 else None
+    canvas.data['bridge'] = GoBridge(cmd_line_args[1], CA_FILE = caFile);
     
     # Set up for ReceiveThread
     Process = threading.Thread(target=canvas.data['bridge'].receiveThread)
@@ -177,6 +177,7 @@ class MsgType() :
     MSG_FORCE_COMMIT    = 'MFC'
     MSG_KILL_NODE       = 'MKN'
     MSG_GAME_TYPE       = 'MGT'
+    MSG_JOIN_STATUS     = 'MJS'
     MSG_MYNAME          = 'MMN'
     MSG_PADDLE_DIR      = 'MPD'
     MSG_PAUSE_UPDATE    = 'MPU'
@@ -234,6 +235,8 @@ class MsgIndex() :
     CON_REJOIN_NODE         = 1
     CON_REJOIN_REPLY        = 2
     DEAD_NODE               = 0
+    JOIN_STATUS_CODE        = 0
+    JOIN_STATUS_TEXT        = 1
     KILL_NODE               = 0
     PADDLE_DIR_DIR          = 0
     PADDLE_DIR_CENTER       = 1
@@ -0,0 +1,348 @@
+////////////////////////////////////////////////////////////
+//Multegula - accounts.go
+//Player accounts and the session tokens of the bootstrap server
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrap
+
+import (
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/*
+ * With an accounts file, players may register a name with a password or
+ * log in to one, and get a session token signed by the server's key,
+ * which is kept in the same file. A registered name can only be used by
+ * logging in; other names are guests, unless logins are required.
+ * Passwords are stored as salted PBKDF2 hashes. Checking them is slow on
+ * purpose, so it happens on the client's routine, not in
+ * receiveConnections, and only as many at once as there are CPUs; a
+ * client that waits passwordWait for its turn is told to come back
+ * later. Every address gets LOGIN_BURST attempts to register or log in
+ * with a password, and one more every LOGIN_INTERVAL.
+ */
+const SESSION_LIFETIME = 24 * time.Hour
+const MIN_PASSWORD_LENGTH int = 6
+const SALT_BYTES int = 16
+const HASH_BYTES int = 32
+const LOGIN_BURST int = 5
+const LOGIN_INTERVAL = 10 * time.Second
+
+/* addresses whose attempts are counted before the idle ones are forgotten */
+const MAX_LOGIN_ADDRESSES int = 4096
+
+/* lowered by the tests */
+var passwordIterations int = 600000
+var passwordWait = 5 * time.Second
+
+/* a slot for every password being hashed */
+var passwordHashers = make(chan struct{}, runtime.NumCPU())
+
+var errServerBusy = errors.New("Too many passwords to check")
+
+type account struct {
+	Salt       string // base64
+	Hash       string // base64
+	Iterations int
+	Created    time.Time
+}
+
+type accountStore struct {
+	mutex     sync.Mutex
+	path      string
+	ServerKey string // base64 seed of the server's private key
+	Accounts  map[string]*account
+	key       ed25519.PrivateKey
+	/* turn guests away */
+	requireLogin bool
+	attempts     *loginAttempts
+}
+
+/* the password attempts of every address, a token bucket each */
+type loginAttempts struct {
+	mutex   sync.Mutex
+	buckets map[string]*loginBucket
+	now     func() time.Time
+}
+
+type loginBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLoginAttempts() *loginAttempts {
+	return &loginAttempts{buckets: make(map[string]*loginBucket), now: time.Now}
+}
+
+/*
+ * counts an attempt from an address
+ * @return	false if the address is out of attempts
+ **/
+func (attempts *loginAttempts) allow(address string) bool {
+	attempts.mutex.Lock()
+	defer attempts.mutex.Unlock()
+	now := attempts.now()
+	refill := func(bucket *loginBucket) {
+		bucket.tokens += float64(now.Sub(bucket.last)) / float64(LOGIN_INTERVAL)
+		if bucket.tokens > float64(LOGIN_BURST) {
+			bucket.tokens = float64(LOGIN_BURST)
+		}
+		bucket.last = now
+	}
+	bucket, ok := attempts.buckets[address]
+	if !ok {
+		/* the addresses back to a full bucket are no different from new ones */
+		if len(attempts.buckets) >= MAX_LOGIN_ADDRESSES {
+			for other, idle := range attempts.buckets {
+				if refill(idle); idle.tokens >= float64(LOGIN_BURST) {
+					delete(attempts.buckets, other)
+				}
+			}
+		}
+		bucket = &loginBucket{tokens: float64(LOGIN_BURST), last: now}
+		attempts.buckets[address] = bucket
+	}
+	refill(bucket)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens -= 1
+	return true
+}
+
+/*
+ * opens the accounts file, creating it and the server's key if needed
+ */
+func openAccounts(path string) (*accountStore, error) {
+	store := &accountStore{path: path, Accounts: make(map[string]*account), attempts: newLoginAttempts()}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		store.ServerKey = base64.StdEncoding.EncodeToString(seed)
+		fmt.Println("Creating accounts file", path)
+		if err := store.save(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("Error when decoding %s: %v", path, err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(store.ServerKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Bad server key in %s", path)
+	}
+	store.key = ed25519.NewKeyFromSeed(seed)
+	if store.Accounts == nil {
+		store.Accounts = make(map[string]*account)
+	}
+	return store, nil
+}
+
+/*
+ * takes the server key and accounts of the leading server, see
+ * replication.go
+ */
+func (store *accountStore) replace(serverKey string, replicated []replicaAccount) error {
+	seed, err := base64.StdEncoding.DecodeString(serverKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return errors.New("Bad server key")
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.ServerKey = serverKey
+	store.key = ed25519.NewKeyFromSeed(seed)
+	store.Accounts = make(map[string]*account)
+	for i := range replicated {
+		store.Accounts[replicated[i].Name] = &replicated[i].Account
+	}
+	return store.save()
+}
+
+/* the public key peers check sessions with, "" if accounts are off */
+func (s *Server) serverKey() string {
+	if s.accounts == nil {
+		return ""
+	}
+	return s.accounts.publicKey()
+}
+
+/* the public key peers check sessions with, base64 */
+func (store *accountStore) publicKey() string {
+	return base64.StdEncoding.EncodeToString(store.key.Public().(ed25519.PublicKey))
+}
+
+/*
+ * writes the file, replacing the old one only once the new one is written
+ */
+func (store *accountStore) save() error {
+	data, err := json.MarshalIndent(store, "", "    ")
+	if err != nil {
+		return err
+	}
+	temp := store.path + ".tmp"
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, store.path)
+}
+
+/*
+ * hashes a password once a hasher is free
+ * @return	the hash, errServerBusy if none was free within passwordWait
+ **/
+func hashPassword(password string, salt []byte, iterations int) ([]byte, error) {
+	select {
+	case passwordHashers <- struct{}{}:
+	case <-time.After(passwordWait):
+		return nil, errServerBusy
+	}
+	defer func() { <-passwordHashers }()
+	return pbkdf2.Key(sha256.New, password, salt, iterations, HASH_BYTES)
+}
+
+/*
+ * registers a name
+ * @return	false if the name is registered already
+ **/
+func (store *accountStore) register(name string, password string) (bool, error) {
+	salt := make([]byte, SALT_BYTES)
+	if _, err := rand.Read(salt); err != nil {
+		return false, err
+	}
+	hash, err := hashPassword(password, salt, passwordIterations)
+	if err != nil {
+		return false, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, taken := store.Accounts[name]; taken {
+		return false, nil
+	}
+	store.Accounts[name] = &account{
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Hash:       base64.StdEncoding.EncodeToString(hash),
+		Iterations: passwordIterations,
+		Created:    time.Now(),
+	}
+	if err := store.save(); err != nil {
+		delete(store.Accounts, name)
+		return false, err
+	}
+	fmt.Println("Registered account", name)
+	return true, nil
+}
+
+/*
+ * checks a name's password
+ * @return	false if it is wrong, errServerBusy if it couldn't be checked
+ **/
+func (store *accountStore) login(name string, password string) (bool, error) {
+	store.mutex.Lock()
+	account, ok := store.Accounts[name]
+	store.mutex.Unlock()
+	if !ok {
+		return false, nil
+	}
+	salt, errSalt := base64.StdEncoding.DecodeString(account.Salt)
+	expected, errHash := base64.StdEncoding.DecodeString(account.Hash)
+	if errSalt != nil || errHash != nil {
+		return false, nil
+	}
+	hash, err := hashPassword(password, salt, account.Iterations)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(hash, expected) == 1, nil
+}
+
+func (store *accountStore) registered(name string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	_, ok := store.Accounts[name]
+	return ok
+}
+
+/* a new session for a node that logged in */
+func (store *accountStore) issue(node messagePasser.Node) (string, error) {
+	session := bootstrapClient.Session{Name: node.Name, Key: node.Key, Expires: time.Now().Add(SESSION_LIFETIME)}
+	return bootstrapClient.SignSession(session, store.key)
+}
+
+/*
+ * logs a client in, or lets it play as a guest
+ * @param	node – the client's node, its name is the account
+ * @param	login – how the client logs in, zero for a guest
+ *
+ * @return	the client's session, "" for a guest, or a reply turning the
+ *			client away
+ **/
+func (store *accountStore) authenticate(node messagePasser.Node, login bootstrapClient.Login) (string, *bootstrapClient.Reply) {
+	reject := func(reason string, message string) (string, *bootstrapClient.Reply) {
+		return "", &bootstrapClient.Reply{Rejected: reason, Message: message}
+	}
+	if (login.Register || len(login.Password) > 0) && !store.attempts.allow(node.IP) {
+		fmt.Println("Too many login attempts from", node.IP)
+		return reject(bootstrapClient.REJECT_BAD_LOGIN, "Too many attempts to log in, wait a minute and try again.")
+	}
+	switch {
+	case login.Register:
+		if len(login.Password) < MIN_PASSWORD_LENGTH {
+			return reject(bootstrapClient.REJECT_BAD_LOGIN,
+				fmt.Sprintf("Passwords need at least %d characters.", MIN_PASSWORD_LENGTH))
+		}
+		created, err := store.register(node.Name, login.Password)
+		if err == errServerBusy {
+			return reject(bootstrapClient.REJECT_BAD_LOGIN, "The server is busy, try again later.")
+		} else if err != nil {
+			fmt.Println("Couldn't register", node.Name, err)
+			return reject(bootstrapClient.REJECT_BAD_LOGIN, "The server couldn't save the account, try again later.")
+		} else if !created {
+			return reject(bootstrapClient.REJECT_NAME_REGISTERED,
+				fmt.Sprintf("The name %s is registered already, log in or pick another name.", node.Name))
+		}
+	case len(login.Password) > 0:
+		if ok, err := store.login(node.Name, login.Password); err != nil {
+			return reject(bootstrapClient.REJECT_BAD_LOGIN, "The server is busy, try again later.")
+		} else if !ok {
+			return reject(bootstrapClient.REJECT_BAD_LOGIN, "Wrong name or password.")
+		}
+	case len(login.Session) > 0:
+		// the other players see the token, only the key it was issued to may log in with it
+		session, err := bootstrapClient.VerifySession(login.Session, store.publicKey())
+		if err != nil || session.Name != node.Name || session.Key != node.Key || !store.registered(node.Name) {
+			return reject(bootstrapClient.REJECT_BAD_LOGIN, "The session is over, log in again.")
+		}
+	case store.registered(node.Name):
+		return reject(bootstrapClient.REJECT_NAME_REGISTERED,
+			fmt.Sprintf("The name %s belongs to an account, log in or pick another name.", node.Name))
+	case store.requireLogin:
+		return reject(bootstrapClient.REJECT_LOGIN_REQUIRED, "This server only takes players with an account, register or log in.")
+	default:
+		return "", nil
+	}
+	session, err := store.issue(node)
+	if err != nil {
+		return reject(bootstrapClient.REJECT_BAD_LOGIN, "The server couldn't start a session, try again later.")
+	}
+	return session, nil
+}
@@ -0,0 +1,156 @@
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+func openTestAccounts(t *testing.T) *accountStore {
+	passwordIterations = 1000
+	store, err := openAccounts(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func rejection(reply *bootstrapClient.Reply) string {
+	if reply == nil {
+		return ""
+	}
+	return reply.Rejected
+}
+
+func TestRegisterAndLogIn(t *testing.T) {
+	store := openTestAccounts(t)
+	node := messagePasser.Node{Name: "armin", Key: "key"}
+	session, reply := store.authenticate(node, bootstrapClient.Login{Password: "secret1", Register: true})
+	if reply != nil || len(session) == 0 {
+		t.Fatalf("Expected a session, got %+v", reply)
+	}
+	if err := bootstrapClient.VerifyNode(messagePasser.Node{Name: "armin", Key: "key", Session: session}, store.publicKey()); err != nil {
+		t.Errorf("The session should check out: %v", err)
+	}
+	for _, c := range []struct {
+		login  bootstrapClient.Login
+		reason string
+	}{
+		{bootstrapClient.Login{Password: "secret1"}, ""},
+		{bootstrapClient.Login{Session: session}, ""},
+		{bootstrapClient.Login{Password: "wrong!!"}, bootstrapClient.REJECT_BAD_LOGIN},
+		{bootstrapClient.Login{Session: "not.signed"}, bootstrapClient.REJECT_BAD_LOGIN},
+		{bootstrapClient.Login{Password: "secret2", Register: true}, bootstrapClient.REJECT_NAME_REGISTERED},
+		{bootstrapClient.Login{}, bootstrapClient.REJECT_NAME_REGISTERED},
+	} {
+		if _, reply := store.authenticate(node, c.login); rejection(reply) != c.reason {
+			t.Errorf("%+v: expected %q, got %+v", c.login, c.reason, reply)
+		}
+	}
+	stolen := messagePasser.Node{Name: "armin", Key: "another"}
+	if _, reply := store.authenticate(stolen, bootstrapClient.Login{Session: session}); rejection(reply) != bootstrapClient.REJECT_BAD_LOGIN {
+		t.Errorf("A session should only work with its own key, got %+v", reply)
+	}
+	if _, reply := store.authenticate(messagePasser.Node{Name: "lunwen"}, bootstrapClient.Login{Password: "short", Register: true}); rejection(reply) != bootstrapClient.REJECT_BAD_LOGIN {
+		t.Errorf("A short password should be refused, got %+v", reply)
+	}
+}
+
+func TestGuestsAndRequiredLogin(t *testing.T) {
+	store := openTestAccounts(t)
+	guest := messagePasser.Node{Name: "daniel"}
+	if session, reply := store.authenticate(guest, bootstrapClient.Login{}); reply != nil || len(session) != 0 {
+		t.Errorf("Expected a guest, got %q %+v", session, reply)
+	}
+	store.requireLogin = true
+	if _, reply := store.authenticate(guest, bootstrapClient.Login{}); rejection(reply) != bootstrapClient.REJECT_LOGIN_REQUIRED {
+		t.Errorf("Guests should be turned away, got %+v", reply)
+	}
+}
+
+func TestAccountsAreKept(t *testing.T) {
+	store := openTestAccounts(t)
+	if created, err := store.register("garrett", "secret1"); !created || err != nil {
+		t.Fatalf("Couldn't register: %v", err)
+	}
+	reopened, err := openAccounts(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.publicKey() != store.publicKey() {
+		t.Errorf("The server key changed.")
+	}
+	right, _ := reopened.login("garrett", "secret1")
+	wrong, _ := reopened.login("garrett", "secret2")
+	if !right || wrong {
+		t.Errorf("The account didn't survive reopening.")
+	}
+}
+
+func TestLoginAttemptsAreLimitedPerAddress(t *testing.T) {
+	store := openTestAccounts(t)
+	clock := time.Unix(1000, 0)
+	store.attempts.now = func() time.Time { return clock }
+	store.register("armin", "secret1")
+	guess := func(ip string) string {
+		_, reply := store.authenticate(messagePasser.Node{Name: "armin", IP: ip}, bootstrapClient.Login{Password: "guess!!"})
+		return reply.Message
+	}
+	for i := 0; i < LOGIN_BURST; i++ {
+		if message := guess("10.0.0.1"); message != "Wrong name or password." {
+			t.Fatalf("Attempt %d should be checked, got %q", i+1, message)
+		}
+	}
+	if message := guess("10.0.0.1"); message == "Wrong name or password." {
+		t.Errorf("Attempts past the burst shouldn't be checked.")
+	}
+	if message := guess("10.0.0.2"); message != "Wrong name or password." {
+		t.Errorf("Another address has attempts of its own, got %q", message)
+	}
+	clock = clock.Add(LOGIN_INTERVAL)
+	if message := guess("10.0.0.1"); message != "Wrong name or password." {
+		t.Errorf("An attempt should come back after LOGIN_INTERVAL, got %q", message)
+	}
+	// guests have no password to check and aren't counted
+	if _, reply := store.authenticate(messagePasser.Node{Name: "daniel", IP: "10.0.0.1"}, bootstrapClient.Login{}); reply != nil {
+		t.Errorf("A guest shouldn't be limited, got %+v", reply)
+	}
+}
+
+func TestPasswordsWaitForAFreeHasher(t *testing.T) {
+	store := openTestAccounts(t)
+	store.register("armin", "secret1")
+	wait := passwordWait
+	passwordWait = 50 * time.Millisecond
+	defer func() { passwordWait = wait }()
+	for i := 0; i < cap(passwordHashers); i++ {
+		passwordHashers <- struct{}{}
+	}
+	_, err := store.login("armin", "secret1")
+	for i := 0; i < cap(passwordHashers); i++ {
+		<-passwordHashers
+	}
+	if err != errServerBusy {
+		t.Errorf("Expected the server to be busy, got %v", err)
+	}
+	if ok, err := store.login("armin", "secret1"); !ok || err != nil {
+		t.Errorf("A free hasher should check the password, got %v, %v", ok, err)
+	}
+}
+
+func TestLoginWithoutAccounts(t *testing.T) {
+	var buffer bytes.Buffer
+	request := &bootstrapClient.Request{Node: messagePasser.Node{Name: "armin"}, Login: bootstrapClient.Login{Password: "secret1"}}
+	if newServer(DefaultConfig()).logIn(request, ClientInfo{Encoder: gob.NewEncoder(&buffer)}) {
+		t.Fatalf("Logging in without accounts should be refused.")
+	}
+	reply := bootstrapClient.Reply{}
+	if err := gob.NewDecoder(&buffer).Decode(&reply); err != nil || reply.Rejected != bootstrapClient.REJECT_NO_ACCOUNTS || len(reply.Message) == 0 {
+		t.Errorf("Expected a NO_ACCOUNTS rejection with a message, got %+v %v", reply, err)
+	}
+}
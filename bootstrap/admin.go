@@ -0,0 +1,301 @@
+////////////////////////////////////////////////////////////
+//Multegula - admin.go
+//HTTP status and admin API of the bootstrap server
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrap
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+)
+
+/*
+ * The admin API answers with JSON:
+ *	GET    /status                the rooms, their players and recent games
+ *	POST   /kick?room=&name=      drops a waiting player
+ *	POST   /start?room=           starts a room with whoever is waiting
+ *	POST   /drain                 turns new players away, the waiting ones stay
+ *	DELETE /drain                 takes new players again
+ *	GET    /leaderboard?limit=    the best players, see history.go
+ *	GET    /history?name=&limit=  the last games of a player
+ * room is the join code, empty or missing for quick match. The lobby
+ * state belongs to receiveConnections, so the requests that touch it
+ * run there through adminChannel; the methods of the Server that the API
+ * calls do the same for code that runs a server itself.
+ */
+const RECENT_GAMES int = 50
+
+type PlayerStatus struct {
+	Name   string
+	Addr   string
+	Ready  bool
+	Joined time.Time
+}
+
+type RoomStatus struct {
+	Code      string
+	Policy    LobbyPolicy
+	Players   []PlayerStatus
+	Counting  bool // the countdown is running
+	Checking  bool // a ready check is running
+	Permanent bool
+}
+
+type GameRecord struct {
+	ID      string // "" if the game couldn't be registered for rejoining
+	Room    string
+	Players []string
+	Started time.Time
+}
+
+type ReplicaStatus struct {
+	Self     string // where we replicate
+	Replicas []string
+	Leading  bool
+	Leader   string // where clients reach the leader, "" if unknown
+	Term     int
+}
+
+type ServerStatus struct {
+	Replica  *ReplicaStatus // nil if the server runs alone
+	Draining bool
+	Rooms    []RoomStatus
+	Games    []GameRecord // most recent first
+}
+
+/*
+ * remembers a game for the status, forgetting the oldest ones
+ */
+func (s *Server) recordGame(r *room, group map[net.Addr]bool, active *activeGame) {
+	game := GameRecord{Room: r.code, Started: time.Now()}
+	if active != nil {
+		game.ID = active.ID
+	}
+	for connAddr := range group {
+		game.Players = append(game.Players, r.clients[connAddr].Node.Name)
+	}
+	sort.Strings(game.Players)
+	s.recentGames = append([]GameRecord{game}, s.recentGames...)
+	if len(s.recentGames) > RECENT_GAMES {
+		s.recentGames = s.recentGames[:RECENT_GAMES]
+	}
+	if s.config.OnGameStarted != nil {
+		s.config.OnGameStarted(game)
+	}
+}
+
+/*
+ * runs an action in receiveConnections and waits for it
+ * @return	false if the server was closed before it ran
+ **/
+func (s *Server) runAdmin(action func()) bool {
+	done := make(chan struct{})
+	select {
+	case s.adminChannel <- func() {
+		action()
+		close(done)
+	}:
+	case <-s.quit:
+		return false
+	}
+	<-done
+	return true
+}
+
+func (s *Server) serverStatus() ServerStatus {
+	status := ServerStatus{Replica: s.replicaStatus(), Draining: s.draining, Rooms: []RoomStatus{}, Games: append([]GameRecord{}, s.recentGames...)}
+	for _, r := range s.rooms {
+		room := RoomStatus{Code: r.code, Policy: r.policy, Players: []PlayerStatus{},
+			Counting: r.countdown != 0, Checking: r.check != 0, Permanent: r.permanent}
+		for connAddr, client := range r.clients {
+			room.Players = append(room.Players, PlayerStatus{client.Node.Name, connAddr.String(), client.Ready, client.Joined})
+		}
+		sort.Slice(room.Players, func(i, j int) bool { return room.Players[i].Joined.Before(room.Players[j].Joined) })
+		status.Rooms = append(status.Rooms, room)
+	}
+	sort.Slice(status.Rooms, func(i, j int) bool { return status.Rooms[i].Code < status.Rooms[j].Code })
+	return status
+}
+
+/*
+ * drops a waiting player from a room
+ * @return	an error if there is no such room or player
+ **/
+func (s *Server) kick(code string, name string) error {
+	r, ok := s.rooms[normalizeRoomCode(code)]
+	if !ok {
+		return fmt.Errorf("No room %q", code)
+	}
+	for connAddr, client := range r.clients {
+		if client.Node.Name == name {
+			fmt.Printf("Kicking %s out of %v.\n", name, r)
+			sendLastReply(bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_KICKED}, client)
+			r.remove(connAddr)
+			r.update(false)
+			return nil
+		}
+	}
+	return fmt.Errorf("No player %q in %v", name, r)
+}
+
+/*
+ * starts a room now, with its usual ready check
+ * @return	an error if the room can't start
+ **/
+func (s *Server) forceStart(code string) error {
+	r, ok := s.rooms[normalizeRoomCode(code)]
+	if !ok {
+		return fmt.Errorf("No room %q", code)
+	}
+	if r.check != 0 {
+		return fmt.Errorf("%v is already starting", r)
+	}
+	if len(r.clients) < r.policy.MinPlayers {
+		return fmt.Errorf("%v needs at least %d players, it has %d", r, r.policy.MinPlayers, len(r.clients))
+	}
+	fmt.Printf("Starting %v with %v players on request!\n", r, len(r.clients))
+	r.countdown = 0
+	r.startCheck()
+	return nil
+}
+
+/* the rooms, their players and the recent games */
+func (s *Server) Status() ServerStatus {
+	var status ServerStatus
+	s.runAdmin(func() { status = s.serverStatus() })
+	return status
+}
+
+/*
+ * drops a waiting player from a room, "" for quick match
+ * @return	an error if there is no such room or player
+ **/
+func (s *Server) Kick(code string, name string) error {
+	err := ErrServerClosed
+	s.runAdmin(func() { err = s.kick(code, name) })
+	return err
+}
+
+/*
+ * starts a room with whoever is waiting, "" for quick match
+ * @return	an error if the room can't start
+ **/
+func (s *Server) ForceStart(code string) error {
+	err := ErrServerClosed
+	s.runAdmin(func() { err = s.forceStart(code) })
+	return err
+}
+
+/* turns new players away, or takes them again */
+func (s *Server) SetDraining(draining bool) {
+	s.runAdmin(func() {
+		s.draining = draining
+		fmt.Println("Draining:", s.draining)
+	})
+}
+
+/*
+ * the handler of the admin API
+ * @param	token – the bearer token requests need, "" for none
+ **/
+func (s *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.Status())
+	})
+	mux.HandleFunc("/kick", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		writeResult(w, s.Kick(req.FormValue("room"), req.FormValue("name")), http.StatusNotFound)
+	})
+	mux.HandleFunc("/start", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		writeResult(w, s.ForceStart(req.FormValue("room")), http.StatusConflict)
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+			http.Error(w, "POST or DELETE only", http.StatusMethodNotAllowed)
+			return
+		}
+		s.SetDraining(req.Method == http.MethodPost)
+		writeResult(w, nil, 0)
+	})
+	mux.HandleFunc("/leaderboard", func(w http.ResponseWriter, req *http.Request) {
+		s.serveHistory(w, req, bootstrapClient.HistoryQuery{})
+	})
+	mux.HandleFunc("/history", func(w http.ResponseWriter, req *http.Request) {
+		if len(req.FormValue("name")) == 0 {
+			writeResult(w, errors.New("No player name"), http.StatusBadRequest)
+			return
+		}
+		s.serveHistory(w, req, bootstrapClient.HistoryQuery{Player: req.FormValue("name")})
+	})
+	if len(token) == 0 {
+		return mux
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+/*
+ * answers a history query with the leaderboard or the player's games
+ */
+func (s *Server) serveHistory(w http.ResponseWriter, req *http.Request, query bootstrapClient.HistoryQuery) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	query.Limit, _ = strconv.Atoi(req.FormValue("limit"))
+	reply := s.queryHistory(query)
+	if len(reply.Rejected) > 0 {
+		writeResult(w, errors.New(reply.Message), http.StatusNotFound)
+	} else if len(query.Player) == 0 {
+		writeJSON(w, reply.Leaderboard)
+	} else {
+		writeJSON(w, reply.History)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+/*
+ * answers {"Ok": true}, or the error with the given status code
+ */
+func writeResult(w http.ResponseWriter, err error, code int) {
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Ok": false, "Error": err.Error()})
+		return
+	}
+	writeJSON(w, map[string]interface{}{"Ok": true})
+}
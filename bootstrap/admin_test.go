@@ -0,0 +1,139 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* runs admin actions the way receiveConnections does, for the test */
+func serveAdmin(t *testing.T, s *Server, token string) *httptest.Server {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case action := <-s.adminChannel:
+				action()
+			case <-done:
+				return
+			}
+		}
+	}()
+	server := httptest.NewServer(s.AdminHandler(token))
+	t.Cleanup(func() {
+		server.Close()
+		close(done)
+	})
+	return server
+}
+
+func adminRequest(t *testing.T, method string, url string) *http.Response {
+	req, _ := http.NewRequest(method, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminStatusAndKick(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.Countdown = time.Hour
+	r := newTestRoom(policy)
+	addTestClient(t, r, "armin")
+	lunwen := addTestClient(t, r, "lunwen")
+	server := serveAdmin(t, r.server, "")
+
+	status := ServerStatus{}
+	json.NewDecoder(adminRequest(t, "GET", server.URL+"/status").Body).Decode(&status)
+	found := false
+	for _, room := range status.Rooms {
+		if room.Code == r.code {
+			found = true
+			if len(room.Players) != 2 || room.Players[0].Name != "armin" || !room.Counting || room.Policy.Countdown != time.Hour {
+				t.Errorf("Expected armin and lunwen counting down, got %+v", room)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Expected %s in %+v", r.code, status)
+	}
+
+	if resp := adminRequest(t, "POST", server.URL+"/kick?room=test2&name=lunwen"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Kick failed: %v", resp.Status)
+	}
+	if reply := <-lunwen; reply.Rejected != "KICKED" {
+		t.Errorf("Expected lunwen to hear about the kick, got %+v", reply)
+	}
+	if len(r.clients) != 1 || r.countdown != 0 {
+		t.Errorf("Expected armin alone without a countdown, got %v", r.clients)
+	}
+	if resp := adminRequest(t, "POST", server.URL+"/kick?room=test2&name=lunwen"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Kicking twice should fail, got %v", resp.Status)
+	}
+	if resp := adminRequest(t, "POST", server.URL+"/start?room=test2"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("A room with one player shouldn't start, got %v", resp.Status)
+	}
+}
+
+func TestAdminForceStartNeedsMinPlayers(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.Countdown = time.Hour
+	policy.MinPlayers = 3
+	r := newTestRoom(policy)
+	addTestClient(t, r, "armin")
+	addTestClient(t, r, "daniel")
+	if err := r.server.forceStart("TEST2"); err == nil || r.check != 0 {
+		t.Errorf("A room needing 3 players shouldn't start with 2.")
+	}
+	addTestClient(t, r, "garrett")
+	if r.check == 0 && r.server.forceStart("TEST2") != nil {
+		t.Errorf("Expected the room to start with 3 players.")
+	}
+}
+
+func TestAdminForceStartRecordsGame(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.Countdown = time.Hour
+	r := newTestRoom(policy)
+	armin := addTestClient(t, r, "armin")
+	addTestClient(t, r, "daniel")
+	server := serveAdmin(t, r.server, "")
+
+	if resp := adminRequest(t, "POST", server.URL+"/start?room=TEST2"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Start failed: %v", resp.Status)
+	}
+	r.server.runAdmin(func() { passCheck(t, r) })
+	if !gotGame(armin) {
+		t.Fatalf("Expected the game to start.")
+	}
+	status := ServerStatus{}
+	json.NewDecoder(adminRequest(t, "GET", server.URL+"/status").Body).Decode(&status)
+	if len(status.Games) == 0 || status.Games[0].Room != "TEST2" || strings.Join(status.Games[0].Players, ",") != "armin,daniel" {
+		t.Errorf("Expected the game in the status, got %+v", status.Games)
+	}
+}
+
+func TestAdminDrainAndToken(t *testing.T) {
+	s := newServer(DefaultConfig())
+	server := serveAdmin(t, s, "secret")
+	if resp := adminRequest(t, "POST", server.URL+"/drain"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the token to be needed, got %v", resp.Status)
+	}
+	req, _ := http.NewRequest("POST", server.URL+"/drain", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Drain failed: %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	s.runAdmin(func() {
+		if !s.draining {
+			t.Errorf("Expected the server to drain.")
+		}
+	})
+}
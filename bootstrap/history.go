@@ -0,0 +1,335 @@
+////////////////////////////////////////////////////////////
+//Multegula - history.go
+//Match history and leaderboard of the bootstrap server
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/arminm/multegula/bootstrapClient"
+)
+
+/*
+ * With a history file, the server keeps the games its players report at
+ * their end. The file is an append only log, one JSON MatchRecord per
+ * line, synced before the report is acknowledged. It is read back into
+ * memory when the server starts and the leaderboard is worked out from
+ * it. A report is only taken for a game the server started and still has
+ * in activeGames, from one of its players, once per player. Any player
+ * could sign anything, so a game is only kept once more than half of its
+ * players sent the same results; a game most of whose players went away
+ * isn't kept.
+ */
+const MAX_HISTORY_LIMIT int = 200
+const MAX_RECORD_BYTES int = 1 << 20
+
+type matchStore struct {
+	mutex   sync.Mutex
+	file    *os.File
+	matches []bootstrapClient.MatchRecord // oldest first
+	games   map[string]bool               // IDs of the games reported
+}
+
+/*
+ * opens the history file, creating it if needed
+ */
+func openHistory(path string) (*matchStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store := &matchStore{file: file, matches: []bootstrapClient.MatchRecord{}, games: make(map[string]bool)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), MAX_RECORD_BYTES)
+	for line := 1; scanner.Scan(); line++ {
+		match := bootstrapClient.MatchRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &match); err != nil {
+			// most likely a write cut short when the server stopped
+			fmt.Printf("Skipping line %d of %s: %v\n", line, path, err)
+			continue
+		}
+		store.matches = append(store.matches, match)
+		store.games[match.GameID] = true
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error when reading %s: %v", path, err)
+	}
+	// a line cut short mustn't swallow the next record
+	if end, err := file.Seek(0, io.SeekEnd); err == nil && end > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, end-1); err == nil && last[0] != '\n' {
+			file.Write([]byte("\n"))
+		}
+	}
+	return store, nil
+}
+
+/*
+ * keeps a game
+ * @return	an error if the game couldn't be written
+ **/
+func (store *matchStore) record(match bootstrapClient.MatchRecord) error {
+	data, err := json.Marshal(match)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, err := store.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := store.file.Sync(); err != nil {
+		return err
+	}
+	store.matches = append(store.matches, match)
+	store.games[match.GameID] = true
+	return nil
+}
+
+/*
+ * keeps the games of another server's history we don't have, in its order
+ * @return	an error if a game couldn't be written
+ **/
+func (store *matchStore) merge(matches []bootstrapClient.MatchRecord) error {
+	for _, match := range matches {
+		if store.reported(match.GameID) {
+			continue
+		}
+		if err := store.record(match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* every game kept, oldest first */
+func (store *matchStore) all() []bootstrapClient.MatchRecord {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return append([]bootstrapClient.MatchRecord{}, store.matches...)
+}
+
+func (store *matchStore) reported(gameID string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.games[gameID]
+}
+
+func historyLimit(limit int) int {
+	if limit <= 0 {
+		return bootstrapClient.DEFAULT_HISTORY_LIMIT
+	} else if limit > MAX_HISTORY_LIMIT {
+		return MAX_HISTORY_LIMIT
+	}
+	return limit
+}
+
+/*
+ * the best players: most wins, then most points
+ */
+func (store *matchStore) leaderboard(limit int) []bootstrapClient.PlayerStats {
+	store.mutex.Lock()
+	players := make(map[string]*bootstrapClient.PlayerStats)
+	for _, match := range store.matches {
+		for _, result := range match.Players {
+			stats, ok := players[result.Name]
+			if !ok {
+				stats = &bootstrapClient.PlayerStats{Name: result.Name, BestScore: result.Score}
+				players[result.Name] = stats
+			}
+			stats.Games++
+			if match.Winner == result.Name {
+				stats.Wins++
+			}
+			stats.Blocks += result.Blocks
+			stats.TotalScore += result.Score
+			if result.Score > stats.BestScore {
+				stats.BestScore = result.Score
+			}
+		}
+	}
+	store.mutex.Unlock()
+	board := []bootstrapClient.PlayerStats{}
+	for _, stats := range players {
+		board = append(board, *stats)
+	}
+	sort.Slice(board, func(i, j int) bool {
+		if board[i].Wins != board[j].Wins {
+			return board[i].Wins > board[j].Wins
+		} else if board[i].TotalScore != board[j].TotalScore {
+			return board[i].TotalScore > board[j].TotalScore
+		}
+		return board[i].Name < board[j].Name
+	})
+	if limit = historyLimit(limit); len(board) > limit {
+		board = board[:limit]
+	}
+	return board
+}
+
+/*
+ * the last games of a player, most recent first
+ */
+func (store *matchStore) playerHistory(name string, limit int) []bootstrapClient.MatchRecord {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	games := []bootstrapClient.MatchRecord{}
+	limit = historyLimit(limit)
+	for i := len(store.matches) - 1; i >= 0 && len(games) < limit; i-- {
+		for _, result := range store.matches[i].Players {
+			if result.Name == name {
+				games = append(games, store.matches[i])
+				break
+			}
+		}
+	}
+	return games
+}
+
+/*
+ * checks the report of a game and keeps it, in receiveConnections since
+ * the games belong to it
+ * @return	the reply to the reporter
+ **/
+func (s *Server) reportGame(report bootstrapClient.GameReport) bootstrapClient.Reply {
+	reject := func(format string, args ...interface{}) bootstrapClient.Reply {
+		message := fmt.Sprintf(format, args...)
+		fmt.Printf("Refusing the report of game %s: %s\n", report.GameID, message)
+		return bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_BAD_REPORT, Message: message}
+	}
+	if s.history == nil {
+		return bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_NO_HISTORY, Message: "This server keeps no match history."}
+	}
+	s.pruneGames()
+	game, ok := s.activeGames[report.GameID]
+	if !ok {
+		return reject("Unknown game, or it started too long ago.")
+	}
+	reporter, ok := game.Players[report.Reporter]
+	if !ok {
+		return reject("%s didn't play in this game.", report.Reporter)
+	}
+	if err := bootstrapClient.VerifyReport(report, reporter.Node); err != nil {
+		return reject("The report isn't signed by %s.", report.Reporter)
+	}
+	if s.history.reported(game.ID) {
+		return reject("The game was reported already.")
+	}
+	seen := make(map[string]bool)
+	for _, result := range report.Players {
+		if _, ok := game.Players[result.Name]; !ok || seen[result.Name] {
+			return reject("The players don't match the game.")
+		} else if result.Lives < 0 || result.Blocks < 0 {
+			return reject("Bad result for %s.", result.Name)
+		}
+		seen[result.Name] = true
+	}
+	if len(seen) != len(game.Players) {
+		return reject("The players don't match the game.")
+	} else if len(report.Winner) > 0 && !seen[report.Winner] {
+		return reject("The winner didn't play in this game.")
+	}
+	players := append([]bootstrapClient.PlayerResult{}, report.Players...)
+	sort.Slice(players, func(i, j int) bool { return players[i].Name < players[j].Name })
+	report.Players = players
+	if game.Reports == nil {
+		game.Reports = make(map[string]bootstrapClient.GameReport)
+	}
+	// a later report replaces the one made when the player left, say
+	game.Reports[report.Reporter] = report
+	reporters := []string{}
+	for reporter := range game.Reports {
+		reporters = append(reporters, reporter)
+	}
+	sort.Strings(reporters)
+	var final *bootstrapClient.GameReport
+	for _, reporter := range reporters {
+		candidate := game.Reports[reporter]
+		if candidate.Final && backers(game, candidate)*2 > len(game.Players) {
+			final = &candidate
+			break
+		}
+	}
+	if final == nil {
+		fmt.Printf("%s reported game %s, %d of %d players reported so far.\n", report.Reporter, game.ID, len(game.Reports), len(game.Players))
+		return bootstrapClient.Reply{Message: "The game is kept once most of its players back its final results."}
+	}
+	match := bootstrapClient.MatchRecord{GameID: game.ID, Room: game.Room, Reporter: final.Reporter,
+		Winner: final.Winner, Players: final.Players, Started: game.Started, Ended: final.Ended}
+	if err := s.history.record(match); err != nil {
+		fmt.Println("Couldn't keep the report:", err)
+		return bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_BAD_REPORT, Message: "The server couldn't keep the report, try again later."}
+	}
+	fmt.Printf("Game %s is over, %s won.\n", game.ID, final.Winner)
+	return bootstrapClient.Reply{}
+}
+
+/*
+ * counts the players backing the final results of a game: those whose
+ * own report is final with the same results, and those that left before
+ * the end, as the results say
+ */
+func backers(game *activeGame, final bootstrapClient.GameReport) int {
+	left := make(map[string]bool)
+	for _, result := range final.Players {
+		left[result.Name] = result.Left
+	}
+	count := 0
+	for _, report := range game.Reports {
+		if (report.Final && sameResults(report, final)) || (!report.Final && left[report.Reporter]) {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+ * checks if two reports of a game tell the same results, their players
+ * sorted by name
+ */
+func sameResults(a bootstrapClient.GameReport, b bootstrapClient.GameReport) bool {
+	if a.Winner != b.Winner || len(a.Players) != len(b.Players) {
+		return false
+	}
+	for i := range a.Players {
+		if a.Players[i] != b.Players[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * answers a query for the leaderboard or the games of a player
+ */
+func (s *Server) queryHistory(query bootstrapClient.HistoryQuery) bootstrapClient.Reply {
+	if s.history == nil {
+		return bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_NO_HISTORY, Message: "This server keeps no match history."}
+	} else if len(query.Player) == 0 {
+		return bootstrapClient.Reply{Leaderboard: s.history.leaderboard(query.Limit)}
+	}
+	return bootstrapClient.Reply{History: s.history.playerHistory(query.Player, query.Limit)}
+}
+
+/*
+ * answers a client that only sends a report or a query
+ */
+func (s *Server) answerHistory(request *bootstrapClient.Request, clientInfo ClientInfo) {
+	if request.Report != nil {
+		reply := bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_BAD_REPORT, Message: "The server is shutting down."}
+		s.runAdmin(func() { reply = s.reportGame(*request.Report) })
+		sendReply(reply, clientInfo)
+	} else {
+		sendReply(s.queryHistory(*request.Query), clientInfo)
+	}
+}
@@ -0,0 +1,175 @@
+package bootstrap
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/* signs a report with a new key for its reporter's node */
+func signAs(t *testing.T, game *activeGame, report bootstrapClient.GameReport) bootstrapClient.GameReport {
+	key, err := messagePasser.GenerateLocalKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	game.Players[report.Reporter].Node.Key = key
+	report.Players = append([]bootstrapClient.PlayerResult{}, report.Players...)
+	bootstrapClient.SignReport(&report)
+	return report
+}
+
+/* a game of armin and lunwen, and the same report signed by each of them */
+func newReportedGame(t *testing.T, s *Server) (*activeGame, bootstrapClient.GameReport, bootstrapClient.GameReport) {
+	game := &activeGame{ID: "game1", Room: "TEST2", Started: time.Now(), Players: map[string]*gamePlayer{
+		"armin":  {Node: messagePasser.Node{Name: "armin"}},
+		"lunwen": {Node: messagePasser.Node{Name: "lunwen"}},
+	}}
+	s.activeGames[game.ID] = game
+	report := bootstrapClient.GameReport{GameID: game.ID, Winner: "armin", Ended: time.Now().UTC(), Final: true,
+		Players: []bootstrapClient.PlayerResult{{Name: "armin", Score: 120, Lives: 2, Blocks: 9}, {Name: "lunwen", Score: 40, Blocks: 3}}}
+	report.Reporter = "lunwen"
+	lunwen := signAs(t, game, report)
+	report.Reporter = "armin"
+	return game, signAs(t, game, report), lunwen
+}
+
+func openTestHistory(t *testing.T, s *Server, path string) {
+	store, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.history = store
+	t.Cleanup(func() { store.file.Close() })
+}
+
+func TestBadReportsAreRefused(t *testing.T) {
+	s := newServer(DefaultConfig())
+	openTestHistory(t, s, filepath.Join(t.TempDir(), "history.log"))
+	game, report, lunwen := newReportedGame(t, s)
+	for name, bad := range map[string]func(report *bootstrapClient.GameReport){
+		"unknown game":   func(report *bootstrapClient.GameReport) { report.GameID = "game2" },
+		"not a player":   func(report *bootstrapClient.GameReport) { report.Reporter = "daniel" },
+		"tampered":       func(report *bootstrapClient.GameReport) { report.Players[1].Score = 400 },
+		"other reporter": func(report *bootstrapClient.GameReport) { report.Reporter = "lunwen" },
+		"missing player": func(report *bootstrapClient.GameReport) { report.Players = report.Players[:1] },
+	} {
+		changed := report
+		changed.Players = append([]bootstrapClient.PlayerResult{}, report.Players...)
+		bad(&changed)
+		if reply := s.reportGame(changed); reply.Rejected != bootstrapClient.REJECT_BAD_REPORT {
+			t.Errorf("%s: expected the report to be refused, got %+v", name, reply)
+		}
+	}
+	if reply := s.reportGame(report); len(reply.Rejected) > 0 {
+		t.Fatalf("Expected the report to be taken, got %+v", reply)
+	}
+	if s.history.reported(game.ID) {
+		t.Errorf("One of two players can't report the game alone.")
+	}
+	if reply := s.reportGame(report); len(reply.Rejected) > 0 || s.history.reported(game.ID) {
+		t.Errorf("Reporting again should only replace the report, got %+v", reply)
+	}
+	if reply := s.reportGame(lunwen); len(reply.Rejected) > 0 || !s.history.reported(game.ID) {
+		t.Fatalf("Expected the game to be kept, got %+v", reply)
+	}
+	if reply := s.reportGame(lunwen); reply.Rejected != bootstrapClient.REJECT_BAD_REPORT {
+		t.Errorf("A game should only be kept once, got %+v", reply)
+	}
+}
+
+func TestReportsMustAgree(t *testing.T) {
+	s := newServer(DefaultConfig())
+	openTestHistory(t, s, filepath.Join(t.TempDir(), "history.log"))
+	game, report, lunwen := newReportedGame(t, s)
+	lunwen.Winner = "lunwen"
+	lunwen.Players[1].Score = 400
+	lunwen = signAs(t, game, lunwen)
+	for _, report := range []bootstrapClient.GameReport{lunwen, report} {
+		if reply := s.reportGame(report); len(reply.Rejected) > 0 {
+			t.Fatalf("Expected the report of %s to be taken, got %+v", report.Reporter, reply)
+		}
+	}
+	if s.history.reported(game.ID) {
+		t.Errorf("The game shouldn't be kept when the players disagree.")
+	}
+	if board := s.queryHistory(bootstrapClient.HistoryQuery{}).Leaderboard; len(board) > 0 {
+		t.Errorf("Expected an empty leaderboard, got %+v", board)
+	}
+}
+
+func TestReportsBeforeTheEndDontCount(t *testing.T) {
+	s := newServer(DefaultConfig())
+	openTestHistory(t, s, filepath.Join(t.TempDir(), "history.log"))
+	game, report, lunwen := newReportedGame(t, s)
+	early := lunwen
+	early.Final, early.Winner = false, ""
+	early.Players = []bootstrapClient.PlayerResult{{Name: "armin", Score: 20, Lives: 5, Blocks: 1}, {Name: "lunwen", Score: 10, Lives: 5}}
+	early = signAs(t, game, early)
+	for _, report := range []bootstrapClient.GameReport{early, report} {
+		if reply := s.reportGame(report); len(reply.Rejected) > 0 {
+			t.Fatalf("Expected the report of %s to be taken, got %+v", report.Reporter, reply)
+		}
+	}
+	if s.history.reported(game.ID) {
+		t.Errorf("lunwen didn't leave, its report from before the end can't back armin's.")
+	}
+	// the final report replaces the one from before the end
+	lunwen = signAs(t, game, lunwen)
+	if reply := s.reportGame(lunwen); len(reply.Rejected) > 0 || !s.history.reported(game.ID) {
+		t.Fatalf("Expected the game to be kept, got %+v", reply)
+	}
+	if games := s.queryHistory(bootstrapClient.HistoryQuery{Player: "lunwen"}).History; len(games) != 1 || games[0].Players[1].Score != 40 {
+		t.Errorf("Expected the final results, got %+v", games)
+	}
+}
+
+func TestPlayerLeavingEarlyBacksTheResults(t *testing.T) {
+	s := newServer(DefaultConfig())
+	openTestHistory(t, s, filepath.Join(t.TempDir(), "history.log"))
+	game, report, lunwen := newReportedGame(t, s)
+	// lunwen quit half way, armin played on alone
+	lunwen.Final, lunwen.Winner = false, ""
+	lunwen.Players = []bootstrapClient.PlayerResult{{Name: "armin", Score: 60, Lives: 3, Blocks: 4}, {Name: "lunwen", Score: 40, Lives: 2, Blocks: 3}}
+	lunwen = signAs(t, game, lunwen)
+	report.Players[1] = bootstrapClient.PlayerResult{Name: "lunwen", Score: 40, Lives: 2, Blocks: 3, Left: true}
+	report = signAs(t, game, report)
+	if reply := s.reportGame(report); len(reply.Rejected) > 0 || s.history.reported(game.ID) {
+		t.Fatalf("armin can't say alone that lunwen left, got %+v", reply)
+	}
+	if reply := s.reportGame(lunwen); len(reply.Rejected) > 0 || !s.history.reported(game.ID) {
+		t.Fatalf("Expected the game to be kept once lunwen reported leaving, got %+v", reply)
+	}
+	if games := s.queryHistory(bootstrapClient.HistoryQuery{Player: "armin"}).History; len(games) != 1 || games[0].Reporter != "armin" {
+		t.Errorf("Expected armin's results, got %+v", games)
+	}
+}
+
+func TestHistoryIsKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+	s := newServer(DefaultConfig())
+	openTestHistory(t, s, path)
+	_, report, lunwen := newReportedGame(t, s)
+	for _, report := range []bootstrapClient.GameReport{report, lunwen} {
+		if reply := s.reportGame(report); len(reply.Rejected) > 0 {
+			t.Fatalf("Expected the report to be kept, got %+v", reply)
+		}
+	}
+	s.history.file.Write([]byte(`{"GameID": "cut sho`))
+	s.history.file.Close()
+	openTestHistory(t, s, path)
+
+	board := s.queryHistory(bootstrapClient.HistoryQuery{}).Leaderboard
+	if len(board) != 2 || board[0].Name != "armin" || board[0].Wins != 1 || board[0].Blocks != 9 || board[1].TotalScore != 40 {
+		t.Errorf("Unexpected leaderboard %+v", board)
+	}
+	games := s.queryHistory(bootstrapClient.HistoryQuery{Player: "lunwen"}).History
+	if len(games) != 1 || games[0].Room != "TEST2" || games[0].Winner != "armin" {
+		t.Errorf("Unexpected history %+v", games)
+	}
+	if reply := s.reportGame(report); reply.Rejected != bootstrapClient.REJECT_BAD_REPORT {
+		t.Errorf("The game should still be known as reported, got %+v", reply)
+	}
+}
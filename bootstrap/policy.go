@@ -0,0 +1,157 @@
+////////////////////////////////////////////////////////////
+//Multegula - policy.go
+//When the rooms of the bootstrap server start their games
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/defs"
+)
+
+/*
+ * Once MinPlayers wait in a room a countdown starts, and the game starts
+ * when it runs out or as soon as MaxPlayers wait. With RestartOnJoin
+ * every player that joins during the countdown starts it over, with
+ * StartWhenReady the game also starts once every waiting player, at least
+ * MinPlayers of them, said they are ready.
+ *
+ * A base policy, from bootstrapServer's flags, applies to every room. The
+ * lobby file, if there is one, may set other policies for the quick match
+ * room, for created rooms and for named rooms that are always open; a
+ * policy in the file only needs the fields it changes, e.g.
+ *	{"QuickMatch": {"Countdown": "20s"}, "Named": {"FRIDAY": {"MaxPlayers": 2}}}
+ */
+type LobbyPolicy struct {
+	MinPlayers     int
+	MaxPlayers     int
+	Countdown      time.Duration // written like "10s" in the lobby file
+	RestartOnJoin  bool
+	StartWhenReady bool
+}
+
+type LobbyConfig struct {
+	QuickMatch LobbyPolicy
+	Created    LobbyPolicy            // rooms opened by players
+	Named      map[string]LobbyPolicy // rooms that are always open, by code
+}
+
+/* the policy of the constants in defs */
+func DefaultLobbyPolicy() LobbyPolicy {
+	return LobbyPolicy{
+		MinPlayers: defs.MIN_PLAYERS_PER_GAME,
+		MaxPlayers: defs.MAX_PLAYERS_PER_GAME,
+		Countdown:  defs.TIMEOUT_DURATION,
+	}
+}
+
+func (policy *LobbyPolicy) UnmarshalJSON(data []byte) error {
+	type plain LobbyPolicy
+	fields := struct {
+		*plain
+		Countdown string
+	}{plain: (*plain)(policy), Countdown: policy.Countdown.String()}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	countdown, err := time.ParseDuration(fields.Countdown)
+	if err != nil {
+		return err
+	}
+	policy.Countdown = countdown
+	return nil
+}
+
+func (policy LobbyPolicy) MarshalJSON() ([]byte, error) {
+	type plain LobbyPolicy
+	return json.Marshal(struct {
+		plain
+		Countdown string
+	}{plain(policy), policy.Countdown.String()})
+}
+
+/*
+ * checks a policy, the game has room for defs.MAX_PLAYERS_PER_GAME
+ */
+func (policy LobbyPolicy) validate() error {
+	if policy.MinPlayers < 2 || policy.MaxPlayers < policy.MinPlayers || policy.MaxPlayers > defs.MAX_PLAYERS_PER_GAME {
+		return fmt.Errorf("Bad lobby size: %d to %d players, 2 to %d allowed",
+			policy.MinPlayers, policy.MaxPlayers, defs.MAX_PLAYERS_PER_GAME)
+	}
+	if policy.Countdown <= 0 {
+		return fmt.Errorf("Bad countdown: %v", policy.Countdown)
+	}
+	return nil
+}
+
+/*
+ * reads the lobby policies from the lobby file
+ * @param	policy – the policy of every room the file doesn't change
+ * @param	path – the lobby file, it's fine if it doesn't exist
+ * @return	the policies, checked once the server takes them
+ **/
+func LoadLobbyConfig(policy LobbyPolicy, path string) (LobbyConfig, error) {
+	config := LobbyConfig{QuickMatch: policy, Created: policy}
+	file, errOpenFile := os.Open(path)
+	if errOpenFile == nil {
+		defer file.Close()
+		decoded := struct {
+			QuickMatch LobbyPolicy
+			Created    LobbyPolicy
+			Named      map[string]json.RawMessage
+		}{QuickMatch: policy, Created: policy}
+		if err := json.NewDecoder(file).Decode(&decoded); err != nil {
+			return config, fmt.Errorf("Error when decoding %s: %v", path, err)
+		}
+		config.QuickMatch = decoded.QuickMatch
+		config.Created = decoded.Created
+		// every named room starts from the given policy too
+		config.Named = make(map[string]LobbyPolicy)
+		for code, data := range decoded.Named {
+			named := policy
+			if err := json.Unmarshal(data, &named); err != nil {
+				return config, fmt.Errorf("Error when decoding room %s: %v", code, err)
+			}
+			config.Named[normalizeRoomCode(code)] = named
+		}
+		fmt.Println("Lobby policies from", path)
+	}
+	return config, nil
+}
+
+/*
+ * replaces the lobby policies and opens the named rooms
+ * @return	an error if a policy is invalid, nothing changes then
+ **/
+func (s *Server) setLobbyConfig(config LobbyConfig) error {
+	if err := config.QuickMatch.validate(); err != nil {
+		return fmt.Errorf("Quick match: %v", err)
+	}
+	if err := config.Created.validate(); err != nil {
+		return fmt.Errorf("Created rooms: %v", err)
+	}
+	for code, policy := range config.Named {
+		if len(normalizeRoomCode(code)) == 0 {
+			return fmt.Errorf("A named room needs a code")
+		}
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("Room %s: %v", code, err)
+		}
+	}
+	s.lobbyConfig = config
+	s.rooms[bootstrapClient.QUICK_MATCH].policy = config.QuickMatch
+	for code, policy := range config.Named {
+		code = normalizeRoomCode(code)
+		r := s.newRoom(code, policy)
+		r.permanent = true
+		s.rooms[code] = r
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package bootstrap
+
+import (
+	"encoding/gob"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+func writeLobbyFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "lobby.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+/* a new server with the lobby file */
+func loadLobbyFile(policy LobbyPolicy, path string) (*Server, error) {
+	config, err := LoadLobbyConfig(policy, path)
+	if err != nil {
+		return nil, err
+	}
+	s := newServer(DefaultConfig())
+	return s, s.setLobbyConfig(config)
+}
+
+func TestLobbyFileOnlyChangesItsFields(t *testing.T) {
+	flags := DefaultLobbyPolicy()
+	flags.RestartOnJoin = true
+	path := writeLobbyFile(t, `{"QuickMatch": {"Countdown": "20s"}, "Named": {"friday": {"MaxPlayers": 2}}}`)
+	s, err := loadLobbyFile(flags, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quickMatch := s.rooms[bootstrapClient.QUICK_MATCH].policy
+	if quickMatch.Countdown != 20*time.Second || quickMatch.MaxPlayers != flags.MaxPlayers || !quickMatch.RestartOnJoin {
+		t.Errorf("Expected the flags with a 20s countdown, got %+v", quickMatch)
+	}
+	if s.lobbyConfig.Created != flags {
+		t.Errorf("Expected created rooms to follow the flags, got %+v", s.lobbyConfig.Created)
+	}
+	friday, ok := s.rooms["FRIDAY"]
+	if !ok || !friday.permanent || friday.policy.MaxPlayers != 2 || friday.policy.Countdown != flags.Countdown {
+		t.Errorf("Expected an open room FRIDAY for 2, got %+v", friday)
+	}
+}
+
+func TestBadLobbyPolicyIsRefused(t *testing.T) {
+	for _, content := range []string{
+		`{"QuickMatch": {"MinPlayers": 1}}`,
+		`{"Created": {"MinPlayers": 3, "MaxPlayers": 2}}`,
+		`{"QuickMatch": {"MaxPlayers": 5}}`,
+		`{"QuickMatch": {"Countdown": "soon"}}`,
+		`{"Named": {"": {}}}`,
+	} {
+		if _, err := loadLobbyFile(DefaultLobbyPolicy(), writeLobbyFile(t, content)); err == nil {
+			t.Errorf("%s should be refused.", content)
+		}
+	}
+	if _, err := loadLobbyFile(DefaultLobbyPolicy(), filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("A missing lobby file should be fine, got %v", err)
+	}
+}
+
+/* net.Pipe addresses are all the same, tell the test clients apart */
+type testAddr string
+
+func (addr testAddr) Network() string { return "test" }
+func (addr testAddr) String() string  { return string(addr) }
+
+type testConn struct {
+	net.Conn
+	addr testAddr
+}
+
+func (conn testConn) RemoteAddr() net.Addr { return conn.addr }
+
+/* a client waiting in r, its replies go to the returned channel */
+func addTestClient(t *testing.T, r *room, name string) chan bootstrapClient.Reply {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	replies := make(chan bootstrapClient.Reply, 16)
+	go func() {
+		dec := gob.NewDecoder(client)
+		for {
+			reply := bootstrapClient.Reply{}
+			if dec.Decode(&reply) != nil {
+				io.Copy(io.Discard, client)
+				return
+			}
+			replies <- reply
+		}
+	}()
+	var conn net.Conn = testConn{server, testAddr(name)}
+	info := ClientInfo{Conn: &conn, Node: &messagePasser.Node{Name: name}, Encoder: gob.NewEncoder(conn)}
+	if !r.add(info) {
+		t.Fatalf("Couldn't add %s", name)
+	}
+	r.update(true)
+	return replies
+}
+
+/* every client in the ready check answers it */
+func passCheck(t *testing.T, r *room) {
+	if r.check == 0 {
+		t.Fatalf("Expected a ready check in %v", r)
+	}
+	for connAddr := range r.group {
+		r.answerCheck(connAddr, r.check)
+	}
+	r.update(false)
+}
+
+/* a room of its own server */
+func newTestRoom(policy LobbyPolicy) *room {
+	s := newServer(DefaultConfig())
+	r := s.newRoom("TEST2", policy)
+	r.permanent = true
+	s.rooms[r.code] = r
+	return r
+}
+
+func gotGame(replies chan bootstrapClient.Reply) bool {
+	for {
+		select {
+		case reply := <-replies:
+			if len(reply.Nodes) > 0 {
+				return true
+			}
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+}
+
+func TestEveryoneReadyStartsEarly(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.Countdown = time.Hour
+	policy.StartWhenReady = true
+	r := newTestRoom(policy)
+	armin := addTestClient(t, r, "armin")
+	lunwen := addTestClient(t, r, "lunwen")
+	if r.countdown == 0 {
+		t.Fatalf("Two players should start the countdown.")
+	}
+	r.setReady(testAddr("armin"))
+	r.update(false)
+	if len(r.clients) != 2 {
+		t.Fatalf("The game started before everyone was ready.")
+	}
+	r.setReady(testAddr("lunwen"))
+	r.update(false)
+	passCheck(t, r)
+	if !gotGame(armin) || !gotGame(lunwen) || len(r.clients) != 0 {
+		t.Errorf("Expected the game to start once everyone was ready.")
+	}
+}
+
+func TestRestartOnJoin(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.Countdown = time.Hour
+	for _, restart := range []bool{false, true} {
+		policy.RestartOnJoin = restart
+		r := newTestRoom(policy)
+		addTestClient(t, r, "armin")
+		addTestClient(t, r, "lunwen")
+		first := r.countdown
+		addTestClient(t, r, "daniel")
+		if restarted := r.countdown != first; restarted != restart {
+			t.Errorf("RestartOnJoin %v: countdown restarted %v", restart, restarted)
+		}
+		r.remove(testAddr("daniel"))
+		r.remove(testAddr("lunwen"))
+		r.update(false)
+		if r.countdown != 0 {
+			t.Errorf("The countdown should stop below MinPlayers.")
+		}
+	}
+}
+
+func TestMaxPlayersStartRightAway(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.MaxPlayers = 3
+	r := newTestRoom(policy)
+	armin := addTestClient(t, r, "armin")
+	addTestClient(t, r, "lunwen")
+	addTestClient(t, r, "daniel")
+	passCheck(t, r)
+	if !gotGame(armin) || len(r.clients) != 0 {
+		t.Errorf("Expected the game to start with 3 players.")
+	}
+}
@@ -0,0 +1,240 @@
+////////////////////////////////////////////////////////////
+//Multegula - rejoin.go
+//Registry of the games in progress, for players coming back and spectators
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrap
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/*
+ * Every game the server starts gets an ID, and every player in it a
+ * secret rejoin token, both sent with the other players. A player whose
+ * client went away comes back with its name, its signing key, the game ID
+ * and its token and gets the current roster back, with its own new
+ * address recorded for anyone asking after it. The key has to be the one
+ * it played with, the other players check its messages with that one.
+ *
+ * Every game also gets a watch code and a watch token, sent to all the
+ * players. The game's ID and the room code are no good for watching, a
+ * spectator registers with the watch code a player shared with it. It
+ * gets the token, which the players ask for before letting it follow the
+ * game, and the players' names and keys, to check what they send; where
+ * to reach a player comes from the player that let it watch. The server
+ * forgets a game after GameTTL, it can't tell when a game is over.
+ */
+const DEFAULT_GAME_TTL = 2 * time.Hour
+const TICKET_BYTES int = 16
+
+type gamePlayer struct {
+	Node  messagePasser.Node
+	Token string
+}
+
+type activeGame struct {
+	ID         string
+	Room       string
+	Started    time.Time
+	Players    map[string]*gamePlayer // by name
+	WatchToken string                 // shared by the players, for spectators
+	WatchCode  string                 // shared by the players with spectators
+	/* the reports of the game by reporter, see history.go */
+	Reports map[string]bootstrapClient.GameReport
+}
+
+func newTicketString() (string, error) {
+	buffer := make([]byte, TICKET_BYTES)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+/*
+ * registers a game that is starting
+ * @param	group – the clients in the game
+ * @return	the game, nil if no ID or token could be made
+ **/
+func (s *Server) registerGame(r *room, group map[net.Addr]bool) *activeGame {
+	s.pruneGames()
+	id, err := newTicketString()
+	if err != nil {
+		fmt.Println("Can't register the game:", err)
+		return nil
+	}
+	watchToken, err := newTicketString()
+	if err != nil {
+		fmt.Println("Can't register the game:", err)
+		return nil
+	}
+	watchCode, err := newTicketString()
+	if err != nil {
+		fmt.Println("Can't register the game:", err)
+		return nil
+	}
+	game := &activeGame{ID: id, Room: r.code, Started: time.Now(), Players: make(map[string]*gamePlayer),
+		WatchToken: watchToken, WatchCode: watchCode}
+	for connAddr := range group {
+		node := r.clients[connAddr].Node
+		token, err := newTicketString()
+		if err != nil {
+			fmt.Println("Can't register the game:", err)
+			return nil
+		}
+		game.Players[node.Name] = &gamePlayer{Node: *node, Token: token}
+	}
+	s.activeGames[id] = game
+	return game
+}
+
+/*
+ * the ticket of a player in a game, the zero Ticket if there is no game
+ */
+func (game *activeGame) ticket(name string) bootstrapClient.Ticket {
+	if game == nil {
+		return bootstrapClient.Ticket{}
+	}
+	return bootstrapClient.Ticket{GameID: game.ID, Token: game.Players[name].Token, Watch: game.WatchToken,
+		WatchCode: game.WatchCode}
+}
+
+/* the other players, by name */
+func (game *activeGame) roster(name string) []messagePasser.Node {
+	return game.players(name)
+}
+
+/*
+ * the players as spectators see them, only their names and keys
+ */
+func (game *activeGame) spectatorRoster() []messagePasser.Node {
+	nodes := []messagePasser.Node{}
+	for _, node := range game.players("") {
+		nodes = append(nodes, messagePasser.Node{Name: node.Name, Key: node.Key})
+	}
+	return nodes
+}
+
+/* the players but one, by name */
+func (game *activeGame) players(name string) []messagePasser.Node {
+	nodes := []messagePasser.Node{}
+	for _, player := range game.Players {
+		if player.Node.Name != name {
+			nodes = append(nodes, player.Node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
+/*
+ * forgets the games older than GameTTL
+ */
+func (s *Server) pruneGames() {
+	for id, game := range s.activeGames {
+		if time.Since(game.Started) > s.config.GameTTL {
+			delete(s.activeGames, id)
+		}
+	}
+}
+
+/*
+ * answers a player coming back to its game
+ * @param	clientInfo – the client, with the ticket it came back with
+ * @return	the roster, or why the client was turned away
+ **/
+func (s *Server) rejoinGame(clientInfo ClientInfo) bootstrapClient.Reply {
+	s.pruneGames()
+	ticket := clientInfo.Rejoin
+	game, ok := s.activeGames[ticket.GameID]
+	if !ok {
+		return bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_UNKNOWN_GAME}
+	}
+	player, ok := game.Players[clientInfo.Node.Name]
+	if !ok || subtle.ConstantTimeCompare([]byte(player.Token), []byte(ticket.Token)) != 1 ||
+		player.Node.Key != clientInfo.Node.Key {
+		return bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_BAD_TOKEN}
+	}
+	// the client may be back on another address or port
+	player.Node = *clientInfo.Node
+	fmt.Printf("%s rejoins game %s.\n", player.Node.Name, game.ID)
+	return bootstrapClient.Reply{Room: game.Room, Ticket: game.ticket(player.Node.Name), ServerKey: s.serverKey(),
+		Nodes: game.roster(player.Node.Name), Relay: s.config.Relay}
+}
+
+/*
+ * the key of a player in a game, for the relay to check its requests
+ * with, this is a public method, see messagePasser.RelayKeys
+ * @return	the player's key, false if the game or the player is unknown
+ **/
+func (s *Server) RelayKey(gameID string, name string) (string, bool) {
+	key, found := "", false
+	s.runAdmin(func() {
+		key, found = s.relayKey(gameID, name)
+	})
+	return key, found
+}
+
+func (s *Server) relayKey(gameID string, name string) (string, bool) {
+	s.pruneGames()
+	game, ok := s.activeGames[gameID]
+	if !ok {
+		return "", false
+	}
+	player, ok := game.Players[name]
+	if !ok || len(player.Node.Key) == 0 {
+		return "", false
+	}
+	return player.Node.Key, true
+}
+
+/*
+ * finds the game a spectator asked for by its watch code
+ * @return	the game, nil if there is none
+ **/
+func (s *Server) findGame(code string) *activeGame {
+	s.pruneGames()
+	for _, game := range s.activeGames {
+		if len(game.WatchCode) > 0 && subtle.ConstantTimeCompare([]byte(game.WatchCode), []byte(code)) == 1 {
+			return game
+		}
+	}
+	return nil
+}
+
+/*
+ * registers a spectator of a game
+ * @param	name – the spectator, for the players' logs
+ * @param	code – the game's watch code, from one of its players
+ * @return	the players and the watch token, or why there is nothing to watch
+ **/
+func (s *Server) watchGame(name string, code string) bootstrapClient.Reply {
+	game := s.findGame(code)
+	if game == nil || len(game.WatchToken) == 0 {
+		return bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_UNKNOWN_GAME,
+			Message: "There is no game to watch with that code, or it's over."}
+	}
+	fmt.Printf("%s watches game %s.\n", name, game.ID)
+	return bootstrapClient.Reply{Room: game.Room, Ticket: bootstrapClient.Ticket{GameID: game.ID, Watch: game.WatchToken},
+		ServerKey: s.serverKey(), Nodes: game.spectatorRoster()}
+}
+
+/*
+ * answers a spectator on its own connection
+ */
+func (s *Server) answerWatch(request *bootstrapClient.Request, clientInfo ClientInfo) {
+	reply := bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_UNKNOWN_GAME, Message: "The server is shutting down."}
+	s.runAdmin(func() { reply = s.watchGame(request.Node.Name, request.Watch) })
+	sendReply(reply, clientInfo)
+}
@@ -0,0 +1,121 @@
+package bootstrap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/* the reply with the players, skipping the ready check */
+func gameReply(t *testing.T, replies chan bootstrapClient.Reply) bootstrapClient.Reply {
+	for {
+		select {
+		case reply := <-replies:
+			if len(reply.Nodes) > 0 {
+				return reply
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No game started.")
+		}
+	}
+}
+
+func TestRejoinGetsRoster(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.MaxPlayers = 2
+	r := newTestRoom(policy)
+	armin := addTestClient(t, r, "armin")
+	lunwen := addTestClient(t, r, "lunwen")
+	passCheck(t, r)
+	ticket := gameReply(t, armin).Ticket
+	other := gameReply(t, lunwen).Ticket
+	s := r.server
+	if len(ticket.GameID) == 0 || ticket.GameID != other.GameID || ticket.Token == other.Token {
+		t.Fatalf("Expected one game with a token per player, got %+v and %+v", ticket, other)
+	}
+
+	back := &messagePasser.Node{Name: "armin", IP: "10.0.0.9", Port: 22222}
+	reply := s.rejoinGame(ClientInfo{Node: back, Rejoin: ticket})
+	if len(reply.Rejected) > 0 || len(reply.Nodes) != 1 || reply.Nodes[0].Name != "lunwen" {
+		t.Errorf("Expected lunwen back, got %+v", reply)
+	}
+	// lunwen coming back now finds armin at the new address
+	reply = s.rejoinGame(ClientInfo{Node: &messagePasser.Node{Name: "lunwen"}, Rejoin: other})
+	if len(reply.Nodes) != 1 || reply.Nodes[0].IP != "10.0.0.9" || reply.Nodes[0].Port != 22222 {
+		t.Errorf("Expected armin's new address, got %+v", reply)
+	}
+
+	stolen := ClientInfo{Node: &messagePasser.Node{Name: "lunwen"}, Rejoin: ticket}
+	if reply := s.rejoinGame(stolen); reply.Rejected != bootstrapClient.REJECT_BAD_TOKEN {
+		t.Errorf("Armin's token shouldn't work for lunwen, got %+v", reply)
+	}
+	newKey := ClientInfo{Node: &messagePasser.Node{Name: "armin", Key: "another"}, Rejoin: ticket}
+	if reply := s.rejoinGame(newKey); reply.Rejected != bootstrapClient.REJECT_BAD_TOKEN {
+		t.Errorf("Armin can't come back with another key, got %+v", reply)
+	}
+	unknown := ClientInfo{Node: back, Rejoin: bootstrapClient.Ticket{GameID: "over", Token: ticket.Token}}
+	if reply := s.rejoinGame(unknown); reply.Rejected != bootstrapClient.REJECT_UNKNOWN_GAME {
+		t.Errorf("Expected an unknown game, got %+v", reply)
+	}
+
+	s.activeGames[ticket.GameID].Started = time.Now().Add(-s.config.GameTTL - time.Second)
+	if reply := s.rejoinGame(ClientInfo{Node: back, Rejoin: ticket}); reply.Rejected != bootstrapClient.REJECT_UNKNOWN_GAME {
+		t.Errorf("Expected the game to be forgotten after GameTTL, got %+v", reply)
+	}
+}
+
+func TestRelayKnowsThePlayersKeys(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.MaxPlayers = 2
+	r := newTestRoom(policy)
+	armin := addTestClient(t, r, "armin")
+	addTestClient(t, r, "lunwen")
+	passCheck(t, r)
+	ticket := gameReply(t, armin).Ticket
+	s := r.server
+	s.activeGames[ticket.GameID].Players["armin"].Node.Key = "arminKey"
+
+	if key, found := s.relayKey(ticket.GameID, "armin"); !found || key != "arminKey" {
+		t.Errorf("Expected armin's key, got %q, %v", key, found)
+	}
+	if _, found := s.relayKey(ticket.GameID, "mallory"); found {
+		t.Errorf("Mallory isn't in the game.")
+	}
+	if _, found := s.relayKey("over", "armin"); found {
+		t.Errorf("An unknown game has no players.")
+	}
+}
+
+func TestSpectatorFindsTheGame(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.MaxPlayers = 2
+	r := newTestRoom(policy)
+	armin := addTestClient(t, r, "armin")
+	addTestClient(t, r, "lunwen")
+	passCheck(t, r)
+	ticket := gameReply(t, armin).Ticket
+	s := r.server
+	if len(ticket.Watch) == 0 || len(ticket.WatchCode) == 0 || ticket.WatchCode == ticket.Watch {
+		t.Fatalf("Expected a watch token and a watch code with the ticket, got %+v", ticket)
+	}
+
+	player := s.activeGames[ticket.GameID].Players["armin"]
+	player.Node.Session = "armin's session"
+	reply := s.watchGame("spectator", ticket.WatchCode)
+	if len(reply.Nodes) != 2 || reply.Nodes[0].Name != "armin" || reply.Nodes[1].Name != "lunwen" ||
+		reply.Ticket.GameID != ticket.GameID || reply.Ticket.Watch != ticket.Watch || len(reply.Ticket.Token) > 0 ||
+		len(reply.Ticket.WatchCode) > 0 {
+		t.Errorf("The watch code should find both players and the token, got %+v", reply)
+	} else if got := reply.Nodes[0]; got.Key != player.Node.Key || len(got.IP) > 0 || got.Port != 0 ||
+		len(got.Addrs) > 0 || len(got.Session) > 0 {
+		t.Errorf("Spectators should only get the players' names and keys, got %+v", reply.Nodes[0])
+	}
+	// knowing the game or its room isn't enough
+	for _, key := range []string{ticket.GameID, "test2", ticket.Watch, ""} {
+		if reply := s.watchGame("spectator", key); reply.Rejected != bootstrapClient.REJECT_UNKNOWN_GAME {
+			t.Errorf("Watching with %q should be refused, got %+v", key, reply)
+		}
+	}
+}
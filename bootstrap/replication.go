@@ -0,0 +1,524 @@
+////////////////////////////////////////////////////////////
+//Multegula - replication.go
+//Several bootstrap servers sharing their state, one of them leading
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrap
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/tlsTransport"
+)
+
+/*
+ * Servers with the same Config.Replicas, the addresses they
+ * replicate on, run as one service. The first one in the list that is
+ * up leads, the way bullySelection picks the unicorn. Only the leader
+ * takes players, the others send them to it with REJECT_NOT_LEADER.
+ *
+ * After every change the leader sends the others a snapshot of what has
+ * to outlive it: the rooms and their codes, the games players may rejoin
+ * and the reports of them so far, the recent games, draining, the
+ * accounts if they are on and the match history. Followers with a
+ * history file add the matches they miss to it; a follower without one
+ * can't keep them. Waiting players aren't in it, their connections go
+ * away with the leader and they come back to the new one with the code of
+ * their room.
+ *
+ * The leader sends a heartbeat every REPLICA_HEARTBEAT. A server that
+ * hears nothing for REPLICA_TIMEOUT probes the servers before it in the
+ * list, and if none answers it leads, with a term above any it has seen.
+ * A leader that hears from a leader with a higher term, or the same term
+ * and an earlier place in the list, follows it. A server coming back
+ * hears the leader before its own timeout and follows it too.
+ *
+ * The election doesn't ask for a majority. Servers that can't reach each
+ * other but are up, a split brain, each lead their own players until
+ * they hear each other again; then one of them follows the other, and the
+ * rooms, games and accounts it changed meanwhile are lost. Split brains
+ * are out of scope, the servers are meant to run on one network.
+ */
+const REPLICA_HEARTBEAT = 500 * time.Millisecond
+const REPLICA_TIMEOUT = 2 * time.Second
+
+/* how long rooms restored from a snapshot wait for their players */
+const REPLICA_GRACE = time.Minute
+
+type replicaRoom struct {
+	Code      string
+	Policy    LobbyPolicy
+	Permanent bool
+}
+
+type replicaGame struct {
+	ID         string
+	Room       string
+	Started    time.Time
+	Players    []gamePlayer // by name
+	WatchToken string
+	WatchCode  string
+	Reports    []bootstrapClient.GameReport // by reporter
+}
+
+type replicaAccount struct {
+	Name    string
+	Account account
+}
+
+type replicaState struct {
+	Rooms     []replicaRoom // by code
+	Games     []replicaGame // by ID
+	Recent    []GameRecord
+	Draining  bool
+	ServerKey string                        // "" if accounts are off
+	Accounts  []replicaAccount              // by name
+	Matches   []bootstrapClient.MatchRecord // the match history, oldest first
+}
+
+type replicaMessage struct {
+	Token  string // Config.ReplicaToken
+	Probe  bool   // only asks whether the server is up
+	Term   int
+	From   int           // the sender's place in the list
+	Leader string        // where clients reach the leader
+	Seq    int           // of the leader's latest snapshot
+	State  *replicaState // nil if the follower has it
+}
+
+/*
+ * joins the service of Config.Replicas, as a follower until the leader
+ * is heard or an election is won
+ */
+func (s *Server) initReplication() error {
+	list, self := s.config.Replicas, s.config.Replica
+	for i, addr := range list {
+		if addr == self {
+			s.replicaSelf = i
+		}
+	}
+	if s.replicaSelf < 0 {
+		return fmt.Errorf("%s isn't in the replicas %v", self, list)
+	} else if len(s.config.Advertise) == 0 {
+		return fmt.Errorf("Replica %s needs the address clients reach it at", self)
+	}
+	ln := s.config.ReplicaListener
+	if ln == nil {
+		var err error
+		if ln, err = tlsTransport.Listen(self); err != nil {
+			return err
+		}
+	}
+	s.replicas = list
+	s.replicaListener = ln
+	s.leading = false
+	s.lastHeard = time.Now()
+	s.replicaSenders = make([]chan replicaMessage, len(list))
+	for i, addr := range list {
+		if i != s.replicaSelf {
+			s.replicaSenders[i] = make(chan replicaMessage, 1)
+			go s.sendReplicaMessages(addr, s.replicaSenders[i])
+		}
+	}
+	s.replicaTicker = time.NewTicker(REPLICA_HEARTBEAT)
+	s.replicaTick = s.replicaTicker.C
+	go s.acceptReplicas(ln)
+	go s.watchLeader()
+	fmt.Printf("Replica %d of %v, replicating on %s.\n", s.replicaSelf, list, self)
+	return nil
+}
+
+/*
+ * stops replicating, once receiveConnections has returned
+ */
+func (s *Server) stopReplication() {
+	if s.replicaSelf < 0 {
+		return
+	}
+	s.replicaTicker.Stop()
+	s.replicaListener.Close()
+	for _, sender := range s.replicaSenders {
+		if sender != nil {
+			close(sender)
+		}
+	}
+}
+
+/*
+ * the state a new leader needs, in an order that only changes with it
+ */
+func (s *Server) snapshot() *replicaState {
+	state := &replicaState{Rooms: []replicaRoom{}, Games: []replicaGame{}, Recent: append([]GameRecord{}, s.recentGames...),
+		Draining: s.draining, Accounts: []replicaAccount{}}
+	for code, r := range s.rooms {
+		state.Rooms = append(state.Rooms, replicaRoom{code, r.policy, r.permanent})
+	}
+	sort.Slice(state.Rooms, func(i, j int) bool { return state.Rooms[i].Code < state.Rooms[j].Code })
+	s.pruneGames()
+	for _, game := range s.activeGames {
+		replica := replicaGame{ID: game.ID, Room: game.Room, Started: game.Started, WatchToken: game.WatchToken,
+			WatchCode: game.WatchCode}
+		for _, player := range game.Players {
+			replica.Players = append(replica.Players, *player)
+		}
+		sort.Slice(replica.Players, func(i, j int) bool { return replica.Players[i].Node.Name < replica.Players[j].Node.Name })
+		for _, report := range game.Reports {
+			replica.Reports = append(replica.Reports, report)
+		}
+		sort.Slice(replica.Reports, func(i, j int) bool { return replica.Reports[i].Reporter < replica.Reports[j].Reporter })
+		state.Games = append(state.Games, replica)
+	}
+	sort.Slice(state.Games, func(i, j int) bool { return state.Games[i].ID < state.Games[j].ID })
+	if s.accounts != nil {
+		s.accounts.mutex.Lock()
+		state.ServerKey = s.accounts.ServerKey
+		for name, account := range s.accounts.Accounts {
+			state.Accounts = append(state.Accounts, replicaAccount{name, *account})
+		}
+		s.accounts.mutex.Unlock()
+		sort.Slice(state.Accounts, func(i, j int) bool { return state.Accounts[i].Name < state.Accounts[j].Name })
+	}
+	if s.history != nil {
+		state.Matches = s.history.all()
+	}
+	return state
+}
+
+/*
+ * takes the leader's state, as a follower without waiting players
+ */
+func (s *Server) applyState(state *replicaState) {
+	s.rooms = make(map[string]*room)
+	for _, replica := range state.Rooms {
+		r := s.newRoom(replica.Code, replica.Policy)
+		r.permanent = replica.Permanent
+		s.rooms[replica.Code] = r
+	}
+	if _, ok := s.rooms[bootstrapClient.QUICK_MATCH]; !ok {
+		s.rooms[bootstrapClient.QUICK_MATCH] = s.newQuickMatch()
+	}
+	s.clientRooms = make(map[net.Addr]string)
+	s.activeGames = make(map[string]*activeGame)
+	for _, replica := range state.Games {
+		game := &activeGame{ID: replica.ID, Room: replica.Room, Started: replica.Started, Players: make(map[string]*gamePlayer),
+			WatchToken: replica.WatchToken, WatchCode: replica.WatchCode}
+		for i := range replica.Players {
+			player := replica.Players[i]
+			game.Players[player.Node.Name] = &player
+		}
+		if len(replica.Reports) > 0 {
+			game.Reports = make(map[string]bootstrapClient.GameReport)
+		}
+		for _, report := range replica.Reports {
+			game.Reports[report.Reporter] = report
+		}
+		s.activeGames[game.ID] = game
+	}
+	s.recentGames = state.Recent
+	s.draining = state.Draining
+	if s.accounts != nil && len(state.ServerKey) > 0 {
+		if err := s.accounts.replace(state.ServerKey, state.Accounts); err != nil {
+			fmt.Println("Couldn't take the leader's accounts:", err)
+		}
+	}
+	if s.history != nil {
+		if err := s.history.merge(state.Matches); err != nil {
+			fmt.Println("Couldn't take the leader's match history:", err)
+		}
+	}
+}
+
+/*
+ * sends the followers our state if it changed, a heartbeat otherwise,
+ * after everything receiveConnections does
+ */
+func (s *Server) publishState() {
+	if s.replicaSelf < 0 || !s.leading {
+		return
+	}
+	state := s.snapshot()
+	if !reflect.DeepEqual(state, s.published) {
+		s.publishedSeq++
+		s.published = state
+	}
+	message := replicaMessage{Token: s.config.ReplicaToken, Term: s.term, From: s.replicaSelf, Leader: s.config.Advertise,
+		Seq: s.publishedSeq, State: s.published}
+	for _, sender := range s.replicaSenders {
+		if sender == nil {
+			continue
+		}
+		// only the latest message matters
+		select {
+		case <-sender:
+		default:
+		}
+		sender <- message
+	}
+}
+
+/*
+ * a message from a leader
+ * @return	false if it is stale or we miss the leader's state, the
+ *			connection is dropped then and the leader sends its state again
+ *			on a new one
+ **/
+func (s *Server) onReplicaMessage(message replicaMessage) bool {
+	if message.Term < s.term || (message.Term == s.term && s.leading && message.From > s.replicaSelf) {
+		return false
+	}
+	if s.leading {
+		fmt.Printf("Following %s, term %d.\n", message.Leader, message.Term)
+		s.stepDown(message.Leader)
+	}
+	s.term = message.Term
+	s.leaderAddr = message.Leader
+	s.lastHeard = time.Now()
+	if message.Term == s.appliedTerm && message.Seq == s.appliedSeq {
+		return true
+	} else if message.State == nil {
+		return false
+	}
+	s.applyState(message.State)
+	s.appliedTerm, s.appliedSeq = message.Term, message.Seq
+	return true
+}
+
+/*
+ * stops leading, sending the waiting players to the new leader
+ */
+func (s *Server) stepDown(leader string) {
+	s.leading = false
+	for _, r := range s.rooms {
+		for connAddr, client := range r.clients {
+			sendLastReply(bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_NOT_LEADER, Leader: leader}, client)
+			delete(r.clients, connAddr)
+			delete(s.clientRooms, connAddr)
+		}
+		r.countdown = 0
+		r.check = 0
+		r.expired = false
+	}
+}
+
+func (s *Server) becomeLeader() {
+	s.term++
+	s.leading = true
+	s.leaderAddr = s.config.Advertise
+	s.published = nil
+	fmt.Printf("Leading the bootstrap service, term %d.\n", s.term)
+	// restored rooms nobody came back to go away
+	go func() {
+		select {
+		case <-time.After(REPLICA_GRACE):
+		case <-s.quit:
+			return
+		}
+		s.runAdmin(func() {
+			for _, r := range s.rooms {
+				r.close()
+			}
+		})
+	}()
+}
+
+/*
+ * where to send a client if we don't lead, "" if we don't know
+ */
+func (s *Server) currentLeader() string {
+	if time.Since(s.lastHeard) > REPLICA_TIMEOUT {
+		return ""
+	}
+	return s.leaderAddr
+}
+
+/*
+ * whether we lead, and where the leader is if we don't, from any routine
+ */
+func (s *Server) leadership() (bool, string) {
+	if s.replicaSelf < 0 {
+		return true, ""
+	}
+	lead, leader := false, ""
+	s.runAdmin(func() { lead, leader = s.leading, s.currentLeader() })
+	return lead, leader
+}
+
+/*
+ * turns a new client away if we don't lead, reports and logins go to the
+ * leader too
+ * @return	true if we lead
+ **/
+func (s *Server) leads(clientInfo ClientInfo) bool {
+	lead, leader := s.leadership()
+	if !lead {
+		sendReply(bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_NOT_LEADER, Leader: leader,
+			Message: "This server doesn't take players right now, try another one."}, clientInfo)
+	}
+	return lead
+}
+
+/* the replication part of the status */
+func (s *Server) replicaStatus() *ReplicaStatus {
+	if s.replicaSelf < 0 {
+		return nil
+	}
+	status := &ReplicaStatus{Self: s.replicas[s.replicaSelf], Replicas: s.replicas, Leading: s.leading, Leader: s.currentLeader(), Term: s.term}
+	if s.leading {
+		status.Leader = s.config.Advertise
+	}
+	return status
+}
+
+/*
+ * turns a client away if we don't lead, in receiveConnections
+ * @return	true if the client was turned away
+ **/
+func (s *Server) redirect(clientInfo ClientInfo) bool {
+	if s.leading {
+		return false
+	}
+	leader := s.currentLeader()
+	fmt.Printf("Sending %s to the leader %q.\n", clientInfo.Node.Name, leader)
+	sendLastReply(bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_NOT_LEADER, Leader: leader,
+		Message: "This server doesn't take players right now, try another one."}, clientInfo)
+	return true
+}
+
+/*
+ * holds an election whenever the leader goes quiet
+ */
+func (s *Server) watchLeader() {
+	ticker := time.NewTicker(REPLICA_HEARTBEAT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+		quiet := false
+		s.runAdmin(func() { quiet = !s.leading && time.Since(s.lastHeard) > REPLICA_TIMEOUT })
+		if !quiet {
+			continue
+		}
+		outranked := false
+		for i := 0; i < s.replicaSelf && !outranked; i++ {
+			outranked = s.probeReplica(s.replicas[i])
+		}
+		s.runAdmin(func() {
+			if outranked {
+				// give it the time to take over
+				s.lastHeard = time.Now()
+			} else if !s.leading && time.Since(s.lastHeard) > REPLICA_TIMEOUT {
+				s.becomeLeader()
+				s.publishState()
+			}
+		})
+	}
+}
+
+/* whether a server is up */
+func (s *Server) probeReplica(addr string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), REPLICA_HEARTBEAT)
+	defer cancel()
+	conn, err := tlsTransport.DialContext(ctx, addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(REPLICA_HEARTBEAT))
+	if gob.NewEncoder(conn).Encode(replicaMessage{Token: s.config.ReplicaToken, Probe: true}) != nil {
+		return false
+	}
+	answer := replicaMessage{}
+	return gob.NewDecoder(conn).Decode(&answer) == nil
+}
+
+/*
+ * keeps a connection to another server and sends it our messages, with
+ * our state whenever it hasn't got it
+ */
+func (s *Server) sendReplicaMessages(addr string, messages chan replicaMessage) {
+	var conn net.Conn
+	var encoder *gob.Encoder
+	sentTerm, sentSeq := 0, 0
+	for message := range messages {
+		if conn == nil {
+			var err error
+			if conn, err = tlsTransport.DialTimeout(addr, REPLICA_HEARTBEAT); err != nil {
+				conn = nil
+				continue
+			}
+			encoder = gob.NewEncoder(conn)
+			sentTerm, sentSeq = 0, 0
+		}
+		if message.Term == sentTerm && message.Seq == sentSeq {
+			message.State = nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(REPLICA_TIMEOUT))
+		if err := encoder.Encode(message); err != nil {
+			conn.Close()
+			conn = nil
+			continue
+		}
+		sentTerm, sentSeq = message.Term, message.Seq
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+/*
+ * takes the messages of the other servers
+ */
+func (s *Server) acceptReplicas(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+			default:
+				fmt.Println("Replication stopped:", err)
+			}
+			return
+		}
+		go s.receiveReplicaMessages(conn)
+	}
+}
+
+func (s *Server) receiveReplicaMessages(conn net.Conn) {
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+	defer conn.Close()
+	dec := gob.NewDecoder(conn)
+	for {
+		message := replicaMessage{}
+		if dec.Decode(&message) != nil {
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(message.Token), []byte(s.config.ReplicaToken)) != 1 {
+			fmt.Println("Bad replication token from", conn.RemoteAddr())
+			return
+		}
+		if message.Probe {
+			gob.NewEncoder(conn).Encode(replicaMessage{})
+			return
+		}
+		taken := false
+		s.runAdmin(func() { taken = s.onReplicaMessage(message) })
+		if !taken {
+			return
+		}
+	}
+}
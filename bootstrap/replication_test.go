@@ -0,0 +1,104 @@
+package bootstrap
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+func TestSnapshotRestoresRoomsAndGames(t *testing.T) {
+	s := newServer(DefaultConfig())
+	policy := DefaultLobbyPolicy()
+	policy.MaxPlayers = 3
+	s.rooms["ABCDE"] = s.newRoom("ABCDE", policy)
+	s.activeGames["game1"] = &activeGame{ID: "game1", Room: "ABCDE", Started: time.Now(), Players: map[string]*gamePlayer{
+		"armin": {Node: messagePasser.Node{Name: "armin", Port: 1111}, Token: "token"},
+	}, WatchToken: "watch", WatchCode: "code"}
+	s.recentGames = []GameRecord{{ID: "game1", Room: "ABCDE", Players: []string{"armin"}}}
+	s.draining = true
+	state := s.snapshot()
+
+	s = newServer(DefaultConfig())
+	s.applyState(state)
+	if r, ok := s.rooms["ABCDE"]; !ok || r.policy.MaxPlayers != 3 || r.permanent {
+		t.Errorf("Expected room ABCDE for 3 back, got %+v", r)
+	}
+	if _, ok := s.rooms[bootstrapClient.QUICK_MATCH]; !ok {
+		t.Errorf("Quick match went away.")
+	}
+	game, ok := s.activeGames["game1"]
+	if !ok || game.ticket("armin").Token != "token" || game.ticket("armin").Watch != "watch" || game.ticket("armin").WatchCode != "code" || game.Players["armin"].Node.Port != 1111 {
+		t.Errorf("Expected game1 back, got %+v", game)
+	}
+	if len(s.recentGames) != 1 || !s.draining {
+		t.Errorf("Expected the recent games and draining back.")
+	}
+	if !reflect.DeepEqual(s.snapshot(), state) {
+		t.Errorf("The restored state should snapshot the same.")
+	}
+}
+
+func TestSnapshotCarriesHistoryAndReports(t *testing.T) {
+	s := newServer(DefaultConfig())
+	openTestHistory(t, s, filepath.Join(t.TempDir(), "history.log"))
+	game, report, lunwen := newReportedGame(t, s)
+	s.reportGame(report)
+	s.reportGame(lunwen)
+	s.activeGames["game2"] = &activeGame{ID: "game2", Room: "TEST2", Started: time.Now(), Players: game.Players}
+	report.GameID = "game2"
+	s.reportGame(signAs(t, game, report))
+	state := s.snapshot()
+
+	follower := newServer(DefaultConfig())
+	path := filepath.Join(t.TempDir(), "history.log")
+	openTestHistory(t, follower, path)
+	follower.applyState(state)
+	follower.applyState(state)
+	if _, ok := follower.activeGames["game2"].Reports["armin"]; !ok {
+		t.Errorf("Expected armin's report of game2 back, got %+v", follower.activeGames["game2"])
+	}
+	follower.history.file.Close()
+	openTestHistory(t, follower, path)
+	if games := follower.queryHistory(bootstrapClient.HistoryQuery{Player: "armin"}).History; len(games) != 1 || games[0].GameID != "game1" {
+		t.Errorf("Expected game1 once in the follower's history, got %+v", games)
+	}
+}
+
+func TestLeaderStepsDown(t *testing.T) {
+	r := newTestRoom(DefaultLobbyPolicy())
+	s := r.server
+	s.leading, s.term, s.replicaSelf = true, 1, 1
+	armin := addTestClient(t, r, "armin")
+
+	if s.onReplicaMessage(replicaMessage{Term: 1, From: 2, Leader: "later:55555", Seq: 1, State: s.snapshot()}) || !s.leading {
+		t.Fatalf("A leader later in the list shouldn't take over.")
+	}
+	state := s.snapshot()
+	if !s.onReplicaMessage(replicaMessage{Term: 1, From: 0, Leader: "first:55555", Seq: 1, State: state}) || s.leading {
+		t.Fatalf("Expected to follow the first server.")
+	}
+	select {
+	case reply := <-armin:
+		for reply.Rejected != bootstrapClient.REJECT_NOT_LEADER {
+			reply = <-armin
+		}
+		if reply.Leader != "first:55555" {
+			t.Errorf("Expected armin to be sent to the leader, got %+v", reply)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("armin wasn't sent to the leader.")
+	}
+	if !s.onReplicaMessage(replicaMessage{Term: 1, From: 0, Leader: "first:55555", Seq: 1}) {
+		t.Errorf("A heartbeat for the state we have should be taken.")
+	}
+	if s.onReplicaMessage(replicaMessage{Term: 1, From: 0, Leader: "first:55555", Seq: 2}) {
+		t.Errorf("A heartbeat for a state we miss should drop the connection.")
+	}
+	if s.onReplicaMessage(replicaMessage{Term: 0, From: 0, Leader: "old:55555", Seq: 9, State: state}) {
+		t.Errorf("An old term should be ignored.")
+	}
+}
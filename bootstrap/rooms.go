@@ -0,0 +1,401 @@
+////////////////////////////////////////////////////////////
+//Multegula - rooms.go
+//Rooms with join codes, each forming its own games
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrap
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/*
+ * Clients wait in rooms. The quick match room always exists and takes
+ * anyone, a client may instead create a room and hand its join code to
+ * friends. Every room counts its own players and runs its own countdown
+ * by its LobbyPolicy, and a created room goes away once its game starts
+ * or everyone leaves.
+ *
+ * A client may have vanished without the server noticing, and would hang
+ * everyone else in InitMessagePasser. So before a group is sent its
+ * players, every client in it has to answer a ready check within
+ * READY_CHECK_TIMEOUT. The ones that don't are dropped and the room is
+ * looked at again without them; players that join during a check wait
+ * for the next game or the next check.
+ *
+ * Whenever a room changes, its clients are sent its LobbyProgress, once
+ * receiveConnections is done with whatever changed it.
+ */
+const ROOM_CODE_LENGTH int = 5
+const READY_CHECK_TIMEOUT = 2 * time.Second
+
+/* no 0/O or 1/I, codes are read out loud and typed in */
+const ROOM_CODE_ALPHABET string = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+type room struct {
+	server    *Server
+	code      string
+	policy    LobbyPolicy
+	permanent bool // stays open when empty
+	clients   map[net.Addr]ClientInfo
+	countdown int               // id of the running countdown, 0 if there is none
+	deadline  time.Time         // when the countdown runs out
+	expired   bool              // the countdown ran out, start as soon as possible
+	check     int               // id of the running ready check, 0 if there is none
+	group     map[net.Addr]bool // the clients checked, true once they answered
+	changed   bool              // the clients haven't been sent the progress yet
+}
+
+/* a countdown or check that ran out, stale if the room started another one since */
+type roomTimeout struct {
+	code string
+	id   int
+}
+
+func (s *Server) newRoom(code string, policy LobbyPolicy) *room {
+	return &room{server: s, code: code, policy: policy, clients: make(map[net.Addr]ClientInfo)}
+}
+
+func (s *Server) newQuickMatch() *room {
+	r := s.newRoom(bootstrapClient.QUICK_MATCH, DefaultLobbyPolicy())
+	r.permanent = true
+	return r
+}
+
+func (r *room) String() string {
+	if r.code == bootstrapClient.QUICK_MATCH {
+		return "quick match"
+	}
+	return "room " + r.code
+}
+
+/*
+ * makes up a join code no open room uses
+ */
+func (s *Server) newRoomCode() (string, error) {
+	buffer := make([]byte, ROOM_CODE_LENGTH)
+	for {
+		if _, err := rand.Read(buffer); err != nil {
+			return "", err
+		}
+		code := make([]byte, ROOM_CODE_LENGTH)
+		for i, b := range buffer {
+			code[i] = ROOM_CODE_ALPHABET[int(b)%len(ROOM_CODE_ALPHABET)]
+		}
+		if _, taken := s.rooms[string(code)]; !taken {
+			return string(code), nil
+		}
+	}
+}
+
+/*
+ * codes are typed by people, ignore case and surrounding spaces
+ */
+func normalizeRoomCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+/*
+ * finds the room a client asked for, creating it if asked to
+ * @return	the room, or nil if there is no room with the code
+ **/
+func (s *Server) roomFor(clientInfo ClientInfo) (*room, error) {
+	if clientInfo.CreateRoom {
+		code, err := s.newRoomCode()
+		if err != nil {
+			return nil, err
+		}
+		s.rooms[code] = s.newRoom(code, s.lobbyConfig.Created)
+		fmt.Println("Created room", code)
+		return s.rooms[code], nil
+	}
+	return s.rooms[normalizeRoomCode(clientInfo.Room)], nil
+}
+
+/*
+ * adds a client to the room unless its name is taken there
+ * @return	false if the name is taken
+ **/
+func (r *room) add(clientInfo ClientInfo) bool {
+	for _, client := range r.clients {
+		if client.Node.Name == clientInfo.Node.Name {
+			return false
+		}
+	}
+	connAddr := (*clientInfo.Conn).RemoteAddr()
+	clientInfo.Joined = time.Now()
+	r.clients[connAddr] = clientInfo
+	r.server.clientRooms[connAddr] = r.code
+	fmt.Printf("%v has %v connections now!\n", r, len(r.clients))
+	fmt.Printf("New Client: %+v\n", clientInfo.Node)
+	return true
+}
+
+/*
+ * removes a client, and the room with it if it was the last one in a
+ * created room
+ */
+func (r *room) remove(connAddr net.Addr) {
+	client, ok := r.clients[connAddr]
+	if !ok {
+		return
+	}
+	fmt.Printf("Removing Client: %+v\n", client.Node)
+	delete(r.clients, connAddr)
+	delete(r.server.clientRooms, connAddr)
+	fmt.Printf("%v has %v connections now!\n", r, len(r.clients))
+	r.close()
+}
+
+/*
+ * marks a client ready to play
+ */
+func (r *room) setReady(connAddr net.Addr) {
+	if client, ok := r.clients[connAddr]; ok && !client.Ready {
+		client.Ready = true
+		r.clients[connAddr] = client
+		fmt.Printf("%s is ready in %v.\n", client.Node.Name, r)
+	}
+}
+
+/* every waiting client is ready */
+func (r *room) allReady() bool {
+	for _, client := range r.clients {
+		if !client.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * drops an empty created room, its code stops working
+ */
+func (r *room) close() {
+	if len(r.clients) == 0 && !r.permanent {
+		fmt.Println("Closing room", r.code)
+		r.countdown = 0
+		r.check = 0
+		delete(r.server.rooms, r.code)
+	}
+}
+
+/*
+ * starts or stops the countdown, or starts the game, after the players
+ * changed
+ * @param	joined – a player just joined
+ **/
+func (r *room) update(joined bool) {
+	r.changed = true
+	if r.check != 0 {
+		// the check decides, unless everyone in it already answered or left
+		for connAddr, answered := range r.group {
+			if _, ok := r.clients[connAddr]; ok && !answered {
+				return
+			}
+		}
+		r.finishCheck()
+		return
+	}
+	count := len(r.clients)
+	switch {
+	case count >= r.policy.MaxPlayers:
+		r.countdown = 0
+		r.startCheck()
+	case count < r.policy.MinPlayers:
+		if r.countdown != 0 || r.expired {
+			fmt.Printf("Not enough players in %v, stopping the countdown.\n", r)
+			r.countdown = 0
+			r.expired = false
+		}
+	case r.expired:
+		fmt.Printf("Timed out, starting %v with %v players!\n", r, count)
+		r.startCheck()
+	case r.policy.StartWhenReady && r.allReady():
+		fmt.Printf("Everyone is ready, starting %v with %v players!\n", r, count)
+		r.countdown = 0
+		r.startCheck()
+	case r.countdown == 0 || (joined && r.policy.RestartOnJoin):
+		fmt.Printf("%v players in %v, starting countdown to game.\n", count, r)
+		r.server.countdowns++
+		timeout := roomTimeout{r.code, r.server.countdowns}
+		r.countdown = timeout.id
+		r.deadline = time.Now().Add(r.policy.Countdown)
+		r.server.after(r.policy.Countdown, r.server.roomTimeoutChannel, timeout)
+	}
+}
+
+/*
+ * asks every waiting client, up to MaxPlayers of them, whether it is
+ * still there
+ */
+func (r *room) startCheck() {
+	r.changed = true
+	r.server.checks++
+	r.check = r.server.checks
+	r.group = make(map[net.Addr]bool)
+	// first come, first served
+	for _, client := range r.waiting() {
+		if len(r.group) == r.policy.MaxPlayers {
+			break
+		}
+		r.group[(*client.Conn).RemoteAddr()] = false
+		sendReply(bootstrapClient.Reply{Room: r.code, Check: r.check}, client)
+	}
+	timeout := roomTimeout{r.code, r.check}
+	r.server.after(READY_CHECK_TIMEOUT, r.server.checkTimeoutChannel, timeout)
+}
+
+/*
+ * hands a timeout to receiveConnections once it runs out, unless the
+ * server is closed by then
+ */
+func (s *Server) after(duration time.Duration, channel chan roomTimeout, timeout roomTimeout) {
+	time.AfterFunc(duration, func() {
+		select {
+		case channel <- timeout:
+		case <-s.quit:
+		}
+	})
+}
+
+/*
+ * a client answered a ready check
+ * @param	check – the id of the check it answered
+ **/
+func (r *room) answerCheck(connAddr net.Addr, check int) {
+	if _, inGroup := r.group[connAddr]; inGroup && check == r.check {
+		r.group[connAddr] = true
+	}
+}
+
+/*
+ * drops the clients that didn't answer the ready check in time
+ */
+func (r *room) expireCheck() {
+	for connAddr, answered := range r.group {
+		if client, ok := r.clients[connAddr]; ok && !answered {
+			fmt.Printf("%s didn't answer the ready check, dropping it.\n", client.Node.Name)
+			(*client.Conn).Close()
+			r.remove(connAddr)
+		}
+	}
+	r.finishCheck()
+}
+
+/*
+ * starts the game if nobody in the group was lost, looks at the room
+ * again without them otherwise
+ */
+func (r *room) finishCheck() {
+	group := r.group
+	r.check = 0
+	r.group = nil
+	for connAddr := range group {
+		if _, ok := r.clients[connAddr]; !ok {
+			fmt.Printf("Lost players in %v, looking again.\n", r)
+			r.update(false)
+			return
+		}
+	}
+	r.startAGame(group)
+}
+
+/*
+ * The synchronous function to start a game with 2-4 players and clear
+ * them from the room for next games.
+ * @param	group – the clients in the game
+ **/
+func (r *room) startAGame(group map[net.Addr]bool) {
+	game := r.server.registerGame(r, group)
+
+	//Give everyone their player list, and a ticket to come back with.
+	for connAddr := range group {
+		client := r.clients[connAddr]
+		fmt.Println("Sending Peers to:", client.Node.Name)
+		sendLastReply(bootstrapClient.Reply{Room: r.code, Ticket: game.ticket(client.Node.Name),
+			ServerKey: r.server.serverKey(), Nodes: *r.nodesForClient(connAddr, group), Relay: r.server.config.Relay}, client)
+	}
+
+	r.server.recordGame(r, group, game)
+
+	//Clear them from the room
+	for connAddr := range group {
+		delete(r.clients, connAddr)
+		delete(r.server.clientRooms, connAddr)
+	}
+	r.countdown = 0
+	r.expired = false
+	r.close()
+	// players that joined during the check wait for the next game
+	if len(r.clients) > 0 {
+		r.update(true)
+	}
+}
+
+/*
+ * the clients waiting in the room, in the order they joined
+ */
+func (r *room) waiting() []ClientInfo {
+	clients := []ClientInfo{}
+	for _, client := range r.clients {
+		clients = append(clients, client)
+	}
+	sort.SliceStable(clients, func(i, j int) bool { return clients[i].Joined.Before(clients[j].Joined) })
+	return clients
+}
+
+/*
+ * how far the room is from starting a game
+ */
+func (r *room) progress() bootstrapClient.LobbyProgress {
+	clients := r.waiting()
+	progress := bootstrapClient.LobbyProgress{Room: r.code, Players: []string{}, MinPlayers: r.policy.MinPlayers,
+		MaxPlayers: r.policy.MaxPlayers, Starting: r.check != 0}
+	for _, client := range clients {
+		progress.Players = append(progress.Players, client.Node.Name)
+		if client.Ready {
+			progress.Ready++
+		}
+	}
+	if r.countdown != 0 && time.Now().Before(r.deadline) {
+		progress.StartsIn = time.Until(r.deadline)
+	}
+	return progress
+}
+
+/*
+ * sends the clients of every room that changed its progress
+ */
+func (s *Server) sendProgress() {
+	for _, r := range s.rooms {
+		if !r.changed {
+			continue
+		}
+		r.changed = false
+		progress := r.progress()
+		for _, client := range r.clients {
+			sendReply(bootstrapClient.Reply{Progress: &progress}, client)
+		}
+	}
+}
+
+// returns the list of peer nodes in the group excluding the client
+func (r *room) nodesForClient(clientAddr net.Addr, group map[net.Addr]bool) *[]messagePasser.Node {
+	peerNodes := []messagePasser.Node{}
+	for connAddr := range group {
+		if connAddr != clientAddr {
+			peerNodes = append(peerNodes, *r.clients[connAddr].Node)
+		}
+	}
+	return &peerNodes
+}
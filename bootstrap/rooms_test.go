@@ -0,0 +1,170 @@
+package bootstrap
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+func TestRoomCodes(t *testing.T) {
+	code, err := newServer(DefaultConfig()).newRoomCode()
+	if err != nil || len(code) != ROOM_CODE_LENGTH || strings.Trim(code, ROOM_CODE_ALPHABET) != "" {
+		t.Errorf("Bad room code %q, %v", code, err)
+	}
+	if normalizeRoomCode(" k7qx2 ") != "K7QX2" {
+		t.Errorf("Room codes should ignore case and spaces.")
+	}
+}
+
+func TestSilentClientIsDropped(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.MaxPlayers = 3
+	r := newTestRoom(policy)
+	armin := addTestClient(t, r, "armin")
+	lunwen := addTestClient(t, r, "lunwen")
+	addTestClient(t, r, "daniel")
+	if r.check == 0 {
+		t.Fatalf("A full room should check its players.")
+	}
+	r.answerCheck(testAddr("armin"), r.check)
+	r.answerCheck(testAddr("lunwen"), r.check)
+	r.update(false)
+	if gotGame(armin) {
+		t.Fatalf("The game started before daniel answered.")
+	}
+
+	// daniel never answers, the others aren't full any more and count down
+	r.expireCheck()
+	if _, ok := r.clients[testAddr("daniel")]; ok || len(r.clients) != 2 {
+		t.Fatalf("Expected daniel to be dropped, got %v", r.clients)
+	}
+	if r.check != 0 || r.countdown == 0 {
+		t.Fatalf("Expected a countdown without daniel.")
+	}
+	r.countdown = 0
+	r.expired = true
+	r.update(false)
+	passCheck(t, r)
+	if !gotGame(armin) || !gotGame(lunwen) {
+		t.Errorf("Expected armin and lunwen to play.")
+	}
+}
+
+func TestLateJoinerWaitsForNextGame(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.Countdown = time.Hour
+	r := newTestRoom(policy)
+	armin := addTestClient(t, r, "armin")
+	addTestClient(t, r, "lunwen")
+	r.expired = true
+	r.update(false)
+	garrett := addTestClient(t, r, "garrett")
+	passCheck(t, r)
+	if !gotGame(armin) || gotGame(garrett) {
+		t.Fatalf("Expected the checked players to play without garrett.")
+	}
+	if _, ok := r.clients[testAddr("garrett")]; !ok || len(r.clients) != 1 {
+		t.Errorf("Expected garrett to keep waiting, got %v", r.clients)
+	}
+}
+
+func TestFirstComeFirstServed(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.Countdown = time.Hour
+	policy.MaxPlayers = 6
+	r := newTestRoom(policy)
+	names := []string{"armin", "lunwen", "daniel", "garrett", "zed"}
+	start := time.Now()
+	for i, name := range names {
+		addTestClient(t, r, name)
+		client := r.clients[testAddr(name)]
+		client.Joined = start.Add(time.Duration(i) * time.Second)
+		r.clients[testAddr(name)] = client
+	}
+	// only room for two once the countdown is up
+	r.policy.MaxPlayers = 2
+	r.expired = true
+	r.update(false)
+	if r.check == 0 || len(r.group) != 2 {
+		t.Fatalf("Expected a check of two players, got %v", r.group)
+	}
+	for _, name := range names[:2] {
+		if _, checked := r.group[testAddr(name)]; !checked {
+			t.Errorf("%s came first, but wasn't picked: %v", name, r.group)
+		}
+	}
+}
+
+/*
+ * a client in r whose replies go through a replyWriter, as in the
+ * server; it reads them into the returned channel, or not at all
+ */
+func addQueuedTestClient(t *testing.T, r *room, name string, reads bool) (chan bootstrapClient.Reply, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	replies := make(chan bootstrapClient.Reply, 2*REPLY_QUEUE_SIZE)
+	if reads {
+		go func() {
+			dec := gob.NewDecoder(client)
+			for {
+				reply := bootstrapClient.Reply{}
+				if dec.Decode(&reply) != nil {
+					io.Copy(io.Discard, client)
+					return
+				}
+				replies <- reply
+			}
+		}()
+	}
+	var conn net.Conn = testConn{server, testAddr(name)}
+	writer := newReplyWriter(conn, gob.NewEncoder(conn))
+	t.Cleanup(writer.finish)
+	if !r.add(ClientInfo{Conn: &conn, Node: &messagePasser.Node{Name: name}, Replies: writer}) {
+		t.Fatalf("Couldn't add %s", name)
+	}
+	return replies, client
+}
+
+func TestClientThatDoesntReadHoldsUpNobody(t *testing.T) {
+	policy := DefaultLobbyPolicy()
+	policy.Countdown = time.Hour
+	r := newTestRoom(policy)
+	_, stalled := addQueuedTestClient(t, r, "daniel", false)
+	armin, _ := addQueuedTestClient(t, r, "armin", true)
+
+	started := time.Now()
+	for i := 0; i < REPLY_QUEUE_SIZE/4; i++ {
+		r.changed = true
+		r.server.sendProgress()
+	}
+	if time.Since(started) >= READY_CHECK_TIMEOUT {
+		t.Errorf("Daniel not reading held up the room for %v", time.Since(started))
+	}
+	for i := 0; i < REPLY_QUEUE_SIZE/4; i++ {
+		select {
+		case reply := <-armin:
+			if reply.Progress == nil || len(reply.Progress.Players) != 2 {
+				t.Fatalf("Expected the room's progress, got %+v", reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Armin got %d of his replies.", i)
+		}
+	}
+
+	/* daniel falls too far behind and is disconnected */
+	daniel := r.clients[testAddr("daniel")]
+	for i := 0; i <= REPLY_QUEUE_SIZE; i++ {
+		sendReply(bootstrapClient.Reply{Room: r.code}, daniel)
+	}
+	stalled.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := stalled.Write([]byte{0}); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Expected daniel's connection closed, got %v", err)
+	}
+}
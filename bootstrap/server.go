@@ -0,0 +1,648 @@
+////////////////////////////////////////////////////////////
+//Multegula - server.go
+//Bootstrapping/Grouping Server for Multegula
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrap
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/defs"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/*
+ * A Server groups the clients of bootstrapClient into games. It takes
+ * its clients from the listeners given to Serve, TLS is up to whoever
+ * makes them. Everything about rooms, games and replication belongs to
+ * the server's routine, receiveConnections; the client routines and the
+ * methods below hand their work to it through channels. Several servers
+ * may run in one process, bootstrapServer runs one from its flags.
+ */
+type ClientInfo struct {
+	Conn       *net.Conn
+	Node       *messagePasser.Node
+	Encoder    *gob.Encoder // the client reads every reply with one decoder
+	Replies    *replyWriter // set once the client is handed to receiveConnections
+	Room       string
+	CreateRoom bool
+	Ready      bool // ready to start before the countdown runs out
+	Check      int  // the ready check the client answered
+	Joined     time.Time
+	Rejoin     bootstrapClient.Ticket // the game the client comes back to, if any
+}
+
+/* server settings, DefaultConfig matches the flags of bootstrapServer */
+type Config struct {
+	Lobby        LobbyConfig
+	GameTTL      time.Duration // how long players can rejoin a game after it started
+	AccountsFile string        // created if missing, "" for no accounts
+	RequireLogin bool          // only take players that log in to an account
+	HistoryFile  string        // created if missing, "" for no match history
+	MaxClients   int           // waiting in every room together, 0 for no limit
+	Relay        string        // our relay, sent to players, ":port" on the host they reached us on; "" for none
+	/* replication addresses of every server of a replicated service, nil to run alone */
+	Replicas        []string
+	Replica         string       // ours, one of Replicas
+	ReplicaListener net.Listener // listens on Replica if nil
+	Advertise       string       // where clients reach us, needed with Replicas
+	ReplicaToken    string       // secret the servers share
+	/* called in the server's routine when a client starts waiting in a room, may be nil */
+	OnJoin func(room string, node messagePasser.Node)
+	/* called in the server's routine when a room starts a game, may be nil */
+	OnGameStarted func(game GameRecord)
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Lobby:   LobbyConfig{QuickMatch: DefaultLobbyPolicy(), Created: DefaultLobbyPolicy()},
+		GameTTL: DEFAULT_GAME_TTL,
+	}
+}
+
+var ErrServerClosed = errors.New("bootstrap: Server closed")
+
+type Server struct {
+	config Config
+
+	addClientChannel    chan ClientInfo
+	removeClientChannel chan ClientInfo
+	readyClientChannel  chan ClientInfo
+	checkClientChannel  chan ClientInfo
+	roomTimeoutChannel  chan roomTimeout
+	checkTimeoutChannel chan roomTimeout
+	adminChannel        chan func()
+
+	/* owned by receiveConnections, see rooms.go, rejoin.go and admin.go */
+	lobbyConfig LobbyConfig
+	rooms       map[string]*room
+	clientRooms map[net.Addr]string
+	countdowns  int
+	checks      int
+	activeGames map[string]*activeGame
+	draining    bool
+	recentGames []GameRecord
+
+	/* nil if they are off, see accounts.go and history.go */
+	accounts *accountStore
+	history  *matchStore
+
+	/* see replication.go, replicaSelf is -1 if the server runs alone */
+	replicas        []string
+	replicaSelf     int
+	replicaListener net.Listener
+	replicaSenders  []chan replicaMessage
+	replicaTicker   *time.Ticker
+	replicaTick     <-chan time.Time
+	/* owned by receiveConnections */
+	leading                 bool
+	term                    int
+	leaderAddr              string
+	lastHeard               time.Time
+	appliedTerm, appliedSeq int
+	published               *replicaState
+	publishedSeq            int
+
+	mutex     sync.Mutex
+	closed    bool
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	quit      chan struct{} // closed by Close
+	stopped   chan struct{} // closed once receiveConnections returns
+}
+
+/*
+ * the server's state without its files, routines or replication
+ */
+func newServer(config Config) *Server {
+	s := &Server{
+		config:              config,
+		addClientChannel:    make(chan ClientInfo, defs.CHANNEL_SIZE),
+		removeClientChannel: make(chan ClientInfo, defs.CHANNEL_SIZE),
+		readyClientChannel:  make(chan ClientInfo, defs.CHANNEL_SIZE),
+		checkClientChannel:  make(chan ClientInfo, defs.CHANNEL_SIZE),
+		roomTimeoutChannel:  make(chan roomTimeout, defs.CHANNEL_SIZE),
+		checkTimeoutChannel: make(chan roomTimeout, defs.CHANNEL_SIZE),
+		adminChannel:        make(chan func()),
+		lobbyConfig:         DefaultConfig().Lobby,
+		clientRooms:         make(map[net.Addr]string),
+		activeGames:         make(map[string]*activeGame),
+		recentGames:         []GameRecord{},
+		replicaSelf:         -1,
+		leading:             true,
+		listeners:           make(map[net.Listener]bool),
+		conns:               make(map[net.Conn]bool),
+		quit:                make(chan struct{}),
+		stopped:             make(chan struct{}),
+	}
+	s.rooms = map[string]*room{bootstrapClient.QUICK_MATCH: s.newQuickMatch()}
+	if s.config.GameTTL <= 0 {
+		s.config.GameTTL = DEFAULT_GAME_TTL
+	}
+	return s
+}
+
+/*
+ * sets up a server, it takes clients once it is given a listener
+ * @return	the server, or an error if the config is bad or a file
+ *			can't be opened
+ **/
+func NewServer(config Config) (*Server, error) {
+	s := newServer(config)
+	if err := s.setLobbyConfig(config.Lobby); err != nil {
+		return nil, err
+	}
+	if len(config.AccountsFile) > 0 {
+		store, err := openAccounts(config.AccountsFile)
+		if err != nil {
+			return nil, err
+		}
+		store.requireLogin = config.RequireLogin
+		s.accounts = store
+		fmt.Println("Accounts are on, server key:", store.publicKey())
+	}
+	if len(config.HistoryFile) > 0 {
+		store, err := openHistory(config.HistoryFile)
+		if err != nil {
+			return nil, err
+		}
+		s.history = store
+		fmt.Printf("Keeping the match history, %d games so far.\n", len(store.matches))
+	}
+	if len(config.Replicas) > 0 {
+		if err := s.initReplication(); err != nil {
+			if s.history != nil {
+				s.history.file.Close()
+			}
+			return nil, err
+		}
+	}
+	// Start the routine that manages connections and calls startAGame()
+	go s.receiveConnections()
+	return s, nil
+}
+
+/*
+ * takes clients from a listener until it fails or the server is closed
+ * @return	ErrServerClosed once the server is closed, the listener's
+ *			error otherwise
+ **/
+func (s *Server) Serve(ln net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, ln)
+		s.mutex.Unlock()
+	}()
+
+	for {
+		//Begin accepting connections
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return ErrServerClosed
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			fmt.Println(err)
+			continue
+		}
+		//Spawn thread to handle connections
+		fmt.Println("Connection received from:", conn.RemoteAddr())
+		go s.handleConnection(conn)
+	}
+}
+
+/*
+ * stops the server: closes its listeners and every client connection,
+ * stops its routines and closes its files
+ */
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.quit)
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	<-s.stopped
+	s.stopReplication()
+	if s.history != nil {
+		return s.history.file.Close()
+	}
+	return nil
+}
+
+/*
+ * keeps track of a connection for Close
+ * @return	false if the server is closed, the connection is closed then
+ **/
+func (s *Server) track(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	delete(s.conns, conn)
+	s.mutex.Unlock()
+}
+
+/*
+ * hands a client to receiveConnections, unless the server is closed
+ */
+func (s *Server) send(channel chan ClientInfo, clientInfo ClientInfo) {
+	select {
+	case channel <- clientInfo:
+	case <-s.quit:
+	}
+}
+
+/*
+ * Handle Connections
+ *
+ * @param connection
+ *        the connection object
+ *
+ **/
+func (s *Server) handleConnection(conn net.Conn) {
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+	// keep track of having already added a connection to keep the loop running
+	// in case the client got disconnected, so we can remove the added connection
+	// from our maps. If the disconnect happens before we add the conn to our maps
+	// then we just simply return from the function.
+	haveAddedConnection := false
+	dec := gob.NewDecoder(conn)
+	encoder := gob.NewEncoder(conn)
+	var replies *replyWriter
+	defer func() {
+		if replies != nil {
+			replies.finish()
+		}
+	}()
+	for {
+		request, err := receiveRequest(dec)
+		if err != nil {
+			if err.Error() == "EOF" {
+				fmt.Println("Got disconnected from", conn.RemoteAddr())
+			} else {
+				fmt.Println("Disconnecting:", conn.RemoteAddr())
+			}
+			if haveAddedConnection {
+				s.send(s.removeClientChannel, ClientInfo{Conn: &conn})
+			}
+			return
+		} else if !haveAddedConnection && !checkRequest(request, ClientInfo{Conn: &conn, Encoder: encoder}) {
+			conn.Close()
+			return
+		} else if !haveAddedConnection && !s.leads(ClientInfo{Conn: &conn, Encoder: encoder}) {
+			conn.Close()
+			return
+		} else if !haveAddedConnection && request.Type == bootstrapClient.REQUEST_WATCH {
+			s.answerWatch(request, ClientInfo{Conn: &conn, Encoder: encoder})
+			conn.Close()
+			return
+		} else if !haveAddedConnection && request.Type != bootstrapClient.REQUEST_JOIN {
+			s.answerHistory(request, ClientInfo{Conn: &conn, Encoder: encoder})
+			conn.Close()
+			return
+		} else if len(request.Node.Name) == 0 {
+			fmt.Println("Received empty Node.")
+			sendLastReply(bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_BAD_NODE},
+				ClientInfo{Conn: &conn, Encoder: encoder, Replies: replies})
+			return
+		}
+		if haveAddedConnection == false {
+			// we have to set the public ip of the client, since the client itself
+			// doesn't know what their public ip is.
+			ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+			if err != nil {
+				fmt.Println("Can't tell the address of", conn.RemoteAddr())
+				conn.Close()
+				return
+			}
+			request.Node.IP = ip
+			request.Node.Session = ""
+			if !s.logIn(request, ClientInfo{Conn: &conn, Encoder: encoder}) {
+				conn.Close()
+				return
+			}
+			// from here on receiveConnections replies, without waiting on the client
+			replies = newReplyWriter(conn, encoder)
+			s.send(s.addClientChannel, ClientInfo{Conn: &conn, Node: &request.Node, Replies: replies,
+				Room: request.Room, CreateRoom: request.CreateRoom, Ready: request.Ready, Rejoin: request.Rejoin})
+			haveAddedConnection = true
+		} else if request.Type == bootstrapClient.REQUEST_CHECK {
+			s.send(s.checkClientChannel, ClientInfo{Conn: &conn, Check: request.Check})
+		} else if request.Type == bootstrapClient.REQUEST_READY {
+			s.send(s.readyClientChannel, ClientInfo{Conn: &conn})
+		}
+	}
+}
+
+/*
+ * checks the first request of a client: a protocol version we speak, and
+ * a type that can come first with what the type needs
+ * @return	false if the client was turned away
+ **/
+func checkRequest(request *bootstrapClient.Request, clientInfo ClientInfo) bool {
+	reject := func(reason string, message string) bool {
+		fmt.Printf("Turning %v away: %s\n", (*clientInfo.Conn).RemoteAddr(), message)
+		sendReply(bootstrapClient.Reply{Rejected: reason, Message: message}, clientInfo)
+		return false
+	}
+	if request.Version < bootstrapClient.MIN_PROTOCOL_VERSION || request.Version > bootstrapClient.PROTOCOL_VERSION {
+		return reject(bootstrapClient.REJECT_VERSION, fmt.Sprintf("This server speaks protocol versions %d to %d, not %d.",
+			bootstrapClient.MIN_PROTOCOL_VERSION, bootstrapClient.PROTOCOL_VERSION, request.Version))
+	}
+	switch {
+	case request.Type == bootstrapClient.REQUEST_JOIN:
+	case request.Type == bootstrapClient.REQUEST_REPORT && request.Report != nil:
+	case request.Type == bootstrapClient.REQUEST_QUERY && request.Query != nil:
+	case request.Type == bootstrapClient.REQUEST_WATCH && len(request.Node.Name) > 0:
+	default:
+		return reject(bootstrapClient.REJECT_BAD_REQUEST, fmt.Sprintf("A %q request can't come first.", request.Type))
+	}
+	return true
+}
+
+/*
+ * The routine to manage connections and trigger startAGame in every room
+ */
+func (s *Server) receiveConnections() {
+	defer close(s.stopped)
+	for {
+		//wait for new connections or disconnections, or for a countdown or check to run out
+		select {
+		case clientInfo := <-s.addClientChannel:
+			if s.redirect(clientInfo) {
+				continue
+			}
+			if len(clientInfo.Rejoin.GameID) > 0 {
+				// players in a game may come back even while draining
+				sendLastReply(s.rejoinGame(clientInfo), clientInfo)
+				continue
+			}
+			// turned away before a room is made for them, it would stay empty
+			if s.draining {
+				fmt.Println("Closing connection! Draining: ", clientInfo.Node.Name)
+				sendLastReply(bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_DRAINING,
+					Message: "The server is down for maintenance, try again later."}, clientInfo)
+				continue
+			}
+			if s.config.MaxClients > 0 && len(s.clientRooms) >= s.config.MaxClients {
+				fmt.Println("Closing connection! Server full: ", clientInfo.Node.Name)
+				sendLastReply(bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_SERVER_FULL,
+					Message: fmt.Sprintf("The server is full with %d players waiting, try again later.", len(s.clientRooms))}, clientInfo)
+				continue
+			}
+			r, err := s.roomFor(clientInfo)
+			if err != nil {
+				fmt.Println("Couldn't create a room:", err)
+				(*clientInfo.Conn).Close()
+			} else if r == nil {
+				fmt.Println("Closing connection! Unknown room: ", clientInfo.Room)
+				sendLastReply(bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_UNKNOWN_ROOM,
+					Message: fmt.Sprintf("There is no room %s, or its game has started.", clientInfo.Room)}, clientInfo)
+			} else if !r.add(clientInfo) {
+				fmt.Println("Closing connection! Duplicate Node Name: ", clientInfo.Node.Name)
+				sendLastReply(bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_DUPLICATE_NAME,
+					Message: fmt.Sprintf("Someone called %s is already waiting in %v, pick another name.", clientInfo.Node.Name, r)}, clientInfo)
+				r.close()
+			} else {
+				// tell the client where it waits, so it can share the code
+				sendReply(bootstrapClient.Reply{Room: r.code}, clientInfo)
+				if s.config.OnJoin != nil {
+					s.config.OnJoin(r.code, *clientInfo.Node)
+				}
+				r.update(true)
+			}
+		case clientInfo := <-s.removeClientChannel:
+			connAddr := (*clientInfo.Conn).RemoteAddr()
+			if code, ok := s.clientRooms[connAddr]; ok {
+				r := s.rooms[code]
+				r.remove(connAddr)
+				r.update(false)
+			}
+		case clientInfo := <-s.readyClientChannel:
+			connAddr := (*clientInfo.Conn).RemoteAddr()
+			if code, ok := s.clientRooms[connAddr]; ok {
+				r := s.rooms[code]
+				r.setReady(connAddr)
+				r.update(false)
+			}
+		case clientInfo := <-s.checkClientChannel:
+			connAddr := (*clientInfo.Conn).RemoteAddr()
+			if code, ok := s.clientRooms[connAddr]; ok {
+				r := s.rooms[code]
+				r.answerCheck(connAddr, clientInfo.Check)
+				r.update(false)
+			}
+		case timeout := <-s.roomTimeoutChannel:
+			//This is the case that handles our timeouts if we don't get enough players
+			if r, ok := s.rooms[timeout.code]; ok && r.countdown == timeout.id {
+				r.countdown = 0
+				r.expired = true
+				r.update(false)
+			}
+		case timeout := <-s.checkTimeoutChannel:
+			if r, ok := s.rooms[timeout.code]; ok && r.check == timeout.id {
+				r.expireCheck()
+			}
+		case action := <-s.adminChannel:
+			action()
+		case <-s.replicaTick:
+		case <-s.quit:
+			return
+		}
+		s.sendProgress()
+		s.publishState()
+	}
+}
+
+/*
+ * sends a reply: the room, the other players or why the client was
+ * turned away. Once the client has a replyWriter the reply is queued
+ * for it, before that it is written right away.
+ */
+func sendReply(reply bootstrapClient.Reply, clientInfo ClientInfo) {
+	reply.Version = bootstrapClient.PROTOCOL_VERSION
+	if clientInfo.Replies != nil {
+		clientInfo.Replies.queue(queuedReply{reply: reply})
+		return
+	}
+	// a client that stopped reading mustn't hold us up for long
+	if clientInfo.Conn != nil {
+		(*clientInfo.Conn).SetWriteDeadline(time.Now().Add(READY_CHECK_TIMEOUT))
+	}
+	clientInfo.Encoder.Encode(reply)
+}
+
+/*
+ * sends the last reply to a client and closes its connection once the
+ * reply is written
+ */
+func sendLastReply(reply bootstrapClient.Reply, clientInfo ClientInfo) {
+	reply.Version = bootstrapClient.PROTOCOL_VERSION
+	if clientInfo.Replies != nil {
+		clientInfo.Replies.queue(queuedReply{reply: reply, last: true})
+		return
+	}
+	sendReply(reply, clientInfo)
+	(*clientInfo.Conn).Close()
+}
+
+/*
+ * Replies to a client that receiveConnections handles are written by a
+ * routine of the client's own, in order, so that a client that stopped
+ * reading holds up nobody but itself. A client that falls
+ * REPLY_QUEUE_SIZE replies behind, or takes READY_CHECK_TIMEOUT to take
+ * one, is disconnected.
+ */
+const REPLY_QUEUE_SIZE int = 64
+
+type queuedReply struct {
+	reply bootstrapClient.Reply
+	last  bool // close the connection once it is written
+}
+
+type replyWriter struct {
+	conn    net.Conn
+	encoder *gob.Encoder
+	replies chan queuedReply
+	done    chan struct{} // closed once the client's connection is handled no more
+}
+
+func newReplyWriter(conn net.Conn, encoder *gob.Encoder) *replyWriter {
+	writer := &replyWriter{conn: conn, encoder: encoder, replies: make(chan queuedReply, REPLY_QUEUE_SIZE),
+		done: make(chan struct{})}
+	go writer.run()
+	return writer
+}
+
+/*
+ * queues a reply without waiting, disconnecting a client that is too far
+ * behind
+ */
+func (writer *replyWriter) queue(queued queuedReply) {
+	select {
+	case writer.replies <- queued:
+	default:
+		fmt.Println("Disconnecting a client that doesn't read its replies:", writer.conn.RemoteAddr())
+		writer.conn.Close()
+	}
+}
+
+/*
+ * stops the writer once what is queued is written, called when the
+ * client's connection is handled no more
+ */
+func (writer *replyWriter) finish() {
+	close(writer.done)
+}
+
+func (writer *replyWriter) run() {
+	for {
+		select {
+		case queued := <-writer.replies:
+			if writer.write(queued) {
+				return
+			}
+		case <-writer.done:
+			for {
+				select {
+				case queued := <-writer.replies:
+					if writer.write(queued) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+/*
+ * writes a reply
+ * @return	true if the connection is closed now
+ **/
+func (writer *replyWriter) write(queued queuedReply) bool {
+	writer.conn.SetWriteDeadline(time.Now().Add(READY_CHECK_TIMEOUT))
+	if err := writer.encoder.Encode(queued.reply); err != nil || queued.last {
+		writer.conn.Close()
+		return true
+	}
+	return false
+}
+
+/*
+ * logs a client in to its account, if it asks to or has to, and sends it
+ * its session
+ * @return	false if the client was turned away
+ **/
+func (s *Server) logIn(request *bootstrapClient.Request, clientInfo ClientInfo) bool {
+	login := request.Login
+	if s.accounts == nil {
+		if login.Register || len(login.Password) > 0 || len(login.Session) > 0 {
+			sendReply(bootstrapClient.Reply{Rejected: bootstrapClient.REJECT_NO_ACCOUNTS,
+				Message: "This server has no accounts, play without logging in."}, clientInfo)
+			return false
+		}
+		return true
+	}
+	session, rejection := s.accounts.authenticate(request.Node, login)
+	if rejection != nil {
+		fmt.Printf("Turning %s away: %s\n", request.Node.Name, rejection.Rejected)
+		sendReply(*rejection, clientInfo)
+		return false
+	}
+	if len(session) > 0 {
+		request.Node.Session = session
+		sendReply(bootstrapClient.Reply{Session: session, ServerKey: s.accounts.publicKey()}, clientInfo)
+	}
+	return true
+}
+
+/*
+ * receives a single request
+ */
+func receiveRequest(dec *gob.Decoder) (*bootstrapClient.Request, error) {
+	request := &bootstrapClient.Request{}
+	err := dec.Decode(request)
+	return request, err
+}
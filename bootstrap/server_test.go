@@ -0,0 +1,334 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/* a server for 2 players on a loopback port, closed after the test */
+func startTestServer(t *testing.T, config Config) (*Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Lobby.QuickMatch.MaxPlayers = 2
+	config.Lobby.Created.MaxPlayers = 2
+	if len(config.Replicas) > 0 {
+		config.Advertise = ln.Addr().String()
+	}
+	s, err := NewServer(config)
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("Serve should end with ErrServerClosed, got %v", err)
+		}
+	})
+	return s, ln.Addr().String()
+}
+
+type joinResult struct {
+	nodes []messagePasser.Node
+	err   error
+}
+
+/* a bootstrapClient waiting for a game, its result goes to the returned channel */
+func join(name string, config bootstrapClient.Config) chan joinResult {
+	config.Backoff.MaxAttempts = 1
+	config.Deadline = 10 * time.Second
+	result := make(chan joinResult, 1)
+	go func() {
+		nodes, err := bootstrapClient.GetNodesContext(context.Background(), messagePasser.Node{Name: name, Port: 1}, config)
+		if err != nil {
+			result <- joinResult{err: err}
+		} else {
+			result <- joinResult{nodes: *nodes}
+		}
+	}()
+	return result
+}
+
+func clientConfig(server string) bootstrapClient.Config {
+	config := bootstrapClient.DefaultConfig()
+	config.Server = server
+	return config
+}
+
+/* the names of the peers a client got */
+func peers(t *testing.T, result chan joinResult) string {
+	select {
+	case got := <-result:
+		if got.err != nil {
+			t.Fatalf("Expected a game, got %v", got.err)
+		}
+		names := []string{}
+		for _, node := range got.nodes {
+			names = append(names, node.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	case <-time.After(15 * time.Second):
+		t.Fatalf("No game formed.")
+	}
+	return ""
+}
+
+func TestServerStartsAGame(t *testing.T) {
+	joined := make(chan string, 4)
+	started := make(chan GameRecord, 1)
+	config := DefaultConfig()
+	config.OnJoin = func(room string, node messagePasser.Node) { joined <- node.Name }
+	config.OnGameStarted = func(game GameRecord) { started <- game }
+	s, addr := startTestServer(t, config)
+
+	armin := join("armin", clientConfig(addr))
+	if name := <-joined; name != "armin" {
+		t.Fatalf("Expected armin to join, got %s", name)
+	}
+	lunwen := join("lunwen", clientConfig(addr))
+	if got := peers(t, armin); got != "lunwen" {
+		t.Errorf("armin should play with lunwen, got %q", got)
+	}
+	if got := peers(t, lunwen); got != "armin" {
+		t.Errorf("lunwen should play with armin, got %q", got)
+	}
+	game := <-started
+	if game.Room != bootstrapClient.QUICK_MATCH || strings.Join(game.Players, ",") != "armin,lunwen" || len(game.ID) == 0 {
+		t.Errorf("Unexpected game %+v", game)
+	}
+	if status := s.Status(); len(status.Games) != 1 || status.Games[0].ID != game.ID {
+		t.Errorf("Expected the game in the status, got %+v", status.Games)
+	}
+}
+
+func TestServerRoomsAndDraining(t *testing.T) {
+	s, addr := startTestServer(t, DefaultConfig())
+	codes := make(chan string, 1)
+	creator := clientConfig(addr)
+	creator.CreateRoom = true
+	creator.OnRoom = func(code string) { codes <- code }
+	daniel := join("daniel", creator)
+	code := <-codes
+
+	s.SetDraining(true)
+	late := clientConfig(addr)
+	late.Room = code
+	if got := <-join("garrett", late); !errors.Is(got.err, bootstrapClient.ErrServerDraining) {
+		t.Errorf("A draining server should turn garrett away, got %+v", got)
+	}
+	s.SetDraining(false)
+	lower := clientConfig(addr)
+	lower.Room = strings.ToLower(code)
+	if got := peers(t, join("lunwen", lower)); got != "daniel" {
+		t.Errorf("lunwen should play with daniel in %s, got %q", code, got)
+	}
+	if got := peers(t, daniel); got != "lunwen" {
+		t.Errorf("daniel should play with lunwen, got %q", got)
+	}
+}
+
+func TestCloseDropsWaitingClients(t *testing.T) {
+	joined := make(chan string, 1)
+	config := DefaultConfig()
+	config.OnJoin = func(room string, node messagePasser.Node) { joined <- node.Name }
+	s, addr := startTestServer(t, config)
+	armin := join("armin", clientConfig(addr))
+	<-joined
+	s.Close()
+	select {
+	case got := <-armin:
+		if got.err == nil {
+			t.Errorf("armin can't get a game from a closed server, got %+v", got.nodes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("armin kept waiting on a closed server.")
+	}
+	if err := s.Kick("", "armin"); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed, got %v", err)
+	}
+}
+
+/*
+ * starts n servers replicating each other, and waits for the first to lead
+ * @return	the servers and the addresses of their players' ports
+ **/
+func startReplicas(t *testing.T, n int) ([]*Server, []string) {
+	listeners := []net.Listener{}
+	replicas := []string{}
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+		replicas = append(replicas, ln.Addr().String())
+	}
+	servers, addrs := []*Server{}, []string{}
+	for i := 0; i < n; i++ {
+		config := DefaultConfig()
+		config.Replicas, config.Replica, config.ReplicaListener = replicas, replicas[i], listeners[i]
+		s, addr := startTestServer(t, config)
+		servers, addrs = append(servers, s), append(addrs, addr)
+	}
+	// the first replica wins the election and the second hears about it
+	deadline := time.Now().Add(3 * REPLICA_TIMEOUT)
+	for status := servers[1].Status(); status.Replica.Leader != addrs[0]; status = servers[1].Status() {
+		if time.Now().After(deadline) {
+			t.Fatalf("The follower didn't hear from the leader: %+v", status.Replica)
+		}
+		time.Sleep(REPLICA_HEARTBEAT / 5)
+	}
+	return servers, addrs
+}
+
+func TestFollowerSendsClientsToLeader(t *testing.T) {
+	servers, addrs := startReplicas(t, 2)
+	armin := join("armin", clientConfig(addrs[1]))
+	lunwen := join("lunwen", clientConfig(addrs[1]))
+	if got := peers(t, armin); got != "lunwen" {
+		t.Errorf("armin should play with lunwen, got %q", got)
+	}
+	if got := peers(t, lunwen); got != "armin" {
+		t.Errorf("lunwen should play with armin, got %q", got)
+	}
+	if games := servers[0].Status().Games; len(games) != 1 {
+		t.Errorf("Expected the leader to start the game, got %+v", games)
+	}
+}
+
+func TestClientsFailOverToTheNextServer(t *testing.T) {
+	servers, addrs := startReplicas(t, 2)
+	servers[0].Close()
+	deadline := time.Now().Add(3 * REPLICA_TIMEOUT)
+	for !servers[1].Status().Replica.Leading {
+		if time.Now().After(deadline) {
+			t.Fatalf("The second server didn't take over: %+v", servers[1].Status().Replica)
+		}
+		time.Sleep(REPLICA_HEARTBEAT / 5)
+	}
+
+	config := clientConfig(addrs[0])
+	config.Servers = addrs[1:]
+	armin := join("armin", config)
+	lunwen := join("lunwen", config)
+	if got := peers(t, armin); got != "lunwen" {
+		t.Errorf("armin should play with lunwen, got %q", got)
+	}
+	if got := peers(t, lunwen); got != "armin" {
+		t.Errorf("lunwen should play with armin, got %q", got)
+	}
+	if games := servers[1].Status().Games; len(games) != 1 {
+		t.Errorf("Expected the second server to start the game, got %+v", games)
+	}
+}
+
+/* the reply of the server at addr to a single request */
+func exchange(t *testing.T, addr string, request bootstrapClient.Request) bootstrapClient.Reply {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply := bootstrapClient.Reply{}
+	if err := gob.NewEncoder(conn).Encode(request); err != nil {
+		t.Fatal(err)
+	} else if err := gob.NewDecoder(conn).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestServerChecksTheHandshake(t *testing.T) {
+	_, addr := startTestServer(t, DefaultConfig())
+	node := messagePasser.Node{Name: "armin", Port: 1}
+	reply := exchange(t, addr, bootstrapClient.Request{Type: bootstrapClient.REQUEST_JOIN, Node: node})
+	if reply.Rejected != bootstrapClient.REJECT_VERSION || reply.Version != bootstrapClient.PROTOCOL_VERSION {
+		t.Errorf("A request without a version should be turned away, got %+v", reply)
+	}
+	reply = exchange(t, addr, bootstrapClient.Request{Version: bootstrapClient.PROTOCOL_VERSION,
+		Type: bootstrapClient.REQUEST_READY, Node: node})
+	if reply.Rejected != bootstrapClient.REJECT_BAD_REQUEST {
+		t.Errorf("A READY can't come first, got %+v", reply)
+	}
+	reply = exchange(t, addr, bootstrapClient.Request{Version: bootstrapClient.PROTOCOL_VERSION,
+		Type: bootstrapClient.REQUEST_QUERY, Node: node})
+	if reply.Rejected != bootstrapClient.REJECT_BAD_REQUEST {
+		t.Errorf("A QUERY needs a query, got %+v", reply)
+	}
+}
+
+func TestServerFullAndProgress(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxClients = 1
+	s, addr := startTestServer(t, config)
+	progress := make(chan bootstrapClient.LobbyProgress, 4)
+	armin := clientConfig(addr)
+	armin.OnProgress = func(p bootstrapClient.LobbyProgress) { progress <- p }
+	waiting := join("armin", armin)
+	select {
+	case p := <-progress:
+		if p.Room != bootstrapClient.QUICK_MATCH || strings.Join(p.Players, ",") != "armin" || p.MaxPlayers != 2 {
+			t.Errorf("Expected armin alone in the quick match, got %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("armin heard nothing about the lobby.")
+	}
+	if got := <-join("lunwen", clientConfig(addr)); !errors.Is(got.err, bootstrapClient.ErrServerFull) {
+		t.Errorf("A full server should turn lunwen away, got %+v", got)
+	}
+	creator := clientConfig(addr)
+	creator.CreateRoom = true
+	if got := <-join("daniel", creator); !errors.Is(got.err, bootstrapClient.ErrServerFull) {
+		t.Errorf("A full server should turn daniel away, got %+v", got)
+	}
+	if rooms := s.Status().Rooms; len(rooms) != 1 {
+		t.Errorf("A client turned away shouldn't leave a room behind, got %+v", rooms)
+	}
+	select {
+	case got := <-waiting:
+		t.Errorf("armin shouldn't get a game alone, got %+v", got)
+	default:
+	}
+}
+
+func TestSpectatorRegistersWithTheServer(t *testing.T) {
+	started := make(chan GameRecord, 1)
+	config := DefaultConfig()
+	config.OnGameStarted = func(game GameRecord) { started <- game }
+	_, addr := startTestServer(t, config)
+	tickets := make(chan bootstrapClient.Ticket, 2)
+	player := clientConfig(addr)
+	player.OnTicket = func(ticket bootstrapClient.Ticket) { tickets <- ticket }
+	armin, lunwen := join("armin", player), join("lunwen", player)
+	peers(t, armin)
+	peers(t, lunwen)
+	game := <-started
+	ticket := <-tickets
+
+	watched, err := bootstrapClient.WatchGame(context.Background(), clientConfig(addr), "spectator", ticket.WatchCode)
+	if err != nil {
+		t.Fatalf("Couldn't watch the game: %v", err)
+	}
+	if watched.ID != game.ID || watched.Token != ticket.Watch || len(watched.Players) != 2 || watched.Players[0].Port != 0 {
+		t.Errorf("Expected the players' names and the token %s, got %+v", ticket.Watch, watched)
+	}
+	var notFound *bootstrapClient.GameNotFoundError
+	if _, err := bootstrapClient.WatchGame(context.Background(), clientConfig(addr), "spectator", game.ID); !errors.As(err, &notFound) {
+		t.Errorf("The game's ID shouldn't be enough to watch it, got %v", err)
+	}
+}
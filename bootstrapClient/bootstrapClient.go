@@ -7,55 +7,560 @@
 package bootstrapClient
 
 import (
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
+
 	"github.com/arminm/multegula/defs"
 	"github.com/arminm/multegula/messagePasser"
+	"github.com/arminm/multegula/tlsTransport"
 )
 
+/*
+ * A client sends a Request and the server answers with Replies: the code
+ * of the room it joined, then the other players once a game is formed, or
+ * why the client was turned away. Every request says which of the
+ * REQUEST_ types it is and which PROTOCOL_VERSION the client speaks, a
+ * server that doesn't speak it turns the client away with REJECT_VERSION
+ * and its own version. While the client waits, the server sends it the
+ * LobbyProgress of its room whenever the room changes. Every room forms
+ * its own games, the room with the code QUICK_MATCH is open to anyone. Before a game is
+ * formed the server sends a ready check, a client that doesn't send the
+ * check back in time is dropped. With the players comes a Ticket, a client
+ * that lost its game sends it back under the same name for the roster.
+ * A client may log in first with Login, see session.go, the server then
+ * answers with the client's session before anything else. Reports and
+ * history queries are answered with a single Reply, see report.go, and
+ * so are spectators registering to watch a game, see watch.go.
+ * A replicated service has several servers and only its leader takes
+ * clients: the others turn them away with REJECT_NOT_LEADER and the
+ * leader's address. A client given Servers follows the leader and, when
+ * its server goes away, fails over to the others and comes back to the
+ * same room.
+ */
+const QUICK_MATCH string = ""
+
+/* the version of the protocol we speak, and the oldest one the server takes */
+const PROTOCOL_VERSION int = 1
+const MIN_PROTOCOL_VERSION int = 1
+
+const REQUEST_JOIN string = "JOIN"     // wait for a game, or rejoin one
+const REQUEST_READY string = "READY"   // we are ready to start
+const REQUEST_CHECK string = "CHECK"   // answers a ready check
+const REQUEST_REPORT string = "REPORT" // the end of a game
+const REQUEST_QUERY string = "QUERY"   // the leaderboard or a player's games
+const REQUEST_WATCH string = "WATCH"   // the players of a game to watch
+
+const REJECT_DUPLICATE_NAME string = "DUPLICATE_NAME"
+const REJECT_BAD_NODE string = "BAD_NODE"
+const REJECT_UNKNOWN_ROOM string = "UNKNOWN_ROOM"
+const REJECT_KICKED string = "KICKED"
+const REJECT_DRAINING string = "DRAINING"
+const REJECT_UNKNOWN_GAME string = "UNKNOWN_GAME"
+const REJECT_BAD_TOKEN string = "BAD_TOKEN"
+const REJECT_BAD_LOGIN string = "BAD_LOGIN"
+const REJECT_NAME_REGISTERED string = "NAME_REGISTERED"
+const REJECT_LOGIN_REQUIRED string = "LOGIN_REQUIRED"
+const REJECT_NO_ACCOUNTS string = "NO_ACCOUNTS"
+const REJECT_BAD_REPORT string = "BAD_REPORT"
+const REJECT_NO_HISTORY string = "NO_HISTORY"
+const REJECT_NOT_LEADER string = "NOT_LEADER"
+const REJECT_VERSION string = "VERSION"
+const REJECT_BAD_REQUEST string = "BAD_REQUEST"
+const REJECT_SERVER_FULL string = "SERVER_FULL"
+
+/* connections to new servers one GetNodes call makes after the first */
+const MAX_FAILOVERS int = 20
+
+type Ticket struct {
+	GameID string
+	Token  string // secret, only this player's
+	Watch  string // secret, the game's, spectators show it to the players
+	/* secret, the game's, players share it with those they let watch */
+	WatchCode string
+}
+
+/* how a client logs in to the account of its name, zero for a guest */
+type Login struct {
+	Password string
+	Register bool   // create the account with Password
+	Session  string // log in again with an earlier session instead
+}
+
+type Request struct {
+	Version    int    // PROTOCOL_VERSION
+	Type       string // one of the REQUEST_ types
+	Node       messagePasser.Node
+	Room       string // join code of the room to join, QUICK_MATCH for anyone
+	CreateRoom bool   // open a new room instead, Room is ignored
+	Ready      bool   // ready to start before the countdown runs out
+	Check      int    // answers the ready check with this id
+	Rejoin     Ticket // the game to come back to, Room is ignored then
+	Login      Login
+	Report     *GameReport   // the end of a game, see report.go
+	Query      *HistoryQuery // asks for the leaderboard or a player's games
+	Watch      string        // the watch code of the game to watch, see Ticket
+}
+
+type Reply struct {
+	Version     int                  // the server's PROTOCOL_VERSION
+	Rejected    string               // one of the REJECT_ codes
+	Room        string               // the room the client is waiting in
+	Check       int                  // a ready check to answer, 0 if none
+	Ticket      Ticket               // to rejoin the game with
+	Session     string               // the client's session once it logged in
+	ServerKey   string               // checks the sessions of the players, see VerifyNode
+	Message     string               // why the client was turned away, for people
+	Nodes       []messagePasser.Node // the other players, once the game starts
+	Leaderboard []PlayerStats        // answers a HistoryQuery without a Player
+	History     []MatchRecord        // answers a HistoryQuery for a Player
+	Leader      string               // where to go instead, with REJECT_NOT_LEADER
+	Progress    *LobbyProgress       // the room we wait in changed
+	Relay       string               // the server's relay, ":port" on the server's host, "" if none
+}
+
+/* how far the room we wait in is from starting a game */
+type LobbyProgress struct {
+	Room       string
+	Players    []string      // waiting, in the order they came
+	Ready      int           // of them are ready to start
+	MinPlayers int           // to start the countdown
+	MaxPlayers int           // to start right away
+	StartsIn   time.Duration // left on the countdown, 0 if it isn't running
+	Starting   bool          // the ready check before the game runs
+}
+
+/* how long to wait between attempts to reach the server */
+type Backoff struct {
+	Initial     time.Duration // wait after the first failed attempt
+	Max         time.Duration // longest wait
+	Multiplier  float64       // growth of the wait after each attempt
+	MaxAttempts int           // rounds of every server, 0 to keep trying until the deadline
+}
+
+/* client settings, DefaultConfig matches the old behaviour */
+type Config struct {
+	Server      string   // host:port of the bootstrap server
+	Servers     []string // more servers of a replicated bootstrap service
+	Backoff     Backoff
+	DialTimeout time.Duration // for a single attempt
+	Deadline    time.Duration // for the whole call, 0 for none
+	Room        string        // join code of the room to join, QUICK_MATCH for anyone
+	CreateRoom  bool          // open a new room and wait in it
+	Rejoin      Ticket        // come back to this game instead of waiting for one
+	Login       Login         // log in to the account of our name
+	/* closing it tells the server we are ready to start, may be nil */
+	Ready <-chan struct{}
+	/* called before waiting to try again, may be nil */
+	OnRetry func(attempt int, wait time.Duration, err error)
+	/* called once the server has our node and we wait for a game, may be nil */
+	OnConnected func()
+	/* called with the code of the room we wait in, may be nil */
+	OnRoom func(code string)
+	/* called whenever the room we wait in changes, may be nil */
+	OnProgress func(progress LobbyProgress)
+	/* called with the ticket to rejoin the game with, may be nil */
+	OnTicket func(ticket Ticket)
+	/* called with the host:port of the server's relay once the game starts, may be nil */
+	OnRelay func(address string)
+	/* called with our session and the server's key once we logged in, may be nil */
+	OnSession func(session string, serverKey string)
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Server: defs.SERVER_DNS,
+		Backoff: Backoff{
+			Initial:    500 * time.Millisecond,
+			Max:        10 * time.Second,
+			Multiplier: 2,
+		},
+		DialTimeout: 5 * time.Second,
+	}
+}
+
+/*
+ * the server we reached follows another one, of a replicated bootstrap
+ * service, clients have to go to its leader
+ */
+type notLeaderError struct {
+	Server string
+	Leader string // "" if it doesn't know one yet
+}
+
+func (err *notLeaderError) Error() string {
+	if len(err.Leader) == 0 {
+		return fmt.Sprintf("Bootstrap server %s doesn't lead and knows no leader", err.Server)
+	}
+	return fmt.Sprintf("Bootstrap server %s doesn't lead, %s does", err.Server, err.Leader)
+}
+
+/* the server couldn't be reached, or the connection to it was lost */
+type ServerUnreachableError struct {
+	Server   string
+	Attempts int
+	Err      error
+}
+
+func (err *ServerUnreachableError) Error() string {
+	return fmt.Sprintf("Bootstrap server %s unreachable after %d attempts: %v", err.Server, err.Attempts, err.Err)
+}
+
+func (err *ServerUnreachableError) Unwrap() error {
+	return err.Err
+}
+
+/* the server takes no new players, wrapped in a *ServerUnreachableError */
+var ErrServerDraining = errors.New("Bootstrap server is down for maintenance")
+
+/* the server has no room for more players, wrapped in a *ServerUnreachableError */
+var ErrServerFull = errors.New("Bootstrap server is full")
+
+/* the server doesn't speak our protocol version, or didn't get our request */
+type ProtocolError struct {
+	Reason        string // REJECT_VERSION or REJECT_BAD_REQUEST
+	ServerVersion int
+	Message       string // the server's explanation, may be ""
+}
+
+func (err *ProtocolError) Error() string {
+	if err.Reason == REJECT_VERSION {
+		return fmt.Sprintf("Bootstrap server speaks protocol version %d, we speak %d, update the game",
+			err.ServerVersion, PROTOCOL_VERSION)
+	} else if len(err.Message) > 0 {
+		return err.Message
+	}
+	return fmt.Sprintf("Bootstrap server didn't take our request: %s", err.Reason)
+}
+
+/* the server turned our node away, or removed it from the lobby */
+type NameRejectedError struct {
+	Name    string
+	Reason  string // one of the REJECT_ codes
+	Message string // the server's explanation, may be ""
+}
+
+func (err *NameRejectedError) Error() string {
+	if len(err.Message) > 0 {
+		return err.Message
+	} else if err.Reason == REJECT_DUPLICATE_NAME {
+		return fmt.Sprintf("The name %s is already taken", err.Name)
+	} else if err.Reason == REJECT_KICKED {
+		return fmt.Sprintf("%s was removed from the lobby", err.Name)
+	}
+	return fmt.Sprintf("Bootstrap server rejected %s: %s", err.Name, err.Reason)
+}
+
+/* logging in or registering failed, or the name needs it */
+type LoginError struct {
+	Name    string
+	Reason  string // one of the REJECT_ codes
+	Message string // the server's explanation, may be ""
+}
+
+func (err *LoginError) Error() string {
+	if len(err.Message) > 0 {
+		return err.Message
+	}
+	return fmt.Sprintf("Couldn't log in as %s: %s", err.Name, err.Reason)
+}
+
+/* there is no room with the code, or its game has started */
+type RoomNotFoundError struct {
+	Code string
+}
+
+func (err *RoomNotFoundError) Error() string {
+	return fmt.Sprintf("There is no room with the code %s", err.Code)
+}
+
+/* the game is over or unknown, or the token or the key isn't ours */
+type RejoinError struct {
+	GameID string
+	Reason string // one of the REJECT_ codes
+}
+
+func (err *RejoinError) Error() string {
+	if err.Reason == REJECT_BAD_TOKEN {
+		return fmt.Sprintf("Wrong rejoin token or key for game %s", err.GameID)
+	}
+	return fmt.Sprintf("Game %s is over or unknown", err.GameID)
+}
+
+/* no game was formed before the deadline, or the wait was cancelled */
+type LobbyTimeoutError struct {
+	Waited time.Duration
+	Err    error
+}
+
+func (err *LobbyTimeoutError) Error() string {
+	return fmt.Sprintf("No game formed after %v: %v", err.Waited.Round(time.Second), err.Err)
+}
+
+func (err *LobbyTimeoutError) Unwrap() error {
+	return err.Err
+}
+
 /*
  * Get Nodes
  *
  **/
 func GetNodes(localNode messagePasser.Node) (*[]messagePasser.Node, error) {
-	var conn net.Conn
-	var err error
-	for {
-		//TODO: Make this configurable
-		conn, err = net.Dial("tcp", defs.SERVER_DNS)
-		if err == nil {
-			break
+	return GetNodesContext(context.Background(), localNode, DefaultConfig())
+}
+
+/*
+ * gets the other players of a game from the bootstrap server
+ * @param	ctx – cancels dialing and waiting
+ * @param	localNode – this player
+ * @param	config – the client settings
+ *
+ * @return	the other players, or a *ServerUnreachableError,
+ *			*NameRejectedError, *LoginError, *RoomNotFoundError,
+ *			*RejoinError, *ProtocolError or *LobbyTimeoutError
+ **/
+func GetNodesContext(ctx context.Context, localNode messagePasser.Node, config Config) (*[]messagePasser.Node, error) {
+	if config.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Deadline)
+		defer cancel()
+	}
+	started := time.Now()
+	request := Request{Version: PROTOCOL_VERSION, Type: REQUEST_JOIN, Node: localNode,
+		Room: config.Room, CreateRoom: config.CreateRoom, Rejoin: config.Rejoin, Login: config.Login}
+	leader := ""
+	for failovers := 0; ; failovers++ {
+		conn, server, attempts, err := dialServer(ctx, config, leader)
+		if err != nil {
+			return nil, err
+		}
+		nodes, err := waitForGame(ctx, conn, &request, config, server, attempts, started)
+		conn.Close()
+		var moved *notLeaderError
+		var lost *ServerUnreachableError
+		switch {
+		case failovers >= MAX_FAILOVERS || ctx.Err() != nil:
+			return nodes, err
+		case errors.As(err, &moved):
+			if len(moved.Leader) == 0 || moved.Leader == leader {
+				// no leader yet, give the servers time to elect one
+				select {
+				case <-ctx.Done():
+				case <-time.After(config.Backoff.Initial):
+				}
+			}
+			leader = moved.Leader
+		case errors.As(err, &lost) && !errors.Is(err, ErrServerDraining) && !errors.Is(err, ErrServerFull) && len(config.Servers) > 0:
+			fmt.Println("Lost the bootstrap server, failing over:", err)
+			leader = ""
+		default:
+			return nodes, err
 		}
-		fmt.Print(".")
-		time.Sleep(time.Second * 1)
 	}
+}
+
+/*
+ * sends our request on a connection and waits there for a game
+ * @param	request – updated with what a new connection needs to pick up
+ *			where this one stopped: our room and session
+ **/
+func waitForGame(ctx context.Context, conn net.Conn, request *Request, config Config, server string, attempts int, started time.Time) (*[]messagePasser.Node, error) {
 	fmt.Println("Connected to Bootstrap Server!")
-	sendNode(localNode, conn)
+	localNode := request.Node
+
+	/* unblocks the read below when ctx is done */
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	sender := &requestSender{encoder: gob.NewEncoder(conn), request: *request}
+	if err := sender.send(); err != nil {
+		return nil, &ServerUnreachableError{server, attempts, err}
+	}
+	if config.Ready != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go sender.sendReady(config.Ready, done)
+	}
 	fmt.Println("Sent local info. Waiting for peer nodes...")
-	return receiveNodes(conn)
+	if config.OnConnected != nil {
+		config.OnConnected()
+	}
+	dec := gob.NewDecoder(conn)
+	for {
+		reply := Reply{}
+		if err := dec.Decode(&reply); err != nil {
+			if ctx.Err() != nil {
+				return nil, &LobbyTimeoutError{time.Since(started), ctx.Err()}
+			}
+			return nil, &ServerUnreachableError{server, attempts, err}
+		}
+		switch {
+		case reply.Check != 0:
+			sender.answerCheck(reply.Check)
+		case reply.Rejected == REJECT_NOT_LEADER:
+			return nil, &ServerUnreachableError{server, attempts, &notLeaderError{server, reply.Leader}}
+		case reply.Rejected == REJECT_UNKNOWN_ROOM:
+			return nil, &RoomNotFoundError{config.Room}
+		case reply.Rejected == REJECT_UNKNOWN_GAME || reply.Rejected == REJECT_BAD_TOKEN:
+			return nil, &RejoinError{config.Rejoin.GameID, reply.Rejected}
+		case reply.Rejected == REJECT_BAD_LOGIN || reply.Rejected == REJECT_NAME_REGISTERED ||
+			reply.Rejected == REJECT_LOGIN_REQUIRED || reply.Rejected == REJECT_NO_ACCOUNTS:
+			return nil, &LoginError{localNode.Name, reply.Rejected, reply.Message}
+		case reply.Rejected == REJECT_DRAINING:
+			return nil, &ServerUnreachableError{server, attempts, ErrServerDraining}
+		case reply.Rejected == REJECT_SERVER_FULL:
+			return nil, &ServerUnreachableError{server, attempts, ErrServerFull}
+		case reply.Rejected == REJECT_VERSION || reply.Rejected == REJECT_BAD_REQUEST:
+			return nil, &ProtocolError{reply.Rejected, reply.Version, reply.Message}
+		case len(reply.Rejected) > 0:
+			return nil, &NameRejectedError{localNode.Name, reply.Rejected, reply.Message}
+		case len(reply.Nodes) > 0:
+			if len(reply.Ticket.GameID) > 0 && config.OnTicket != nil {
+				config.OnTicket(reply.Ticket)
+			}
+			if len(reply.Relay) > 0 && config.OnRelay != nil {
+				config.OnRelay(relayAddress(reply.Relay, server))
+			}
+			checkSessions(reply.Nodes, reply.ServerKey)
+			return &reply.Nodes, nil
+		case len(reply.Session) > 0:
+			// another server takes the session, registering again would fail
+			request.Login = Login{Session: reply.Session}
+			if config.OnSession != nil {
+				config.OnSession(reply.Session, reply.ServerKey)
+			}
+		case reply.Progress != nil:
+			if config.OnProgress != nil {
+				config.OnProgress(*reply.Progress)
+			}
+		default:
+			// come back to the same room if the server goes away
+			request.Room = reply.Room
+			request.CreateRoom = false
+			if config.OnRoom != nil {
+				config.OnRoom(reply.Room)
+			}
+		}
+	}
 }
 
 /*
- * Send Nodes to Bootstrap Server
- *
+ * the address of the server's relay
+ * @param	relay – from the reply, a port alone means on the server's host
+ * @param	server – the server we reached
  **/
-func sendNode(node messagePasser.Node, conn net.Conn) {
-	encoder := gob.NewEncoder(conn)
-	encoder.Encode(node)
+func relayAddress(relay string, server string) string {
+	host, port, err := net.SplitHostPort(relay)
+	if err != nil || len(host) > 0 {
+		return relay
+	}
+	serverHost, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return relay
+	}
+	return net.JoinHostPort(serverHost, port)
 }
 
 /*
- * Receive Nodes from Bootstrap Server
- *
+ * the servers to try, in order, each once
+ * @param	prefer – tried first, "" for none
  **/
-func receiveNodes(conn net.Conn) (*[]messagePasser.Node, error) {
-	dec := gob.NewDecoder(conn)
-	nodes := &[]messagePasser.Node{}
-	err := dec.Decode(nodes)
-	if err != nil {
-		return nodes, err
+func serverList(config Config, prefer string) []string {
+	servers := []string{}
+	seen := make(map[string]bool)
+	for _, server := range append([]string{prefer, config.Server}, config.Servers...) {
+		if len(server) > 0 && !seen[server] {
+			servers = append(servers, server)
+			seen[server] = true
+		}
+	}
+	return servers
+}
+
+/*
+ * dials the servers in turn, backing off after trying all of them
+ * @param	prefer – the server to try first, such as the leader, "" for none
+ * @return	the connection, the server it goes to and the number of
+ *			attempts it took
+ **/
+func dialServer(ctx context.Context, config Config, prefer string) (net.Conn, string, int, error) {
+	servers := serverList(config, prefer)
+	wait := config.Backoff.Initial
+	for attempt := 1; ; attempt++ {
+		server := servers[(attempt-1)%len(servers)]
+		dialCtx, cancel := context.WithTimeout(ctx, config.DialTimeout)
+		conn, err := tlsTransport.DialContext(dialCtx, server)
+		cancel()
+		if err == nil {
+			return conn, server, attempt, nil
+		}
+		if ctx.Err() != nil {
+			return nil, server, attempt, &ServerUnreachableError{server, attempt, ctx.Err()}
+		}
+		if config.Backoff.MaxAttempts > 0 && attempt >= config.Backoff.MaxAttempts*len(servers) {
+			return nil, server, attempt, &ServerUnreachableError{server, attempt, err}
+		}
+		if attempt%len(servers) != 0 {
+			// the next server may be up
+			continue
+		}
+		if config.OnRetry != nil {
+			config.OnRetry(attempt, wait, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, server, attempt, &ServerUnreachableError{server, attempt, ctx.Err()}
+		case <-time.After(wait):
+		}
+		wait = time.Duration(float64(wait) * config.Backoff.Multiplier)
+		if wait > config.Backoff.Max {
+			wait = config.Backoff.Max
+		}
 	}
-	return nodes, nil
+}
+
+/* sends our request again whenever it changes, from more than one routine */
+type requestSender struct {
+	mutex   sync.Mutex
+	encoder *gob.Encoder
+	request Request
+}
+
+func (sender *requestSender) send() error {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	return sender.encoder.Encode(sender.request)
+}
+
+/*
+ * tells the server we are ready once ready is closed, unless done is
+ * closed first
+ */
+func (sender *requestSender) sendReady(ready <-chan struct{}, done <-chan struct{}) {
+	select {
+	case <-ready:
+		sender.mutex.Lock()
+		sender.request.Ready = true
+		request := sender.request
+		request.Type = REQUEST_READY
+		sender.encoder.Encode(request)
+		sender.mutex.Unlock()
+	case <-done:
+	}
+}
+
+/*
+ * answers a ready check, we are still here
+ */
+func (sender *requestSender) answerCheck(check int) {
+	sender.mutex.Lock()
+	request := sender.request
+	request.Type = REQUEST_CHECK
+	request.Check = check
+	sender.encoder.Encode(request)
+	sender.mutex.Unlock()
 }
@@ -0,0 +1,367 @@
+package bootstrapClient
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/* a server that answers every request with reply, or never if reply is nil */
+func fakeServer(t *testing.T, reply *Reply) net.Listener {
+	if reply == nil {
+		return fakeRoomServer(t, nil)
+	}
+	return fakeRoomServer(t, []Reply{*reply})
+}
+
+/* a server that answers every request with replies, or never if there are none */
+func fakeRoomServer(t *testing.T, replies []Reply) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				request := Request{}
+				if gob.NewDecoder(conn).Decode(&request) != nil || len(replies) == 0 {
+					return
+				}
+				encoder := gob.NewEncoder(conn)
+				for _, reply := range replies {
+					encoder.Encode(reply)
+				}
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func testConfig(server string) Config {
+	config := DefaultConfig()
+	config.Server = server
+	config.Backoff = Backoff{Initial: 10 * time.Millisecond, Max: 40 * time.Millisecond, Multiplier: 2}
+	config.DialTimeout = time.Second
+	return config
+}
+
+var armin = messagePasser.Node{Name: "armin", Port: 11111}
+
+func TestGetNodesReturnsGame(t *testing.T) {
+	ln := fakeServer(t, &Reply{Nodes: []messagePasser.Node{{Name: "lunwen", IP: "10.0.0.3", Port: 11111}}})
+	defer ln.Close()
+	connected := false
+	config := testConfig(ln.Addr().String())
+	config.OnConnected = func() { connected = true }
+	nodes, err := GetNodesContext(context.Background(), armin, config)
+	if err != nil || len(*nodes) != 1 || (*nodes)[0].Name != "lunwen" {
+		t.Fatalf("Expected lunwen, got %v, %v", nodes, err)
+	}
+	if !connected {
+		t.Errorf("OnConnected wasn't called.")
+	}
+}
+
+func TestUnreachableServerBacksOff(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := ln.Addr().String()
+	ln.Close()
+
+	waits := []time.Duration{}
+	config := testConfig(address)
+	config.Backoff.MaxAttempts = 5
+	config.OnRetry = func(attempt int, wait time.Duration, err error) { waits = append(waits, wait) }
+	_, err := GetNodesContext(context.Background(), armin, config)
+	var unreachable *ServerUnreachableError
+	if !errors.As(err, &unreachable) || unreachable.Attempts != 5 {
+		t.Fatalf("Expected an unreachable server after 5 attempts, got %v", err)
+	}
+	expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond}
+	if len(waits) != len(expected) {
+		t.Fatalf("Expected waits %v, got %v", expected, waits)
+	}
+	for i := range expected {
+		if waits[i] != expected[i] {
+			t.Errorf("Expected waits %v, got %v", expected, waits)
+		}
+	}
+}
+
+func TestDuplicateNameIsRejected(t *testing.T) {
+	ln := fakeServer(t, &Reply{Rejected: REJECT_DUPLICATE_NAME})
+	defer ln.Close()
+	_, err := GetNodesContext(context.Background(), armin, testConfig(ln.Addr().String()))
+	var rejected *NameRejectedError
+	if !errors.As(err, &rejected) || rejected.Name != "armin" || rejected.Reason != REJECT_DUPLICATE_NAME {
+		t.Errorf("Expected the name to be rejected, got %v", err)
+	}
+}
+
+func TestRoomCodeIsReported(t *testing.T) {
+	ln := fakeRoomServer(t, []Reply{
+		{Room: "K7QX2"},
+		{Room: "K7QX2", Nodes: []messagePasser.Node{{Name: "daniel", IP: "10.0.0.2", Port: 11111}}},
+	})
+	defer ln.Close()
+	code := ""
+	config := testConfig(ln.Addr().String())
+	config.CreateRoom = true
+	config.OnRoom = func(room string) { code = room }
+	nodes, err := GetNodesContext(context.Background(), armin, config)
+	if err != nil || len(*nodes) != 1 || (*nodes)[0].Name != "daniel" {
+		t.Fatalf("Expected daniel, got %v, %v", nodes, err)
+	}
+	if code != "K7QX2" {
+		t.Errorf("Expected room K7QX2, got %q", code)
+	}
+}
+
+func TestUnknownRoomIsRejected(t *testing.T) {
+	ln := fakeServer(t, &Reply{Rejected: REJECT_UNKNOWN_ROOM})
+	defer ln.Close()
+	config := testConfig(ln.Addr().String())
+	config.Room = "NOPE2"
+	_, err := GetNodesContext(context.Background(), armin, config)
+	var notFound *RoomNotFoundError
+	if !errors.As(err, &notFound) || notFound.Code != "NOPE2" {
+		t.Errorf("Expected the room not to be found, got %v", err)
+	}
+}
+
+func TestReadyIsSent(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := gob.NewDecoder(conn)
+		request := Request{}
+		for dec.Decode(&request) == nil && !request.Ready {
+		}
+		if request.Node.Name == "armin" {
+			gob.NewEncoder(conn).Encode(Reply{Nodes: []messagePasser.Node{{Name: "garrett"}}})
+		}
+	}()
+	ready := make(chan struct{})
+	config := testConfig(ln.Addr().String())
+	config.Ready = ready
+	config.OnConnected = func() { close(ready) }
+	config.Deadline = time.Second
+	nodes, err := GetNodesContext(context.Background(), armin, config)
+	if err != nil || len(*nodes) != 1 {
+		t.Errorf("Expected the server to start once we were ready, got %v", err)
+	}
+}
+
+func TestReadyCheckIsAnswered(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := gob.NewDecoder(conn)
+		encoder := gob.NewEncoder(conn)
+		request := Request{}
+		dec.Decode(&request)
+		encoder.Encode(Reply{Check: 7})
+		if dec.Decode(&request) == nil && request.Check == 7 {
+			encoder.Encode(Reply{Nodes: []messagePasser.Node{{Name: "garrett"}}})
+		}
+	}()
+	config := testConfig(ln.Addr().String())
+	config.Deadline = time.Second
+	nodes, err := GetNodesContext(context.Background(), armin, config)
+	if err != nil || len(*nodes) != 1 {
+		t.Errorf("Expected the game once the check was answered, got %v", err)
+	}
+}
+
+func TestTicketIsReported(t *testing.T) {
+	ticket := Ticket{GameID: "g1", Token: "t1"}
+	ln := fakeServer(t, &Reply{Ticket: ticket, Nodes: []messagePasser.Node{{Name: "lunwen"}}})
+	defer ln.Close()
+	reported := Ticket{}
+	config := testConfig(ln.Addr().String())
+	config.OnTicket = func(t Ticket) { reported = t }
+	if _, err := GetNodesContext(context.Background(), armin, config); err != nil || reported != ticket {
+		t.Errorf("Expected ticket %+v, got %+v, %v", ticket, reported, err)
+	}
+}
+
+func TestRelayIsOnTheServersHost(t *testing.T) {
+	ln := fakeServer(t, &Reply{Relay: ":55556", Nodes: []messagePasser.Node{{Name: "lunwen"}}})
+	defer ln.Close()
+	relay := ""
+	config := testConfig(ln.Addr().String())
+	config.OnRelay = func(address string) { relay = address }
+	if _, err := GetNodesContext(context.Background(), armin, config); err != nil || relay != "127.0.0.1:55556" {
+		t.Errorf("Expected the relay on the server's host, got %q, %v", relay, err)
+	}
+	if address := relayAddress("relay.example.com:1234", "10.0.0.1:55555"); address != "relay.example.com:1234" {
+		t.Errorf("A relay with a host should be kept, got %q", address)
+	}
+}
+
+func TestStaleTicketIsRejected(t *testing.T) {
+	ln := fakeServer(t, &Reply{Rejected: REJECT_UNKNOWN_GAME})
+	defer ln.Close()
+	config := testConfig(ln.Addr().String())
+	config.Rejoin = Ticket{GameID: "g1", Token: "t1"}
+	_, err := GetNodesContext(context.Background(), armin, config)
+	var rejoin *RejoinError
+	if !errors.As(err, &rejoin) || rejoin.GameID != "g1" {
+		t.Errorf("Expected the rejoin to fail, got %v", err)
+	}
+}
+
+func TestTicketIsKeptPrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "multegula", "armin.ticket")
+	saved := SavedTicket{Name: "armin", Ticket: Ticket{GameID: "g1", Token: "t1", Watch: "w1"}, Key: "secret"}
+	if err := SaveTicket(path, saved); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Only the player should read its ticket, got %v, %v", info, err)
+	}
+	loaded, err := LoadTicket(path)
+	if err != nil || loaded != saved {
+		t.Errorf("Expected %+v back, got %+v, %v", saved, loaded, err)
+	}
+}
+
+func TestLobbyTimesOut(t *testing.T) {
+	ln := fakeServer(t, nil)
+	defer ln.Close()
+	config := testConfig(ln.Addr().String())
+	config.Deadline = 200 * time.Millisecond
+	_, err := GetNodesContext(context.Background(), armin, config)
+	var timeout *LobbyTimeoutError
+	if !errors.As(err, &timeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the lobby to time out, got %v", err)
+	}
+}
+
+func TestCancelStopsDialing(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := ln.Addr().String()
+	ln.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err := GetNodesContext(ctx, armin, testConfig(address))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the dial to be cancelled, got %v", err)
+	}
+}
+
+func TestLeaderboardAndRefusedReport(t *testing.T) {
+	board := []PlayerStats{{Name: "armin", Games: 2, Wins: 1}}
+	ln := fakeServer(t, &Reply{Leaderboard: board})
+	defer ln.Close()
+	got, err := GetLeaderboard(context.Background(), testConfig(ln.Addr().String()), 0)
+	if err != nil || len(got) != 1 || got[0] != board[0] {
+		t.Errorf("Expected the leaderboard, got %+v %v", got, err)
+	}
+
+	refused := fakeServer(t, &Reply{Rejected: REJECT_BAD_REPORT, Message: "The game was reported already."})
+	defer refused.Close()
+	err = SendReport(context.Background(), testConfig(refused.Addr().String()), GameReport{GameID: "game", Reporter: "armin"})
+	var historyErr *HistoryError
+	if !errors.As(err, &historyErr) || historyErr.Reason != REJECT_BAD_REPORT || err.Error() != "The game was reported already." {
+		t.Errorf("Expected a HistoryError, got %v", err)
+	}
+}
+
+func TestFollowerSendsToLeader(t *testing.T) {
+	leader := fakeServer(t, &Reply{Nodes: []messagePasser.Node{{Name: "lunwen"}}})
+	defer leader.Close()
+	follower := fakeServer(t, &Reply{Rejected: REJECT_NOT_LEADER, Leader: leader.Addr().String()})
+	defer follower.Close()
+	nodes, err := GetNodesContext(context.Background(), armin, testConfig(follower.Addr().String()))
+	if err != nil || len(*nodes) != 1 {
+		t.Errorf("Expected the game from the leader, got %v", err)
+	}
+}
+
+func TestFailoverKeepsTheRoom(t *testing.T) {
+	// the first server gives us a room and goes away
+	first, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		conn, err := first.Accept()
+		first.Close()
+		if err != nil {
+			return
+		}
+		gob.NewDecoder(conn).Decode(&Request{})
+		gob.NewEncoder(conn).Encode(Reply{Room: "ABCDE"})
+		conn.Close()
+	}()
+	second, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer second.Close()
+	go func() {
+		conn, err := second.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request := Request{}
+		if gob.NewDecoder(conn).Decode(&request) == nil && request.Room == "ABCDE" && !request.CreateRoom {
+			gob.NewEncoder(conn).Encode(Reply{Nodes: []messagePasser.Node{{Name: "lunwen"}}})
+		}
+	}()
+	config := testConfig(first.Addr().String())
+	config.Servers = []string{second.Addr().String()}
+	config.CreateRoom = true
+	config.Deadline = 2 * time.Second
+	nodes, err := GetNodesContext(context.Background(), armin, config)
+	if err != nil || len(*nodes) != 1 {
+		t.Errorf("Expected the game from the second server, got %v", err)
+	}
+}
+
+func TestOldServerIsAProtocolError(t *testing.T) {
+	ln := fakeServer(t, &Reply{Version: 2, Rejected: REJECT_VERSION, Message: "This server speaks protocol versions 2 to 2, not 1."})
+	defer ln.Close()
+	_, err := GetNodesContext(context.Background(), armin, testConfig(ln.Addr().String()))
+	var protocol *ProtocolError
+	if !errors.As(err, &protocol) || protocol.Reason != REJECT_VERSION || protocol.ServerVersion != 2 {
+		t.Errorf("Expected a protocol error from version 2, got %v", err)
+	}
+}
+
+func TestProgressIsReported(t *testing.T) {
+	ln := fakeRoomServer(t, []Reply{
+		{Progress: &LobbyProgress{Room: QUICK_MATCH, Players: []string{"armin"}, MinPlayers: 2, MaxPlayers: 4}},
+		{Progress: &LobbyProgress{Room: QUICK_MATCH, Players: []string{"armin", "daniel"}, MinPlayers: 2, MaxPlayers: 4,
+			StartsIn: 10 * time.Second}},
+		{Nodes: []messagePasser.Node{{Name: "daniel", IP: "10.0.0.2", Port: 11111}}},
+	})
+	defer ln.Close()
+	progress := []LobbyProgress{}
+	config := testConfig(ln.Addr().String())
+	config.OnProgress = func(p LobbyProgress) { progress = append(progress, p) }
+	nodes, err := GetNodesContext(context.Background(), armin, config)
+	if err != nil || len(*nodes) != 1 {
+		t.Fatalf("Expected daniel, got %v, %v", nodes, err)
+	}
+	if len(progress) != 2 || len(progress[0].Players) != 1 || len(progress[1].Players) != 2 || progress[1].StartsIn != 10*time.Second {
+		t.Errorf("Expected 1 and then 2 players starting in 10s, got %+v", progress)
+	}
+}
@@ -0,0 +1,196 @@
+////////////////////////////////////////////////////////////
+//Multegula - report.go
+//End of game reports and the match history of the bootstrap server
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrapClient
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/*
+ * When a game is over every player reports how everyone did, signed with
+ * the key of its node; a player leaving before the end reports too, not
+ * Final. The server only takes a report if it started the game and the
+ * reporter played in it, a later report of a player replacing its
+ * earlier one. It keeps the game once most of its players back the same
+ * final results: by reporting them, or by having left before the end
+ * when the results say they left. It answers queries for the leaderboard
+ * and the games of a player. A report or a query is sent on a connection
+ * of its own and answered with a single Reply.
+ */
+const DEFAULT_HISTORY_LIMIT int = 20
+
+type PlayerResult struct {
+	Name   string
+	Score  int
+	Lives  int
+	Blocks int  // blocks the player broke
+	Left   bool // the player left before the end
+}
+
+type GameReport struct {
+	GameID    string // from the players' Ticket
+	Reporter  string // the player reporting
+	Winner    string // "" if nobody won
+	Players   []PlayerResult
+	Ended     time.Time
+	Final     bool   // the game was over, false if the Reporter left before the end
+	Signature []byte // the Reporter's, over the rest of the report
+}
+
+/* asks for the games of Player, or for the leaderboard if Player is "" */
+type HistoryQuery struct {
+	Player string
+	Limit  int // 0 for DEFAULT_HISTORY_LIMIT
+}
+
+type PlayerStats struct {
+	Name       string
+	Games      int
+	Wins       int
+	Blocks     int
+	TotalScore int
+	BestScore  int
+}
+
+type MatchRecord struct {
+	GameID   string
+	Room     string
+	Reporter string // whose final report most of the players backed
+	Winner   string
+	Players  []PlayerResult
+	Started  time.Time
+	Ended    time.Time
+}
+
+/* the server refused a report or a query */
+type HistoryError struct {
+	Reason  string // one of the REJECT_ codes
+	Message string
+}
+
+func (err *HistoryError) Error() string {
+	if len(err.Message) > 0 {
+		return err.Message
+	}
+	return fmt.Sprintf("Bootstrap server refused: %s", err.Reason)
+}
+
+/* the bytes the reporter signs, the report without its signature */
+func (report GameReport) digest() []byte {
+	report.Signature = nil
+	data, _ := json.Marshal(report)
+	return data
+}
+
+/*
+ * signs a report with the key of the local node
+ */
+func SignReport(report *GameReport) {
+	report.Signature = messagePasser.Sign(report.digest())
+}
+
+/*
+ * checks that a report was signed by its reporter
+ * @param	reporter – the reporter's node, as the server knows it
+ **/
+func VerifyReport(report GameReport, reporter messagePasser.Node) error {
+	if report.Reporter != reporter.Name {
+		return fmt.Errorf("Report of %s checked against %s", report.Reporter, reporter.Name)
+	}
+	return messagePasser.VerifySignature(reporter, report.digest(), report.Signature)
+}
+
+/*
+ * sends the report of a game to the bootstrap server
+ * @return	nil once the server kept it, a *HistoryError if it refused it,
+ *			or a *ProtocolError or *ServerUnreachableError
+ **/
+func SendReport(ctx context.Context, config Config, report GameReport) error {
+	_, err := exchange(ctx, config, Request{Type: REQUEST_REPORT, Node: messagePasser.Node{Name: report.Reporter}, Report: &report})
+	return err
+}
+
+/*
+ * gets the best players from the bootstrap server
+ * @param	limit – how many, 0 for DEFAULT_HISTORY_LIMIT
+ **/
+func GetLeaderboard(ctx context.Context, config Config, limit int) ([]PlayerStats, error) {
+	reply, err := exchange(ctx, config, Request{Type: REQUEST_QUERY, Query: &HistoryQuery{Limit: limit}})
+	return reply.Leaderboard, err
+}
+
+/*
+ * gets the last games of a player from the bootstrap server
+ * @param	limit – how many, 0 for DEFAULT_HISTORY_LIMIT
+ * @return	the games, most recent first
+ **/
+func GetHistory(ctx context.Context, config Config, player string, limit int) ([]MatchRecord, error) {
+	reply, err := exchange(ctx, config, Request{Type: REQUEST_QUERY, Query: &HistoryQuery{Player: player, Limit: limit}})
+	return reply.History, err
+}
+
+/*
+ * sends a single request to the leading server and waits for its reply
+ */
+func exchange(ctx context.Context, config Config, request Request) (Reply, error) {
+	if config.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Deadline)
+		defer cancel()
+	}
+	request.Version = PROTOCOL_VERSION
+	leader := ""
+	for failovers := 0; ; failovers++ {
+		conn, server, attempts, err := dialServer(ctx, config, leader)
+		if err != nil {
+			return Reply{}, err
+		}
+		reply, err := exchangeOnce(ctx, conn, request)
+		conn.Close()
+		if err != nil {
+			return reply, &ServerUnreachableError{server, attempts, err}
+		}
+		switch {
+		case reply.Rejected == REJECT_NOT_LEADER && failovers < MAX_FAILOVERS && ctx.Err() == nil:
+			if len(reply.Leader) == 0 || reply.Leader == leader {
+				select {
+				case <-ctx.Done():
+				case <-time.After(config.Backoff.Initial):
+				}
+			}
+			leader = reply.Leader
+		case reply.Rejected == REJECT_NOT_LEADER:
+			return reply, &ServerUnreachableError{server, attempts, &notLeaderError{server, reply.Leader}}
+		case reply.Rejected == REJECT_DRAINING:
+			return reply, &ServerUnreachableError{server, attempts, ErrServerDraining}
+		case reply.Rejected == REJECT_VERSION || reply.Rejected == REJECT_BAD_REQUEST:
+			return reply, &ProtocolError{reply.Rejected, reply.Version, reply.Message}
+		case len(reply.Rejected) > 0:
+			return reply, &HistoryError{reply.Rejected, reply.Message}
+		default:
+			return reply, nil
+		}
+	}
+}
+
+func exchangeOnce(ctx context.Context, conn net.Conn, request Request) (Reply, error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	reply := Reply{}
+	if err := gob.NewEncoder(conn).Encode(request); err != nil {
+		return reply, err
+	}
+	err := gob.NewDecoder(conn).Decode(&reply)
+	return reply, err
+}
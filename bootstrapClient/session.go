@@ -0,0 +1,117 @@
+////////////////////////////////////////////////////////////
+//Multegula - session.go
+//Session tokens the bootstrap server issues to logged in players
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrapClient
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/*
+ * A player that logs in gets a session token: the Session below in JSON
+ * and the server's signature of it, both base64 and joined by a dot. The
+ * server puts the token in the player's Node, so the other players can
+ * check with the server's public key that the name belongs to an account
+ * and that the node's signing key is the one that logged in. The token
+ * isn't a secret: the server only takes it back from the node with that
+ * key, e.g. to log in again on another server.
+ */
+const SESSION_SEPARATOR string = "."
+
+type Session struct {
+	Name    string
+	Key     string // the node's message signing key
+	Expires time.Time
+}
+
+/*
+ * signs a session, this is for the bootstrap server
+ * @param	key – the server's private key
+ **/
+func SignSession(session Session, key ed25519.PrivateKey) (string, error) {
+	claims, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	encoding := base64.RawURLEncoding
+	return encoding.EncodeToString(claims) + SESSION_SEPARATOR + encoding.EncodeToString(ed25519.Sign(key, claims)), nil
+}
+
+/*
+ * checks a session token
+ * @param	token – as issued by the server
+ * @param	serverKey – the server's base64 public key
+ *
+ * @return	the session if the server signed it and it hasn't expired
+ **/
+func VerifySession(token string, serverKey string) (*Session, error) {
+	key, err := base64.StdEncoding.DecodeString(serverKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("Bad server key")
+	}
+	parts := strings.Split(token, SESSION_SEPARATOR)
+	if len(parts) != 2 {
+		return nil, errors.New("Bad session token")
+	}
+	claims, errClaims := base64.RawURLEncoding.DecodeString(parts[0])
+	signature, errSignature := base64.RawURLEncoding.DecodeString(parts[1])
+	if errClaims != nil || errSignature != nil || !ed25519.Verify(ed25519.PublicKey(key), claims, signature) {
+		return nil, errors.New("Session token not signed by the server")
+	}
+	session := &Session{}
+	if err := json.Unmarshal(claims, session); err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.Expires) {
+		return nil, fmt.Errorf("Session of %s expired", session.Name)
+	}
+	return session, nil
+}
+
+/*
+ * turns the players whose sessions don't check out into guests, so a
+ * Session in the nodes GetNodes returns is always valid
+ * @param	serverKey – "" if the server has no accounts
+ **/
+func checkSessions(nodes []messagePasser.Node, serverKey string) {
+	for i := range nodes {
+		if len(nodes[i].Session) == 0 {
+			continue
+		}
+		if len(serverKey) == 0 {
+			nodes[i].Session = ""
+		} else if err := VerifyNode(nodes[i], serverKey); err != nil {
+			fmt.Println("Treating a player as a guest:", err)
+			nodes[i].Session = ""
+		}
+	}
+}
+
+/*
+ * checks that a node is the account it claims to be
+ * @return	nil if the node's session is valid and matches its name and key
+ **/
+func VerifyNode(node messagePasser.Node, serverKey string) error {
+	if len(node.Session) == 0 {
+		return fmt.Errorf("%s isn't logged in", node.Name)
+	}
+	session, err := VerifySession(node.Session, serverKey)
+	if err != nil {
+		return err
+	}
+	if session.Name != node.Name || session.Key != node.Key {
+		return fmt.Errorf("Session of %s belongs to another node", node.Name)
+	}
+	return nil
+}
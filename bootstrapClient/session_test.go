@@ -0,0 +1,65 @@
+package bootstrapClient
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/messagePasser"
+)
+
+func newServerKey(t *testing.T) (ed25519.PrivateKey, string) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private, base64.StdEncoding.EncodeToString(public)
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	private, public := newServerKey(t)
+	token, err := SignSession(Session{Name: "armin", Key: "key", Expires: time.Now().Add(time.Hour)}, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session, err := VerifySession(token, public); err != nil || session.Name != "armin" {
+		t.Fatalf("Expected armin's session, got %+v %v", session, err)
+	}
+	_, other := newServerKey(t)
+	if _, err := VerifySession(token, other); err == nil {
+		t.Errorf("Another server's key should be refused.")
+	}
+	forged, _ := SignSession(Session{Name: "lunwen", Key: "key", Expires: time.Now().Add(time.Hour)}, private)
+	tampered := strings.Split(forged, SESSION_SEPARATOR)[0] + SESSION_SEPARATOR + strings.Split(token, SESSION_SEPARATOR)[1]
+	if _, err := VerifySession(tampered, public); err == nil {
+		t.Errorf("A tampered session should be refused.")
+	}
+	expired, _ := SignSession(Session{Name: "armin", Key: "key", Expires: time.Now().Add(-time.Minute)}, private)
+	if _, err := VerifySession(expired, public); err == nil {
+		t.Errorf("An expired session should be refused.")
+	}
+}
+
+func TestCheckSessions(t *testing.T) {
+	private, public := newServerKey(t)
+	token, _ := SignSession(Session{Name: "armin", Key: "key", Expires: time.Now().Add(time.Hour)}, private)
+	nodes := []messagePasser.Node{
+		{Name: "armin", Key: "key", Session: token},
+		{Name: "armin", Key: "other", Session: token},
+		{Name: "lunwen", Key: "key", Session: token},
+		{Name: "daniel"},
+	}
+	checkSessions(nodes, public)
+	for i, expected := range []bool{true, false, false, false} {
+		if loggedIn := len(nodes[i].Session) > 0; loggedIn != expected {
+			t.Errorf("Node %d (%s): expected logged in %v", i, nodes[i].Name, expected)
+		}
+	}
+	nodes[0].Session = token
+	checkSessions(nodes, "")
+	if len(nodes[0].Session) > 0 {
+		t.Errorf("Without a server key nobody is logged in.")
+	}
+}
@@ -0,0 +1,65 @@
+////////////////////////////////////////////////////////////
+//Multegula - ticket.go
+//The ticket a player keeps to come back to its game
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrapClient
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+/*
+ * A player keeps the ticket of its game with its signing key, which the
+ * other players know it by, in a file only it can read. A client started
+ * again loads it and sets Config.Rejoin to come back to the game.
+ */
+type SavedTicket struct {
+	Name   string
+	Ticket Ticket
+	Key    string // the private signing key, see messagePasser.LocalKey
+}
+
+/*
+ * where a player's ticket is kept
+ * @param	name – the player
+ **/
+func TicketPath(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "multegula", name+".ticket")
+}
+
+/*
+ * keeps a ticket, replacing the one kept before
+ * @param	path – see TicketPath
+ **/
+func SaveTicket(path string, saved SavedTicket) error {
+	encoded, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, encoded, 0600)
+}
+
+/*
+ * loads a ticket SaveTicket kept
+ * @param	path – see TicketPath
+ **/
+func LoadTicket(path string) (SavedTicket, error) {
+	saved := SavedTicket{}
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return saved, err
+	}
+	err = json.Unmarshal(encoded, &saved)
+	return saved, err
+}
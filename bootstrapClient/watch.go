@@ -0,0 +1,60 @@
+////////////////////////////////////////////////////////////
+//Multegula - watch.go
+//Registering spectators of a game with the bootstrap server
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package bootstrapClient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/*
+ * A spectator asks the server for a game by the watch code one of its
+ * players shared, see Ticket.WatchCode, and gets the players' names and
+ * keys with the game's watch token in the Ticket. The game itself comes
+ * from the player that shared the code, at the address it gave along,
+ * see messagePasser.Watch; the spectator never joins a room and isn't
+ * one of the players.
+ */
+type WatchedGame struct {
+	ID        string
+	Room      string
+	Token     string               // shown to the players, see messagePasser.Watch
+	ServerKey string               // the server's key, spectators don't get the players' sessions
+	Players   []messagePasser.Node // every player by name, only its name and key
+}
+
+/* the server knows no game to watch by that watch code */
+type GameNotFoundError struct {
+	Game string
+}
+
+func (err *GameNotFoundError) Error() string {
+	return fmt.Sprintf("There is no game to watch with code %s, or it's over", err.Game)
+}
+
+/*
+ * registers a spectator of a game with the bootstrap server
+ * @param	name – the spectator's name, for the players' logs
+ * @param	game – the game's watch code, from one of its players
+ * @return	the players, or a *GameNotFoundError, *ProtocolError or
+ *			*ServerUnreachableError
+ **/
+func WatchGame(ctx context.Context, config Config, name string, game string) (WatchedGame, error) {
+	reply, err := exchange(ctx, config, Request{Type: REQUEST_WATCH, Node: messagePasser.Node{Name: name}, Watch: game})
+	var refused *HistoryError
+	if errors.As(err, &refused) && refused.Reason == REJECT_UNKNOWN_GAME {
+		return WatchedGame{}, &GameNotFoundError{game}
+	} else if err != nil {
+		return WatchedGame{}, err
+	}
+	checkSessions(reply.Nodes, reply.ServerKey)
+	return WatchedGame{ID: reply.Ticket.GameID, Room: reply.Room, Token: reply.Ticket.Watch,
+		ServerKey: reply.ServerKey, Players: reply.Nodes}, nil
+}
@@ -7,73 +7,54 @@
 package main
 
 import (
-	"encoding/gob"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
-	//"strings"
-	"time"
 
-	"github.com/arminm/multegula/defs"
+	"github.com/arminm/multegula/bootstrap"
 	"github.com/arminm/multegula/messagePasser"
+	"github.com/arminm/multegula/tlsTransport"
 )
 
-type ClientInfo struct {
-	Conn *net.Conn
-	Node *messagePasser.Node
-}
+/*
+ * Runs a bootstrap.Server from the flags, with the relay and the admin
+ * API next to it.
+ */
+const DEFAULT_LOBBY_FILE string = "./bootstrapServer/lobby.json"
 
-//Declare a map of connections to nodes
-var connections = make(map[net.Addr]*net.Conn)
-var nodes = make(map[net.Addr]*messagePasser.Node)
-var addClientChannel = make(chan ClientInfo, defs.CHANNEL_SIZE)
-var removeClientChannel = make(chan ClientInfo, defs.CHANNEL_SIZE)
-var timeoutTimer *time.Timer = time.NewTimer(time.Second)
+/*
+ * registers the lobby flags
+ * @return	the policy the flags set once parsed, and the lobby file
+ **/
+func registerLobbyFlags() (*bootstrap.LobbyPolicy, *string) {
+	policy := &bootstrap.LobbyPolicy{}
+	defaults := bootstrap.DefaultLobbyPolicy()
+	flag.IntVar(&policy.MinPlayers, "minplayers", defaults.MinPlayers, "Players needed to start the countdown.")
+	flag.IntVar(&policy.MaxPlayers, "maxplayers", defaults.MaxPlayers, "Players that start a game right away.")
+	flag.DurationVar(&policy.Countdown, "countdown", defaults.Countdown, "How long to wait for more players once there are enough.")
+	flag.BoolVar(&policy.RestartOnJoin, "restartonjoin", defaults.RestartOnJoin, "Start the countdown over whenever a player joins.")
+	flag.BoolVar(&policy.StartWhenReady, "readystart", defaults.StartWhenReady, "Start as soon as every waiting player is ready.")
+	file := flag.String("lobby", DEFAULT_LOBBY_FILE, "Lobby policy file, used if it exists.")
+	return policy, file
+}
 
 /*
- * Handle Connections
- *
- * @param connection
- *        the connection object
- *
+ * tells whether an address only takes connections from this machine
+ * @param	address – host:port
  **/
-func handleConnection(conn net.Conn) {
-	// keep track of having already added a connection to keep the loop running
-	// in case the client got disconnected, so we can remove the added connection
-	// from our maps. If the disconnect happens before we add the conn to our maps
-	// then we just simply return from the function.
-	haveAddedConnection := false
-	for {
-		nodePtr, err := receiveNode(conn)
-		if err != nil {
-			if err.Error() == "EOF" {
-				fmt.Println("Got disconnected from", conn.RemoteAddr())
-			} else {
-				fmt.Println("Disconnecting:", conn.RemoteAddr())
-			}
-			if haveAddedConnection {
-				removeClientChannel <- ClientInfo{&conn, nil}
-			}
-			return
-		} else if (*nodePtr == messagePasser.Node{}) {
-			fmt.Println("Received empty Node.")
-			conn.Close()
-			return
-		}
-		if haveAddedConnection == false {
-			// we have to set the public ip of the client, since the client itself
-			// doesn't know what their public ip is.
-			ip := strings.Split(conn.RemoteAddr().String(), ":")[0]
-			if ip == "[" {
-				ip = "127.0.0.1"
-			}
-			(*nodePtr).IP = ip
-			addClientChannel <- ClientInfo{&conn, nodePtr}
-			haveAddedConnection = true
-		}
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
 	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 /* Main function.
@@ -83,147 +64,96 @@ func main() {
 
 	//Set port from command line
 	portFlag := flag.Int("port", 55555, "Port to listen on for connections.")
+	hostFlag := flag.String("host", "", "Address to listen on, e.g. 0.0.0.0 or ::1 (default: every address).")
+	relayPortFlag := flag.Int("relayport", 55556, "Port to relay peer connections on, 0 to turn the relay off.")
+	relayFlag := flag.String("relay", "", "Where players reach the relay, if not on the host they reach us on (default: that host and -relayport).")
+	adminFlag := flag.String("admin", "", "Address of the HTTP admin API, e.g. localhost:55557 (default: off).")
+	accountsFlag := flag.String("accounts", "", "File of player accounts, created if missing (default: no accounts).")
+	requireLoginFlag := flag.Bool("requirelogin", false, "Only take players that log in to an account.")
+	historyFlag := flag.String("history", "", "File the reports of finished games are kept in, created if missing (default: no history).")
+	gameTTLFlag := flag.Duration("gamettl", bootstrap.DEFAULT_GAME_TTL, "How long players can rejoin a game after it started.")
+	replicasFlag := flag.String("replicas", "", "Replication addresses of every server of a replicated service, in order, e.g. localhost:56555,localhost:56556 (default: run alone).")
+	replicaFlag := flag.String("replica", "", "Our replication address, one of -replicas.")
+	advertiseFlag := flag.String("advertise", "", "Where clients reach us, for the other servers to send them here (default: the host of -replica and -port).")
+	replicaTokenFlag := flag.String("replicatoken", "", "Secret the servers of a replicated service share (default: none).")
+	adminTokenFlag := flag.String("admintoken", "", "Bearer token the admin API asks for (default: none, the admin API has to be on a loopback address then).")
+	maxClientsFlag := flag.Int("maxclients", 0, "Players that can wait in every room together, 0 for no limit.")
+	lobbyPolicy, lobbyFile := registerLobbyFlags()
+	tlsFlags := tlsTransport.RegisterFlags()
 	flag.Parse()
-	fmt.Println("Multegula Bootstrap Server listening on TCP Port: ", *portFlag)
 
-	//And listen
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(*portFlag))
+	config := bootstrap.DefaultConfig()
+	config.GameTTL = *gameTTLFlag
+	config.AccountsFile = *accountsFlag
+	config.RequireLogin = *requireLoginFlag
+	config.HistoryFile = *historyFlag
+	config.MaxClients = *maxClientsFlag
+	if *relayPortFlag > 0 {
+		config.Relay = *relayFlag
+		if len(config.Relay) == 0 {
+			config.Relay = ":" + strconv.Itoa(*relayPortFlag)
+		}
+	}
+	lobby, err := bootstrap.LoadLobbyConfig(*lobbyPolicy, *lobbyFile)
 	if err != nil {
-		fmt.Println("Couldn't start Bootstrap Server!")
+		fmt.Println("Bad lobby policy!")
 		panic(err)
 	}
-
-	// Start the routine that manages connections and calls startAGame()
-	go receiveConnections()
-
-	//Loop forever
-	for {
-		//Begin accepting connections
-		conn, err := ln.Accept()
-		if err != nil {
-			fmt.Println(err)
-			continue
-		}
-		//Spawn thread to handle connections
-		fmt.Println("Connection received from:", conn.RemoteAddr())
-		go handleConnection(conn)
+	config.Lobby = lobby
+	if err := tlsTransport.Init(*tlsFlags); err != nil {
+		fmt.Println("Couldn't set up TLS!")
+		panic(err)
 	}
-}
-
-/*
- * The routine to manage connections and trigger startAGame
- */
-func receiveConnections() {
-	// Make sure the timer is not running.
-	timeoutTimer.Stop()
-
-	for {
-		//wait for new connections or disconnections, or for a timeout if there's one
-		select {
-		case clientInfo := <-addClientChannel:
-			// check for duplicates
-			if !duplicateNameExists(nodes, clientInfo.Node.Name) {
-				connAddr := (*clientInfo.Conn).RemoteAddr()
-				connections[connAddr] = clientInfo.Conn
-				nodes[connAddr] = clientInfo.Node
-
-				fmt.Printf("We have %v connections now!\n", len(connections))
-				fmt.Printf("New Client: %+v\n", clientInfo.Node)
-			} else {
-				fmt.Println("Closing connection! Duplicate Node Name: ", clientInfo.Node.Name)
-				(*clientInfo.Conn).Close()
-			}
-		case clientInfo := <-removeClientChannel:
-			connAddr := (*clientInfo.Conn).RemoteAddr()
-			if node, ok := nodes[connAddr]; ok {
-				fmt.Printf("Removing Client: %+v\n", node)
-				delete(connections, connAddr)
-				delete(nodes, connAddr)
-				fmt.Printf("We have %v connections now!\n", len(connections))
-			}
-		case <-timeoutTimer.C:
-			//This is the case that handles our timeouts if we don't get enough players
-			if len(connections) >= defs.MIN_PLAYERS_PER_GAME {
-				fmt.Printf("Timed out, starting with %v players!\n", len(connections))
-				startAGame()
-			}
-		}
-
-		if len(connections) == defs.MIN_PLAYERS_PER_GAME {
-			//Reset our timeoutTimer
-			fmt.Println("Two connections established, starting countdown to game.")
-			timeoutTimer.Reset(defs.TIMEOUT_DURATION)
-		} else if len(connections) == defs.MAX_PLAYERS_PER_GAME {
-			// Stop the timeoutTimer
-			timeoutTimer.Stop()
-			startAGame()
+	if len(*replicasFlag) > 0 {
+		config.Replicas = strings.Split(*replicasFlag, ",")
+		config.Replica = *replicaFlag
+		config.ReplicaToken = *replicaTokenFlag
+		config.Advertise = *advertiseFlag
+		if len(config.Advertise) == 0 {
+			host, _, _ := net.SplitHostPort(*replicaFlag)
+			config.Advertise = net.JoinHostPort(host, strconv.Itoa(*portFlag))
 		}
 	}
-}
-
-/*
- * check for duplicate names in a map of nodes
- */
-func duplicateNameExists(existingNodes map[net.Addr]*messagePasser.Node, newNodeName string) bool {
-	for _, node := range existingNodes {
-		if node.Name == newNodeName {
-			return true
-		}
+	server, err := bootstrap.NewServer(config)
+	if err != nil {
+		fmt.Println("Couldn't start Bootstrap Server!")
+		panic(err)
 	}
-	return false
-}
-
-/*
- * The synchronous function to start a game with 2-4 players and clear
- * the connections map for next games.
- */
-func startAGame() {
-	//First, ensure that everyone still exists.
-	//Remove them from the map if not.
-
-	//Give everyone their player list, if there's at least two remaining.
-	//If not, just close their connections.
-	for connAddr, connection := range connections {
-		fmt.Println("Sending Peers to:", nodes[connAddr].Name)
-		sendNodes(nodesForClient(connAddr), *connection)
-		(*connection).Close()
+	fmt.Println("Multegula Bootstrap Server listening on TCP Port: ", *portFlag)
+	if tlsTransport.Enabled() {
+		fmt.Println("TLS is enabled.")
 	}
 
-	//Clear the maps
-	for connAddr := range connections {
-		delete(connections, connAddr)
-		delete(nodes, connAddr)
+	//And listen
+	ln, err := tlsTransport.Listen(net.JoinHostPort(*hostFlag, strconv.Itoa(*portFlag)))
+	if err != nil {
+		fmt.Println("Couldn't start Bootstrap Server!")
+		panic(err)
 	}
-}
 
-// returns the list of peer nodes excluding the client
-func nodesForClient(clientAddr net.Addr) *[]messagePasser.Node {
-	peerNodes := []messagePasser.Node{}
-	for connAddr := range connections {
-		if connAddr != clientAddr {
-			peerNodes = append(peerNodes, *nodes[connAddr])
+	// Relay for players that can't connect to each other directly
+	if *relayPortFlag > 0 {
+		relayLn, err := net.Listen("tcp", net.JoinHostPort(*hostFlag, strconv.Itoa(*relayPortFlag)))
+		if err != nil {
+			fmt.Println("Couldn't start the relay!")
+			panic(err)
 		}
+		fmt.Println("Relaying peer connections on TCP Port: ", *relayPortFlag)
+		go messagePasser.ServeRelay(relayLn, server.RelayKey)
 	}
-	return &peerNodes
-}
-
-/*
- * sends nodes by encoding the array of nodes
- */
-func sendNodes(nodes *[]messagePasser.Node, conn net.Conn) {
-	encoder := gob.NewEncoder(conn)
-	encoder.Encode(*nodes)
-}
 
-/*
- * received a single node struct
- */
-func receiveNode(conn net.Conn) (*messagePasser.Node, error) {
-	dec := gob.NewDecoder(conn)
-	node := &messagePasser.Node{}
-	err := dec.Decode(node)
-	if err != nil {
-		return node, err
+	// HTTP status and admin API for operators
+	if len(*adminFlag) > 0 {
+		if len(*adminTokenFlag) == 0 && !isLoopback(*adminFlag) {
+			fmt.Println("Couldn't start the admin API!")
+			panic("The admin API on " + *adminFlag + " needs -admintoken, or a loopback address like localhost:55557")
+		}
+		fmt.Println("Admin API listening on: ", *adminFlag)
+		go func() {
+			err := http.ListenAndServe(*adminFlag, server.AdminHandler(*adminTokenFlag))
+			fmt.Println("Admin API stopped:", err)
+		}()
 	}
-	return node, nil
+
+	panic(server.Serve(ln))
 }
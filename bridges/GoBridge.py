@@ -6,6 +6,7 @@
 
 #######IMPORTS#######
 import socket #Needed for network communications
+import ssl #Needed for optional TLS to the Go bridge
 import time #Needed for labeling date/time
 import datetime #Needed for labeling date/time
 import queue #Needed for receive queue
@@ -18,7 +19,8 @@ class GoBridge :
     ### __init___ - initialize and return GoBridge
     ## # this function starts the GoBridge running
 	## # Returns a connected socket object GoBridge
-	def __init__(self, CLI_PORT, src = DEFAULT_SRC) :
+	## # CA_FILE turns on TLS, matching multegula.go's -uitls flag
+	def __init__(self, CLI_PORT, src = DEFAULT_SRC, CA_FILE = None) :
 		# set the self src
 		self.src = src;
 		
@@ -28,6 +30,11 @@ class GoBridge :
 		#Disable Nagle's Algorithm to decrease latency.
 		#TCP_NODELAY sends packets immediately.
 		GoSocket.setsockopt(socket.IPPROTO_TCP, socket.TCP_NODELAY, 1)
+
+		#Wrap the socket in TLS if we were given a CA to trust.
+		if CA_FILE :
+			context = ssl.create_default_context(cafile=CA_FILE)
+			GoSocket = context.wrap_socket(GoSocket, server_hostname=LOCALHOST_IP)
 		
 		try:
 			#Try to open connection to local Go Bridge
@@ -8,6 +8,7 @@ package bridges
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	"reflect"
@@ -15,6 +16,8 @@ import (
 	"strings"
 	"github.com/arminm/multegula/defs"
 	"github.com/arminm/multegula/messagePasser"
+	"github.com/arminm/multegula/payload"
+	"github.com/arminm/multegula/tlsTransport"
 )
 
 /* the queue for messages to be sent to multegula */
@@ -24,26 +27,38 @@ var sendQueue chan messagePasser.Message = make(chan messagePasser.Message, defs
 var receivedQueue chan messagePasser.Message = make(chan messagePasser.Message, defs.QUEUE_SIZE)
 
 /*
- * construct message from it's string format
+ * construct message from it's string format. The UI writes payloads
+ * as '|' separated fields, they are converted to typed payloads here.
  * @param	messageString
  *			message in string format
  *
  * @return	message
  **/
-func decodeMessage(messageString string) messagePasser.Message {
+func decodeMessage(messageString string) (messagePasser.Message, error) {
 	var elements []string = strings.Split(messageString, defs.DELIMITER)
-	return messagePasser.Message{Source: elements[0], Destination: elements[1], Content: elements[2], Kind: elements[3]}
+	if len(elements) != 4 {
+		return messagePasser.Message{}, errors.New("Malformed message from UI: " + messageString)
+	}
+	content, err := payload.FromLegacy(elements[3], elements[2])
+	if err != nil {
+		return messagePasser.Message{}, err
+	}
+	return messagePasser.Message{Source: elements[0], Destination: elements[1], Content: content, Kind: elements[3]}, nil
 }
 
 /*
- * convert message to string
+ * convert message to string, with its payload in the UI's format
  * @param	message
  *			message to be converted
  *
  * @return	the string format of the message
  **/
-func encodeMessage(message messagePasser.Message) string {
-	return message.Source + defs.DELIMITER + message.Destination + defs.DELIMITER + strconv.Itoa(message.SeqNum) + defs.DELIMITER + message.Content + defs.DELIMITER + message.Kind
+func encodeMessage(message messagePasser.Message) (string, error) {
+	content, err := payload.ToLegacy(message.Kind, message.Content)
+	if err != nil {
+		return "", err
+	}
+	return message.Source + defs.DELIMITER + message.Destination + defs.DELIMITER + strconv.Itoa(message.SeqNum) + defs.DELIMITER + content + defs.DELIMITER + message.Kind, nil
 }
 
 /*
@@ -91,7 +106,12 @@ func receiveFromUI(conn net.Conn) {
 		messageString, _ := bufio.NewReader(conn).ReadString('\n')
 		if len(messageString) > 0 {
 			// fmt.Printf("PyBridge: Message received from UI: %s\n", messageString[0:len(messageString)-1])
-			go putMessageToSendQueue(decodeMessage(messageString[0 : len(messageString)-1]))
+			message, err := decodeMessage(messageString[0 : len(messageString)-1])
+			if err != nil {
+				fmt.Println("PyBridge: Dropping message from UI:", err)
+				continue
+			}
+			go putMessageToSendQueue(message)
 		}
 	}
 }
@@ -105,15 +125,26 @@ func sendToUI(conn net.Conn) {
 	for {
 		var message messagePasser.Message = <-receivedQueue
 		if (!reflect.DeepEqual(message, messagePasser.Message{})) {
-			// fmt.Printf("PyBridge: Message sent to UI: %s\n", encodeMessage(message))
-			conn.Write([]byte(encodeMessage(message) + "\n"))
+			messageString, err := encodeMessage(message)
+			if err != nil {
+				fmt.Println("PyBridge: Dropping message to UI:", err)
+				continue
+			}
+			// fmt.Printf("PyBridge: Message sent to UI: %s\n", messageString)
+			conn.Write([]byte(messageString + "\n"))
 		}
 	}
 }
 
 func InitPyBridge(port int) {
-	portStr := ":" + strconv.Itoa(port)
-	ln, err := net.Listen("tcp", portStr)
+	portStr := net.JoinHostPort("", strconv.Itoa(port))
+	var ln net.Listener
+	var err error
+	if tlsTransport.BridgeEnabled() {
+		ln, err = tlsTransport.Listen(portStr)
+	} else {
+		ln, err = net.Listen("tcp", portStr)
+	}
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -13,13 +13,15 @@
 package bullySelection
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"strconv"
+	"sync/atomic"
 	"time"
-	"strings"
 
 	"github.com/arminm/multegula/defs"
 	"github.com/arminm/multegula/messagePasser"
+	"github.com/arminm/multegula/payload"
 )
 
 /* If a node doesn't receive message from unicorn after
@@ -48,29 +50,45 @@ var localName string
 /* The name of unicorn */
 var unicorn string
 
+/* 1 while this node runs an election */
+var electing int32
+
 /* Nodes whose names are smaller than local name in the group */
 var frontNodes []string
 
 /* Nodes whose names are greater than local name in the group */
 var latterNodes []string
 
-/* The sequence number of message */
-var seqNum int = -1
-
-const SEQNUM_UPPER_BOUND int = 999999
-
 /* The queue for messages to be sent, messages in this queue
  * will be passed to messagePasser by mutegula
  */
 var sendChannel chan messagePasser.Message = make(chan messagePasser.Message, defs.QUEUE_SIZE)
 
+/*
+ * The unicorn message goes out by reliable multicast, the node it
+ * is meant for is named in the payload
+ */
+type UnicornClaim struct {
+	Unicorn     string
+	Destination string
+}
+
+func (claim *UnicornClaim) Validate() error {
+	if len(claim.Unicorn) == 0 || len(claim.Destination) == 0 {
+		return errors.New("Unicorn claim without unicorn or destination")
+	}
+	return nil
+}
+
+func init() {
+	payload.Register(defs.MSG_BULLY_UNICORN, func() payload.Payload { return &UnicornClaim{} })
+}
+
 /*
  * Put message into sendChannel
  * @param	message - message to be put into sendChannel
  */
 func putMessageToSendChannel(message messagePasser.Message) {
-	message.Content = message.Content + defs.DELIMITER + message.Destination
-	message.Destination = defs.MULTICAST_DEST
 	sendChannel <- message
 }
 
@@ -84,18 +102,6 @@ func GetMessageFromSendChannel() messagePasser.Message {
 	return message
 }
 
-/*
- * When using reliable multicast, the destination of message is MULTICAST_DEST,
- * the realy destination of message is append after message.Content
- * @param	message 	message to be interpreted
- *
- * @return	the content and real destination of message 
- */
-func getMessageContentAndDestination(message messagePasser.Message) (string, string) {
-	elements := strings.Split(message.Content, defs.DELIMITER)
-	return elements[0], elements[1]
-}
-
 /* The queue for received messages, mutegula will put messages,
  * which come from messagePasser, into this queue
  */
@@ -107,14 +113,19 @@ var receiveChannel chan messagePasser.Message = make(chan messagePasser.Message,
  * @param	message - message to be put into receiveChannel
  */
 func PutMessageToReceiveChannel(message messagePasser.Message) {
-	/* 
+	value, err := payload.Decode(message.Kind, message.Content)
+	if err != nil {
+		fmt.Printf("Bully: dropping message from %s: %v\n", message.Source, err)
+		return
+	}
+	/*
 	 * If the muticast message's destination is this node,
 	 * reconstruct this message; otherwise, the message is dropped
 	 */
-	 content, destination := getMessageContentAndDestination(message)
-	if destination == localName {
-		message.Content = content
-		message.Destination = destination
+	claim := value.(*UnicornClaim)
+	if claim.Destination == localName {
+		message.Content = claim.Unicorn
+		message.Destination = claim.Destination
 		receiveChannel <- message
 	}
 }
@@ -128,15 +139,9 @@ func getMessageFromReceiveChannel() messagePasser.Message {
 	return message
 }
 
-/* received answer message */
-var receivedAnswerChannel chan messagePasser.Message = make(chan messagePasser.Message, defs.QUEUE_SIZE)
-
 /* received unicorn message */
 var receivedUnicornChannel chan messagePasser.Message = make(chan messagePasser.Message, defs.QUEUE_SIZE)
 
-/* received health check reply message */
-var receivedHealthCheckReplyChannel chan messagePasser.Message = make(chan messagePasser.Message, defs.QUEUE_SIZE)
-
 /*
  * this channel holds all unicorn update message,
  * whenever there are unicorn update, the unicorn
@@ -145,6 +150,24 @@ var receivedHealthCheckReplyChannel chan messagePasser.Message = make(chan messa
  */
 var unicornUpdateChannel chan messagePasser.Message = make(chan messagePasser.Message, defs.QUEUE_SIZE)
 
+/*
+ * builds the update telling multegula who the unicorn is. It is sent
+ * to ourselves, so we sign it as its Source.
+ * @param	name – the new unicorn
+ */
+func newUnicornUpdate(name string) messagePasser.Message {
+	content, err := payload.Encode(&payload.Name{Name: name})
+	if err != nil {
+		fmt.Println("Bully: bad unicorn name:", err)
+	}
+	return messagePasser.Message{
+		Source:      localName,
+		Destination: localName,
+		Content:     content,
+		Kind:        defs.MSG_UNICORN,
+	}
+}
+
 func putUnicornUpdate(message messagePasser.Message) {
 	unicornUpdateChannel <- message
 }
@@ -158,27 +181,15 @@ func dispatchMessage() {
 	for {
 		message := getMessageFromReceiveChannel()
 		switch message.Kind {
-		case defs.MSG_BULLY_ANSWER:
-			go func() {
-				receivedAnswerChannel <- message
-			}()
 		case defs.MSG_BULLY_UNICORN:
+			/* a node can only claim to be the unicorn itself */
+			if message.Content != message.Source {
+				fmt.Printf("Bully: %s claimed %s is the unicorn, ignoring.\n", message.Source, message.Content)
+				continue
+			}
 			go func() {
 				receivedUnicornChannel <- message
 			}()
-		case defs.MSG_BULLY_ELECTION:
-			sendAnswerMessage(message.Source, message.Content)
-		case defs.MSG_BULLY_ARE_YOU_ALIVE:
-			go putMessageToSendChannel(messagePasser.Message{
-				Source:      localName,
-				Destination: message.Source,
-				Content:     message.Content,
-				Kind:        defs.MSG_BULLY_IAM_ALIVE,
-			})
-		case defs.MSG_BULLY_IAM_ALIVE:
-			go func() {
-				receivedHealthCheckReplyChannel <- message
-			}()
 		}
 	}
 }
@@ -210,181 +221,153 @@ func getFrontAndLatterNodes(nodes messagePasser.Nodes, localName string) ([]stri
 /* Unicorn send unicorn message to other nodes */
 func sendUnicornMessage() {
 	for _, name := range frontNodes {
+		content, err := payload.Encode(&UnicornClaim{Unicorn: localName, Destination: name})
+		if err != nil {
+			fmt.Println("Bully: couldn't send unicorn message:", err)
+			continue
+		}
 		go putMessageToSendChannel(messagePasser.Message{
 			Source:      localName,
-			Destination: name,
-			Content:     localName,
+			Destination: defs.MULTICAST_DEST,
+			Content:     content,
 			Kind:        defs.MSG_BULLY_UNICORN,
 		})
 	}
 }
 
-/* Node sends election message
- * @param	timestamp
- *			the timestamp for this message
+/*
+ * Node sends election requests to all greater nodes
+ * @return	true if any of them answered within TIMEOUT
  */
-func sendElectionMessage(timestamp string) {
+func electionAnswered() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(TIMEOUT)*time.Millisecond)
+	defer cancel()
+	answers := make(chan bool, len(latterNodes))
 	for _, name := range latterNodes {
-		go putMessageToSendChannel(messagePasser.Message{
-			Source:      localName,
-			Destination: name,
-			Content:     timestamp,
-			Kind:        defs.MSG_BULLY_ELECTION,
-		})
+		go func(name string) {
+			_, err := messagePasser.Call(ctx, name, defs.MSG_BULLY_ELECTION, localName)
+			answers <- answered(err)
+		}(name)
+	}
+	for range latterNodes {
+		if <-answers {
+			return true
+		}
 	}
+	return false
 }
 
-/* Node reply answer message
- * @param	destination
- *			the destination of reply
- *
- * @param	timestamp
- *			the timestamp of received election message
+/* Ask the unicorn if it is alive
+ * @return	true if the unicorn answered within TIMEOUT
  */
-func sendAnswerMessage(destination string, timestamp string) {
-	go putMessageToSendChannel(messagePasser.Message{
-		Source:      localName,
-		Destination: destination,
-		Content:     timestamp,
-		Kind:        defs.MSG_BULLY_ANSWER,
-	})
+func unicornAnswered() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(TIMEOUT)*time.Millisecond)
+	defer cancel()
+	reply, err := messagePasser.Call(ctx, unicorn, defs.MSG_BULLY_ARE_YOU_ALIVE, localName)
+	/* a node that no longer thinks it is the unicorn doesn't count */
+	if err == nil && reply.Content != unicorn {
+		fmt.Printf("Bully: %s says %s is the unicorn.\n", unicorn, reply.Content)
+		return false
+	}
+	return answered(err)
 }
 
-/* Get the string representation of current time
- * @return	the current time in string format
+/* Any reply proves the node is alive, even an error from a
+ * node that hasn't registered its handlers yet
  */
-func getCurrentTime() string {
-	seqNum = (seqNum + 1) % SEQNUM_UPPER_BOUND
-	return strconv.Itoa(seqNum)
-}
-
-func sendHealthCheckRequestMessage(timestamp string) {
-	go putMessageToSendChannel(messagePasser.Message{
-		Source:      localName,
-		Destination: unicorn,
-		Content:     timestamp,
-		Kind:        defs.MSG_BULLY_ARE_YOU_ALIVE,
-	})
+func answered(err error) bool {
+	_, remoteError := err.(messagePasser.RemoteError)
+	return err == nil || remoteError
 }
 
 /* check the liveness of unicorn */
 func startHealthCheck() {
 	var count int = -1
 	for {
-		currentTime := getCurrentTime()
-		sendHealthCheckRequestMessage(currentTime)
-		var waitHealthCheckReplyTimeout chan bool = make(chan bool, 1)
-		go func() {
-			time.Sleep(time.Duration(TIMEOUT) * time.Millisecond)
-			waitHealthCheckReplyTimeout <- true
-		}()
-		var i int = -1
-		for i < 0 {
-			select {
-			/* no reply after timeout, unicorn failure detected,
-			 * start election
-			 */
-			case <-waitHealthCheckReplyTimeout:
-				close(waitHealthCheckReplyTimeout)
-				fmt.Println("Bully: Our unicorn has not returned home, find a replacement.")
-				if count >= 0 {
-					go putUnicornUpdate(messagePasser.Message{
-						Source:      localName,
-						Destination: localName,
-						Content:     defs.MSG_DEAD_UNICORN,
-						Kind:        defs.MSG_DEAD_UNICORN,
-					})
-				}
-				count = (count + 1) % 9
-				/* No election message received yet, start an election */
-				startElection()
-				i = 1
-			case message := <-receivedHealthCheckReplyChannel:
-				/* valide health check reply message received
-				 * break the inner loop, wait for TIME_BETWEEN_HEALTH_CHECK,
-				 * and start another round of health check
-				 */
-				if message.Content == currentTime {
-					// fmt.Printf("%s:\treceive health check reply from %s\n", localName, message.Source)
-					for len(receivedHealthCheckReplyChannel) > 0 {
-						<-receivedHealthCheckReplyChannel
-					}
-					i = 1
-				}
+		/* no reply after timeout, unicorn failure detected,
+		 * start election
+		 */
+		if !unicornAnswered() {
+			fmt.Println("Bully: Our unicorn has not returned home, find a replacement.")
+			if count >= 0 {
+				go putUnicornUpdate(messagePasser.Message{
+					Source:      localName,
+					Destination: localName,
+					Content:     defs.MSG_DEAD_UNICORN,
+					Kind:        defs.MSG_DEAD_UNICORN,
+				})
 			}
+			count = (count + 1) % 9
+			/* No election message received yet, start an election */
+			runElection()
 		}
 		time.Sleep(time.Duration(TIME_BETWEEN_HEALTH_CHECK) * time.Millisecond)
 	}
 }
 
+/* Start an election, unless one is running already */
+func runElection() {
+	if !atomic.CompareAndSwapInt32(&electing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&electing, 0)
+	startElection()
+}
+
 /* Start election */
 func startElection() {
-	currentTime := getCurrentTime()
-	sendElectionMessage(currentTime)
-	/* wait for answers from other nodes within timeout */
-	var timeoutWaitAnswer chan bool = make(chan bool, 1)
+	/* no answer after timeout, the node it self is unicorn */
+	if !electionAnswered() {
+		fmt.Printf("Bully: %s usurped. %s is now our magical steed.\n", unicorn, localName)
+		// set self as unicorn, put an unicorn update message into unicornUpdateChannel
+		go putUnicornUpdate(newUnicornUpdate(localName))
+		unicorn = localName
+		sendUnicornMessage()
+		return
+	}
+
+	/* got an answer within timeout, wait for unicorn */
+	var timeoutWaitUnicorn chan bool = make(chan bool, 1)
 	go func() {
-		time.Sleep(time.Duration(TIMEOUT) * time.Millisecond)
-		timeoutWaitAnswer <- true
+		time.Sleep(time.Millisecond * time.Duration(WAITING_UNICORN_MESSAGE_TIMEOUT))
+		timeoutWaitUnicorn <- true
 	}()
-	var i int = -1
-	for i < 0 {
-		select {
-		/* no answer after timeout, the node it self is unicorn */
-		case <-timeoutWaitAnswer:
-			close(timeoutWaitAnswer)
-			fmt.Printf("Bully: %s usurped. %s is now our magical steed.\n", unicorn, localName)
-			// set self as unicorn, put an unicorn update message into unicornUpdateChannel
-			go putUnicornUpdate(messagePasser.Message{
-				Source:      localName,
-				Destination: localName,
-				Content:     localName,
-				Kind:        defs.MSG_UNICORN,
-			})
-			unicorn = localName
-			sendUnicornMessage()
-			i = 1
-			/* get answer within time out */
-		case message := <-receivedAnswerChannel:
-			/* receive a valide answer
-			 * break the loop and wait for unicorn
-			 */
-			if message.Content == currentTime {
-				for len(receivedAnswerChannel) > 0 {
-					<-receivedAnswerChannel
-				}
-				i = 1
-				var timeoutWaitUnicorn chan bool = make(chan bool, 1)
-				go func() {
-					time.Sleep(time.Millisecond * time.Duration(WAITING_UNICORN_MESSAGE_TIMEOUT))
-					timeoutWaitUnicorn <- true
-				}()
-				select {
-				/* no unicorn message received after timeout,
-				 * start another election process
-				 */
-				case <-timeoutWaitUnicorn:
-					close(timeoutWaitUnicorn)
-					startElection()
-					/* recieve an unicorn message within timeout,
-					 * start health check
-					 */
-				case unicornMessage := <-receivedUnicornChannel:
-					fmt.Printf("Bully: %s usurped. %s is now our magical steed.\n", unicorn, unicornMessage.Content)
-					go putUnicornUpdate(messagePasser.Message{
-						Source:      unicornMessage.Source,
-						Destination: unicornMessage.Destination,
-						Kind:        defs.MSG_UNICORN,
-						Content:     unicornMessage.Content,
-					})
-					unicorn = unicornMessage.Content
-				}
-			}
-			//otherwise, drop out-dated answer message
-		}
+	select {
+	/* no unicorn message received after timeout,
+	 * start another election process
+	 */
+	case <-timeoutWaitUnicorn:
+		close(timeoutWaitUnicorn)
+		startElection()
+		/* recieve an unicorn message within timeout,
+		 * start health check
+		 */
+	case unicornMessage := <-receivedUnicornChannel:
+		fmt.Printf("Bully: %s usurped. %s is now our magical steed.\n", unicorn, unicornMessage.Content)
+		go putUnicornUpdate(newUnicornUpdate(unicornMessage.Content))
+		unicorn = unicornMessage.Content
 	}
 }
 
+/*
+ * answers an election request from a smaller node, which tells it
+ * to stand down, and takes over the election
+ */
+func answerElection(request messagePasser.Message) (string, error) {
+	if request.Source >= localName {
+		return "", errors.New("Only smaller nodes ask " + localName + " to stand down")
+	}
+	go runElection()
+	return localName, nil
+}
+
+/*
+ * answers a health check with the node we take for the unicorn
+ */
+func answerAreYouAlive(request messagePasser.Message) (string, error) {
+	return unicorn, nil
+}
+
 /*
  * Initialize the bully algorithm, and start the first election
  * @param	name
@@ -396,6 +379,8 @@ func startElection() {
 func InitBullySelection(nodes messagePasser.Nodes, name string) {
 	localName = name
 	frontNodes, latterNodes = getFrontAndLatterNodes(nodes, localName)
+	messagePasser.HandleRequest(defs.MSG_BULLY_ELECTION, answerElection)
+	messagePasser.HandleRequest(defs.MSG_BULLY_ARE_YOU_ALIVE, answerAreYouAlive)
 	go dispatchMessage()
 	unicorn = defs.UNICORN_DEFAULT_NAME
 	startHealthCheck()
@@ -1,15 +1,15 @@
 package consensus
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/arminm/multegula/defs"
 	"github.com/arminm/multegula/messagePasser"
+	"github.com/arminm/multegula/payload"
 )
 
 var leaderNode messagePasser.Node
@@ -28,8 +28,8 @@ var acceptedProposalsMutex = &sync.Mutex{}
 
 // Leader
 var SeqNum int = 0
-var propVotesMap map[string]*(map[string]*Proposal)
-var propVotesMutex = &sync.Mutex{}
+var latestProposals map[string]int
+var latestMutex = &sync.Mutex{}
 
 type Proposal struct {
 	SeqNum int
@@ -37,6 +37,22 @@ type Proposal struct {
 	Value  string
 }
 
+/*
+ * every consensus message carries a Proposal
+ */
+func (proposal *Proposal) Validate() error {
+	if len(proposal.Type) == 0 {
+		return errors.New("Proposal without type")
+	}
+	return nil
+}
+
+func init() {
+	for _, kind := range []string{defs.CONSENSUS_PROPOSE_KIND, defs.CONSENSUS_COMMIT_KIND} {
+		payload.Register(kind, func() payload.Payload { return &Proposal{} })
+	}
+}
+
 type PropCheck struct {
 	Prop     *Proposal
 	Callback *func(string)
@@ -53,12 +69,14 @@ func InitConsensus(leader messagePasser.Node, peers messagePasser.Nodes, localNo
 	acceptedProposals = make(map[string]*Proposal)
 
 	//Leader
-	propVotesMap = make(map[string]*(map[string]*Proposal))
+	latestProposals = make(map[string]int)
 
+	messagePasser.HandleRequest(defs.CONSENSUS_PROPOSE_KIND, answerProposal)
 }
 
 /*
- * If the leader, propose a value and reach consensus
+ * If the leader, propose a value and reach consensus. The proposal is a
+ * call to every peer, its reply is the value the peer votes for.
  */
 func Propose(value string, valueType string) {
 	if !isLeader {
@@ -67,182 +85,184 @@ func Propose(value string, valueType string) {
 	// Create proposal
 	SeqNum += 1
 	proposal := Proposal{SeqNum, valueType, value}
-	// Create the votesMap to track votes
-	votesMap := make(map[string]*Proposal)
-	// Add own proposal to votesMap
-	votesMap[localName] = &proposal
-	// Keep track of the votesMap for the valueType
-	propVotesMutex.Lock()
-	propVotesMap[valueType] = &votesMap
-	propVotesMutex.Unlock()
-	// Multicast the proposal
-	addMessageToSendChannel(defs.MULTICAST_DEST, defs.CONSENSUS_PROPOSE_KIND, &proposal)
-	// local copy of SeqNum for timeout checks
-	seqNum := SeqNum
-	time.AfterFunc(defs.CONSENSUS_TIMEOUT_INTERVAL, func() {
-		// check if the timeout is still relevant
-		propVotesMutex.Lock()
-		votes, exists := propVotesMap[valueType]
-		propVotesMutex.Unlock()
-		if exists {
-			localVote := (*Proposal)((*votes)[localName])
-			if localVote.SeqNum == seqNum {
-				// Timed out, see if consensus is reached
-				reached, value, err := reachedConsensus(valueType)
-				if err == nil {
-					if reached {
-						// update localVote's value to decided value and multicastCommit
-						proposal.Value = value
-						multicastCommit(&proposal)
-					} else {
-						// If timed out and haven't reached consensus then force value
-						multicastCommit(&proposal)
-					}
-				}
-			}
-		}
-	})
+	// a newer proposal of the same type supersedes this one
+	latestMutex.Lock()
+	latestProposals[valueType] = proposal.SeqNum
+	latestMutex.Unlock()
+	go collectVotes(proposal)
 }
 
 /*
- * Multicasts a commit asking everyone to commit value
+ * Asks every peer to vote on a proposal and commits the majority value,
+ * or the proposed one if there is no majority once every peer has voted
+ * or CONSENSUS_TIMEOUT_INTERVAL is up
  */
-func multicastCommit(proposal *Proposal) {
-	// Check to see if we haven't already multicasted a commit for this proposal
-	propVotesMutex.Lock()
-	if votes, exists := propVotesMap[proposal.Type]; exists {
-		if (*votes)[localName].SeqNum == proposal.SeqNum {
-			delete(propVotesMap, proposal.Type)
-			addMessageToSendChannel(defs.MULTICAST_DEST, defs.CONSENSUS_COMMIT_KIND, proposal)
-			// locally commit as well.
-			commitChannel <- proposal
+func collectVotes(proposal Proposal) {
+	content, err := payload.Encode(&proposal)
+	if err != nil {
+		fmt.Printf("Couldn't send proposal:%+v, Error:%v\n", proposal, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defs.CONSENSUS_TIMEOUT_INTERVAL)
+	defer cancel()
+
+	votes := make(chan *Proposal, len(peerNodes))
+	asked := 0
+	for _, peer := range peerNodes {
+		if peer.Name == localName {
+			continue
 		}
+		asked += 1
+		go func(name string) {
+			votes <- askPeer(ctx, name, content)
+		}(peer.Name)
 	}
-	propVotesMutex.Unlock()
+
+	// Add own proposal to the votes
+	values := []string{proposal.Value}
+	for ; asked > 0; asked-- {
+		if vote := <-votes; vote != nil {
+			values = append(values, vote.Value)
+		}
+	}
+
+	if reached, value := reachedConsensus(values); reached {
+		proposal.Value = value
+	}
+	multicastCommit(&proposal)
 }
 
 /*
- * Receives a consensus related message from the application's message dispatcher
+ * Sends the proposal to one peer
+ * @return	the peer's vote, nil if it didn't answer in time
  */
-func ReceiveMessage(message messagePasser.Message) {
-	proposal, err := stringToProposal(message.Content)
+func askPeer(ctx context.Context, name string, content string) *Proposal {
+	reply, err := messagePasser.Call(ctx, name, defs.CONSENSUS_PROPOSE_KIND, content)
 	if err != nil {
-		fmt.Printf("Couldn't parse Consensus message:%+v\n", message)
-		panic(err)
+		fmt.Printf("No vote from %s: %v\n", name, err)
+		return nil
 	}
-
-	switch message.Kind {
-	case defs.CONSENSUS_PROPOSE_KIND:
-		parseProposal(proposal)
-	case defs.CONSENSUS_COMMIT_KIND:
-		commitProposal(proposal)
-	default:
-		// Message is for the leader
-		handleProposalResponse(&message, proposal)
+	value, err := payload.Decode(defs.CONSENSUS_PROPOSE_KIND, reply.Content)
+	if err != nil {
+		fmt.Printf("Couldn't parse vote from %s: %v\n", name, err)
+		return nil
 	}
+	return value.(*Proposal)
 }
 
 /*
- * Handles the response received from a peer in consensus process
+ * Multicasts a commit asking everyone to commit value
  */
-func handleProposalResponse(message *messagePasser.Message, proposal *Proposal) {
-	if !isLeader {
-		return
-	}
-	propVotesMutex.Lock()
-	votesMapPtr, exists := propVotesMap[proposal.Type]
-	propVotesMutex.Unlock()
-	if !exists {
+func multicastCommit(proposal *Proposal) {
+	// Check that no newer proposal of the same type went out meanwhile
+	latestMutex.Lock()
+	defer latestMutex.Unlock()
+	if latestProposals[proposal.Type] != proposal.SeqNum {
 		return
 	}
-	localVote := (*Proposal)((*votesMapPtr)[localName])
-	if localVote.SeqNum != proposal.SeqNum {
+	delete(latestProposals, proposal.Type)
+	addMessageToSendChannel(defs.MULTICAST_DEST, defs.CONSENSUS_COMMIT_KIND, proposal)
+	// locally commit as well.
+	commitChannel <- proposal
+}
+
+/*
+ * Receives a consensus related message from the application's message dispatcher
+ */
+func ReceiveMessage(message messagePasser.Message) {
+	value, err := payload.Decode(message.Kind, message.Content)
+	if err != nil {
+		fmt.Printf("Couldn't parse Consensus message:%+v, Error:%v\n", message, err)
 		return
 	}
-	(*votesMapPtr)[message.Source] = proposal
-	if len(*votesMapPtr) == len(peerNodes)+1 {
-		reached, value, err := reachedConsensus(proposal.Type)
-		if err != nil {
+
+	switch message.Kind {
+	case defs.CONSENSUS_COMMIT_KIND:
+		if message.Source != leaderNode.Name {
+			fmt.Printf("Ignoring commit from %s, %s is the leader\n", message.Source, leaderNode.Name)
 			return
 		}
-		if reached {
-			consensus := localVote
-			consensus.Value = value
-			multicastCommit(consensus)
-		} else {
-			multicastCommit(localVote)
-		}
+		commitProposal(value.(*Proposal))
 	}
 }
 
 /*
- * Looks at the existing votes to see if majority consensus has been reached
- */
-func reachedConsensus(valueType string) (bool, string, error) {
-	propVotesMutex.Lock()
-	votes, exists := propVotesMap[valueType]
-	propVotesMutex.Unlock()
-	if !exists {
-		return false, "N/A", errors.New("ValueType not found in propVotesMap")
-	}
-
+ * Looks at the votes to see if majority consensus has been reached
+ * @param	values – the value every voter voted for, the leader's first
+ *
+ * @return	whether a majority agreed, and on what
+ **/
+func reachedConsensus(values []string) (bool, string) {
 	// Find majority vote
 	var popularVote string
 	popularCount := 0
-	for _, vote := range *votes {
+	for _, vote := range values {
 		tempCount := 0
-		for _, compareVote := range *votes {
-			if vote.Value == compareVote.Value {
+		for _, compareVote := range values {
+			if vote == compareVote {
 				tempCount += 1
 			}
 		}
 		if tempCount > popularCount {
 			popularCount = tempCount
-			popularVote = vote.Value
+			popularVote = vote
 		}
 	}
 	if popularCount <= len(peerNodes)/2 {
-		return false, "N/A", nil
+		return false, "N/A"
 	}
 
-	return true, popularVote, nil
+	return true, popularVote
 }
 
 /*
- * Check with the application to see what value we agree to regarding the
+ * Answers the leader's proposal with the value we vote for, after
+ * checking with the application what value we agree to regarding the
  * proposal.Type
  */
-func parseProposal(proposal *Proposal) {
-	if isLeader {
-		return
+func answerProposal(request messagePasser.Message) (string, error) {
+	if isLeader || request.Source != leaderNode.Name {
+		return "", errors.New("Not a proposal from our leader")
+	}
+	value, err := payload.Decode(request.Kind, request.Content)
+	if err != nil {
+		return "", err
 	}
+	proposal := value.(*Proposal)
+
 	acceptedProposalsMutex.Lock()
-	if accepted, exists := acceptedProposals[proposal.Type]; exists {
+	accepted, exists := acceptedProposals[proposal.Type]
+	if exists {
 		// A proposal of the same type have already been accepted
 		if accepted.Value == proposal.Value && accepted.SeqNum < proposal.SeqNum {
 			accepted.SeqNum = proposal.SeqNum
-			accept(proposal)
 		} else {
 			// proposal is not the most recent of that type so disregard
 			proposal.Value = accepted.Value
-			reject(proposal)
 		}
-	} else {
+	}
+	acceptedProposalsMutex.Unlock()
+
+	if !exists {
 		// It's a new proposal that hasn't been accepted
+		checked := make(chan string, 1)
 		callback := func(value string) {
+			checked <- value
+		}
+		check(proposal, &callback)
+		select {
+		case value := <-checked:
 			if value == proposal.Value {
 				acceptedProposalsMutex.Lock()
 				acceptedProposals[proposal.Type] = proposal
 				acceptedProposalsMutex.Unlock()
-				accept(proposal)
-			} else {
-				proposal.Value = value
-				reject(proposal)
 			}
+			proposal = &Proposal{proposal.SeqNum, proposal.Type, value}
+		case <-time.After(defs.CONSENSUS_TIMEOUT_INTERVAL):
+			return "", errors.New("The application didn't check the proposal in time")
 		}
-		check(proposal, &callback)
 	}
-	acceptedProposalsMutex.Unlock()
+	return payload.Encode(proposal)
 }
 
 /*
@@ -261,20 +281,6 @@ func ProposalCheck() *PropCheck {
 	return <-proposalCheckChannel
 }
 
-/*
- * Accept the proposal
- */
-func accept(proposal *Proposal) {
-	addMessageToSendChannel(defs.MULTICAST_DEST, defs.CONSENSUS_ACCEPT_KIND, proposal)
-}
-
-/*
- * Reject the proposal
- */
-func reject(proposal *Proposal) {
-	addMessageToSendChannel(defs.MULTICAST_DEST, defs.CONSENSUS_REJECT_KIND, proposal)
-}
-
 /*
  * Adds a proposal to commitProposal channel to be commited by application
  */
@@ -297,11 +303,16 @@ func ProposalToCommit() *Proposal {
  * Adds message to sendChannel to be retreived by the application and sent
  */
 func addMessageToSendChannel(dest string, kind string, proposal *Proposal) {
+	content, err := payload.Encode(proposal)
+	if err != nil {
+		fmt.Printf("Couldn't send proposal:%+v, Error:%v\n", proposal, err)
+		return
+	}
 	message := messagePasser.Message{
 		Destination: dest,
 		Source:      localName,
 		Kind:        kind,
-		Content:     proposalToString(proposal)}
+		Content:     content}
 	sendChannel <- &message
 }
 
@@ -311,26 +322,3 @@ func addMessageToSendChannel(dest string, kind string, proposal *Proposal) {
 func SendMessage() *messagePasser.Message {
 	return <-sendChannel
 }
-
-/*
- * Helper function to create Message.Content string from a Proposal
- */
-func proposalToString(proposal *Proposal) string {
-	return fmt.Sprintf("%v%s%v%s%v", proposal.SeqNum, defs.CONSENSUS_DELIMITER, proposal.Type, defs.CONSENSUS_DELIMITER, proposal.Value)
-}
-
-/*
- * Helper function to create a Proposal from Message.Content string
- * The content will have the format "SeqNum::Type::Value"
- */
-func stringToProposal(content string) (*Proposal, error) {
-	values := strings.Split(content, defs.CONSENSUS_DELIMITER)
-	if len(values) != 3 {
-		return nil, errors.New("Wrong Format: " + content)
-	}
-	seqNum, err := strconv.Atoi(values[0])
-	if err != nil {
-		return nil, err
-	}
-	return &Proposal{seqNum, values[1], values[2]}, nil
-}
@@ -16,29 +16,25 @@ const HOLDBACKQUEUE_LIMIT int = 5
 // const SERVER_DNS string = "multegula.dyndns.org:55555"
 const SERVER_DNS string = "localhost:55555"
 
+
 /* The beginning of message types for bully algorithm */
 /* These kinds of message will be used in bully algorithm */
-/* The election message */
+/* The election request, answered by any greater node that is alive */
 const MSG_BULLY_ELECTION string = "MUE"
 
-/* The answer message */
-const MSG_BULLY_ANSWER string = "MUA"
-
 /* The unicorn message */
 const MSG_BULLY_UNICORN string = "MUU"
 
-/* Nodes request if unicorn is alive */
+/* Nodes request if unicorn is alive, the reply is its heart beat */
 const MSG_BULLY_ARE_YOU_ALIVE string = "MUR"
 
-/* The unicorn heart beat message */
-const MSG_BULLY_IAM_ALIVE string = "MUL"
-
 /* The end of message types for bully algorithm */
 
 /* The default unicorn name */
 /* Note that this name is reserved in the system */
 const UNICORN_DEFAULT_NAME = "unicorn_default_name"
 
+/* only used on the Python-Go bridge, see the payload package */
 const DELIMITER string = "##"
 const PAYLOAD_DELIMITER string = "|"
 
@@ -65,12 +61,14 @@ const MSG_EXIT string = "MEX"
 const MSG_FORCE_COMMIT string = "MFC"
 const MSG_KILL_NODE string = "MKN"
 const MSG_GAME_TYPE string = "MGT"
+const MSG_JOIN_STATUS string = "MJS"
 const MSG_MYNAME string = "MMN"
 const MSG_PADDLE_DIR string = "MPD"
 const MSG_PAUSE_UPDATE string = "MPU"
 const MSG_PLAYER_LOC string = "MPL"
 const MSG_REJOIN_REQ string = "MRR"
 const MSG_REJOIN_ACK string = "MRA"
+const MSG_RPC_ERROR string = "MRE"
 const MSG_START_PLAY string = "MSP"
 const MSG_SYNC_ERROR string = "MSE"
 const MSG_UNICORN string = "MUN"
@@ -87,14 +85,24 @@ const UI_SOURCE string = "UI"
 const GAME_TYPE_MULTI string = "M"
 const GAME_TYPE_SINGLE string = "S"
 
+/* codes of MSG_JOIN_STATUS, shown on the join screen */
+const JOIN_STATUS_RETRYING string = "RETRY"
+const JOIN_STATUS_WAITING string = "WAIT"
+const JOIN_STATUS_UNREACHABLE string = "UNREACHABLE"
+const JOIN_STATUS_NAME_TAKEN string = "NAME"
+const JOIN_STATUS_ROOM string = "ROOM"
+const JOIN_STATUS_LOBBY string = "LOBBY"
+const JOIN_STATUS_NO_ROOM string = "NOROOM"
+const JOIN_STATUS_LOGIN string = "LOGIN"
+const JOIN_STATUS_VERSION string = "VERSION"
+const JOIN_STATUS_TIMEOUT string = "TIMEOUT"
+const JOIN_STATUS_FAILED string = "FAILED"
+
 const DEFAULT_GAME_PORT int = 11111
 const DEFAULT_UI_PORT int = 44444
 
 /*** CONSENSUS CONSTANTS ***/
 const CONSENSUS_PROPOSE_KIND string = "CPK"
-const CONSENSUS_ACCEPT_KIND string = "CAK"
-const CONSENSUS_REJECT_KIND string = "CRK"
 const CONSENSUS_COMMIT_KIND string = "CCK"
 const CONSENSUS_CHANNEL_SIZE int = 10
 const CONSENSUS_TIMEOUT_INTERVAL time.Duration = 5 * time.Second
-const CONSENSUS_DELIMITER string = "::"
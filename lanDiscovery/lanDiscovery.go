@@ -0,0 +1,464 @@
+////////////////////////////////////////////////////////////
+//Multegula - lanDiscovery.go
+//Finding other players on the local network, no bootstrap server needed
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package lanDiscovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/arminm/multegula/defs"
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/*
+ * Every waiting instance announces itself by UDP broadcast, and on
+ * 127.0.0.1 for instances on the same machine. Instances listen on the
+ * first free port of a small range and announce to the whole range, so
+ * several of them can run on one machine.
+ *
+ * The waiting instance with the smallest name leads the lobby and groups
+ * players the way the bootstrap server does: once MinPlayers are waiting
+ * a countdown starts, and the game starts when it runs out or as soon as
+ * MaxPlayers are waiting. The leader then announces the game, and
+ * everyone in it stops announcing and acknowledges it. UDP may lose
+ * either, so the leader repeats the game until every player acknowledged
+ * it, for up to GAME_TIMEOUT, and a player acknowledges every repeat it
+ * gets until the leader falls quiet.
+ */
+const DISCOVERY_PORT int = 45454
+const DISCOVERY_PORTS int = 8
+const ANNOUNCE_INTERVAL = 500 * time.Millisecond
+const PEER_TIMEOUT = 2 * time.Second
+const GAME_INTERVAL = ANNOUNCE_INTERVAL / 5
+const GAME_TIMEOUT = 5 * time.Second
+const MAX_PACKET int = 8192
+
+const LOBBY_MAGIC string = "MULTEGULA-LAN"
+const LOBBY_VERSION int = 1
+const KIND_HELLO string = "HELLO"
+const KIND_GAME string = "GAME"
+const KIND_ACK string = "ACK"
+
+/* lobby settings, DefaultConfig matches the bootstrap server */
+type Config struct {
+	Port       int // first port of the discovery range
+	Ports      int // number of ports in the range
+	MinPlayers int
+	MaxPlayers int
+	Countdown  time.Duration // how long to wait for more players after MinPlayers
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:       DISCOVERY_PORT,
+		Ports:      DISCOVERY_PORTS,
+		MinPlayers: defs.MIN_PLAYERS_PER_GAME,
+		MaxPlayers: defs.MAX_PLAYERS_PER_GAME,
+		Countdown:  defs.TIMEOUT_DURATION,
+	}
+}
+
+/* an instance in the lobby, Instance tells apart players with the same name */
+type Player struct {
+	Instance string
+	Node     messagePasser.Node
+}
+
+/* what instances broadcast */
+type announcement struct {
+	Magic   string
+	Version int
+	Kind    string // KIND_HELLO, KIND_GAME or KIND_ACK
+	Player  Player
+	Players []Player // the players of a KIND_GAME
+	Game    string   // the leader's instance, of a KIND_ACK
+}
+
+type peerState struct {
+	Player
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+type packet struct {
+	announcement announcement
+	addr         *net.UDPAddr
+}
+
+type lobby struct {
+	config   Config
+	conn     *net.UDPConn
+	self     Player
+	peers    map[string]*peerState // by instance
+	deadline time.Time             // end of the countdown, zero if not counting down
+	warned   map[string]bool
+}
+
+/*
+ * Get Nodes from the players on the local network, like
+ * bootstrapClient.GetNodes
+ *
+ **/
+func GetNodes(localNode messagePasser.Node) (*[]messagePasser.Node, error) {
+	return Join(localNode, DefaultConfig())
+}
+
+/*
+ * waits in the LAN lobby until a game is formed
+ * @param	localNode – this player
+ * @param	config – the lobby settings
+ *
+ * @return	the other players of the game
+ **/
+func Join(localNode messagePasser.Node, config Config) (*[]messagePasser.Node, error) {
+	if config.MinPlayers < 2 || config.MaxPlayers < config.MinPlayers {
+		return nil, fmt.Errorf("Bad lobby size: %d to %d players", config.MinPlayers, config.MaxPlayers)
+	}
+	conn, err := listen(config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	instance, err := newInstanceID()
+	if err != nil {
+		return nil, err
+	}
+	l := &lobby{
+		config: config,
+		conn:   conn,
+		self:   Player{Instance: instance, Node: localNode},
+		peers:  make(map[string]*peerState),
+		warned: make(map[string]bool),
+	}
+	fmt.Println("Looking for players on the local network on UDP port", conn.LocalAddr().(*net.UDPAddr).Port)
+
+	packets := make(chan packet, defs.CHANNEL_SIZE)
+	done := make(chan struct{})
+	defer close(done)
+	go receivePackets(conn, packets, done)
+	ticker := time.NewTicker(ANNOUNCE_INTERVAL)
+	defer ticker.Stop()
+	l.announce(announcement{Kind: KIND_HELLO})
+	for {
+		select {
+		case p, ok := <-packets:
+			if !ok {
+				return nil, errors.New("Lobby connection closed")
+			}
+			if players := l.handle(p); players != nil {
+				l.acknowledgeGame(p, packets)
+				return l.peerNodes(players), nil
+			}
+		case <-ticker.C:
+			l.announce(announcement{Kind: KIND_HELLO})
+			l.expirePeers()
+			if players := l.formGame(); players != nil {
+				l.announceGame(players, packets)
+				return l.peerNodes(players), nil
+			}
+		}
+	}
+}
+
+/*
+ * listens on the first free port of the discovery range
+ */
+func listen(config Config) (*net.UDPConn, error) {
+	var lastErr error
+	for port := config.Port; port < config.Port+config.Ports; port++ {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("No free discovery port: %v", lastErr)
+}
+
+func newInstanceID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+/*
+ * reads announcements until the connection is closed
+ */
+func receivePackets(conn *net.UDPConn, packets chan<- packet, done <-chan struct{}) {
+	defer close(packets)
+	buffer := make([]byte, MAX_PACKET)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		var a announcement
+		if json.Unmarshal(buffer[:n], &a) != nil || a.Magic != LOBBY_MAGIC || a.Version != LOBBY_VERSION {
+			continue
+		}
+		select {
+		case packets <- packet{a, addr}:
+		case <-done:
+			return
+		}
+	}
+}
+
+/*
+ * sends an announcement to every port of the range, by broadcast and
+ * on this machine
+ */
+func (l *lobby) announce(a announcement) {
+	a.Magic = LOBBY_MAGIC
+	a.Version = LOBBY_VERSION
+	a.Player = l.self
+	data, err := json.Marshal(a)
+	if err != nil {
+		fmt.Println("Couldn't encode announcement:", err)
+		return
+	}
+	for _, host := range []string{"255.255.255.255", "127.0.0.1"} {
+		for port := l.config.Port; port < l.config.Port+l.config.Ports; port++ {
+			addr := &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+			if _, err := l.conn.WriteToUDP(data, addr); err != nil {
+				l.warnOnce(host, fmt.Sprintf("Can't announce to %s: %v", host, err))
+			}
+		}
+	}
+}
+
+/*
+ * sends an announcement to one instance
+ */
+func (l *lobby) reply(a announcement, addr *net.UDPAddr) {
+	a.Magic = LOBBY_MAGIC
+	a.Version = LOBBY_VERSION
+	a.Player = l.self
+	data, err := json.Marshal(a)
+	if err != nil {
+		fmt.Println("Couldn't encode announcement:", err)
+		return
+	}
+	if _, err := l.conn.WriteToUDP(data, addr); err != nil {
+		fmt.Printf("Can't answer %v: %v\n", addr, err)
+	}
+}
+
+/*
+ * announces the game we lead until every other player in it acknowledged
+ * it, or GAME_TIMEOUT is up
+ * @param	players – the players of the game, us first
+ * @param	packets – the announcements we receive
+ **/
+func (l *lobby) announceGame(players []Player, packets <-chan packet) {
+	waiting := make(map[string]string)
+	for _, player := range players {
+		if player.Instance != l.self.Instance {
+			waiting[player.Instance] = player.Node.Name
+		}
+	}
+	ticker := time.NewTicker(GAME_INTERVAL)
+	defer ticker.Stop()
+	timeout := time.After(GAME_TIMEOUT)
+	l.announce(announcement{Kind: KIND_GAME, Players: players})
+	for len(waiting) > 0 {
+		select {
+		case p, ok := <-packets:
+			if !ok {
+				return
+			}
+			if p.announcement.Kind == KIND_ACK && p.announcement.Game == l.self.Instance {
+				delete(waiting, p.announcement.Player.Instance)
+			}
+		case <-ticker.C:
+			l.announce(announcement{Kind: KIND_GAME, Players: players})
+		case <-timeout:
+			for _, name := range waiting {
+				fmt.Println("No answer from", name, "starting without knowing it got the game")
+			}
+			return
+		}
+	}
+}
+
+/*
+ * acknowledges the game we are in, and every repeat of it, until the
+ * leader stops announcing it
+ * @param	game – the leader's announcement of the game
+ * @param	packets – the announcements we receive
+ **/
+func (l *lobby) acknowledgeGame(game packet, packets <-chan packet) {
+	leader := game.announcement.Player.Instance
+	ack := announcement{Kind: KIND_ACK, Game: leader}
+	l.reply(ack, game.addr)
+	quiet := time.NewTimer(ANNOUNCE_INTERVAL)
+	defer quiet.Stop()
+	for {
+		select {
+		case p, ok := <-packets:
+			if !ok {
+				return
+			}
+			if p.announcement.Kind == KIND_GAME && p.announcement.Player.Instance == leader {
+				l.reply(ack, p.addr)
+				quiet.Reset(ANNOUNCE_INTERVAL)
+			}
+		case <-quiet.C:
+			return
+		}
+	}
+}
+
+func (l *lobby) warnOnce(key string, warning string) {
+	if !l.warned[key] {
+		l.warned[key] = true
+		fmt.Println(warning)
+	}
+}
+
+/*
+ * handles an announcement from another instance
+ * @return	the players of a game we are in, nil otherwise
+ **/
+func (l *lobby) handle(p packet) []Player {
+	sender := p.announcement.Player
+	if sender.Instance == l.self.Instance || len(sender.Node.Name) == 0 {
+		return nil
+	}
+	if p.announcement.Kind == KIND_GAME {
+		for _, player := range p.announcement.Players {
+			if player.Instance == l.self.Instance {
+				return p.announcement.Players
+			}
+		}
+		/* the others are leaving to play */
+		for _, player := range p.announcement.Players {
+			delete(l.peers, player.Instance)
+		}
+		return nil
+	}
+	if p.announcement.Kind != KIND_HELLO {
+		return nil
+	}
+	if sender.Node.Name == l.self.Node.Name {
+		l.warnOnce(sender.Instance, "Ignoring another player with our name: "+sender.Node.Name)
+		return nil
+	}
+	for instance, peer := range l.peers {
+		if peer.Node.Name == sender.Node.Name && instance != sender.Instance {
+			l.warnOnce(sender.Instance, "Ignoring duplicate player name: "+sender.Node.Name)
+			return nil
+		}
+	}
+
+	now := time.Now()
+	peer, known := l.peers[sender.Instance]
+	if !known {
+		peer = &peerState{firstSeen: now}
+		l.peers[sender.Instance] = peer
+		fmt.Printf("Found player %s at %v\n", sender.Node.Name, p.addr.IP)
+	}
+	/* the sender doesn't know its public address, use the one we saw */
+	ip := p.addr.IP.String()
+	if known && p.addr.IP.IsLoopback() && !net.ParseIP(peer.Node.IP).IsLoopback() {
+		ip = peer.Node.IP
+	}
+	peer.Player = sender
+	peer.Node.IP = ip
+	peer.lastSeen = now
+	return nil
+}
+
+/*
+ * forgets the instances that stopped announcing
+ */
+func (l *lobby) expirePeers() {
+	now := time.Now()
+	for instance, peer := range l.peers {
+		if now.Sub(peer.lastSeen) > PEER_TIMEOUT {
+			fmt.Println("Lost player", peer.Node.Name)
+			delete(l.peers, instance)
+		}
+	}
+}
+
+/*
+ * the leader is the waiting instance with the smallest name
+ */
+func (l *lobby) isLeader() bool {
+	for _, peer := range l.peers {
+		if peer.Node.Name < l.self.Node.Name {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * starts or stops the countdown, as the bootstrap server does
+ * @return	the players of the game if it should start now, nil otherwise
+ **/
+func (l *lobby) formGame() []Player {
+	count := len(l.peers) + 1
+	if !l.isLeader() || count < l.config.MinPlayers {
+		l.deadline = time.Time{}
+		return nil
+	}
+	if count < l.config.MaxPlayers {
+		if l.deadline.IsZero() {
+			fmt.Printf("%d players found, starting countdown to game.\n", count)
+			l.deadline = time.Now().Add(l.config.Countdown)
+		}
+		if time.Now().Before(l.deadline) {
+			return nil
+		}
+		fmt.Printf("Timed out, starting with %v players!\n", count)
+	}
+
+	/* first come, first served */
+	peers := []*peerState{}
+	for _, peer := range l.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].firstSeen.Before(peers[j].firstSeen) })
+	players := []Player{l.self}
+	for _, peer := range peers {
+		if len(players) == l.config.MaxPlayers {
+			break
+		}
+		players = append(players, peer.Player)
+	}
+	return players
+}
+
+/*
+ * the nodes of the other players, at the addresses we saw them at
+ */
+func (l *lobby) peerNodes(players []Player) *[]messagePasser.Node {
+	nodes := []messagePasser.Node{}
+	for _, player := range players {
+		if player.Instance == l.self.Instance {
+			continue
+		}
+		if peer, known := l.peers[player.Instance]; known {
+			player.Node.IP = peer.Node.IP
+		}
+		nodes = append(nodes, player.Node)
+	}
+	return &nodes
+}
@@ -0,0 +1,129 @@
+package lanDiscovery
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/messagePasser"
+)
+
+/* a discovery range of our own, so tests don't meet real players */
+func testConfig(min int, max int) Config {
+	return Config{
+		Port:       46000 + os.Getpid()%1000*4,
+		Ports:      4,
+		MinPlayers: min,
+		MaxPlayers: max,
+		Countdown:  time.Second,
+	}
+}
+
+type joined struct {
+	name  string
+	peers *[]messagePasser.Node
+	err   error
+}
+
+func joinAll(config Config, names ...string) chan joined {
+	results := make(chan joined, len(names))
+	for i, name := range names {
+		go func(name string, port int) {
+			peers, err := Join(messagePasser.Node{Name: name, IP: "127.0.0.1", Port: port}, config)
+			results <- joined{name, peers, err}
+		}(name, 11111+i)
+	}
+	return results
+}
+
+func waitForGame(t *testing.T, results chan joined, players int, timeout time.Duration) {
+	for i := 0; i < players; i++ {
+		select {
+		case result := <-results:
+			if result.err != nil {
+				t.Fatalf("%s couldn't join: %v", result.name, result.err)
+			}
+			if len(*result.peers) != players-1 {
+				t.Errorf("%s got %d peers: %+v", result.name, len(*result.peers), *result.peers)
+			}
+			for _, peer := range *result.peers {
+				if peer.Name == result.name || len(peer.IP) == 0 || peer.Port == 0 {
+					t.Errorf("%s got a bad peer: %+v", result.name, peer)
+				}
+			}
+		case <-time.After(timeout):
+			t.Fatalf("Only %d of %d players got into a game.", i, players)
+		}
+	}
+}
+
+func TestFullLobbyStartsRightAway(t *testing.T) {
+	results := joinAll(testConfig(2, 2), "armin", "lunwen")
+	waitForGame(t, results, 2, 3*time.Second)
+}
+
+func TestCountdownStartsGame(t *testing.T) {
+	config := testConfig(2, 4)
+	start := time.Now()
+	results := joinAll(config, "daniel", "garrett")
+	waitForGame(t, results, 2, 5*time.Second)
+	if time.Since(start) < config.Countdown {
+		t.Errorf("Game started before the countdown ran out.")
+	}
+}
+
+func TestRejectsBadLobbySize(t *testing.T) {
+	if _, err := Join(messagePasser.Node{Name: "armin"}, testConfig(1, 4)); err == nil {
+		t.Errorf("A game needs at least two players.")
+	}
+}
+
+func TestLeaderRepeatsGameUntilAcknowledged(t *testing.T) {
+	config := testConfig(2, 2)
+	results := joinAll(config, "armin")
+
+	/* zed only hears the game the seventh time, as if UDP lost the others */
+	conn, err := listen(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	zed := &lobby{config: config, conn: conn, peers: map[string]*peerState{}, warned: map[string]bool{},
+		self: Player{Instance: "zed-instance", Node: messagePasser.Node{Name: "zed", IP: "127.0.0.1", Port: 11112}}}
+	packets := make(chan packet, 16)
+	done := make(chan struct{})
+	defer close(done)
+	go receivePackets(conn, packets, done)
+
+	games := 0
+	acknowledged := time.Time{}
+	ticker := time.NewTicker(GAME_INTERVAL)
+	defer ticker.Stop()
+	for acknowledged.IsZero() {
+		select {
+		case p := <-packets:
+			if p.announcement.Kind == KIND_GAME {
+				if games += 1; games == 7 {
+					zed.reply(announcement{Kind: KIND_ACK, Game: p.announcement.Player.Instance}, p.addr)
+					acknowledged = time.Now()
+				}
+			}
+		case <-ticker.C:
+			if games == 0 {
+				zed.announce(announcement{Kind: KIND_HELLO})
+			}
+		case result := <-results:
+			t.Fatalf("The leader started after %d announcements, without an answer: %+v", games, result)
+		case <-time.After(GAME_TIMEOUT):
+			t.Fatalf("The leader stopped announcing the game after %d announcements.", games)
+		}
+	}
+	select {
+	case result := <-results:
+		if result.err != nil || len(*result.peers) != 1 || (*result.peers)[0].Name != "zed" {
+			t.Errorf("Expected a game with zed, got %+v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The leader didn't start once zed answered.")
+	}
+}
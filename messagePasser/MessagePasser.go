@@ -7,9 +7,9 @@
 package messagePasser
 
 import (
-	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"reflect"
 	"sort"
@@ -18,13 +18,18 @@ import (
 	"time"
 
 	"github.com/arminm/multegula/defs"
+	"github.com/arminm/multegula/payload"
+	"github.com/arminm/multegula/tlsTransport"
 )
 
 // Node structure to hold each node's information
 type Node struct {
-	Name string
-	IP   string
-	Port int
+	Name    string
+	IP      string
+	Port    int
+	Addrs   []string // more addresses to try after IP:Port, see address.go
+	Key     string   // base64 public key used to verify the node's messages
+	Session string   // set by the bootstrap server for logged in players
 }
 
 // required functions to implement the sort.Interface for sorting Nodes
@@ -54,6 +59,13 @@ type Message struct {
 	Kind        string // the Kind of messages
 	SeqNum      int
 	Timestamp   []int
+	/* direct messages that happened before this one, see causal.go */
+	DirectClock []int
+	ID          uint64 // unique per Source, see dedup.go
+	/* set by Call, see rpc.go. 0 for messages that aren't part of a call */
+	CorrelationID int
+	IsReply       bool   // true for the answer to a call
+	Signature     []byte // signature by Source over all other fields
 }
 
 /* InitMessagePasser has to wait for all work to be done before exiting */
@@ -64,43 +76,43 @@ var wg sync.WaitGroup
  */
 var PeerNodes Nodes
 
-/* map stores connections to each node
- * <key, value> = <name, connection>
+/* map stores the framed link to each node
+ * <key, value> = <name, link>
  **/
-var connections map[string]net.Conn = make(map[string]net.Conn)
-var decoders map[string]*gob.Decoder = make(map[string]*gob.Decoder)
-var encoders map[string]*gob.Encoder = make(map[string]*gob.Encoder)
+var links map[string]*peerLink = make(map[string]*peerLink)
 var mapsMutex = &sync.Mutex{}
-var localEncoder *gob.Encoder
 
-func getConnectionName(connection net.Conn) (string, error) {
-	for name, conn := range connections {
-		if conn == connection {
-			return name, nil
-		}
-	}
-	return "Not Found", fmt.Errorf("Connection not found:%v\n", connection)
-}
+/* the port other nodes connect to, guarded by mapsMutex */
+var listener net.Listener
 
-func addConnection(nodeName string, conn net.Conn) {
+/* the routines reading links and passing on multicasts */
+var linkRoutines sync.WaitGroup
+
+func addLink(nodeName string, link *peerLink) {
 	mapsMutex.Lock()
-	connections[nodeName] = conn
+	link.name = nodeName
+	links[nodeName] = link
 	seqNums[nodeName] = 0
-	encoders[nodeName] = gob.NewEncoder(conn)
-	decoders[nodeName] = gob.NewDecoder(conn)
 	mapsMutex.Unlock()
 }
 
+func getLink(nodeName string) (*peerLink, bool) {
+	mapsMutex.Lock()
+	link, exists := links[nodeName]
+	mapsMutex.Unlock()
+	return link, exists
+}
+
 var seqNums map[string]int = make(map[string]int)
 var vectorTimeStamp []int
 var timestampMutex = &sync.Mutex{}
 var localReceivedSeqNum = 0
 
 /*
- * connection for localhost, this is the send side,
- * the receive side is stored in connections map
+ * link for localhost, this is the send side,
+ * the receive side is stored in links map
  **/
-var localConn net.Conn
+var localLink *peerLink
 
 /*
  * The local node's information.
@@ -137,6 +149,9 @@ func updateSeqNum(message *Message) {
  * is not ready yet, and we have to receive [1,2,4] first.
  */
 func isMessageReady(message Message, sourceIndex int, localTimeStamp *[]int) bool {
+	if !directMessagesDelivered(message, sourceIndex) {
+		return false
+	}
 	if LocalIndex == sourceIndex {
 		if message.Timestamp[LocalIndex] == (localReceivedSeqNum + 1) {
 			return true
@@ -154,66 +169,21 @@ func isMessageReady(message Message, sourceIndex int, localTimeStamp *[]int) boo
 	return true
 }
 
-/*
- * checks to see if a message is has been received before.
- */
-func messageHasBeenReceived(message Message) bool {
-	/* check if message has been delivered already */
-	timestampMutex.Lock()
-	if message.Source == LocalNode.Name && message.Timestamp[LocalIndex] <= localReceivedSeqNum {
-		timestampMutex.Unlock()
-		return true
-	} else if message.Source != LocalNode.Name && CompareTimestampsLE(&message.Timestamp, &vectorTimeStamp) {
-		timestampMutex.Unlock()
-		return true
-	}
-	timestampMutex.Unlock()
-
-	/* check if message is in holdbackQueue */
-	holdbackQueueMutex.Lock()
-	for _, msg := range holdbackQueue {
-		if CompareTimestampsSame(&msg.Timestamp, &message.Timestamp) {
-			holdbackQueueMutex.Unlock()
-			return true
-		}
-	}
-	holdbackQueueMutex.Unlock()
-	return false
-}
-
 /*
  * send TCP messages
- * @param	conn – connection to send message over
+ * @param	nodeName – name of the node to send message to
  * @param	message – message to be sent
  **/
 func sendMessageTCP(nodeName string, message *Message) {
+	var err error
 	if nodeName == LocalNode.Name {
-		localEncoder.Encode(message)
-	} else {
-		if encoder, exists := encoders[nodeName]; exists {
-			encoder.Encode(message)
-		}
-	}
-}
-
-/*
- * receive TCP messages
- * @param	conn – the connection to use
- *
- * @return	message
- **/
-func receiveMessageTCP(conn net.Conn) (Message, error) {
-	connName, connErr := getConnectionName(conn)
-	if connErr != nil {
-		return Message{}, connErr
+		err = localLink.writeMessage(message)
+	} else if link, exists := getLink(nodeName); exists {
+		err = link.writeMessage(message)
 	}
-	dec, exists := decoders[connName]
-	if !exists {
-		return Message{}, errors.New("Connection doesn't exist.")
+	if err != nil {
+		fmt.Printf("Error sending to %v: %v\n", nodeName, err)
 	}
-	msg := &Message{}
-	err := dec.Decode(msg)
-	return *msg, err
 }
 
 /*
@@ -223,9 +193,12 @@ func Multicast(message *Message) {
 	if message.Source == LocalNode.Name {
 		message.Destination = defs.MULTICAST_DEST
 		updateSeqNum(message)
+		stampMessageID(message)
 		timestampMutex.Lock()
 		message.Timestamp = *GetNewTimestamp(&vectorTimeStamp, LocalIndex)
+		stampMulticastDirectClock(message)
 		timestampMutex.Unlock()
+		signMessage(message)
 	}
 
 	for _, node := range PeerNodes {
@@ -300,30 +273,108 @@ func GetNodeNames() []string {
 func acceptConnection(frontNodes map[string]Node) {
 	defer wg.Done()
 	fmt.Println("Local Port:", strconv.Itoa(LocalNode.Port))
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(LocalNode.Port))
+	ln, err := tlsTransport.Listen(ListenAddress(LocalNode.Port))
 	if err != nil {
 		fmt.Println("Couldn't Start Server...")
 		panic(err)
 	}
+	mapsMutex.Lock()
+	listener = ln
+	mapsMutex.Unlock()
+	done := make(chan struct{})
+	defer close(done)
+	accepted := make(chan net.Conn)
+	go acceptConns(ln, accepted, nil)
+
+	/* nodes that can't reach us directly may come through the relay */
+	relayed := make(chan relayedConn)
+	var relayTimer <-chan time.Time
+	if len(relayAddress) > 0 {
+		relayTimer = time.After(RELAY_AFTER)
+	}
+
 	for len(frontNodes) > 0 {
 		/*
 		 * when a node first connects to other nodes, it will first
 		 * send it's DNS name so that another node can know it's name
 		 **/
-		conn, _ := ln.Accept()
-		msg := &Message{}
-		dec := gob.NewDecoder(conn)
-		err := dec.Decode(msg)
-		if err != nil {
+		var conn net.Conn
+		relayedFrom := ""
+		select {
+		case conn = <-accepted:
+		case relayedConn := <-relayed:
+			conn, relayedFrom = relayedConn.conn, relayedConn.name
+		case <-relayTimer:
+			for name := range frontNodes {
+				go acceptRelayedFrom(name, relayed, done)
+			}
 			continue
 		}
-		// remove the connected node from the frontNodes
-		delete(frontNodes, msg.Source)
-		addConnection(msg.Source, conn)
+		if !acceptLink(conn, frontNodes) && len(relayedFrom) > 0 {
+			if _, missing := frontNodes[relayedFrom]; missing {
+				go acceptRelayedFrom(relayedFrom, relayed, done)
+			}
+		}
+	}
 
+	/* the port stays open for players coming back and spectators, see rejoin.go and watch.go */
+	go serveWatchers(accepted)
+}
+
+/*
+ * accepts connections until done is closed, a nil done never is
+ */
+func acceptConns(ln net.Listener, accepted chan<- net.Conn, done <-chan struct{}) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		select {
+		case accepted <- conn:
+		case <-done:
+			conn.Close()
+			return
+		}
 	}
 }
 
+/*
+ * runs the handshake on an accepted connection and checks who it is from
+ * @return	true if the connection was added as a link
+ **/
+func acceptLink(conn net.Conn, frontNodes map[string]Node) bool {
+	link, err := acceptHandshake(conn)
+	if err != nil {
+		fmt.Printf("Handshake with %v failed: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return false
+	}
+	msg := &Message{}
+	*msg, err = link.readMessage()
+	if err != nil {
+		conn.Close()
+		return false
+	}
+	/* don't take the claimed name on trust */
+	if _, expected := frontNodes[msg.Source]; !expected {
+		fmt.Printf("Rejecting connection from unexpected node: %s\n", msg.Source)
+		conn.Close()
+		return false
+	}
+	if err := verifyMessage(msg); err != nil {
+		fmt.Printf("Rejecting connection from %v: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return false
+	}
+	// remove the connected node from the frontNodes
+	delete(frontNodes, msg.Source)
+	addLink(msg.Source, link)
+	return true
+}
+
 /*
  * send connections to nodes with greater Names
  * and stores connections into connections map
@@ -335,29 +386,74 @@ func acceptConnection(frontNodes map[string]Node) {
 func sendConnection(latterNodes map[string]Node) {
 	defer wg.Done()
 	for _, node := range latterNodes {
-		conn, err := net.Dial("tcp", node.IP+":"+strconv.Itoa(node.Port))
+		started := time.Now()
+		link, err := dialLink(node)
 		for err != nil {
 			fmt.Print(".")
+			/* fall back on the relay once the direct connection keeps failing */
+			if len(relayAddress) > 0 && node.Name != LocalNode.Name && time.Since(started) >= RELAY_AFTER {
+				if link, err = relayedLink(node); err == nil {
+					fmt.Printf("Connected to %s through the relay\n", node.Name)
+					break
+				}
+			}
 			time.Sleep(time.Second * 1)
-			conn, err = net.Dial("tcp", node.IP+":"+strconv.Itoa(node.Port))
+			link, err = dialLink(node)
 		}
 		if node.Name == LocalNode.Name {
-			localConn = conn
-			localEncoder = gob.NewEncoder(conn)
+			link.name = node.Name
+			localLink = link
 		} else {
-			addConnection(node.Name, conn)
+			addLink(node.Name, link)
 		}
 
 		/* send an initial ping message to other side of the connection */
 		timestampMutex.Lock()
-		msg := Message{LocalNode.Name, node.Name, "ping", "ping", 0, vectorTimeStamp}
+		msg := Message{Source: LocalNode.Name, Destination: node.Name, Content: "ping", Kind: "ping", Timestamp: vectorTimeStamp}
 		timestampMutex.Unlock()
-		encoder := gob.NewEncoder(conn)
-		encoder.Encode(msg)
+		signMessage(&msg)
+		link.writeMessage(&msg)
 	}
 	fmt.Println()
 }
 
+/*
+ * dials a node and runs the wire protocol handshake
+ * @param	node – the node to connect to
+ **/
+func dialLink(node Node) (*peerLink, error) {
+	conn, err := dialNode(node)
+	if err != nil {
+		return nil, err
+	}
+	return handshakeLink(conn, node)
+}
+
+/*
+ * connects to a node through the relay
+ * @param	node – the node to connect to
+ **/
+func relayedLink(node Node) (*peerLink, error) {
+	conn, err := dialRelayed(LocalNode.Name, node.Name)
+	if err != nil {
+		return nil, err
+	}
+	return handshakeLink(conn, node)
+}
+
+/*
+ * runs the wire protocol handshake on a connection we opened
+ */
+func handshakeLink(conn net.Conn, node Node) (*peerLink, error) {
+	link, err := dialHandshake(conn)
+	if err != nil {
+		fmt.Printf("Handshake with %v failed: %v\n", node.Name, err)
+		conn.Close()
+		return nil, err
+	}
+	return link, nil
+}
+
 /*
  * put message to receiveQueue, since the chan <- maybe blocked if the channel is full,
  * in order to not block the void receiveMessageFromConn(conn) method, we creates a new routine
@@ -366,39 +462,88 @@ func sendConnection(latterNodes map[string]Node) {
  *			the message to be put into receiveQueue
  **/
 func addMessageToReceiveChannel(message Message) {
-	if message.Source == LocalNode.Name && message.Destination == defs.MULTICAST_DEST {
-		localReceivedSeqNum += 1
-	} else {
+	/* direct messages are counted apart, see causal.go */
+	if message.Destination == defs.MULTICAST_DEST {
+		sourceIndex, _, _ := FindNodeByName(PeerNodes, message.Source)
 		timestampMutex.Lock()
-		UpdateTimestamp(&vectorTimeStamp, &message.Timestamp)
+		if message.Source == LocalNode.Name {
+			localReceivedSeqNum += 1
+		} else {
+			UpdateTimestamp(&vectorTimeStamp, &message.Timestamp)
+		}
+		mergeDirectClock(message, sourceIndex)
 		timestampMutex.Unlock()
+		// spectators see the multicasts in the order we deliver them
+		feedWatchers(message)
 	}
 	receiveChannel <- message
 }
 
 /*
- * receive message from TCP connection, and put it into receivedQueue of message
- * @param	conn
- *			TCP connection
+ * tells the UI that we've lost a node
+ * @param	name – the node we lost
+ **/
+func reportLostNode(name string) {
+	content, _ := payload.Encode(&payload.Name{Name: name})
+	Multicast(&Message{
+		Source:      LocalNode.Name,
+		Destination: defs.MULTICAST_DEST,
+		Content:     content,
+		Kind:        defs.MSG_DEAD_NODE,
+	})
+}
+
+/*
+ * receive message from a peer's link, and put it into receivedQueue of message
+ * @param	link
+ *			framed connection to the peer
  **/
-func receiveMessageFromConn(conn net.Conn) {
-	defer conn.Close()
+func receiveMessageFromConn(link *peerLink) {
+	defer link.conn.Close()
 	for {
-		msg, err := receiveMessageTCP(conn)
+		msg, err := link.readMessage()
 		// fmt.Printf("holdbackQueue size: %v\n", len(holdbackQueue))
 		if err != nil {
-			name, _ := getConnectionName(conn)
-			if err.Error() == "EOF" {
-				// tell the UI that we've lost a node
-				Multicast(&Message{
-					Source:      LocalNode.Name,
-					Destination: defs.MULTICAST_DEST,
-					Content:     name,
-					Kind:        defs.MSG_DEAD_NODE,
-				})
-				break
-			} else {
-				fmt.Printf("Error from connection:%v, Error:%v\n", name, err.Error())
+			if _, isDecodeError := err.(decodeError); isDecodeError {
+				fmt.Printf("Error from connection:%v, Error:%v\n", link.name, err.Error())
+				continue
+			}
+			if err != io.EOF {
+				fmt.Printf("Lost connection:%v, Error:%v\n", link.name, err.Error())
+			}
+			// nobody is left to receive our large messages
+			link.cancelTransfers()
+			// a link replaced by a player coming back isn't a lost node, see rejoin.go
+			if current, _ := getLink(link.name); current == link {
+				reportLostNode(link.name)
+			}
+			break
+		}
+
+		/* forged or tampered messages never reach the rules or the application */
+		if err := verifyMessage(&msg); err != nil {
+			fmt.Printf("REJECTING Message from connection %v: %v\n", link.name, err)
+			continue
+		}
+
+		/* echoes of a message we have are dropped before they count against its sender */
+		if msg.ID != 0 && receivedIDs.seenBefore(msg.UniqueID()) {
+			continue
+		}
+
+		/* a flooding node is throttled before its messages are re-multicast */
+		if msg.Source != LocalNode.Name {
+			policy, wait := receiveLimiter.take(msg.Source, msg.Kind)
+			if policy == RATE_LIMIT_DROP {
+				continue
+			} else if policy == RATE_LIMIT_DELAY {
+				time.Sleep(wait)
+			} else if policy == RATE_LIMIT_DISCONNECT {
+				/* a peer passing on someone else's flood isn't to blame for it */
+				if link.name == msg.Source {
+					/* the next read fails and the flooder is reported dead */
+					link.conn.Close()
+				}
 				continue
 			}
 		}
@@ -436,12 +581,22 @@ func receiveMessageFromConn(conn net.Conn) {
  * messages that might be ready now.
  */
 func deliverMessage(message Message) {
+	if message.ID != 0 && !receivedIDs.firstSeen(message.UniqueID()) {
+		return
+	}
 	if message.Destination == defs.MULTICAST_DEST {
-		if messageHasBeenReceived(message) {
+		/* without an ID, the echoes of the message can't be recognized */
+		if message.ID == 0 {
+			fmt.Printf("DROPPING multicast Message without ID: %+v\n", message)
 			return
 		}
 		sourceIndex, _, _ := FindNodeByName(PeerNodes, message.Source)
 		timestampMutex.Lock()
+		if countedAtRejoin(message, sourceIndex) {
+			// we came back after it, see rejoin.go
+			timestampMutex.Unlock()
+			return
+		}
 		if isMessageReady(message, sourceIndex, &vectorTimeStamp) {
 			timestampMutex.Unlock()
 			addMessageToReceiveChannel(message)
@@ -463,15 +618,19 @@ func deliverMessage(message Message) {
 			}
 			holdbackQueueMutex.Unlock()
 		}
+		checkDirectHoldbackQueue()
 		/* Once a message has been inspected locally, check to see if it should be
 		 * re-multicasted to other nodes
 		 */
 		if message.Source != LocalNode.Name {
-			go Multicast(&message)
+			linkRoutines.Add(1)
+			go func() {
+				defer linkRoutines.Done()
+				Multicast(&message)
+			}()
 		}
 	} else {
-		// TODO: Handle direct messages with wrong order
-		addMessageToReceiveChannel(message)
+		deliverDirectMessage(message)
 	}
 
 }
@@ -506,9 +665,22 @@ func checkHoldbackQueue() {
  * is that each routine waits in a infinite loop which makes code inefficient.
  **/
 func startReceiveRoutines() {
-	for _, conn := range connections {
-		go receiveMessageFromConn(conn)
+	mapsMutex.Lock()
+	for _, link := range links {
+		startReceiving(link)
 	}
+	mapsMutex.Unlock()
+}
+
+/*
+ * starts the routine receiving the messages of a link
+ */
+func startReceiving(link *peerLink) {
+	linkRoutines.Add(1)
+	go func() {
+		defer linkRoutines.Done()
+		receiveMessageFromConn(link)
+	}()
 }
 
 /*
@@ -560,8 +732,13 @@ func Send(message Message) {
 	} else if message.Destination == defs.MULTICAST_DEST {
 		Multicast(&message)
 	} else {
-		if _, ok := connections[message.Destination]; ok {
+		if _, ok := getLink(message.Destination); ok {
 			updateSeqNum(&message)
+			if message.Source == LocalNode.Name {
+				stampMessageID(&message)
+				stampDirectMessage(&message)
+				signMessage(&message)
+			}
 			go putMessageToSendChannel(message)
 		} else {
 			fmt.Printf("Message's destination %s is not found, it is dropped!\n", message.Destination)
@@ -605,22 +782,7 @@ func printNodesName(nodes []Node) {
  * initialize MessagePasser, this is a public method
  **/
 func InitMessagePasser(nodes Nodes, localName string) {
-	PeerNodes = nodes
-	sort.Sort(PeerNodes)
-	var err error
-	LocalIndex, LocalNode, err = FindNodeByName(PeerNodes, localName)
-	if err != nil {
-		panic(err)
-	}
-
-	initRules()
-
-	// keep track of group seqNum for multicasting
-	mapsMutex.Lock()
-	seqNums[localName] = 0
-	mapsMutex.Unlock()
-	// initialize the vectorTimeStamp
-	vectorTimeStamp = make([]int, len(PeerNodes))
+	initGroup(nodes, localName)
 
 	// separate Node names
 	frontNodes, latterNodes := getFrontAndLatterNodes(PeerNodes)
@@ -639,3 +801,31 @@ func InitMessagePasser(nodes Nodes, localName string) {
 	// start routine to send message
 	go sendMessageToConn()
 }
+
+/*
+ * sets up the group and the local node's state before connecting
+ **/
+func initGroup(nodes Nodes, localName string) {
+	PeerNodes = SignedNodes(nodes)
+	sort.Sort(PeerNodes)
+	var err error
+	LocalIndex, LocalNode, err = FindNodeByName(PeerNodes, localName)
+	if err != nil {
+		panic(err)
+	}
+
+	initRules()
+	initRateLimits()
+
+	// authenticate every message once we sign ours, keyless peers were left out
+	authRequired = localPrivateKey != nil
+
+	// keep track of group seqNum for multicasting
+	mapsMutex.Lock()
+	seqNums[localName] = 0
+	mapsMutex.Unlock()
+	// initialize the vectorTimeStamp
+	vectorTimeStamp = make([]int, len(PeerNodes))
+	resetDirectClock()
+	rejoinedAt = nil
+}
@@ -4,7 +4,7 @@ import "testing"
 
 func TestIsMessageReady(t *testing.T) {
 	timestamp := []int{1, 2, 3}
-	message := Message{"", "", "", "", 0, []int{1, 3, 4}}
+	message := Message{Timestamp: []int{1, 3, 4}}
 	sourceIndex := 1
 	t.Log("Testing timestamp with 1 incremented value...")
 	message.Timestamp = []int{1, 3, 3}
@@ -48,3 +48,29 @@ func TestIsMessageReady(t *testing.T) {
 			message.Timestamp, timestamp)
 	}
 }
+
+/*
+ * closes the port and every link, and waits for the routines reading the
+ * links to exit, so a test can reset the globals they use
+ */
+func closeLinks() {
+	mapsMutex.Lock()
+	closing := []*peerLink{}
+	for name, link := range links {
+		closing = append(closing, link)
+		delete(links, name)
+	}
+	if localLink != nil {
+		closing = append(closing, localLink)
+	}
+	ln := listener
+	listener = nil
+	mapsMutex.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+	for _, link := range closing {
+		link.conn.Close()
+	}
+	linkRoutines.Wait()
+}
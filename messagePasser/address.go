@@ -0,0 +1,95 @@
+////////////////////////////////////////////////////////////
+//Multegula - address.go
+//Addresses a node can be reached at
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/arminm/multegula/tlsTransport"
+)
+
+/*
+ * A node can be reached at IP:Port, as seen by the bootstrap server, and
+ * at the candidates in Addrs, which the node finds on its own interfaces
+ * so that players behind the same NAT or on IPv6 can reach each other
+ * directly. Addresses are "host:port" strings, IPv6 hosts in brackets.
+ */
+const DIAL_TIMEOUT = 3 * time.Second
+
+/*
+ * the addresses to try for a node, in order and without duplicates
+ */
+func (node Node) Addresses() []string {
+	addresses := []string{}
+	seen := make(map[string]bool)
+	candidates := node.Addrs
+	if len(node.IP) > 0 {
+		candidates = append([]string{net.JoinHostPort(node.IP, strconv.Itoa(node.Port))}, candidates...)
+	}
+	for _, address := range candidates {
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+/*
+ * the address to listen on for a port, on every interface, IPv4 and IPv6
+ */
+func ListenAddress(port int) string {
+	return net.JoinHostPort("", strconv.Itoa(port))
+}
+
+/*
+ * finds the addresses of the local interfaces, to advertise in Node.Addrs
+ * @param	port – the port the node listens on
+ * @return	global and private unicast addresses. Loopback addresses are
+ *			left out, the bootstrap server sees those, and so are link-local
+ *			ones which only work with an interface name.
+ **/
+func LocalAddresses(port int) []string {
+	addresses := []string{}
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		fmt.Println("Couldn't list local addresses:", err)
+		return addresses
+	}
+	for _, interfaceAddr := range interfaceAddrs {
+		ipNet, ok := interfaceAddr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(port)))
+	}
+	return addresses
+}
+
+/*
+ * connects to the first address of a node that answers
+ * @param	node – the node to connect to
+ **/
+func dialNode(node Node) (net.Conn, error) {
+	addresses := node.Addresses()
+	if len(addresses) == 0 {
+		return nil, errors.New("No address for node " + node.Name)
+	}
+	var lastErr error
+	for _, address := range addresses {
+		conn, err := tlsTransport.DialTimeout(address, DIAL_TIMEOUT)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,82 @@
+package messagePasser
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestNodeAddresses(t *testing.T) {
+	node := Node{Name: "armin", IP: "2001:db8::7", Port: 11111,
+		Addrs: []string{"192.168.1.4:11111", "[2001:db8::7]:11111", "10.0.0.2:11111"}}
+	expected := []string{"[2001:db8::7]:11111", "192.168.1.4:11111", "10.0.0.2:11111"}
+	addresses := node.Addresses()
+	if len(addresses) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, addresses)
+	}
+	for i := range expected {
+		if addresses[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, addresses)
+		}
+	}
+	if addresses := (Node{Name: "lunwen", Addrs: []string{"10.0.0.3:1"}}).Addresses(); len(addresses) != 1 {
+		t.Errorf("A node without IP should only have its candidates: %v", addresses)
+	}
+}
+
+func TestLocalAddressesCanBeSplit(t *testing.T) {
+	for _, address := range LocalAddresses(11111) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || port != "11111" || net.ParseIP(host) == nil {
+			t.Errorf("Bad local address %q: %v", address, err)
+		}
+	}
+}
+
+/* a port nobody listens on */
+func closedAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	return address
+}
+
+func TestDialNodeTriesCandidatesInOrder(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	node := Node{Name: "lunwen", Addrs: []string{closedAddress(t), ln.Addr().String()}}
+	conn, err := dialNode(node)
+	if err != nil {
+		t.Fatalf("Should have reached the second address: %v", err)
+	}
+	conn.Close()
+
+	if _, err := dialNode(Node{Name: "lunwen", Addrs: []string{closedAddress(t)}}); err == nil {
+		t.Errorf("Dialing a node with no reachable address should fail.")
+	}
+}
+
+func TestDialNodeOverIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", ListenAddress(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	if probe, err := net.Dial("tcp", net.JoinHostPort("::1", strconv.Itoa(port))); err != nil {
+		t.Skip("No IPv6 loopback:", err)
+	} else {
+		probe.Close()
+	}
+	conn, err := dialNode(Node{Name: "lunwen", IP: "::1", Port: port})
+	if err != nil {
+		t.Fatalf("Couldn't dial over IPv6: %v", err)
+	}
+	conn.Close()
+}
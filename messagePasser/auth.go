@@ -0,0 +1,210 @@
+////////////////////////////////////////////////////////////
+//Multegula - auth.go
+//Message authentication for the Message Passer
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+ * every player generates its own signing key pair when it starts. The public
+ * half travels inside the player's Node to the bootstrap server, which hands
+ * it out to the rest of the group along with the peer list. Every message is
+ * signed by the node that created it, so re-multicasted messages can still be
+ * traced back to their original Source.
+ */
+var localPrivateKey ed25519.PrivateKey
+
+/*
+ * set in InitMessagePasser when we sign our own messages, then peers
+ * without a key are left out of the group, see SignedNodes. Only a node
+ * started without a key (e.g. in the hard-coded test groups) skips
+ * authentication.
+ */
+var authRequired bool
+
+/*
+ * generates the local signing key pair
+ * @return	the public key to be advertised in the local Node
+ **/
+func GenerateLocalKey() (string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	localPrivateKey = privateKey
+	return base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+/*
+ * the local private key, for a player to keep and come back to its game
+ * with, see rejoin.go
+ * @return	the base64 private key, "" if there is none
+ **/
+func LocalKey() string {
+	if localPrivateKey == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(localPrivateKey)
+}
+
+/*
+ * signs with a private key LocalKey gave out earlier, instead of
+ * generating a new one
+ * @param	privateKey – the base64 private key
+ *
+ * @return	the public key to be advertised in the local Node
+ **/
+func SetLocalKey(privateKey string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return "", fmt.Errorf("Bad private key length: %d", len(key))
+	}
+	localPrivateKey = ed25519.PrivateKey(key)
+	return base64.StdEncoding.EncodeToString(localPrivateKey.Public().(ed25519.PublicKey)), nil
+}
+
+/*
+ * builds the bytes covered by a message's signature. Every field is length
+ * prefixed so that moving bytes between fields changes the digest.
+ **/
+func messageDigest(message *Message) []byte {
+	var buf bytes.Buffer
+	for _, field := range []string{message.Source, message.Destination, message.Content, message.Kind} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	binary.Write(&buf, binary.BigEndian, int64(message.SeqNum))
+	binary.Write(&buf, binary.BigEndian, uint32(len(message.Timestamp)))
+	for _, value := range message.Timestamp {
+		binary.Write(&buf, binary.BigEndian, int64(value))
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(len(message.DirectClock)))
+	for _, value := range message.DirectClock {
+		binary.Write(&buf, binary.BigEndian, int64(value))
+	}
+	binary.Write(&buf, binary.BigEndian, message.ID)
+	binary.Write(&buf, binary.BigEndian, int64(message.CorrelationID))
+	binary.Write(&buf, binary.BigEndian, message.IsReply)
+	return buf.Bytes()
+}
+
+/*
+ * signs a message created by the local node
+ * @param	message – message to be signed
+ **/
+func signMessage(message *Message) {
+	if localPrivateKey == nil {
+		return
+	}
+	message.Signature = ed25519.Sign(localPrivateKey, messageDigest(message))
+}
+
+/*
+ * signs something other than a message with the local key, such as the
+ * report of a game
+ * @return	the signature, nil if there is no local key
+ **/
+func Sign(data []byte) []byte {
+	if localPrivateKey == nil {
+		return nil
+	}
+	return ed25519.Sign(localPrivateKey, data)
+}
+
+/*
+ * checks a signature Sign made on a node
+ * @return	nil if the node's key signed the data
+ **/
+func VerifySignature(node Node, data []byte, signature []byte) error {
+	key, err := nodePublicKey(node)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return errors.New("Bad signature from " + node.Name)
+	}
+	return nil
+}
+
+/*
+ * decodes a node's advertised public key
+ **/
+func nodePublicKey(node Node) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(node.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Bad key length for %s: %d", node.Name, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+/*
+ * checks that a message was signed by the node named in its Source
+ * @param	message – message to be verified
+ *
+ * @return	nil if the message is authentic or authentication is disabled
+ **/
+func verifyMessage(message *Message) error {
+	if !authRequired {
+		return nil
+	}
+	_, node, err := FindNodeByName(PeerNodes, message.Source)
+	if err != nil {
+		return err
+	}
+	key, err := nodePublicKey(node)
+	if err != nil {
+		return err
+	}
+	if len(message.Signature) == 0 {
+		return errors.New("Unsigned message from " + message.Source)
+	}
+	if !ed25519.Verify(key, messageDigest(message), message.Signature) {
+		return errors.New("Bad signature on message from " + message.Source)
+	}
+	return nil
+}
+
+/*
+ * the nodes of a group that can be authenticated, this is a public method.
+ * When we sign our messages every peer has to, a peer without a key could
+ * say anything and is left out; without a local key all nodes are kept.
+ * @param	nodes – the group, the local node included
+ **/
+func SignedNodes(nodes []Node) Nodes {
+	if localPrivateKey == nil {
+		return append(Nodes{}, nodes...)
+	}
+	return keyedNodes(nodes)
+}
+
+/*
+ * the nodes that advertised a key
+ */
+func keyedNodes(nodes []Node) Nodes {
+	keyed := Nodes{}
+	for _, node := range nodes {
+		if len(node.Key) == 0 {
+			fmt.Printf("Leaving %s out of the group, it has no key to check its messages with\n", node.Name)
+			continue
+		}
+		keyed = append(keyed, node)
+	}
+	return keyed
+}
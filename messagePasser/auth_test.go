@@ -0,0 +1,80 @@
+package messagePasser
+
+import "testing"
+
+func setupAuthNodes(t *testing.T) {
+	key, err := GenerateLocalKey()
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+	PeerNodes = Nodes{Node{Name: "armin", Key: key}, Node{Name: "lunwen", Key: key}}
+	authRequired = true
+}
+
+func TestVerifySignedMessage(t *testing.T) {
+	setupAuthNodes(t)
+	message := Message{Source: "armin", Destination: "lunwen", Content: "hi", Kind: "MPD", SeqNum: 3, Timestamp: []int{1, 2}}
+	signMessage(&message)
+	if err := verifyMessage(&message); err != nil {
+		t.Errorf("Signed message should verify: %v", err)
+	}
+}
+
+func TestVerifyTamperedMessage(t *testing.T) {
+	setupAuthNodes(t)
+	message := Message{Source: "armin", Destination: "lunwen", Content: "hi", Kind: "MPD", SeqNum: 3, Timestamp: []int{1, 2}}
+	signMessage(&message)
+
+	tampered := message
+	tampered.Content = "bye"
+	if verifyMessage(&tampered) == nil {
+		t.Errorf("Tampered content should not verify.")
+	}
+
+	tampered = message
+	tampered.Timestamp = []int{1, 3}
+	if verifyMessage(&tampered) == nil {
+		t.Errorf("Tampered timestamp should not verify.")
+	}
+}
+
+func TestVerifySpoofedSource(t *testing.T) {
+	setupAuthNodes(t)
+	// lunwen's key is replaced, so armin's signature can't pass for lunwen's
+	otherKey, _ := GenerateLocalKey()
+	PeerNodes[1].Key = otherKey
+	message := Message{Source: "lunwen", Destination: "armin", Content: "MUU", Kind: "MUU"}
+	signMessage(&message)
+	PeerNodes[0].Key, _ = GenerateLocalKey()
+	if verifyMessage(&message) != nil {
+		t.Errorf("lunwen's own message should verify.")
+	}
+	message.Source = "armin"
+	if verifyMessage(&message) == nil {
+		t.Errorf("Message with spoofed source should not verify.")
+	}
+
+	unsigned := Message{Source: "armin", Destination: "lunwen", Content: "hi", Kind: "MPD"}
+	if verifyMessage(&unsigned) == nil {
+		t.Errorf("Unsigned message should not verify.")
+	}
+
+	unknown := Message{Source: "mallory", Destination: "lunwen", Content: "hi", Kind: "MPD"}
+	signMessage(&unknown)
+	if verifyMessage(&unknown) == nil {
+		t.Errorf("Message from unknown node should not verify.")
+	}
+}
+
+func TestKeylessPeersAreLeftOut(t *testing.T) {
+	key, _ := GenerateLocalKey()
+	group := Nodes{Node{Name: "armin", Key: key}, Node{Name: "mallory"}, Node{Name: "lunwen", Key: key}}
+	if signed := SignedNodes(group); len(signed) != 2 || signed[0].Name != "armin" || signed[1].Name != "lunwen" {
+		t.Errorf("A peer without a key should be left out, got %+v", signed)
+	}
+	localPrivateKey = nil
+	defer GenerateLocalKey()
+	if signed := SignedNodes(group); len(signed) != 3 {
+		t.Errorf("Without a local key every node should be kept, got %+v", signed)
+	}
+}
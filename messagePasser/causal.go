@@ -0,0 +1,274 @@
+////////////////////////////////////////////////////////////
+//Multegula - causal.go
+//Causal delivery of direct messages
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/*
+ * With causal delivery on, a direct message carries a copy of the
+ * sender's vectorTimeStamp, i.e. the multicasts the sender had delivered
+ * when it sent the message. The receiver holds the message back until it
+ * has delivered those multicasts too, so a reply never overtakes the
+ * multicast it answers.
+ *
+ * Direct messages are counted on a clock of their own, as only their
+ * receiver ever sees them: directClock holds, for every sender and
+ * receiver, how many direct messages between the two happened before
+ * now. Every message, direct or multicast, carries a copy of it in
+ * DirectClock. A message is held back until every direct message to us
+ * that happened before it has been delivered, so a multicast never
+ * overtakes a direct message its sender sent first, and direct messages
+ * from one sender arrive in order. A message without a timestamp (from a
+ * node with the option off) is delivered right away, so nodes don't have
+ * to agree on the option.
+ *
+ * A direct message that was counted but never arrives, dropped by a rule,
+ * a rate limit or a link that went down, would hold back everything its
+ * sender sends after it. Once one has been missing for DIRECT_WAIT, the
+ * next message waiting for it gives up on it, and it is delivered
+ * whenever it turns up after all.
+ */
+const DIRECT_WAIT = 2 * time.Second
+
+var causalDirect bool = false
+
+/*
+ * directClock[sender*len(PeerNodes)+receiver], the direct messages from
+ * sender to receiver that we know happened; directDelivered[sender], the
+ * ones from sender delivered here; directMissingSince[sender], since when
+ * a message has been waiting for one from sender, zero if none is. All
+ * are guarded by timestampMutex.
+ */
+var directClock []int
+var directDelivered []int
+var directMissingSince []time.Time
+
+/* direct messages waiting for multicasts they depend on */
+var directHoldbackQueue []Message = []Message{}
+var directHoldbackMutex = &sync.Mutex{}
+
+/*
+ * turns causal delivery of direct messages on or off, this is a public
+ * method and has to be called before InitMessagePasser
+ * @param	enabled – stamp and order direct messages
+ **/
+func SetCausalDirect(enabled bool) {
+	causalDirect = enabled
+}
+
+/*
+ * sizes the direct message clock for the group, clearing it if the group
+ * changed. Must be called with timestampMutex held.
+ */
+func resetDirectClock() {
+	if len(directClock) != len(PeerNodes)*len(PeerNodes) || len(directDelivered) != len(PeerNodes) ||
+		len(directMissingSince) != len(PeerNodes) {
+		directClock = make([]int, len(PeerNodes)*len(PeerNodes))
+		directDelivered = make([]int, len(PeerNodes))
+		directMissingSince = make([]time.Time, len(PeerNodes))
+	}
+}
+
+/*
+ * stamps a direct message created by the local node, counting it as sent
+ */
+func stampDirectMessage(message *Message) {
+	if !causalDirect {
+		return
+	}
+	destination, _, err := FindNodeByName(PeerNodes, message.Destination)
+	timestampMutex.Lock()
+	message.Timestamp = make([]int, len(vectorTimeStamp))
+	copy(message.Timestamp, vectorTimeStamp)
+	resetDirectClock()
+	if err == nil && LocalIndex >= 0 {
+		directClock[LocalIndex*len(PeerNodes)+destination] += 1
+	}
+	message.DirectClock = make([]int, len(directClock))
+	copy(message.DirectClock, directClock)
+	timestampMutex.Unlock()
+}
+
+/*
+ * stamps a multicast created by the local node with the direct messages
+ * that happened before it. Must be called with timestampMutex held.
+ */
+func stampMulticastDirectClock(message *Message) {
+	if !causalDirect {
+		return
+	}
+	resetDirectClock()
+	message.DirectClock = make([]int, len(directClock))
+	copy(message.DirectClock, directClock)
+}
+
+/*
+ * checks that every direct message to us that happened before a message
+ * has been delivered, giving up on those missing for DIRECT_WAIT. Must be
+ * called with timestampMutex held.
+ * @param	message – a direct message or a multicast
+ * @param	sourceIndex – the index of the message's Source
+ *
+ * @return	true if the message doesn't have to wait for a direct message
+ **/
+func directMessagesDelivered(message Message, sourceIndex int) bool {
+	size := len(directDelivered)
+	if size == 0 || len(message.DirectClock) != size*size || LocalIndex < 0 || LocalIndex >= size {
+		return true
+	}
+	ready := true
+	for sender := 0; sender < size; sender++ {
+		before := message.DirectClock[sender*size+LocalIndex]
+		if message.Destination != defs.MULTICAST_DEST && sender == sourceIndex {
+			/* the message itself is the sender's next one to us */
+			before -= 1
+		}
+		if before <= directDelivered[sender] {
+			continue
+		}
+		if directMissingSince[sender].IsZero() {
+			directMissingSince[sender] = time.Now()
+		} else if time.Since(directMissingSince[sender]) >= DIRECT_WAIT {
+			fmt.Printf("Giving up on %d direct messages from %s\n", before-directDelivered[sender], PeerNodes[sender].Name)
+			directDelivered[sender] = before
+			directMissingSince[sender] = time.Time{}
+			continue
+		}
+		ready = false
+	}
+	return ready
+}
+
+/*
+ * learns the direct messages that happened before a delivered message,
+ * counting it as delivered if it is a direct one. Must be called with
+ * timestampMutex held.
+ */
+func mergeDirectClock(message Message, sourceIndex int) {
+	size := len(directDelivered)
+	if size == 0 || len(message.DirectClock) != size*size || LocalIndex < 0 || LocalIndex >= size {
+		return
+	}
+	for i, value := range message.DirectClock {
+		if value > directClock[i] {
+			directClock[i] = value
+		}
+	}
+	if message.Destination != defs.MULTICAST_DEST && sourceIndex >= 0 && sourceIndex < size {
+		if sent := message.DirectClock[sourceIndex*size+LocalIndex]; sent > directDelivered[sourceIndex] {
+			directDelivered[sourceIndex] = sent
+			directMissingSince[sourceIndex] = time.Time{}
+		}
+	}
+}
+
+/*
+ * a direct message is ready once every multicast its sender had
+ * delivered has been delivered here. Our own multicasts are delivered
+ * by definition, so the local index is skipped.
+ */
+func isDirectMessageReady(message Message, localTimeStamp *[]int) bool {
+	if len(message.Timestamp) != len(*localTimeStamp) {
+		return true
+	}
+	for i, val := range message.Timestamp {
+		if i != LocalIndex && val > (*localTimeStamp)[i] {
+			return false
+		}
+	}
+	sourceIndex, _, _ := FindNodeByName(PeerNodes, message.Source)
+	return directMessagesDelivered(message, sourceIndex)
+}
+
+/*
+ * delivers a direct message, or holds it back until it is ready
+ */
+func deliverDirectMessage(message Message) {
+	if causalDirect {
+		timestampMutex.Lock()
+		ready := isDirectMessageReady(message, &vectorTimeStamp)
+		timestampMutex.Unlock()
+		if !ready {
+			directHoldbackMutex.Lock()
+			Push(&directHoldbackQueue, message)
+			overflow := len(directHoldbackQueue) > defs.HOLDBACKQUEUE_LIMIT
+			directHoldbackMutex.Unlock()
+			if overflow {
+				fmt.Println("Flushing direct holdbackQueue!")
+				flushDirectHoldbackQueue()
+			}
+			return
+		}
+	}
+	releaseDirectMessage(message)
+	if causalDirect {
+		// multicasts and direct messages may have waited for this one
+		checkHoldbackQueue()
+		checkDirectHoldbackQueue()
+	}
+}
+
+/*
+ * hands a direct message that is ready to Call or the application
+ */
+func releaseDirectMessage(message Message) {
+	sourceIndex, _, _ := FindNodeByName(PeerNodes, message.Source)
+	timestampMutex.Lock()
+	mergeDirectClock(message, sourceIndex)
+	timestampMutex.Unlock()
+	if !handleCallMessage(message) {
+		addMessageToReceiveChannel(message)
+	}
+}
+
+/*
+ * delivers the held back direct messages that became ready, called after
+ * every delivery
+ */
+func checkDirectHoldbackQueue() {
+	for {
+		var ready *Message
+		directHoldbackMutex.Lock()
+		timestampMutex.Lock()
+		for i := range directHoldbackQueue {
+			if isDirectMessageReady(directHoldbackQueue[i], &vectorTimeStamp) {
+				message := directHoldbackQueue[i]
+				ready = &message
+				Delete(&directHoldbackQueue, i)
+				break
+			}
+		}
+		timestampMutex.Unlock()
+		directHoldbackMutex.Unlock()
+		if ready == nil {
+			return
+		}
+		/* one at a time, the next may have waited for this one */
+		releaseDirectMessage(*ready)
+		checkHoldbackQueue()
+	}
+}
+
+/*
+ * gives up on the missing multicasts and delivers everything held back,
+ * in the order it arrived
+ */
+func flushDirectHoldbackQueue() {
+	directHoldbackMutex.Lock()
+	held := directHoldbackQueue
+	directHoldbackQueue = []Message{}
+	directHoldbackMutex.Unlock()
+	for _, message := range held {
+		releaseDirectMessage(message)
+	}
+}
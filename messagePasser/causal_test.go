@@ -0,0 +1,162 @@
+package messagePasser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/defs"
+)
+
+func TestIsDirectMessageReady(t *testing.T) {
+	LocalIndex = 0
+	timestamp := []int{5, 2, 3}
+	cases := []struct {
+		stamp []int
+		ready bool
+	}{
+		{[]int{5, 2, 3}, true},
+		{[]int{0, 1, 0}, true},
+		{[]int{9, 2, 3}, true}, // our own multicasts are always delivered here
+		{[]int{5, 3, 3}, false},
+		{[]int{5, 2, 4}, false},
+		{nil, true}, // sender doesn't order its direct messages
+	}
+	for _, c := range cases {
+		message := Message{Timestamp: c.stamp}
+		if isDirectMessageReady(message, &timestamp) != c.ready {
+			t.Errorf("Message stamped %v should have ready=%v at %v", c.stamp, c.ready, timestamp)
+		}
+	}
+}
+
+func receiveWithin(t *testing.T, timeout time.Duration) (Message, bool) {
+	select {
+	case message := <-receiveChannel:
+		return message, true
+	case <-time.After(timeout):
+		return Message{}, false
+	}
+}
+
+func TestDirectMessageWaitsForMulticast(t *testing.T) {
+	// turned off once the loopback is closed
+	t.Cleanup(func() { SetCausalDirect(false) })
+	setupLoopback(t)
+	PeerNodes = Nodes{LocalNode, Node{Name: "lunwen"}}
+	vectorTimeStamp = []int{0, 0}
+	SetCausalDirect(true)
+
+	/* lunwen multicast a proposal, then answered us directly */
+	proposal := Message{Source: "lunwen", Destination: defs.MULTICAST_DEST, Kind: "TEST_PROPOSAL",
+		Timestamp: []int{0, 1}}
+	stampMessageID(&proposal)
+	reply := Message{Source: "lunwen", Destination: "armin", Kind: "TEST_REPLY",
+		Timestamp: []int{0, 1}}
+	stampMessageID(&reply)
+
+	deliverMessage(reply)
+	if message, ok := receiveWithin(t, 50*time.Millisecond); ok {
+		t.Fatalf("Reply overtook the multicast: %+v", message)
+	}
+	deliverMessage(proposal)
+	for _, kind := range []string{"TEST_PROPOSAL", "TEST_REPLY"} {
+		message, ok := receiveWithin(t, time.Second)
+		if !ok || message.Kind != kind {
+			t.Fatalf("Expected %s, got %+v", kind, message)
+		}
+	}
+	if vectorTimeStamp[1] != 1 {
+		t.Errorf("Only the multicast should advance the clock: %v", vectorTimeStamp)
+	}
+}
+
+func TestStampDirectMessage(t *testing.T) {
+	PeerNodes = Nodes{Node{Name: "armin"}, Node{Name: "lunwen"}}
+	LocalIndex = 0
+	vectorTimeStamp = []int{4, 2}
+	directClock = nil
+	message := Message{Source: "armin", Destination: "lunwen"}
+	stampDirectMessage(&message)
+	if message.Timestamp != nil {
+		t.Errorf("Direct messages are only stamped with the option on.")
+	}
+	SetCausalDirect(true)
+	defer SetCausalDirect(false)
+	stampDirectMessage(&message)
+	vectorTimeStamp[0] = 5
+	if len(message.Timestamp) != 2 || message.Timestamp[0] != 4 || message.Timestamp[1] != 2 {
+		t.Errorf("Expected a copy of the clock, got %v", message.Timestamp)
+	}
+	if len(message.DirectClock) != 4 || message.DirectClock[1] != 1 {
+		t.Errorf("Expected the message to armin->lunwen counted, got %v", message.DirectClock)
+	}
+}
+
+func TestMulticastWaitsForEarlierDirectMessage(t *testing.T) {
+	t.Cleanup(func() { SetCausalDirect(false) })
+	setupLoopback(t)
+	PeerNodes = Nodes{LocalNode, Node{Name: "lunwen"}}
+	vectorTimeStamp = []int{0, 0}
+	directClock = nil
+	resetDirectClock()
+	SetCausalDirect(true)
+
+	/* lunwen sent us two direct messages, then multicast; the clock is [from*2+to] */
+	first := Message{Source: "lunwen", Destination: "armin", Kind: "TEST_FIRST",
+		Timestamp: []int{0, 0}, DirectClock: []int{0, 0, 1, 0}}
+	second := Message{Source: "lunwen", Destination: "armin", Kind: "TEST_SECOND",
+		Timestamp: []int{0, 0}, DirectClock: []int{0, 0, 2, 0}}
+	multicast := Message{Source: "lunwen", Destination: defs.MULTICAST_DEST, Kind: "TEST_MULTICAST",
+		Timestamp: []int{0, 1}, DirectClock: []int{0, 0, 1, 0}}
+	for _, message := range []*Message{&first, &second, &multicast} {
+		stampMessageID(message)
+	}
+
+	deliverMessage(multicast)
+	deliverMessage(second)
+	if message, ok := receiveWithin(t, 50*time.Millisecond); ok {
+		t.Fatalf("A message overtook the first direct message: %+v", message)
+	}
+	deliverMessage(first)
+	for _, kind := range []string{"TEST_FIRST", "TEST_MULTICAST", "TEST_SECOND"} {
+		message, ok := receiveWithin(t, time.Second)
+		if !ok || message.Kind != kind {
+			t.Fatalf("Expected %s, got %+v", kind, message)
+		}
+	}
+}
+
+func TestMissingDirectMessageIsGivenUp(t *testing.T) {
+	t.Cleanup(func() { SetCausalDirect(false) })
+	setupLoopback(t)
+	PeerNodes = Nodes{LocalNode, Node{Name: "lunwen"}}
+	vectorTimeStamp = []int{0, 0}
+	directClock = nil
+	resetDirectClock()
+	SetCausalDirect(true)
+
+	/* lunwen's first direct message to us is late, its multicast after it waits */
+	late := Message{Source: "lunwen", Destination: "armin", Kind: "TEST_LATE",
+		Timestamp: []int{0, 0}, DirectClock: []int{0, 0, 1, 0}}
+	multicast := Message{Source: "lunwen", Destination: defs.MULTICAST_DEST, Kind: "TEST_MULTICAST",
+		Timestamp: []int{0, 1}, DirectClock: []int{0, 0, 1, 0}}
+	for _, message := range []*Message{&late, &multicast} {
+		stampMessageID(message)
+	}
+
+	deliverMessage(multicast)
+	if message, ok := receiveWithin(t, 50*time.Millisecond); ok {
+		t.Fatalf("The multicast didn't wait for the direct message: %+v", message)
+	}
+	timestampMutex.Lock()
+	directMissingSince[1] = time.Now().Add(-DIRECT_WAIT)
+	timestampMutex.Unlock()
+	checkHoldbackQueue()
+	deliverMessage(late)
+	for _, kind := range []string{"TEST_MULTICAST", "TEST_LATE"} {
+		message, ok := receiveWithin(t, time.Second)
+		if !ok || message.Kind != kind {
+			t.Fatalf("Expected %s, got %+v", kind, message)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+////////////////////////////////////////////////////////////
+//Multegula - codec.go
+//Pluggable Message codecs for the wire protocol
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/* codec IDs sent on the wire during the handshake */
+const CODEC_GOB uint8 = 1
+const CODEC_JSON uint8 = 2
+const CODEC_BINARY uint8 = 3
+
+/*
+ * a Codec turns a Message into the payload of a single frame and back.
+ * Codecs don't keep any state between messages.
+ */
+type Codec interface {
+	ID() uint8
+	Name() string
+	Encode(message *Message) ([]byte, error)
+	Decode(data []byte, message *Message) error
+}
+
+/* all codecs this build understands, by ID */
+var codecs map[uint8]Codec = map[uint8]Codec{
+	CODEC_GOB:    gobCodec{},
+	CODEC_JSON:   jsonCodec{},
+	CODEC_BINARY: binaryCodec{},
+}
+
+/* the codecs offered during the handshake, most preferred first */
+var preferredCodecs []uint8 = []uint8{CODEC_GOB, CODEC_BINARY, CODEC_JSON}
+
+/*
+ * finds a codec by its name, e.g. "gob", "json" or "binary"
+ */
+func CodecByName(name string) (Codec, error) {
+	for _, codec := range codecs {
+		if codec.Name() == strings.ToLower(name) {
+			return codec, nil
+		}
+	}
+	return nil, errors.New("Unknown codec: " + name)
+}
+
+/*
+ * makes a codec the first choice offered to peers. The other codecs
+ * are still accepted if a peer doesn't support it.
+ * @param	name – the codec's name
+ **/
+func SetPreferredCodec(name string) error {
+	codec, err := CodecByName(name)
+	if err != nil {
+		return err
+	}
+	preferred := []uint8{codec.ID()}
+	for _, id := range preferredCodecs {
+		if id != codec.ID() {
+			preferred = append(preferred, id)
+		}
+	}
+	preferredCodecs = preferred
+	return nil
+}
+
+/*
+ * picks the first codec in the dialer's list that we support
+ */
+func chooseCodec(offered []uint8) (Codec, error) {
+	for _, id := range offered {
+		if codec, exists := codecs[id]; exists {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("No common codec in %v", offered)
+}
+
+/* gob encoded messages, each frame carries its own type information */
+type gobCodec struct{}
+
+func (gobCodec) ID() uint8 {
+	return CODEC_GOB
+}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Encode(message *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(message)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Decode(data []byte, message *Message) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(message)
+}
+
+/* JSON encoded messages, handy when debugging with a packet capture */
+type jsonCodec struct{}
+
+func (jsonCodec) ID() uint8 {
+	return CODEC_JSON
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Encode(message *Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonCodec) Decode(data []byte, message *Message) error {
+	return json.Unmarshal(data, message)
+}
+
+/*
+ * compact binary messages: every field in order, strings and byte slices
+ * prefixed with their length as a uvarint, integers as varints.
+ */
+type binaryCodec struct{}
+
+func (binaryCodec) ID() uint8 {
+	return CODEC_BINARY
+}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Encode(message *Message) ([]byte, error) {
+	w := binaryWriter{}
+	w.writeString(message.Source)
+	w.writeString(message.Destination)
+	w.writeString(message.Content)
+	w.writeString(message.Kind)
+	w.writeInt(int64(message.SeqNum))
+	w.writeUint(uint64(len(message.Timestamp)))
+	for _, value := range message.Timestamp {
+		w.writeInt(int64(value))
+	}
+	w.writeUint(uint64(len(message.DirectClock)))
+	for _, value := range message.DirectClock {
+		w.writeInt(int64(value))
+	}
+	w.writeUint(message.ID)
+	w.writeInt(int64(message.CorrelationID))
+	w.writeBool(message.IsReply)
+	w.writeBytes(message.Signature)
+	return w.buf, nil
+}
+
+func (binaryCodec) Decode(data []byte, message *Message) error {
+	r := binaryReader{data: data}
+	message.Source = r.readString()
+	message.Destination = r.readString()
+	message.Content = r.readString()
+	message.Kind = r.readString()
+	message.SeqNum = int(r.readInt())
+	length := r.readUint()
+	if r.err == nil && length > uint64(len(r.data)) {
+		return errors.New("Binary codec: bad timestamp length")
+	}
+	message.Timestamp = make([]int, length)
+	for i := range message.Timestamp {
+		message.Timestamp[i] = int(r.readInt())
+	}
+	length = r.readUint()
+	if r.err == nil && length > uint64(len(r.data)) {
+		return errors.New("Binary codec: bad direct clock length")
+	}
+	if length > 0 {
+		message.DirectClock = make([]int, length)
+	}
+	for i := range message.DirectClock {
+		message.DirectClock[i] = int(r.readInt())
+	}
+	message.ID = r.readUint()
+	message.CorrelationID = int(r.readInt())
+	message.IsReply = r.readBool()
+	message.Signature = r.readBytes()
+	if r.err == nil && len(r.data) > 0 {
+		return errors.New("Binary codec: trailing bytes")
+	}
+	return r.err
+}
+
+type binaryWriter struct {
+	buf []byte
+}
+
+func (w *binaryWriter) writeUint(value uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], value)
+	w.buf = append(w.buf, tmp[:n]...)
+}
+
+func (w *binaryWriter) writeInt(value int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], value)
+	w.buf = append(w.buf, tmp[:n]...)
+}
+
+func (w *binaryWriter) writeBool(value bool) {
+	if value {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *binaryWriter) writeBytes(value []byte) {
+	w.writeUint(uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *binaryWriter) writeString(value string) {
+	w.writeUint(uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+/* reads fields back, remembering the first error so callers check once */
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) readUint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errors.New("Binary codec: bad uvarint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *binaryReader) readInt() int64 {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errors.New("Binary codec: bad varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *binaryReader) readBool() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.data) == 0 {
+		r.err = errors.New("Binary codec: field runs past end of frame")
+		return false
+	}
+	value := r.data[0]
+	r.data = r.data[1:]
+	return value != 0
+}
+
+func (r *binaryReader) readBytes() []byte {
+	length := r.readUint()
+	if r.err != nil {
+		return nil
+	}
+	if length > uint64(len(r.data)) {
+		r.err = errors.New("Binary codec: field runs past end of frame")
+		return nil
+	}
+	if length == 0 {
+		return nil
+	}
+	value := make([]byte, length)
+	copy(value, r.data[:length])
+	r.data = r.data[length:]
+	return value
+}
+
+func (r *binaryReader) readString() string {
+	return string(r.readBytes())
+}
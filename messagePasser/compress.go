@@ -0,0 +1,124 @@
+////////////////////////////////////////////////////////////
+//Multegula - compress.go
+//Per-connection stream compression for peer links
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+/* handshake feature bit: this side can compress frames */
+const FEATURE_COMPRESSION uint8 = 1
+
+/* frame flag: the payload is a chunk of the link's deflate stream */
+const FRAME_COMPRESSED uint8 = 1
+
+/* encoded messages smaller than this are sent as they are */
+const DEFAULT_COMPRESSION_THRESHOLD int = 128
+
+/* local compression settings, offered to peers during the handshake */
+var compressionEnabled bool = false
+var compressionThreshold int = DEFAULT_COMPRESSION_THRESHOLD
+
+/*
+ * turns compression on or off for links set up after this call. Both
+ * sides have to enable it for a link to be compressed.
+ * @param	enabled – offer compression to peers
+ * @param	threshold – smallest encoded message worth compressing
+ **/
+func SetCompression(enabled bool, threshold int) {
+	compressionEnabled = enabled
+	compressionThreshold = threshold
+}
+
+/*
+ * the feature bits we offer during the handshake
+ */
+func localFeatures() uint8 {
+	if compressionEnabled {
+		return FEATURE_COMPRESSION
+	}
+	return 0
+}
+
+/*
+ * byte counts for a link, used to see what compression saves
+ */
+type LinkStats struct {
+	EncodedBytes uint64 // bytes of encoded messages handed to the link
+	WireBytes    uint64 // bytes actually written to the connection
+}
+
+/*
+ * compresses one encoded message as the next chunk of the link's deflate
+ * stream. Every chunk ends with a sync flush so the receiver can decode
+ * it as soon as it arrives, while the dictionary carries over between
+ * messages. Must be called with link.writeMutex held so chunks hit the
+ * wire in the order they were compressed.
+ **/
+func (link *peerLink) deflate(payload []byte) ([]byte, error) {
+	if link.deflater == nil {
+		deflater, err := flate.NewWriter(&link.deflateBuffer, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		link.deflater = deflater
+	}
+	link.deflateBuffer.Reset()
+	if _, err := link.deflater.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := link.deflater.Flush(); err != nil {
+		return nil, err
+	}
+	return link.deflateBuffer.Bytes(), nil
+}
+
+/*
+ * decompresses the next chunk of the peer's deflate stream
+ * @param	chunk – compressed bytes from one frame
+ * @param	rawLength – size of the encoded message inside the chunk
+ **/
+func (link *peerLink) inflate(chunk []byte, rawLength uint32) ([]byte, error) {
+	/*
+	 * the inflater reads from a buffer that outlives each frame. The flate
+	 * reader only asks for more input once it has handed out everything
+	 * from the previous sync flush, so it never sees the buffer run dry.
+	 */
+	link.inflateBuffer.Write(chunk)
+	if link.inflater == nil {
+		link.inflater = flate.NewReader(&link.inflateBuffer)
+	}
+	payload := make([]byte, rawLength)
+	if _, err := io.ReadFull(link.inflater, payload); err != nil {
+		return nil, fmt.Errorf("Compressed stream is corrupt: %v", err)
+	}
+	return payload, nil
+}
+
+/*
+ * returns the link's byte counts so far
+ */
+func (link *peerLink) stats() LinkStats {
+	link.writeMutex.Lock()
+	defer link.writeMutex.Unlock()
+	return link.sent
+}
+
+/*
+ * returns the byte counts of every link, by node name
+ */
+func GetLinkStats() map[string]LinkStats {
+	stats := make(map[string]LinkStats)
+	mapsMutex.Lock()
+	defer mapsMutex.Unlock()
+	for name, link := range links {
+		stats[name] = link.stats()
+	}
+	return stats
+}
@@ -0,0 +1,184 @@
+package messagePasser
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arminm/multegula/defs"
+	"github.com/arminm/multegula/payload"
+)
+
+/*
+ * connects two links over an in-memory pipe. Compression is enabled on
+ * both sides if compress is set, but the dialer can be made to leave it
+ * out of its hello.
+ */
+func linkPair(t testing.TB, compress bool, dialerOffers bool) (*peerLink, *peerLink) {
+	SetCompression(compress, DEFAULT_COMPRESSION_THRESHOLD)
+	defer SetCompression(false, DEFAULT_COMPRESSION_THRESHOLD)
+	dialSide, acceptSide := net.Pipe()
+	accepted := make(chan *peerLink)
+	go func() {
+		link, err := acceptHandshake(acceptSide)
+		if err != nil {
+			t.Errorf("Accept handshake failed: %v", err)
+		}
+		accepted <- link
+	}()
+	link, err := dialHandshake(&helloFilter{Conn: dialSide, strip: !dialerOffers})
+	if err != nil {
+		t.Fatalf("Dial handshake failed: %v", err)
+	}
+	return link, <-accepted
+}
+
+/* clears the feature bits in the first write, i.e. the dialer's hello */
+type helloFilter struct {
+	net.Conn
+	strip bool
+	done  bool
+}
+
+func (conn *helloFilter) Write(data []byte) (int, error) {
+	if conn.strip && !conn.done {
+		data[len(data)-1] = 0
+	}
+	conn.done = true
+	return conn.Conn.Write(data)
+}
+
+func sendAndCheck(t *testing.T, from *peerLink, to *peerLink, messages []Message) {
+	go func() {
+		for i := range messages {
+			from.writeMessage(&messages[i])
+		}
+	}()
+	for i, sent := range messages {
+		received, err := to.readMessage()
+		if err != nil {
+			t.Fatalf("Couldn't read message %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(sent, received) {
+			t.Fatalf("Message %d changed.\nSent:%+v\nGot:%+v", i, sent, received)
+		}
+	}
+}
+
+func TestCompressedLinkRoundTrip(t *testing.T) {
+	dialLink, acceptLink := linkPair(t, true, true)
+	if !dialLink.compress || !acceptLink.compress {
+		t.Fatalf("Compression should be negotiated when both sides offer it.")
+	}
+	messages := []Message{}
+	for i := 0; i < 200; i++ {
+		content := fmt.Sprintf("L|%d|83", i)
+		if i%10 == 0 {
+			content = strings.Repeat("CGS|4|armin|23|3|daniel|53|5|lunwen|10|1|", i/10+1)
+		}
+		messages = append(messages, Message{Source: "armin", Destination: "EVR1", Content: content,
+			Kind: "MPD", SeqNum: i, Timestamp: []int{i, 0, 3, 1}})
+	}
+	sendAndCheck(t, dialLink, acceptLink, messages)
+	sendAndCheck(t, acceptLink, dialLink, messages)
+	if stats := dialLink.stats(); stats.WireBytes >= stats.EncodedBytes {
+		t.Errorf("Compression didn't save anything: %+v", stats)
+	}
+}
+
+func TestCompressionNeedsBothSides(t *testing.T) {
+	dialLink, acceptLink := linkPair(t, true, false)
+	if dialLink.compress || acceptLink.compress {
+		t.Fatalf("Compression should only be used if both sides offer it.")
+	}
+	messages := []Message{{Source: "armin", Destination: "EVR1", Content: strings.Repeat("x", 500), Kind: "MPD"}}
+	sendAndCheck(t, dialLink, acceptLink, messages)
+}
+
+/*
+ * a 4 player game the way a live one goes over a link: the unicorn agrees
+ * on the game with the others, counts down and starts the ball, then the
+ * players move their paddles and deflect, miss and break blocks. Every
+ * message is signed the way a live game would be.
+ */
+func recordedGame(b *testing.B) []Message {
+	GenerateLocalKey()
+	players := []string{"armin", "daniel", "garrett", "lunwen"}
+	timestamp := make([]int, len(players))
+	messages := []Message{}
+	add := func(player int, kind string, value payload.Payload) {
+		content, err := payload.Encode(value)
+		if err != nil {
+			b.Fatal(err)
+		}
+		timestamp[player] += 1
+		message := Message{Source: players[player], Destination: defs.MULTICAST_DEST, Content: content, Kind: kind,
+			SeqNum: timestamp[player], Timestamp: append([]int{}, timestamp...), ID: uint64(len(messages) + 1)}
+		signMessage(&message)
+		messages = append(messages, message)
+	}
+	state := &payload.ConsensusValue{Type: "CGS", Value: "4|armin|23|3|daniel|53|5|lunwen|10|1|garrett|19|4|0|101110111101110111010"}
+	add(0, defs.MSG_CON_REQ, state)
+	for player := 1; player < len(players); player++ {
+		add(player, defs.MSG_CON_REPLY, state)
+	}
+	add(0, defs.MSG_CON_COMMIT, state)
+	for countdown := 3; countdown > 0; countdown-- {
+		add(0, defs.MSG_PAUSE_UPDATE, &payload.PauseUpdate{Countdown: countdown, Level: 1})
+	}
+	add(0, defs.MSG_START_PLAY, &payload.StartPlay{XSpeed: 3.5, YSpeed: -4})
+	directions := []string{"L", "S", "R", "S"}
+	for turn := 0; turn < 120; turn++ {
+		player := turn % len(players)
+		center := 250 + float64(turn%50)*3.5
+		for step := 0; step < 4; step++ {
+			add(player, defs.MSG_PADDLE_DIR, &payload.PaddleMove{Direction: directions[step], Center: center + float64(step), Width: 80})
+		}
+		ball := payload.Ball{XCenter: center, YCenter: 30 + float64(turn%7)*2.25, Radius: 8, XSpeed: 3.5, YSpeed: 4}
+		add(player, defs.MSG_BALL_DEFLECTED, &payload.BallDeflected{Ball: ball, Score: turn * 10})
+		if turn%3 == 0 {
+			add(player, defs.MSG_BLOCK_BROKEN, &payload.BlockBroken{Ball: ball, Score: turn*10 + 5, Lives: 3, Block: turn % 21})
+		} else if turn%17 == 0 {
+			add(player, defs.MSG_BALL_MISSED, &payload.BallMissed{Score: turn * 10, Lives: 2})
+		}
+	}
+	return messages
+}
+
+/*
+ * replays the recorded game over one link and reports the bytes written
+ * per game, with and without compression, for every codec
+ */
+func BenchmarkRecordedGame(b *testing.B) {
+	messages := recordedGame(b)
+	for _, codecName := range []string{"gob", "json", "binary"} {
+		for _, compress := range []bool{false, true} {
+			name := fmt.Sprintf("%s/compress=%v", codecName, compress)
+			b.Run(name, func(b *testing.B) {
+				defer SetPreferredCodec("gob")
+				SetPreferredCodec(codecName)
+				var stats LinkStats
+				for n := 0; n < b.N; n++ {
+					dialLink, acceptLink := linkPair(b, compress, true)
+					done := make(chan bool)
+					go func() {
+						for range messages {
+							acceptLink.readMessage()
+						}
+						done <- true
+					}()
+					for i := range messages {
+						dialLink.writeMessage(&messages[i])
+					}
+					<-done
+					stats = dialLink.stats()
+					dialLink.conn.Close()
+				}
+				b.ReportMetric(float64(stats.WireBytes), "wireB/game")
+				b.ReportMetric(100*(1-float64(stats.WireBytes)/float64(stats.EncodedBytes+5*uint64(len(messages)))), "saved%")
+			})
+		}
+	}
+}
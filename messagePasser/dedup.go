@@ -0,0 +1,127 @@
+////////////////////////////////////////////////////////////
+//Multegula - dedup.go
+//Message IDs and the duplicate detection window
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Every message created by a node gets the next number of that node's
+ * sequence, so (Source, ID) names a message uniquely however many times
+ * it is re-multicast. The sequence starts at the time the node started,
+ * so a player that restarts and rejoins doesn't reuse IDs its peers still
+ * remember.
+ */
+type MessageID struct {
+	Origin string
+	Seq    uint64
+}
+
+/* the ID of a message, only meaningful if message.ID != 0 */
+func (message *Message) UniqueID() MessageID {
+	return MessageID{message.Source, message.ID}
+}
+
+var lastMessageID uint64 = uint64(time.Now().UnixNano())
+
+/*
+ * gives a message created by the local node its ID
+ */
+func stampMessageID(message *Message) {
+	message.ID = atomic.AddUint64(&lastMessageID, 1)
+}
+
+/*
+ * A message is a duplicate if its ID was seen within the last
+ * DEDUP_WINDOW. Echoes of a multicast arrive within a round trip or two,
+ * so the window only has to outlast the slowest link. At most
+ * DEDUP_MAX_ENTRIES IDs are remembered, the oldest are forgotten first.
+ * The receive rate limits let a node through about 20k messages in a
+ * window, 80k for a full game, so the cap is only reached by a flood the
+ * window isn't meant to survive; duplicates are never recorded.
+ */
+const DEDUP_WINDOW = 30 * time.Second
+const DEDUP_MAX_ENTRIES int = 1 << 18
+
+type dedupEntry struct {
+	id   MessageID
+	seen time.Time
+}
+
+type dedupWindow struct {
+	mutex sync.Mutex
+	seen  map[MessageID]bool
+	order []dedupEntry // oldest first, starting at head
+	head  int
+	now   func() time.Time
+}
+
+func newDedupWindow() *dedupWindow {
+	return &dedupWindow{seen: make(map[MessageID]bool), now: time.Now}
+}
+
+/* the IDs of the messages this node has received */
+var receivedIDs *dedupWindow = newDedupWindow()
+
+/*
+ * records a message ID
+ * @return	true if the ID is new, false for a duplicate
+ **/
+func (window *dedupWindow) firstSeen(id MessageID) bool {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+	now := window.now()
+	window.expire(now)
+	if window.seen[id] {
+		return false
+	}
+	window.seen[id] = true
+	window.order = append(window.order, dedupEntry{id, now})
+	return true
+}
+
+/*
+ * checks for a message ID without recording it
+ * @return	true if the ID was seen within the window
+ **/
+func (window *dedupWindow) seenBefore(id MessageID) bool {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+	window.expire(window.now())
+	return window.seen[id]
+}
+
+/*
+ * forgets the IDs that left the window, must be called with the mutex held
+ */
+func (window *dedupWindow) expire(now time.Time) {
+	for window.head < len(window.order) {
+		entry := window.order[window.head]
+		if now.Sub(entry.seen) < DEDUP_WINDOW && len(window.order)-window.head < DEDUP_MAX_ENTRIES {
+			break
+		}
+		delete(window.seen, entry.id)
+		window.head += 1
+	}
+	/* reclaim the space once half the slice has expired */
+	if window.head > 0 && window.head*2 >= len(window.order) {
+		window.order = append(window.order[:0], window.order[window.head:]...)
+		window.head = 0
+	}
+}
+
+/*
+ * number of IDs currently remembered
+ */
+func (window *dedupWindow) size() int {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+	return len(window.order) - window.head
+}
@@ -0,0 +1,96 @@
+package messagePasser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/* a window with a clock the test moves by hand */
+func testWindow() (*dedupWindow, *time.Time) {
+	clock := time.Unix(1000, 0)
+	window := newDedupWindow()
+	window.now = func() time.Time { return clock }
+	return window, &clock
+}
+
+func TestDedupWindowDetectsDuplicates(t *testing.T) {
+	window, _ := testWindow()
+	if !window.firstSeen(MessageID{"armin", 7}) {
+		t.Errorf("First copy should be new.")
+	}
+	if window.firstSeen(MessageID{"armin", 7}) {
+		t.Errorf("Second copy should be a duplicate.")
+	}
+	if !window.firstSeen(MessageID{"lunwen", 7}) || !window.firstSeen(MessageID{"armin", 8}) {
+		t.Errorf("Other origins and sequence numbers are different messages.")
+	}
+}
+
+func TestDedupWindowForgetsOldIDs(t *testing.T) {
+	window, clock := testWindow()
+	window.firstSeen(MessageID{"armin", 1})
+	*clock = clock.Add(DEDUP_WINDOW / 2)
+	window.firstSeen(MessageID{"armin", 2})
+	*clock = clock.Add(DEDUP_WINDOW/2 + time.Millisecond)
+	if window.firstSeen(MessageID{"armin", 2}) {
+		t.Errorf("ID inside the window should still be a duplicate.")
+	}
+	if window.size() != 1 {
+		t.Errorf("ID outside the window should be forgotten, remembering %d", window.size())
+	}
+}
+
+func TestDedupWindowIsBounded(t *testing.T) {
+	window, _ := testWindow()
+	for seq := uint64(1); seq <= uint64(3*DEDUP_MAX_ENTRIES); seq++ {
+		window.firstSeen(MessageID{"armin", seq})
+	}
+	if window.size() > DEDUP_MAX_ENTRIES || len(window.order) > 2*DEDUP_MAX_ENTRIES {
+		t.Errorf("Window grew past its bound: %d IDs, %d entries", window.size(), len(window.order))
+	}
+	if window.firstSeen(MessageID{"armin", uint64(3 * DEDUP_MAX_ENTRIES)}) {
+		t.Errorf("Newest ID should still be remembered.")
+	}
+}
+
+func TestDedupWindowHoldsAFullGameAtTheRateLimits(t *testing.T) {
+	/* what the default limits let every player send within a window */
+	perPlayer := 0
+	for _, limit := range DEFAULT_RATE_LIMITS {
+		perPlayer += int(limit.Rate*DEDUP_WINDOW.Seconds()) + limit.Burst
+	}
+	total := perPlayer * defs.MAX_PLAYERS_PER_GAME
+	step := DEDUP_WINDOW / time.Duration(total+1)
+
+	window, clock := testWindow()
+	for i := 0; i < total; i++ {
+		window.firstSeen(MessageID{"armin", uint64(i)})
+		*clock = clock.Add(step)
+	}
+	if window.size() != total {
+		t.Errorf("Expected all %d IDs within the window, remembering %d", total, window.size())
+	}
+	if window.firstSeen(MessageID{"armin", 0}) {
+		t.Errorf("The first ID is still within the window and should be a duplicate.")
+	}
+}
+
+func TestStampedIDsAreUnique(t *testing.T) {
+	first, second := Message{Source: "armin"}, Message{Source: "armin"}
+	stampMessageID(&first)
+	stampMessageID(&second)
+	if first.ID == 0 || first.UniqueID() == second.UniqueID() {
+		t.Errorf("Messages got the same ID: %v", first.ID)
+	}
+}
+
+func BenchmarkDedupWindow(b *testing.B) {
+	window := newDedupWindow()
+	for i := 0; i < b.N; i++ {
+		id := MessageID{"armin", uint64(i)}
+		window.firstSeen(id)
+		window.firstSeen(id)
+	}
+}
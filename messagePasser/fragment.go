@@ -0,0 +1,246 @@
+////////////////////////////////////////////////////////////
+//Multegula - fragment.go
+//Fragmentation and reassembly of large messages
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/*
+ * Encoded messages bigger than FRAGMENT_SIZE (a level definition or a
+ * rejoin snapshot, say) are sent as a transfer: a series of fragment
+ * frames written by their own routine. Before every fragment the routine
+ * steps aside for any small frames waiting on the link, so paddle updates
+ * don't queue up behind a large payload. A small message may so overtake
+ * a large one written before it; the receiver puts the messages that
+ * depend on each other back in order by their sequence numbers, see
+ * deliverMessage and causal.go. Transfers on a link run one after the
+ * other in the order they were started, and the receiver checks that
+ * each one's fragments come in order. Fragment frames carry
+ *
+ *   TRANSFER_ID(4) INDEX(4) COUNT(4)
+ *
+ * in front of their payload, and COUNT = 0 aborts the transfer.
+ */
+const FRAGMENT_SIZE int = 16 << 10
+
+/* frame flag: the payload is one fragment of a transfer */
+const FRAME_FRAGMENT uint8 = 2
+
+/* upper bound for a reassembled message */
+const MAX_MESSAGE_SIZE int = 64 << 20
+
+/* returned to transfers cancelled with CancelTransfers */
+var ErrTransferCancelled = errors.New("Transfer cancelled")
+
+/*
+ * progress of a transfer, reported after every fragment on both sides
+ */
+type TransferProgress struct {
+	Peer     string // the node on the other end of the link
+	Outgoing bool   // true when we're the sender
+	ID       uint32 // transfer ID, unique per link and direction
+	Kind     string // the message Kind, only known on the sending side
+	Bytes    int    // bytes of the encoded message moved so far
+	Total    int    // size of the encoded message
+	Done     bool   // the whole message has been sent or reassembled
+	Err      error  // set if the transfer failed or was cancelled
+}
+
+/* the queue for transfer progress reports */
+var transferProgressChannel chan TransferProgress = make(chan TransferProgress, defs.QUEUE_SIZE)
+
+/*
+ * reports progress without ever blocking the link. If nobody is reading
+ * the reports and the channel is full, the report is dropped.
+ */
+func reportProgress(progress TransferProgress) {
+	select {
+	case transferProgressChannel <- progress:
+	default:
+	}
+}
+
+/*
+ * a public method that returns the next transfer progress report,
+ * blocking if there is none.
+ */
+func GetTransferProgress() TransferProgress {
+	return <-transferProgressChannel
+}
+
+/* state of an outgoing transfer */
+type transfer struct {
+	id        uint32
+	cancelled int32
+}
+
+/* state of an incoming transfer being reassembled */
+type reassembly struct {
+	count   uint32
+	next    uint32
+	payload []byte
+}
+
+/*
+ * starts sending a large encoded message in the background
+ * @param	message – the message, for progress reports
+ * @param	payload – the encoded message
+ **/
+func (link *peerLink) startTransfer(message *Message, payload []byte) {
+	link.transfersMutex.Lock()
+	link.nextTransferID += 1
+	t := &transfer{id: link.nextTransferID}
+	link.transfers[t.id] = t
+	previous := link.lastTransfer
+	done := make(chan struct{})
+	link.lastTransfer = done
+	link.transfersMutex.Unlock()
+
+	go func() {
+		defer close(done)
+		if previous != nil {
+			<-previous
+		}
+		link.runTransfer(t, message.Kind, payload)
+	}()
+}
+
+/*
+ * writes the fragments of one transfer, yielding to small frames
+ */
+func (link *peerLink) runTransfer(t *transfer, kind string, payload []byte) {
+	defer func() {
+		link.transfersMutex.Lock()
+		delete(link.transfers, t.id)
+		link.transfersMutex.Unlock()
+	}()
+
+	count := uint32((len(payload) + FRAGMENT_SIZE - 1) / FRAGMENT_SIZE)
+	progress := TransferProgress{Peer: link.name, Outgoing: true, ID: t.id, Kind: kind, Total: len(payload)}
+	for index := uint32(0); index < count; index++ {
+		/* let waiting small messages go first */
+		for atomic.LoadInt32(&link.waitingWriters) > 0 {
+			runtime.Gosched()
+		}
+		start := int(index) * FRAGMENT_SIZE
+		end := start + FRAGMENT_SIZE
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		link.writeMutex.Lock()
+		var err error
+		if atomic.LoadInt32(&t.cancelled) != 0 {
+			err = ErrTransferCancelled
+			/* tell the receiver to drop what it has so far */
+			link.writeFrame(FRAME_FRAGMENT, nil, fragmentHeader(t.id, 0, 0))
+		} else {
+			err = link.writeFrame(FRAME_FRAGMENT, payload[start:end], fragmentHeader(t.id, index, count))
+		}
+		link.writeMutex.Unlock()
+
+		if err != nil {
+			progress.Err = err
+			reportProgress(progress)
+			fmt.Printf("Transfer %d to %v failed: %v\n", t.id, link.name, err)
+			return
+		}
+		progress.Bytes = end
+		progress.Done = index == count-1
+		reportProgress(progress)
+	}
+}
+
+/*
+ * builds the fragment header for a fragment frame
+ */
+func fragmentHeader(id uint32, index uint32, count uint32) []byte {
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header[0:], id)
+	binary.BigEndian.PutUint32(header[4:], index)
+	binary.BigEndian.PutUint32(header[8:], count)
+	return header
+}
+
+/*
+ * cancels the link's outgoing transfers
+ */
+func (link *peerLink) cancelTransfers() {
+	link.transfersMutex.Lock()
+	for _, t := range link.transfers {
+		atomic.StoreInt32(&t.cancelled, 1)
+	}
+	link.transfersMutex.Unlock()
+}
+
+/*
+ * cancels every outgoing transfer to a node, e.g. because the player
+ * left. The transfers report ErrTransferCancelled.
+ * @param	nodeName – the receiving node
+ **/
+func CancelTransfers(nodeName string) {
+	if link, exists := getLink(nodeName); exists {
+		link.cancelTransfers()
+	}
+}
+
+/*
+ * adds a fragment to its transfer
+ * @param	header – the 12 byte fragment header
+ * @param	chunk – the fragment's payload
+ *
+ * @return	the reassembled payload once the last fragment is in, else nil
+ **/
+func (link *peerLink) addFragment(header []byte, chunk []byte) ([]byte, error) {
+	id := binary.BigEndian.Uint32(header[0:])
+	index := binary.BigEndian.Uint32(header[4:])
+	count := binary.BigEndian.Uint32(header[8:])
+
+	if count == 0 {
+		if r, exists := link.reassemblies[id]; exists {
+			delete(link.reassemblies, id)
+			reportProgress(TransferProgress{Peer: link.name, ID: id, Bytes: len(r.payload), Err: ErrTransferCancelled})
+		}
+		return nil, nil
+	}
+	if uint64(count)*uint64(FRAGMENT_SIZE) > uint64(MAX_MESSAGE_SIZE)+uint64(FRAGMENT_SIZE) {
+		return nil, fmt.Errorf("Transfer %d is too large (%d fragments)", id, count)
+	}
+	r, exists := link.reassemblies[id]
+	if !exists {
+		if index != 0 {
+			return nil, fmt.Errorf("Transfer %d starts at fragment %d", id, index)
+		}
+		r = &reassembly{count: count}
+		link.reassemblies[id] = r
+	}
+	if index != r.next || count != r.count {
+		delete(link.reassemblies, id)
+		return nil, fmt.Errorf("Transfer %d: fragment %d/%d out of order", id, index, count)
+	}
+	r.payload = append(r.payload, chunk...)
+	r.next += 1
+
+	progress := TransferProgress{Peer: link.name, ID: id, Bytes: len(r.payload), Total: len(r.payload)}
+	if r.next < r.count {
+		/* the sender's fragments are all full sized except the last */
+		progress.Total = int(r.count) * FRAGMENT_SIZE
+		reportProgress(progress)
+		return nil, nil
+	}
+	delete(link.reassemblies, id)
+	progress.Done = true
+	reportProgress(progress)
+	return r.payload, nil
+}
@@ -0,0 +1,150 @@
+package messagePasser
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func drainProgress() {
+	for len(transferProgressChannel) > 0 {
+		<-transferProgressChannel
+	}
+}
+
+/*
+ * waits for a progress report matching check, failing after a second
+ */
+func waitForProgress(t *testing.T, check func(TransferProgress) bool) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case progress := <-transferProgressChannel:
+			if progress.Total != 0 && progress.Bytes > progress.Total {
+				t.Errorf("Bad progress report: %+v", progress)
+			}
+			if check(progress) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Expected progress report never came.")
+		}
+	}
+}
+
+func TestLargeMessageInterleavesWithSmallOnes(t *testing.T) {
+	dialLink, acceptLink := linkPair(t, false, false)
+	drainProgress()
+	level := Message{Source: "armin", Destination: "lunwen", Kind: "MLV", Content: strings.Repeat("101110111101110111010|", 20000)}
+	paddle := Message{Source: "armin", Destination: "lunwen", Kind: "MPD", Content: "L|250|83"}
+
+	if err := dialLink.writeMessage(&level); err != nil {
+		t.Fatalf("Couldn't start transfer: %v", err)
+	}
+	/* the large message is still going out while we send a small one */
+	go dialLink.writeMessage(&paddle)
+
+	first, err := acceptLink.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Kind != "MPD" {
+		t.Errorf("Paddle message should overtake the large transfer, got %v first", first.Kind)
+	}
+	second, err := acceptLink.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Kind != "MLV" || second.Content != level.Content {
+		t.Errorf("Large message wasn't reassembled correctly (%d bytes)", len(second.Content))
+	}
+
+	waitForProgress(t, func(progress TransferProgress) bool {
+		return progress.Outgoing && progress.Done && progress.Bytes == progress.Total
+	})
+}
+
+func TestTransfersKeepTheirOrder(t *testing.T) {
+	dialLink, acceptLink := linkPair(t, false, false)
+	drainProgress()
+	first := Message{Source: "armin", Destination: "lunwen", Kind: "MLV", Content: strings.Repeat("1", 5*FRAGMENT_SIZE)}
+	second := Message{Source: "armin", Destination: "lunwen", Kind: "MLV", Content: strings.Repeat("2", 2*FRAGMENT_SIZE)}
+	dialLink.writeMessage(&first)
+	dialLink.writeMessage(&second)
+
+	for _, expected := range []Message{first, second} {
+		got, err := acceptLink.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Content != expected.Content {
+			t.Errorf("Expected the transfers in the order they were started, got %d bytes of %q", len(got.Content), got.Content[:1])
+		}
+	}
+}
+
+func TestLargeMessageWithCompression(t *testing.T) {
+	dialLink, acceptLink := linkPair(t, true, true)
+	messages := []Message{
+		{Source: "armin", Destination: "lunwen", Kind: "MPD", Content: "R|100|83"},
+		{Source: "armin", Destination: "lunwen", Kind: "MLV", Content: strings.Repeat("CGS|4|armin|23|3|", 10000)},
+	}
+	go func() {
+		for i := range messages {
+			dialLink.writeMessage(&messages[i])
+		}
+	}()
+	received := map[string]string{}
+	for range messages {
+		message, err := acceptLink.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[message.Kind] = message.Content
+	}
+	for _, message := range messages {
+		if received[message.Kind] != message.Content {
+			t.Errorf("%s message changed over a compressed link.", message.Kind)
+		}
+	}
+}
+
+func TestCancelledTransferIsDropped(t *testing.T) {
+	dialLink, acceptLink := linkPair(t, false, false)
+	drainProgress()
+	level := Message{Source: "armin", Destination: "lunwen", Kind: "MLV", Content: strings.Repeat("x", 10*FRAGMENT_SIZE)}
+	dialLink.writeMessage(&level)
+
+	/* take one fragment, then cancel the rest */
+	if _, _, _, err := acceptLink.readFrame(); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan Message, 1)
+	go func() {
+		for {
+			message, err := acceptLink.readMessage()
+			if err != nil {
+				return
+			}
+			received <- message
+		}
+	}()
+	dialLink.cancelTransfers()
+	waitForProgress(t, func(progress TransferProgress) bool {
+		return progress.Outgoing && progress.Err == ErrTransferCancelled
+	})
+
+	/* the abort frame went out before this one */
+	go dialLink.writeMessage(&Message{Source: "armin", Destination: "lunwen", Kind: "MPD", Content: "S|250|83"})
+	select {
+	case message := <-received:
+		if message.Kind != "MPD" {
+			t.Errorf("Cancelled transfer was delivered.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Small message after the cancelled transfer never arrived.")
+	}
+	if len(acceptLink.reassemblies) != 0 {
+		t.Errorf("Receiver kept the cancelled transfer's fragments.")
+	}
+}
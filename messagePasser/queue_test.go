@@ -6,11 +6,11 @@ import (
 )
 
 func TestPush(t *testing.T) {
-	msg0 := Message{"Lunwen", "Armin", "Hi Armin!", "Regular", 1, []int{}}
-	msg1 := Message{"Armin", "Lunwen", "Hi Lunwen!", "Regular", 1, []int{}}
+	msg0 := Message{Source: "Lunwen", Destination: "Armin", Content: "Hi Armin!", Kind: "Regular", SeqNum: 1, Timestamp: []int{}}
+	msg1 := Message{Source: "Armin", Destination: "Lunwen", Content: "Hi Lunwen!", Kind: "Regular", SeqNum: 1, Timestamp: []int{}}
 	queue := make([]Message, 2, 5)
 	queue[0], queue[1] = msg0, msg1
-	msg2 := Message{"Daniel", "", "Hi All!", "Multicast", 1, []int{}}
+	msg2 := Message{Source: "Daniel", Destination: "", Content: "Hi All!", Kind: "Multicast", SeqNum: 1, Timestamp: []int{}}
 	Push(&queue, msg2)
 	if !reflect.DeepEqual(queue[2], msg2) {
 		t.Errorf("Message was not pushed to queue.\nQueue:%+v\nMessage:%v", queue, msg2)
@@ -18,9 +18,9 @@ func TestPush(t *testing.T) {
 }
 
 func TestPop(t *testing.T) {
-	msg0 := Message{"Lunwen", "Armin", "Hi Armin!", "Regular", 1, []int{}}
-	msg1 := Message{"Armin", "Lunwen", "Hi Lunwen!", "Regular", 1, []int{}}
-	msg2 := Message{"Daniel", "", "Hi All!", "Multicast", 1, []int{}}
+	msg0 := Message{Source: "Lunwen", Destination: "Armin", Content: "Hi Armin!", Kind: "Regular", SeqNum: 1, Timestamp: []int{}}
+	msg1 := Message{Source: "Armin", Destination: "Lunwen", Content: "Hi Lunwen!", Kind: "Regular", SeqNum: 1, Timestamp: []int{}}
+	msg2 := Message{Source: "Daniel", Destination: "", Content: "Hi All!", Kind: "Multicast", SeqNum: 1, Timestamp: []int{}}
 	queue := make([]Message, 3, 5)
 	queue[0], queue[1], queue[2] = msg0, msg1, msg2
 
@@ -31,9 +31,9 @@ func TestPop(t *testing.T) {
 }
 
 func TestDelete(t *testing.T) {
-	msg0 := Message{"Lunwen", "Armin", "Hi Armin!", "Regular", 1, []int{}}
-	msg1 := Message{"Armin", "Lunwen", "Hi Lunwen!", "Regular", 1, []int{}}
-	msg2 := Message{"Daniel", "", "Hi All!", "Multicast", 1, []int{}}
+	msg0 := Message{Source: "Lunwen", Destination: "Armin", Content: "Hi Armin!", Kind: "Regular", SeqNum: 1, Timestamp: []int{}}
+	msg1 := Message{Source: "Armin", Destination: "Lunwen", Content: "Hi Lunwen!", Kind: "Regular", SeqNum: 1, Timestamp: []int{}}
+	msg2 := Message{Source: "Daniel", Destination: "", Content: "Hi All!", Kind: "Multicast", SeqNum: 1, Timestamp: []int{}}
 	queue := make([]Message, 3, 5)
 	queue[0], queue[1], queue[2] = msg0, msg1, msg2
 
@@ -44,10 +44,10 @@ func TestDelete(t *testing.T) {
 }
 
 func TestInsert(t *testing.T) {
-	msg0 := Message{"Lunwen", "Armin", "Hi Armin!", "Regular", 1, []int{}}
-	msg1 := Message{"Armin", "Lunwen", "Hi Lunwen!", "Regular", 1, []int{}}
-	msg2 := Message{"Daniel", "", "Hi All!", "Multicast", 1, []int{}}
-	msg3 := Message{"Garrett", "", "Heeey!!", "Multicast", 1, []int{}}
+	msg0 := Message{Source: "Lunwen", Destination: "Armin", Content: "Hi Armin!", Kind: "Regular", SeqNum: 1, Timestamp: []int{}}
+	msg1 := Message{Source: "Armin", Destination: "Lunwen", Content: "Hi Lunwen!", Kind: "Regular", SeqNum: 1, Timestamp: []int{}}
+	msg2 := Message{Source: "Daniel", Destination: "", Content: "Hi All!", Kind: "Multicast", SeqNum: 1, Timestamp: []int{}}
+	msg3 := Message{Source: "Garrett", Destination: "", Content: "Heeey!!", Kind: "Multicast", SeqNum: 1, Timestamp: []int{}}
 
 	queue := make([]Message, 1, 4)
 	queue[0] = msg0
@@ -0,0 +1,227 @@
+////////////////////////////////////////////////////////////
+//Multegula - ratelimit.go
+//Per-sender, per-kind rate limits on received messages
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/*
+ * Every node gets a token bucket per message kind, keyed by the Source
+ * of the messages it creates, which the signature check vouches for.
+ * The peers re-multicasting a node's messages don't use up their own
+ * buckets, and echoes of a message already received are dropped before
+ * they are counted. A bucket holds up to Burst messages and refills at
+ * Rate messages per second. A message arriving at an empty bucket is
+ * handled by the policy:
+ * drop: drop the message
+ * delay: stop reading from the connection it came on until the bucket
+ *	refills
+ * disconnect: close the connection it came on if the node sent it itself,
+ *	that node is reported dead; a message another peer passed on is
+ *	dropped
+ * Messages over the limit are dropped before they are delivered, so
+ * they are never re-multicast to the other nodes either.
+ */
+const RATE_LIMIT_DROP string = "drop"
+const RATE_LIMIT_DELAY string = "delay"
+const RATE_LIMIT_DISCONNECT string = "disconnect"
+
+type RateLimit struct {
+	Kind   string  // the kind of message, "" for every other kind
+	Rate   float64 // messages per second
+	Burst  int     // messages allowed at once
+	Policy string  // drop, delay or disconnect
+}
+
+/*
+ * used when messagePasser/ratelimits.json is missing
+ */
+var DEFAULT_RATE_LIMITS = []RateLimit{
+	{Kind: defs.MSG_PADDLE_DIR, Rate: 100, Burst: 200, Policy: RATE_LIMIT_DROP},
+	{Kind: defs.MSG_BULLY_ELECTION, Rate: 10, Burst: 20, Policy: RATE_LIMIT_DROP},
+	{Kind: "", Rate: 500, Burst: 1000, Policy: RATE_LIMIT_DELAY},
+}
+
+/* a node that went over a limit */
+type RateLimitHit struct {
+	Peer    string // the Source of the messages
+	Kind    string
+	Policy  string
+	Count   int // messages over the limit so far
+	First   time.Time
+	Last    time.Time
+	limited bool // still over the limit, only the start of a flood is printed
+}
+
+type bucketKey struct {
+	peer string
+	kind string
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mutex   sync.Mutex
+	limits  []RateLimit
+	buckets map[bucketKey]*tokenBucket
+	hits    map[bucketKey]*RateLimitHit
+	now     func() time.Time
+}
+
+func newRateLimiter(limits []RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		buckets: make(map[bucketKey]*tokenBucket),
+		hits:    make(map[bucketKey]*RateLimitHit),
+		now:     time.Now,
+	}
+}
+
+/* limits on the messages received from peers */
+var receiveLimiter *rateLimiter = newRateLimiter(DEFAULT_RATE_LIMITS)
+
+/* init function, decode rate limits from ratelimits.json */
+func initRateLimits() {
+	file, errOpenFile := os.Open("./messagePasser/ratelimits.json")
+	if errOpenFile != nil {
+		fmt.Println("No rate limits file, using the defaults")
+		return
+	}
+	defer file.Close()
+	limits := []RateLimit{}
+	if errDecode := json.NewDecoder(file).Decode(&limits); errDecode != nil {
+		fmt.Println("error when decoding rate limits: ", errDecode)
+		return
+	}
+	if err := SetRateLimits(limits); err != nil {
+		fmt.Println("error in rate limits: ", err)
+	}
+}
+
+/*
+ * replaces the rate limits, this is a public method
+ * @param	limits – checked in order, the first one with the message's
+ *			kind applies, otherwise the first one with an empty kind
+ * @return	an error if a limit is invalid, the old limits are kept then
+ **/
+func SetRateLimits(limits []RateLimit) error {
+	for _, limit := range limits {
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return fmt.Errorf("Rate limit for %q needs a positive rate and burst", limit.Kind)
+		}
+		switch limit.Policy {
+		case RATE_LIMIT_DROP, RATE_LIMIT_DELAY, RATE_LIMIT_DISCONNECT:
+		default:
+			return fmt.Errorf("Unknown rate limit policy %q", limit.Policy)
+		}
+	}
+	receiveLimiter.mutex.Lock()
+	receiveLimiter.limits = limits
+	receiveLimiter.buckets = make(map[bucketKey]*tokenBucket)
+	receiveLimiter.mutex.Unlock()
+	return nil
+}
+
+/*
+ * a public method that returns the peers that went over a limit,
+ * most recent first
+ */
+func GetRateLimitHits() []RateLimitHit {
+	receiveLimiter.mutex.Lock()
+	hits := []RateLimitHit{}
+	for _, hit := range receiveLimiter.hits {
+		hits = append(hits, *hit)
+	}
+	receiveLimiter.mutex.Unlock()
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Last.After(hits[j].Last) })
+	return hits
+}
+
+/*
+ * finds the limit for a kind of message
+ */
+func (limiter *rateLimiter) limitFor(kind string) (RateLimit, bool) {
+	var fallback *RateLimit
+	for i, limit := range limiter.limits {
+		if limit.Kind == kind {
+			return limit, true
+		}
+		if len(limit.Kind) == 0 && fallback == nil {
+			fallback = &limiter.limits[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return RateLimit{}, false
+}
+
+/*
+ * takes a token for a message received from a node
+ * @param	peer – the message's Source
+ * @param	kind – the message's Kind
+ * @return	"" if the message is within its limit, the policy otherwise.
+ *			For delay, how long to wait, the token is already taken.
+ **/
+func (limiter *rateLimiter) take(peer string, kind string) (string, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limit, ok := limiter.limitFor(kind)
+	if !ok {
+		return "", 0
+	}
+	now := limiter.now()
+	key := bucketKey{peer, kind}
+	bucket, exists := limiter.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limit.Rate
+	if bucket.tokens > float64(limit.Burst) {
+		bucket.tokens = float64(limit.Burst)
+	}
+	bucket.last = now
+
+	hit := limiter.hits[key]
+	if bucket.tokens >= 1 {
+		bucket.tokens -= 1
+		if hit != nil {
+			hit.limited = false
+		}
+		return "", 0
+	}
+
+	if hit == nil {
+		hit = &RateLimitHit{Peer: peer, Kind: kind, First: now}
+		limiter.hits[key] = hit
+	}
+	hit.Policy = limit.Policy
+	hit.Count += 1
+	hit.Last = now
+	if !hit.limited {
+		hit.limited = true
+		fmt.Printf("RATE LIMIT: %s sent %s faster than %v/s, %s\n", peer, kind, limit.Rate, limit.Policy)
+	}
+
+	if limit.Policy == RATE_LIMIT_DELAY {
+		bucket.tokens -= 1
+		return limit.Policy, time.Duration((-bucket.tokens) / limit.Rate * float64(time.Second))
+	}
+	return limit.Policy, 0
+}
@@ -0,0 +1,227 @@
+package messagePasser
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+/* a limiter with a clock the test moves by hand */
+func testLimiter(limits []RateLimit) (*rateLimiter, *time.Time) {
+	clock := time.Unix(1000, 0)
+	limiter := newRateLimiter(limits)
+	limiter.now = func() time.Time { return clock }
+	return limiter, &clock
+}
+
+func TestRateLimitBurstAndRefill(t *testing.T) {
+	limiter, clock := testLimiter([]RateLimit{{Kind: "MPD", Rate: 10, Burst: 3, Policy: RATE_LIMIT_DROP}})
+	for i := 0; i < 3; i++ {
+		if policy, _ := limiter.take("lunwen", "MPD"); policy != "" {
+			t.Fatalf("Message %d of the burst was limited", i)
+		}
+	}
+	if policy, _ := limiter.take("lunwen", "MPD"); policy != RATE_LIMIT_DROP {
+		t.Errorf("Message over the burst should be dropped, got %q", policy)
+	}
+	if policy, _ := limiter.take("daniel", "MPD"); policy != "" {
+		t.Errorf("Other peers have their own buckets.")
+	}
+	if policy, _ := limiter.take("lunwen", "MUE"); policy != "" {
+		t.Errorf("Kinds without a limit should pass.")
+	}
+	*clock = clock.Add(100 * time.Millisecond)
+	if policy, _ := limiter.take("lunwen", "MPD"); policy != "" {
+		t.Errorf("Bucket should have refilled one token.")
+	}
+}
+
+func TestRateLimitDelayAndFallback(t *testing.T) {
+	limiter, _ := testLimiter([]RateLimit{
+		{Kind: "MPD", Rate: 100, Burst: 100, Policy: RATE_LIMIT_DROP},
+		{Kind: "", Rate: 10, Burst: 1, Policy: RATE_LIMIT_DELAY},
+	})
+	limiter.take("lunwen", "MUE")
+	policy, wait := limiter.take("lunwen", "MUE")
+	if policy != RATE_LIMIT_DELAY || wait != 100*time.Millisecond {
+		t.Errorf("Expected a 100ms delay, got %q %v", policy, wait)
+	}
+	if _, wait = limiter.take("lunwen", "MUE"); wait != 200*time.Millisecond {
+		t.Errorf("Delayed messages should queue behind each other, got %v", wait)
+	}
+	if policy, _ := limiter.take("lunwen", "MUU"); policy != "" {
+		t.Errorf("The fallback limit is per kind too.")
+	}
+}
+
+func TestRateLimitHitsAreLogged(t *testing.T) {
+	limiter, clock := testLimiter([]RateLimit{{Kind: "MUE", Rate: 1, Burst: 1, Policy: RATE_LIMIT_DROP}})
+	for i := 0; i < 5; i++ {
+		limiter.take("garrett", "MUE")
+	}
+	*clock = clock.Add(time.Second)
+	limiter.take("garrett", "MUE")
+	hit := limiter.hits[bucketKey{"garrett", "MUE"}]
+	if hit == nil || hit.Count != 4 || hit.Policy != RATE_LIMIT_DROP || hit.limited {
+		t.Errorf("Unexpected log entry: %+v", hit)
+	}
+}
+
+func TestSetRateLimitsValidates(t *testing.T) {
+	invalid := [][]RateLimit{
+		{{Kind: "MPD", Rate: 0, Burst: 1, Policy: RATE_LIMIT_DROP}},
+		{{Kind: "MPD", Rate: 1, Burst: 0, Policy: RATE_LIMIT_DROP}},
+		{{Kind: "MPD", Rate: 1, Burst: 1, Policy: "ignore"}},
+	}
+	for _, limits := range invalid {
+		if err := SetRateLimits(limits); err == nil {
+			t.Errorf("Limits %+v should be rejected.", limits)
+		}
+	}
+}
+
+func TestRateLimitDisconnectsFlooder(t *testing.T) {
+	LocalNode = Node{Name: "armin"}
+	PeerNodes = Nodes{}
+	LocalIndex = 0
+	vectorTimeStamp = []int{0} // for the lost peer's notice
+	authRequired = false
+	if err := SetRateLimits([]RateLimit{{Kind: "TEST_FLOOD", Rate: 1, Burst: 2, Policy: RATE_LIMIT_DISCONNECT}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetRateLimits(DEFAULT_RATE_LIMITS)
+
+	dialLink, acceptLink := linkPair(t, false, false)
+	acceptLink.name = "flooder"
+	done := make(chan bool)
+	go func() {
+		receiveMessageFromConn(acceptLink)
+		done <- true
+	}()
+	go func() {
+		for i := 0; i < 10; i++ {
+			message := Message{Source: "flooder", Destination: "armin", Kind: "TEST_FLOOD"}
+			stampMessageID(&message)
+			if dialLink.writeMessage(&message) != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Flooding peer was not disconnected.")
+	}
+	for delivered := 0; delivered < 2; delivered++ {
+		if message := <-receiveChannel; message.Kind != "TEST_FLOOD" {
+			t.Errorf("Expected the burst, got %+v", message)
+		}
+	}
+	if len(receiveChannel) != 0 {
+		t.Errorf("Messages over the limit were delivered.")
+	}
+}
+
+func TestRateLimitChargesTheSenderNotEchoes(t *testing.T) {
+	LocalNode = Node{Name: "armin"}
+	PeerNodes = Nodes{}
+	LocalIndex = 0
+	vectorTimeStamp = []int{0} // for the lost peer's notice
+	authRequired = false
+	if err := SetRateLimits([]RateLimit{{Kind: "TEST_RELAYED", Rate: 0.01, Burst: 2, Policy: RATE_LIMIT_DROP}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetRateLimits(DEFAULT_RATE_LIMITS)
+
+	dialLink, acceptLink := linkPair(t, false, false)
+	acceptLink.name = "lunwen"
+	go receiveMessageFromConn(acceptLink)
+	defer dialLink.conn.Close()
+
+	/* lunwen passes on two of daniel's messages twice, then sends its own */
+	relayed := []Message{}
+	for i := 0; i < 3; i++ {
+		message := Message{Source: "daniel", Destination: "armin", Kind: "TEST_RELAYED", Content: fmt.Sprint(i)}
+		stampMessageID(&message)
+		relayed = append(relayed, message)
+	}
+	own := Message{Source: "lunwen", Destination: "armin", Kind: "TEST_RELAYED", Content: "lunwen"}
+	stampMessageID(&own)
+	for _, message := range []Message{relayed[0], relayed[1], relayed[0], relayed[1], own, relayed[2]} {
+		if err := dialLink.writeMessage(&message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, content := range []string{"0", "1", "lunwen"} {
+		select {
+		case message := <-receiveChannel:
+			if message.Content != content {
+				t.Errorf("Expected %s, got %+v", content, message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message %s within the sender's limit never arrived.", content)
+		}
+	}
+	select {
+	case message := <-receiveChannel:
+		t.Errorf("daniel's third message went over its limit, but was delivered: %+v", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for _, hit := range GetRateLimitHits() {
+		if hit.Kind == "TEST_RELAYED" && hit.Peer != "daniel" {
+			t.Errorf("The limit was charged to %s instead of daniel.", hit.Peer)
+		}
+	}
+}
+
+func TestRateLimitKeepsThePeerPassingOnAFlood(t *testing.T) {
+	LocalNode = Node{Name: "armin"}
+	PeerNodes = Nodes{}
+	LocalIndex = 0
+	vectorTimeStamp = []int{0} // for the lost peer's notice
+	authRequired = false
+	if err := SetRateLimits([]RateLimit{{Kind: "TEST_PASSED_ON", Rate: 0.01, Burst: 2, Policy: RATE_LIMIT_DISCONNECT}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetRateLimits(DEFAULT_RATE_LIMITS)
+
+	dialLink, acceptLink := linkPair(t, false, false)
+	acceptLink.name = "lunwen"
+	done := make(chan bool, 1)
+	go func() {
+		receiveMessageFromConn(acceptLink)
+		done <- true
+	}()
+	defer dialLink.conn.Close()
+
+	/* lunwen re-multicasts daniel's flood, then sends its own message */
+	for i := 0; i < 10; i++ {
+		message := Message{Source: "daniel", Destination: "armin", Kind: "TEST_PASSED_ON", Content: fmt.Sprint(i)}
+		stampMessageID(&message)
+		if err := dialLink.writeMessage(&message); err != nil {
+			t.Fatalf("lunwen was cut off for daniel's flood: %v", err)
+		}
+	}
+	own := Message{Source: "lunwen", Destination: "armin", Kind: "TEST_PASSED_ON", Content: "lunwen"}
+	stampMessageID(&own)
+	if err := dialLink.writeMessage(&own); err != nil {
+		t.Fatalf("lunwen was cut off for daniel's flood: %v", err)
+	}
+
+	for _, content := range []string{"0", "1", "lunwen"} {
+		select {
+		case message := <-receiveChannel:
+			if message.Content != content {
+				t.Errorf("Expected %s, got %+v", content, message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message %s never arrived.", content)
+		}
+	}
+	select {
+	case <-done:
+		t.Errorf("The link to lunwen was closed for daniel's flood.")
+	default:
+	}
+}
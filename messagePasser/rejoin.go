@@ -0,0 +1,213 @@
+////////////////////////////////////////////////////////////
+//Multegula - rejoin.go
+//Players coming back to a game they left
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+ * A player whose client went away can come back to its game with the
+ * same name and signing key, see LocalKey. The players keep their port
+ * open once the group is linked, and a player coming back dials every
+ * one of them and sends a REJOIN_KIND message signed with its key. A
+ * player that knows the name and the key replaces the link it lost and
+ * answers with a REJOIN_KIND message of its own, carrying the multicasts
+ * and direct messages it has delivered. The player coming back counts
+ * from there: the messages it missed are counted as delivered, so the
+ * next ones are ready right away, and its own messages are the next ones
+ * the others expect. What happened in the game while it was gone is up
+ * to the application to catch up on. Players that can't be reached
+ * within REJOIN_TIMEOUT are reported lost; coming back through the relay
+ * isn't supported.
+ */
+const REJOIN_KIND string = "rejoin"
+const REJOIN_TIMEOUT = 10 * time.Second
+
+/*
+ * the timestamp we came back with, nil if we didn't. Guarded by
+ * timestampMutex.
+ */
+var rejoinedAt []int
+
+/*
+ * checks if a multicast is one of those we counted as delivered when we
+ * came back to the game. Must be called with timestampMutex held.
+ * @param	message – a multicast
+ * @param	sourceIndex – the index of the message's Source
+ **/
+func countedAtRejoin(message Message, sourceIndex int) bool {
+	if len(rejoinedAt) == 0 || sourceIndex < 0 || sourceIndex >= len(rejoinedAt) ||
+		len(message.Timestamp) != len(rejoinedAt) {
+		return false
+	}
+	return message.Timestamp[sourceIndex] <= rejoinedAt[sourceIndex]
+}
+
+/*
+ * takes a player coming back to the game, replacing the link we had to it
+ * @param	link – the link the player dialed
+ * @param	hello – the first message on the link
+ **/
+func acceptRejoin(link *peerLink, hello Message) {
+	index, _, err := FindNodeByName(PeerNodes, hello.Source)
+	if err == nil && hello.Source == LocalNode.Name {
+		err = errors.New("We can't come back to ourselves")
+	}
+	if err == nil {
+		err = verifyMessage(&hello)
+	}
+	if err != nil {
+		fmt.Printf("Rejecting %s coming back: %v\n", hello.Source, err)
+		link.conn.Close()
+		return
+	}
+
+	welcome := Message{Source: LocalNode.Name, Destination: hello.Source, Kind: REJOIN_KIND}
+	timestampMutex.Lock()
+	resetDirectClock()
+	size := len(PeerNodes)
+	// the direct messages its old client sent us and we didn't get are lost
+	directDelivered[index] = directClock[index*size+LocalIndex]
+	welcome.Timestamp = make([]int, len(vectorTimeStamp))
+	copy(welcome.Timestamp, vectorTimeStamp)
+	welcome.DirectClock = make([]int, len(directClock))
+	copy(welcome.DirectClock, directClock)
+	timestampMutex.Unlock()
+	stampMessageID(&welcome)
+	signMessage(&welcome)
+	if err := link.writeMessage(&welcome); err != nil {
+		fmt.Printf("Couldn't welcome %s back: %v\n", hello.Source, err)
+		link.conn.Close()
+		return
+	}
+
+	lost, _ := getLink(hello.Source)
+	addLink(hello.Source, link)
+	if lost != nil {
+		lost.cancelTransfers()
+		lost.conn.Close()
+	}
+	fmt.Printf("%s is back in the game\n", hello.Source)
+	startReceiving(link)
+}
+
+/*
+ * comes back to a game we left, this is a public method to call instead
+ * of InitMessagePasser. Our signing key has to be the one we played
+ * with, see SetLocalKey.
+ * @param	nodes – the group, the local node included
+ * @param	localName – our name in the group
+ **/
+func RejoinMessagePasser(nodes Nodes, localName string) {
+	initGroup(nodes, localName)
+
+	// only the link to ourselves is made the way InitMessagePasser does
+	wg.Add(2)
+	go acceptConnection(map[string]Node{localName: LocalNode})
+	go sendConnection(map[string]Node{localName: LocalNode})
+	wg.Wait()
+
+	welcomes := []Message{}
+	lost := []string{}
+	for _, node := range PeerNodes {
+		if node.Name == LocalNode.Name {
+			continue
+		}
+		welcome, err := rejoinPeer(node)
+		if err != nil {
+			fmt.Printf("Couldn't come back to %s: %v\n", node.Name, err)
+			lost = append(lost, node.Name)
+			continue
+		}
+		welcomes = append(welcomes, welcome)
+	}
+	resumeFrom(welcomes)
+
+	startReceiveRoutines()
+	go sendMessageToConn()
+	for _, name := range lost {
+		reportLostNode(name)
+	}
+}
+
+/*
+ * dials a player of our game and asks it to take us back
+ * @param	node – the player
+ *
+ * @return	its welcome, with the messages it has delivered
+ **/
+func rejoinPeer(node Node) (Message, error) {
+	started := time.Now()
+	link, err := dialLink(node)
+	for err != nil && time.Since(started) < REJOIN_TIMEOUT {
+		time.Sleep(time.Second * 1)
+		link, err = dialLink(node)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	hello := Message{Source: LocalNode.Name, Destination: node.Name, Kind: REJOIN_KIND}
+	stampMessageID(&hello)
+	signMessage(&hello)
+	if err := link.writeMessage(&hello); err != nil {
+		link.conn.Close()
+		return Message{}, err
+	}
+	link.conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	welcome, err := link.readMessage()
+	link.conn.SetReadDeadline(time.Time{})
+	if err == nil && (welcome.Kind != REJOIN_KIND || welcome.Source != node.Name) {
+		err = errors.New("Not taken back by " + node.Name)
+	}
+	if err == nil {
+		err = verifyMessage(&welcome)
+	}
+	if err != nil {
+		link.conn.Close()
+		return Message{}, err
+	}
+	addLink(node.Name, link)
+	return welcome, nil
+}
+
+/*
+ * counts the messages the players we came back to have delivered as
+ * delivered here too
+ * @param	welcomes – the welcomes of the players
+ **/
+func resumeFrom(welcomes []Message) {
+	timestampMutex.Lock()
+	defer timestampMutex.Unlock()
+	resetDirectClock()
+	size := len(PeerNodes)
+	for _, welcome := range welcomes {
+		UpdateTimestamp(&vectorTimeStamp, &welcome.Timestamp)
+		if len(welcome.DirectClock) != len(directClock) {
+			continue
+		}
+		for i, value := range welcome.DirectClock {
+			if value > directClock[i] {
+				directClock[i] = value
+			}
+		}
+	}
+	// every player knows best what it sent us and what it got from us
+	for _, welcome := range welcomes {
+		index, _, err := FindNodeByName(PeerNodes, welcome.Source)
+		if err != nil || len(welcome.DirectClock) != len(directClock) {
+			continue
+		}
+		directDelivered[index] = welcome.DirectClock[index*size+LocalIndex]
+		directClock[LocalIndex*size+index] = welcome.DirectClock[LocalIndex*size+index]
+	}
+	localReceivedSeqNum = vectorTimeStamp[LocalIndex]
+	rejoinedAt = make([]int, len(vectorTimeStamp))
+	copy(rejoinedAt, vectorTimeStamp)
+}
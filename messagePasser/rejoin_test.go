@@ -0,0 +1,122 @@
+package messagePasser
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/*
+ * the other player of TestPlayerComesBack runs in a process of its own,
+ * this test binary started again with REJOIN_HELPER_ENV set to "play" or
+ * "rejoin"
+ */
+const REJOIN_HELPER_ENV string = "MULTEGULA_REJOIN_HELPER"
+const REJOIN_NODES_ENV string = "MULTEGULA_REJOIN_NODES"
+const REJOIN_KEY_ENV string = "MULTEGULA_REJOIN_KEY"
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+/* waits for a message of a kind from source, skipping the others */
+func expectMessage(t *testing.T, source string, kind string, content string) {
+	deadline := time.After(20 * time.Second)
+	for {
+		select {
+		case message := <-receiveChannel:
+			if message.Source == source && message.Kind == kind && (len(content) == 0 || message.Content == content) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("No %s %q from %s.", kind, content, source)
+		}
+	}
+}
+
+func TestRejoinHelper(t *testing.T) {
+	mode := os.Getenv(REJOIN_HELPER_ENV)
+	if len(mode) == 0 {
+		t.Skip("Only run by TestPlayerComesBack.")
+	}
+	var nodes Nodes
+	if err := json.Unmarshal([]byte(os.Getenv(REJOIN_NODES_ENV)), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetLocalKey(os.Getenv(REJOIN_KEY_ENV)); err != nil {
+		t.Fatal(err)
+	}
+	if mode == "play" {
+		InitMessagePasser(nodes, "lunwen")
+		Multicast(&Message{Source: "lunwen", Kind: defs.MSG_PADDLE_DIR, Content: "before"})
+		expectMessage(t, "armin", defs.MSG_PADDLE_DIR, "before")
+		// gone without a word
+		os.Exit(0)
+	}
+	RejoinMessagePasser(nodes, "lunwen")
+	Multicast(&Message{Source: "lunwen", Kind: defs.MSG_PADDLE_DIR, Content: "back"})
+	expectMessage(t, "armin", defs.MSG_PADDLE_DIR, "welcome back")
+}
+
+func TestPlayerComesBack(t *testing.T) {
+	peers, local, index, auth, key := PeerNodes, LocalNode, LocalIndex, authRequired, localPrivateKey
+	defer func() {
+		closeLinks()
+		timestampMutex.Lock()
+		PeerNodes, LocalNode, LocalIndex, authRequired, localPrivateKey = peers, local, index, auth, key
+		vectorTimeStamp, localReceivedSeqNum, rejoinedAt = []int{0}, 0, nil
+		timestampMutex.Unlock()
+	}()
+
+	lunwenKey, _ := GenerateLocalKey()
+	lunwenPrivateKey := LocalKey()
+	arminKey, _ := GenerateLocalKey()
+	nodes := Nodes{
+		{Name: "armin", IP: "127.0.0.1", Port: freePort(t), Key: arminKey},
+		{Name: "lunwen", IP: "127.0.0.1", Port: freePort(t), Key: lunwenKey},
+	}
+	encoded, _ := json.Marshal(nodes)
+	var output bytes.Buffer
+	lunwen := func(mode string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestRejoinHelper$")
+		cmd.Env = append(os.Environ(), REJOIN_HELPER_ENV+"="+mode, REJOIN_NODES_ENV+"="+string(encoded),
+			REJOIN_KEY_ENV+"="+lunwenPrivateKey)
+		cmd.Stdout, cmd.Stderr = &output, &output
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return cmd
+	}
+	defer func() {
+		if t.Failed() {
+			t.Logf("lunwen's output:\n%s", output.String())
+		}
+	}()
+
+	first := lunwen("play")
+	InitMessagePasser(nodes, "armin")
+	expectMessage(t, "lunwen", defs.MSG_PADDLE_DIR, "before")
+	Multicast(&Message{Source: "armin", Kind: defs.MSG_PADDLE_DIR, Content: "before"})
+	first.Wait()
+	expectMessage(t, "armin", defs.MSG_DEAD_NODE, "")
+
+	// lunwen's messages must be the next ones we expect, and ours the next ones for lunwen
+	second := lunwen("rejoin")
+	expectMessage(t, "lunwen", defs.MSG_PADDLE_DIR, "back")
+	Multicast(&Message{Source: "armin", Kind: defs.MSG_PADDLE_DIR, Content: "welcome back"})
+	if err := second.Wait(); err != nil {
+		t.Fatalf("lunwen didn't get back into the game: %v", err)
+	}
+	expectMessage(t, "armin", defs.MSG_DEAD_NODE, "")
+}
@@ -0,0 +1,390 @@
+////////////////////////////////////////////////////////////
+//Multegula - relay.go
+//Tunnelling peer connections through the bootstrap server
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arminm/multegula/defs"
+	"github.com/arminm/multegula/tlsTransport"
+)
+
+/*
+ * A player behind NAT can't accept the connections of the players with
+ * smaller names. When dialing a peer keeps failing for RELAY_AFTER, both
+ * sides connect to the relay instead: the dialer asks for a DIAL to the
+ * peer, the peer, still missing the connection, asks to ACCEPT from the
+ * dialer. The relay pairs the two, answers OK to both and then copies
+ * bytes between them, so the usual handshake, TLS included, runs end to
+ * end and the relay can't read or forge messages. Direct connections are
+ * always tried first.
+ *
+ * The relay opens with a line of its own, MRELAY|<nonce>. A request is a
+ * single line: MRELAY|DIAL|<from>|<to>|<game>|<signature> or
+ * MRELAY|ACCEPT|<from>|<to>|<game>|<signature>, where from is always the
+ * dialing node and game the ID of the game from our ticket. The node
+ * asking, from for a DIAL and to for an ACCEPT, signs the nonce and the
+ * request with its key, and the relay checks it against the key the
+ * player has in that game, so nobody else can take its place or replace
+ * a request it is waiting with.
+ */
+const RELAY_MAGIC string = "MRELAY"
+const RELAY_DIAL string = "DIAL"
+const RELAY_ACCEPT string = "ACCEPT"
+const RELAY_OK string = "OK"
+const RELAY_AFTER = 5 * time.Second
+const RELAY_WAIT = 60 * time.Second
+const MAX_RELAY_LINE int = 512
+const RELAY_NONCE_BYTES int = 16
+
+/* the relay to fall back on, "" if there is none */
+var relayAddress string = ""
+
+/* the ID of our game, which the relay knows our key in */
+var relayGame string = ""
+
+/*
+ * sets the relay used for peers that can't be reached directly, this is a
+ * public method and has to be called before InitMessagePasser
+ * @param	address – host:port of the relay, "" to turn relaying off
+ **/
+func SetRelay(address string) {
+	relayAddress = address
+}
+
+/*
+ * sets the game we ask the relay for connections in, this is a public
+ * method and has to be called before InitMessagePasser
+ * @param	gameID – the game's ID, from the bootstrap server's ticket
+ **/
+func SetRelayGame(gameID string) {
+	relayGame = gameID
+}
+
+/*
+ * the key of a player in a game, for the relay to check its requests
+ * with
+ * @return	the player's base64 public key, false if there is no such player
+ **/
+type RelayKeys func(gameID string, name string) (string, bool)
+
+type RelayRequest struct {
+	Side      string // RELAY_DIAL or RELAY_ACCEPT
+	From      string // the node dialing
+	To        string // the node accepting
+	Game      string // the ID of the game both are in
+	Signature string // base64, see relayDigest
+}
+
+func (request RelayRequest) String() string {
+	return strings.Join([]string{RELAY_MAGIC, request.Side, request.From, request.To, request.Game, request.Signature},
+		defs.PAYLOAD_DELIMITER) + "\n"
+}
+
+/*
+ * the node that has to sign the request
+ */
+func (request RelayRequest) signer() string {
+	if request.Side == RELAY_DIAL {
+		return request.From
+	}
+	return request.To
+}
+
+/*
+ * the request without its signature, what the relay pairs requests by
+ */
+func (request RelayRequest) unsigned() RelayRequest {
+	request.Signature = ""
+	return request
+}
+
+/*
+ * the bytes a request's signature covers, the relay's nonce included so
+ * that a request seen once can't be sent again
+ */
+func relayDigest(nonce string, request RelayRequest) []byte {
+	return []byte(strings.Join([]string{RELAY_MAGIC, nonce, request.Side, request.From, request.To, request.Game},
+		defs.PAYLOAD_DELIMITER))
+}
+
+/*
+ * reads a single line without reading past it, the rest of the stream
+ * belongs to the peers
+ */
+func readRelayLine(conn net.Conn) (string, error) {
+	line := []byte{}
+	buffer := make([]byte, 1)
+	for len(line) < MAX_RELAY_LINE {
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return "", err
+		}
+		if buffer[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, buffer[0])
+	}
+	return "", errors.New("Relay line too long")
+}
+
+/*
+ * reads the request a node opens a relay connection with
+ */
+func readRelayRequest(conn net.Conn) (RelayRequest, error) {
+	line, err := readRelayLine(conn)
+	if err != nil {
+		return RelayRequest{}, err
+	}
+	fields := strings.Split(line, defs.PAYLOAD_DELIMITER)
+	if len(fields) != 6 || fields[0] != RELAY_MAGIC || len(fields[2]) == 0 || len(fields[3]) == 0 ||
+		len(fields[4]) == 0 || len(fields[5]) == 0 || (fields[1] != RELAY_DIAL && fields[1] != RELAY_ACCEPT) {
+		return RelayRequest{}, fmt.Errorf("Bad relay request %q", line)
+	}
+	return RelayRequest{Side: fields[1], From: fields[2], To: fields[3], Game: fields[4], Signature: fields[5]}, nil
+}
+
+/*
+ * checks that the node asking signed the request with its key in the game
+ */
+func verifyRelayRequest(request RelayRequest, nonce string, keys RelayKeys) error {
+	key, found := keys(request.Game, request.signer())
+	if !found {
+		return fmt.Errorf("%s isn't in game %s", request.signer(), request.Game)
+	}
+	signature, err := base64.StdEncoding.DecodeString(request.Signature)
+	if err != nil {
+		return err
+	}
+	return VerifySignature(Node{Name: request.signer(), Key: key}, relayDigest(nonce, request), signature)
+}
+
+/*
+ * connects to the relay and waits until the other side shows up
+ * @param	request – who we are and who we wait for
+ * @param	cancel – closing it gives up waiting, may be nil
+ **/
+func openRelay(request RelayRequest, cancel <-chan struct{}) (net.Conn, error) {
+	if len(relayAddress) == 0 {
+		return nil, errors.New("No relay")
+	}
+	if len(relayGame) == 0 || localPrivateKey == nil {
+		return nil, errors.New("The relay only takes the players of its games")
+	}
+	request.Game = relayGame
+	conn, err := net.DialTimeout("tcp", relayAddress, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(DIAL_TIMEOUT))
+	nonce, err := readRelayNonce(conn)
+	if err == nil {
+		request.Signature = base64.StdEncoding.EncodeToString(Sign(relayDigest(nonce, request)))
+		_, err = io.WriteString(conn, request.String())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	waited := make(chan struct{})
+	defer close(waited)
+	go func() {
+		select {
+		case <-cancel:
+			conn.Close()
+		case <-waited:
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(RELAY_WAIT))
+	line, err := readRelayLine(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err == nil && line != RELAY_OK {
+		err = fmt.Errorf("Relay refused: %q", line)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+/*
+ * reads the nonce the relay opens with
+ */
+func readRelayNonce(conn net.Conn) (string, error) {
+	line, err := readRelayLine(conn)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Split(line, defs.PAYLOAD_DELIMITER)
+	if len(fields) != 2 || fields[0] != RELAY_MAGIC || len(fields[1]) == 0 {
+		return "", fmt.Errorf("Not a relay: %q", line)
+	}
+	return fields[1], nil
+}
+
+/*
+ * connects to a node through the relay, with TLS end to end if enabled
+ */
+func dialRelayed(from string, to string) (net.Conn, error) {
+	conn, err := openRelay(RelayRequest{Side: RELAY_DIAL, From: from, To: to}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tlsTransport.Client(conn), nil
+}
+
+/*
+ * waits for a node to connect to us through the relay
+ */
+func acceptRelayed(from string, to string, cancel <-chan struct{}) (net.Conn, error) {
+	conn, err := openRelay(RelayRequest{Side: RELAY_ACCEPT, From: from, To: to}, cancel)
+	if err != nil {
+		return nil, err
+	}
+	return tlsTransport.Server(conn), nil
+}
+
+/* a connection accepted through the relay */
+type relayedConn struct {
+	name string
+	conn net.Conn
+}
+
+/*
+ * keeps asking the relay for a connection from a node until one arrives
+ * or cancel is closed
+ * @param	name – the node expected to dial us
+ * @param	accepted – where the connection goes
+ **/
+func acceptRelayedFrom(name string, accepted chan<- relayedConn, cancel <-chan struct{}) {
+	for {
+		conn, err := acceptRelayed(name, LocalNode.Name, cancel)
+		if err == nil {
+			select {
+			case accepted <- relayedConn{name, conn}:
+			case <-cancel:
+				conn.Close()
+			}
+			return
+		}
+		select {
+		case <-cancel:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+/*
+ * the relay side: pairs the connections of two nodes and copies
+ * between them, this is a public method for the bootstrap server
+ * @param	ln – where nodes connect to the relay
+ * @param	keys – the players' keys, only requests they signed are taken
+ **/
+func ServeRelay(ln net.Listener, keys RelayKeys) {
+	relay := &relayServer{keys: keys, waiting: make(map[RelayRequest]net.Conn)}
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		go relay.handle(conn)
+	}
+}
+
+type relayServer struct {
+	keys    RelayKeys
+	mutex   sync.Mutex
+	waiting map[RelayRequest]net.Conn // by the request without its signature
+}
+
+func (relay *relayServer) handle(conn net.Conn) {
+	buffer := make([]byte, RELAY_NONCE_BYTES)
+	if _, err := rand.Read(buffer); err != nil {
+		conn.Close()
+		return
+	}
+	nonce := hex.EncodeToString(buffer)
+	conn.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+	_, err := io.WriteString(conn, strings.Join([]string{RELAY_MAGIC, nonce}, defs.PAYLOAD_DELIMITER)+"\n")
+	var request RelayRequest
+	if err == nil {
+		request, err = readRelayRequest(conn)
+	}
+	if err == nil {
+		err = verifyRelayRequest(request, nonce, relay.keys)
+	}
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		fmt.Printf("Relay: rejecting %v: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	request = request.unsigned()
+	other := request
+	if request.Side == RELAY_DIAL {
+		other.Side = RELAY_ACCEPT
+	} else {
+		other.Side = RELAY_DIAL
+	}
+
+	relay.mutex.Lock()
+	peer, found := relay.waiting[other]
+	if found {
+		delete(relay.waiting, other)
+	} else {
+		/* a node that asks again replaces its old request, only it could sign it */
+		if old, exists := relay.waiting[request]; exists {
+			old.Close()
+		}
+		relay.waiting[request] = conn
+	}
+	relay.mutex.Unlock()
+
+	if !found {
+		time.AfterFunc(RELAY_WAIT, func() {
+			relay.mutex.Lock()
+			if relay.waiting[request] == conn {
+				delete(relay.waiting, request)
+				conn.Close()
+			}
+			relay.mutex.Unlock()
+		})
+		return
+	}
+
+	fmt.Printf("Relay: connecting %s to %s\n", request.From, request.To)
+	for _, side := range []net.Conn{conn, peer} {
+		if _, err := io.WriteString(side, RELAY_OK+"\n"); err != nil {
+			conn.Close()
+			peer.Close()
+			return
+		}
+	}
+	go splice(conn, peer)
+	splice(peer, conn)
+}
+
+/*
+ * copies from one side to the other, closing both when either is done
+ */
+func splice(dst net.Conn, src net.Conn) {
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+}
@@ -0,0 +1,208 @@
+package messagePasser
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadRelayRequest(t *testing.T) {
+	lines := map[string]bool{
+		"MRELAY|DIAL|armin|lunwen|game|c2ln\n":    true,
+		"MRELAY|ACCEPT|armin|lunwen|game|c2ln\n":  true,
+		"MRELAY|CONNECT|armin|lunwen|game|c2ln\n": false,
+		"MRELAY|DIAL|armin|lunwen|game\n":         false,
+		"MRELAY|DIAL|armin|lunwen||c2ln\n":        false,
+		"MRELAY|DIAL||lunwen|game|c2ln\n":         false,
+		"GET / HTTP/1.1\n":                        false,
+	}
+	for line, valid := range lines {
+		client, server := net.Pipe()
+		go func() {
+			io.WriteString(client, line)
+			client.Close()
+		}()
+		request, err := readRelayRequest(server)
+		if valid && (err != nil || request.String() != line) {
+			t.Errorf("%q should be read back, got %+v, %v", line, request, err)
+		} else if !valid && err == nil {
+			t.Errorf("%q should be rejected.", line)
+		}
+		server.Close()
+	}
+}
+
+/*
+ * starts a relay on a free port for a game whose players all sign with
+ * the local key
+ */
+func startRelay(t *testing.T) net.Listener {
+	key, err := GenerateLocalKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	players := map[string]bool{"armin": true, "lunwen": true, "daniel": true}
+	go ServeRelay(ln, func(gameID string, name string) (string, bool) {
+		return key, gameID == "game" && players[name]
+	})
+	SetRelay(ln.Addr().String())
+	SetRelayGame("game")
+	t.Cleanup(func() { SetRelayGame("") })
+	return ln
+}
+
+func TestRelayPairsDialerAndAccepter(t *testing.T) {
+	ln := startRelay(t)
+	defer ln.Close()
+	defer SetRelay("")
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := acceptRelayed("armin", "lunwen", nil)
+		if err != nil {
+			t.Errorf("Accept through the relay failed: %v", err)
+		}
+		accepted <- conn
+	}()
+	dialed, err := dialRelayed("armin", "lunwen")
+	if err != nil {
+		t.Fatalf("Dial through the relay failed: %v", err)
+	}
+	defer dialed.Close()
+	conn := <-accepted
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	io.WriteString(dialed, "ping")
+	buffer := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buffer); err != nil || string(buffer) != "ping" {
+		t.Errorf("Expected ping, got %q, %v", buffer, err)
+	}
+	io.WriteString(conn, "pong")
+	if _, err := io.ReadFull(dialed, buffer); err != nil || string(buffer) != "pong" {
+		t.Errorf("Expected pong, got %q, %v", buffer, err)
+	}
+}
+
+func TestRelayWaitCanBeCancelled(t *testing.T) {
+	ln := startRelay(t)
+	defer ln.Close()
+	defer SetRelay("")
+
+	cancel := make(chan struct{})
+	result := make(chan error)
+	go func() {
+		_, err := acceptRelayed("daniel", "lunwen", cancel)
+		result <- err
+	}()
+	/* someone else's dial doesn't pair with us */
+	dialCancel := make(chan struct{})
+	dialed := make(chan struct{})
+	go func() {
+		openRelay(RelayRequest{Side: RELAY_DIAL, From: "armin", To: "lunwen"}, dialCancel)
+		close(dialed)
+	}()
+	/* both waits have to be over before the relay is turned off */
+	defer func() {
+		close(dialCancel)
+		<-dialed
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(cancel)
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("Cancelled wait should fail.")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Cancelling didn't stop the wait.")
+		<-result
+	}
+}
+
+/*
+ * sends a request to the relay signed by sign, which gets the relay's
+ * nonce
+ * @return	whether the relay kept the connection open
+ **/
+func sendRelayRequest(t *testing.T, request RelayRequest, sign func(nonce string) []byte) bool {
+	conn, err := net.Dial("tcp", relayAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	nonce, err := readRelayNonce(conn)
+	if err != nil {
+		t.Fatalf("No nonce from the relay: %v", err)
+	}
+	request.Signature = base64.StdEncoding.EncodeToString(sign(nonce))
+	io.WriteString(conn, request.String())
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestRelayRefusesRequestsNotSignedByThePlayer(t *testing.T) {
+	ln := startRelay(t)
+	defer ln.Close()
+	defer SetRelay("")
+
+	cancel := make(chan struct{})
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := acceptRelayed("armin", "lunwen", cancel)
+		accepted <- conn
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	/* someone without lunwen's key tries to take its place */
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	request := RelayRequest{Side: RELAY_ACCEPT, From: "armin", To: "lunwen", Game: "game"}
+	if sendRelayRequest(t, request, func(nonce string) []byte {
+		return ed25519.Sign(otherKey, relayDigest(nonce, request))
+	}) {
+		t.Errorf("A request signed with another key should be refused.")
+	}
+	/* a signature of lunwen's made for another connection */
+	stale := Sign(relayDigest("0000", request))
+	if sendRelayRequest(t, request, func(nonce string) []byte { return stale }) {
+		t.Errorf("A signature over another nonce should be refused.")
+	}
+	other := request
+	other.Game = "other"
+	if sendRelayRequest(t, other, func(nonce string) []byte { return Sign(relayDigest(nonce, other)) }) {
+		t.Errorf("A request for another game should be refused.")
+	}
+
+	/* lunwen's request is still the one waiting */
+	dialed, err := dialRelayed("armin", "lunwen")
+	if err != nil {
+		close(cancel)
+		<-accepted
+		t.Fatalf("Dial through the relay failed: %v", err)
+	}
+	defer dialed.Close()
+	select {
+	case conn := <-accepted:
+		if conn == nil {
+			t.Fatalf("Lunwen's wait was cut short.")
+		}
+		conn.Close()
+	case <-time.After(time.Second):
+		close(cancel)
+		<-accepted
+		t.Errorf("The dial didn't reach lunwen's wait.")
+	}
+}
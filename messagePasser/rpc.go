@@ -0,0 +1,164 @@
+////////////////////////////////////////////////////////////
+//Multegula - rpc.go
+//Request/response calls on top of the Message Passer
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/*
+ * Call sends a direct message with a fresh CorrelationID and waits for
+ * the message answering it. On the other side, a request never reaches
+ * Receive(): the handler registered for its Kind runs in its own routine
+ * and whatever it returns goes back as the reply, with the same Kind and
+ * CorrelationID and IsReply set. Replies that nobody waits for any more,
+ * because the call timed out, are dropped.
+ */
+
+/* answers a request, the returned string is the reply's Content */
+type RequestHandler func(request Message) (string, error)
+
+/* returned by Call when the other side couldn't answer the request */
+type RemoteError struct {
+	Node   string
+	Kind   string
+	Reason string
+}
+
+func (err RemoteError) Error() string {
+	return fmt.Sprintf("%s request failed on %s: %s", err.Kind, err.Node, err.Reason)
+}
+
+/* a call waiting for its reply */
+type pendingCall struct {
+	destination string
+	reply       chan Message
+}
+
+var requestHandlers map[string]RequestHandler = make(map[string]RequestHandler)
+var pendingCalls map[int]*pendingCall = make(map[int]*pendingCall)
+var nextCorrelationID int = 0
+var callsMutex = &sync.Mutex{}
+
+/*
+ * registers the handler answering requests of a Kind, replacing any
+ * earlier one. This is a public method.
+ * @param	kind – the Kind of request
+ * @param	handler – called once for every request
+ **/
+func HandleRequest(kind string, handler RequestHandler) {
+	callsMutex.Lock()
+	requestHandlers[kind] = handler
+	callsMutex.Unlock()
+}
+
+/*
+ * sends a request and waits for its reply, this is a public method
+ * @param	ctx – bounds the wait, use context.WithTimeout
+ * @param	destination – the node to ask
+ * @param	kind – the Kind of request
+ * @param	payload – the request's Content
+ *
+ * @return	the reply, or ctx.Err() if it didn't come in time
+ **/
+func Call(ctx context.Context, destination string, kind string, payload string) (Message, error) {
+	if _, exists := getLink(destination); !exists {
+		return Message{}, errors.New("Node not found: " + destination)
+	}
+
+	call := &pendingCall{destination: destination, reply: make(chan Message, 1)}
+	callsMutex.Lock()
+	nextCorrelationID += 1
+	id := nextCorrelationID
+	pendingCalls[id] = call
+	callsMutex.Unlock()
+	defer func() {
+		callsMutex.Lock()
+		delete(pendingCalls, id)
+		callsMutex.Unlock()
+	}()
+
+	Send(Message{
+		Source:        LocalNode.Name,
+		Destination:   destination,
+		Content:       payload,
+		Kind:          kind,
+		CorrelationID: id,
+	})
+
+	select {
+	case reply := <-call.reply:
+		if reply.Kind == defs.MSG_RPC_ERROR {
+			return reply, RemoteError{Node: destination, Kind: kind, Reason: reply.Content}
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+/*
+ * takes requests and replies out of the stream of direct messages
+ * @param	message – a received direct message
+ *
+ * @return	true if the message was a request or reply and has been handled
+ **/
+func handleCallMessage(message Message) bool {
+	if message.CorrelationID == 0 {
+		return false
+	}
+
+	callsMutex.Lock()
+	defer callsMutex.Unlock()
+	if message.IsReply {
+		call, waiting := pendingCalls[message.CorrelationID]
+		if !waiting {
+			return true
+		}
+		if call.destination != message.Source {
+			fmt.Printf("DROPPING reply from %s to a call to %s\n", message.Source, call.destination)
+			return true
+		}
+		select {
+		case call.reply <- message:
+		default:
+		}
+		return true
+	}
+	go answerRequest(message, requestHandlers[message.Kind])
+	return true
+}
+
+/*
+ * runs the handler for a request and sends its reply back
+ * @param	request – the received request
+ * @param	handler – the handler registered for its Kind, or nil
+ **/
+func answerRequest(request Message, handler RequestHandler) {
+	reply := Message{
+		Source:        LocalNode.Name,
+		Destination:   request.Source,
+		Kind:          request.Kind,
+		CorrelationID: request.CorrelationID,
+		IsReply:       true,
+	}
+	if handler == nil {
+		reply.Kind = defs.MSG_RPC_ERROR
+		reply.Content = "No handler for " + request.Kind
+	} else if content, err := handler(request); err != nil {
+		reply.Kind = defs.MSG_RPC_ERROR
+		reply.Content = err.Error()
+	} else {
+		reply.Content = content
+	}
+	Send(reply)
+}
@@ -0,0 +1,104 @@
+package messagePasser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var startSendRoutine sync.Once
+
+/*
+ * sets up a single node talking to itself over an in-memory link, the
+ * same way InitMessagePasser connects a node to itself
+ */
+func setupLoopback(t *testing.T) {
+	LocalNode = Node{Name: "armin"}
+	PeerNodes = Nodes{LocalNode}
+	LocalIndex = 0
+	authRequired = false
+	dialLink, acceptLink := linkPair(t, false, false)
+	dialLink.name = LocalNode.Name
+	localLink = dialLink
+	addLink(LocalNode.Name, acceptLink)
+	startReceiving(acceptLink)
+	t.Cleanup(closeLinks)
+	startSendRoutine.Do(func() {
+		go sendMessageToConn()
+	})
+}
+
+func TestCallRoundTrip(t *testing.T) {
+	setupLoopback(t)
+	HandleRequest("TEST_UPPER", func(request Message) (string, error) {
+		return strings.ToUpper(request.Content), nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			payload := fmt.Sprintf("paddle %d", i)
+			reply, err := Call(ctx, "armin", "TEST_UPPER", payload)
+			if err != nil {
+				t.Errorf("Call %d failed: %v", i, err)
+			} else if reply.Content != strings.ToUpper(payload) || !reply.IsReply {
+				t.Errorf("Call %d got someone else's reply: %+v", i, reply)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(receiveChannel) != 0 {
+		t.Errorf("Requests and replies should not reach the application.")
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	setupLoopback(t)
+	HandleRequest("TEST_SLOW", func(request Message) (string, error) {
+		time.Sleep(200 * time.Millisecond)
+		return "late", nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Call(ctx, "armin", "TEST_SLOW", ""); err != context.DeadlineExceeded {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	/* the late reply is dropped */
+	time.Sleep(300 * time.Millisecond)
+	callsMutex.Lock()
+	pending := len(pendingCalls)
+	callsMutex.Unlock()
+	if pending != 0 || len(receiveChannel) != 0 {
+		t.Errorf("Late reply was kept: %d pending calls, %d received messages", pending, len(receiveChannel))
+	}
+}
+
+func TestCallRemoteErrors(t *testing.T) {
+	setupLoopback(t)
+	HandleRequest("TEST_FAIL", func(request Message) (string, error) {
+		return "", errors.New("no paddle")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := Call(ctx, "armin", "TEST_FAIL", "")
+	if remote, ok := err.(RemoteError); !ok || remote.Reason != "no paddle" {
+		t.Errorf("Expected the handler's error, got %v", err)
+	}
+	_, err = Call(ctx, "armin", "TEST_NO_HANDLER", "")
+	if _, ok := err.(RemoteError); !ok {
+		t.Errorf("Expected an error for a Kind without handler, got %v", err)
+	}
+	if _, err = Call(ctx, "mallory", "TEST_FAIL", ""); err == nil {
+		t.Errorf("Call to an unknown node should fail.")
+	}
+}
@@ -0,0 +1,318 @@
+////////////////////////////////////////////////////////////
+//Multegula - watch.go
+//Read-only game feed for spectators
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/*
+ * A spectator watches a game without playing in it. The bootstrap server
+ * gives every game a watch token: the players get it with their ticket,
+ * spectators that register to watch the game get it with the players'
+ * names and keys, but not their addresses. A player that allows watchers
+ * keeps its port open once its links are up. A spectator dials the player
+ * that let it watch, at the address that player gave it, and sends a
+ * WATCH_KIND message carrying the token. The player answers with a signed
+ * WATCH_KIND message of its own with the addresses of the players, and
+ * from then on sends a copy of every multicast it delivers, in the causal
+ * order it delivers them. The addresses are those of every player, for
+ * the spectator to go on with another one, so whoever holds the token
+ * learns where all the players of the game can be reached; the players
+ * only share the watch code with those they would give that to.
+ *
+ * Spectators aren't peers: they aren't in PeerNodes, so they never take
+ * part in elections or consensus, and nothing they send after the token
+ * is read. A spectator that can't keep up is dropped. The messages keep
+ * the signatures of their Source, so the spectator checks them against
+ * the players' keys, the player it watches through can't forge any. When
+ * that player goes away the spectator goes on with the next one; the
+ * multicasts delivered in between are missed, the ones seen twice are
+ * dropped.
+ */
+const WATCH_KIND string = "watch"
+const MAX_WATCHERS int = 8
+const WATCH_RETRIES int = 3
+
+/* the token spectators show, "" if we don't take any */
+var watchToken string = ""
+
+type watcher struct {
+	name string
+	link *peerLink
+	feed chan Message
+}
+
+var watchers map[*watcher]bool = make(map[*watcher]bool)
+var watchersMutex = &sync.Mutex{}
+
+/*
+ * lets spectators with the game's watch token follow our multicasts, this
+ * is a public method and has to be called before InitMessagePasser
+ * @param	token – the game's watch token, "" to turn spectators away
+ **/
+func AllowWatchers(token string) {
+	watchToken = token
+}
+
+/*
+ * takes the spectators and the players coming back, see rejoin.go,
+ * connecting to our port once the players are linked
+ * @param	accepted – the connections accepted on the port
+ **/
+func serveWatchers(accepted <-chan net.Conn) {
+	for conn := range accepted {
+		go acceptWatcher(conn)
+	}
+}
+
+/*
+ * runs the handshake with a spectator and checks its token, a player
+ * coming back is handed to acceptRejoin
+ */
+func acceptWatcher(conn net.Conn) {
+	link, err := acceptHandshake(conn)
+	if err != nil {
+		fmt.Printf("Handshake with %v failed: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	hello, err := link.readMessage()
+	conn.SetReadDeadline(time.Time{})
+	if err == nil && hello.Kind == REJOIN_KIND {
+		acceptRejoin(link, hello)
+		return
+	}
+	if err != nil || hello.Kind != WATCH_KIND || len(watchToken) == 0 ||
+		subtle.ConstantTimeCompare([]byte(hello.Content), []byte(watchToken)) != 1 {
+		fmt.Printf("Rejecting connection from %v: not a player or spectator of the game\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	welcome, err := watchWelcome(hello.Source)
+	if err != nil {
+		fmt.Printf("Couldn't welcome spectator %s: %v\n", hello.Source, err)
+		conn.Close()
+		return
+	}
+	w := &watcher{name: hello.Source, link: link, feed: make(chan Message, defs.QUEUE_SIZE)}
+	w.feed <- welcome
+	watchersMutex.Lock()
+	full := len(watchers) >= MAX_WATCHERS
+	if !full {
+		watchers[w] = true
+	}
+	watchersMutex.Unlock()
+	if full {
+		fmt.Printf("Rejecting spectator %s: %d are watching already\n", w.name, MAX_WATCHERS)
+		conn.Close()
+		return
+	}
+	fmt.Printf("%s is watching the game\n", w.name)
+	go feedWatcher(w)
+	// a spectator has nothing to say, reading only tells when it's gone
+	for {
+		if _, err := link.readMessage(); err != nil {
+			if _, isDecodeError := err.(decodeError); !isDecodeError {
+				break
+			}
+		}
+	}
+	dropWatcher(w)
+}
+
+/*
+ * the first message to a spectator, signed, with the addresses of all
+ * the players for it to go on with another one when we go away, every
+ * player takes spectators with the token
+ * @param	name – the spectator
+ **/
+func watchWelcome(name string) (Message, error) {
+	addresses := Nodes{}
+	for _, node := range PeerNodes {
+		addresses = append(addresses, Node{Name: node.Name, IP: node.IP, Port: node.Port, Addrs: node.Addrs})
+	}
+	encoded, err := json.Marshal(addresses)
+	if err != nil {
+		return Message{}, err
+	}
+	welcome := Message{Source: LocalNode.Name, Destination: name, Kind: WATCH_KIND, Content: string(encoded)}
+	stampMessageID(&welcome)
+	signMessage(&welcome)
+	return welcome, nil
+}
+
+/*
+ * writes the multicasts queued for a spectator until it's dropped
+ */
+func feedWatcher(w *watcher) {
+	for message := range w.feed {
+		if err := w.link.writeMessage(&message); err != nil {
+			break
+		}
+	}
+	// the read in acceptWatcher fails and drops the spectator, if it hasn't been
+	w.link.cancelTransfers()
+	w.link.conn.Close()
+}
+
+/*
+ * forgets a spectator and stops its feed, once
+ */
+func dropWatcher(w *watcher) {
+	watchersMutex.Lock()
+	if watchers[w] {
+		delete(watchers, w)
+		close(w.feed)
+		fmt.Printf("%s stopped watching the game\n", w.name)
+	}
+	watchersMutex.Unlock()
+}
+
+/*
+ * queues a multicast we deliver for every spectator, without waiting on
+ * any of them
+ */
+func feedWatchers(message Message) {
+	watchersMutex.Lock()
+	defer watchersMutex.Unlock()
+	for w := range watchers {
+		select {
+		case w.feed <- message:
+		default:
+			fmt.Printf("Dropping spectator %s, it can't keep up\n", w.name)
+			delete(watchers, w)
+			close(w.feed)
+		}
+	}
+}
+
+/*
+ * watches a game as a spectator instead of playing, this is a public
+ * method to call instead of InitMessagePasser
+ * @param	players – the players of the game with their keys, from the
+ *			bootstrap server
+ * @param	localName – our name, for the players' logs
+ * @param	token – the game's watch token
+ * @param	through – the address of the player that let us watch, "host:port"
+ *
+ * @return	the multicasts of the game, closed once no player can be
+ *			reached; an error if the player we watch through can't be
+ **/
+func Watch(players Nodes, localName string, token string, through string) (<-chan Message, error) {
+	// the players' signatures are always checked, we can't tell a player from the one we watch through
+	PeerNodes = keyedNodes(players)
+	sort.Sort(PeerNodes)
+	LocalNode = Node{Name: localName}
+	LocalIndex = -1
+	authRequired = true
+
+	link, next, err := watchThrough(Node{Addrs: []string{through}}, token)
+	if err != nil {
+		return nil, err
+	}
+	feed := make(chan Message, defs.QUEUE_SIZE)
+	go func() {
+		defer close(feed)
+		seen := newDedupWindow()
+		for {
+			message, err := link.readMessage()
+			if _, isDecodeError := err.(decodeError); isDecodeError {
+				continue
+			} else if err != nil {
+				link.conn.Close()
+				fmt.Printf("Lost the game feed: %v\n", err)
+				for retry := 0; retry < WATCH_RETRIES; retry++ {
+					if link, next, err = watchPlayer(next, token); err == nil {
+						break
+					}
+					time.Sleep(time.Second)
+				}
+				if err != nil {
+					return
+				}
+				continue
+			}
+			if err := verifyMessage(&message); err != nil {
+				fmt.Printf("REJECTING Message from the game feed: %v\n", err)
+				continue
+			}
+			if message.Destination != defs.MULTICAST_DEST || !seen.firstSeen(message.UniqueID()) {
+				continue
+			}
+			feed <- message
+		}
+	}()
+	return feed, nil
+}
+
+/*
+ * connects to the first player that can be reached, starting at first
+ * @return	the link, and where to start looking for the next one
+ **/
+func watchPlayer(first int, token string) (*peerLink, int, error) {
+	for i := 0; i < len(PeerNodes); i++ {
+		link, next, err := watchThrough(PeerNodes[(first+i)%len(PeerNodes)], token)
+		if err == nil {
+			return link, next, nil
+		}
+	}
+	return nil, first, errors.New("No player of the game can be reached")
+}
+
+/*
+ * connects to a player and waits for its welcome, taking the addresses
+ * of the players from it
+ * @param	node – where to reach the player
+ * @return	the link, and where to start looking for the next player
+ **/
+func watchThrough(node Node, token string) (*peerLink, int, error) {
+	link, err := dialLink(node)
+	if err != nil {
+		return nil, 0, err
+	}
+	hello := Message{Source: LocalNode.Name, Destination: node.Name, Kind: WATCH_KIND, Content: token}
+	if err := link.writeMessage(&hello); err != nil {
+		link.conn.Close()
+		return nil, 0, err
+	}
+	link.conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	welcome, err := link.readMessage()
+	link.conn.SetReadDeadline(time.Time{})
+	if err == nil && welcome.Kind != WATCH_KIND {
+		err = errors.New("Not let in to watch the game")
+	}
+	if err == nil {
+		err = verifyMessage(&welcome)
+	}
+	addresses := Nodes{}
+	if err == nil {
+		err = json.Unmarshal([]byte(welcome.Content), &addresses)
+	}
+	if err != nil {
+		link.conn.Close()
+		return nil, 0, err
+	}
+	for _, address := range addresses {
+		if index, _, err := FindNodeByName(PeerNodes, address.Name); err == nil {
+			PeerNodes[index].IP, PeerNodes[index].Port, PeerNodes[index].Addrs = address.IP, address.Port, address.Addrs
+		}
+	}
+	index, _, _ := FindNodeByName(PeerNodes, welcome.Source)
+	fmt.Printf("Watching the game through %s\n", welcome.Source)
+	return link, (index + 1) % len(PeerNodes), nil
+}
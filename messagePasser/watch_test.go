@@ -0,0 +1,167 @@
+package messagePasser
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/* waits until n spectators are watching */
+func waitForWatchers(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		watchersMutex.Lock()
+		count := len(watchers)
+		watchersMutex.Unlock()
+		if count == n {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Expected %d spectators, got %d", n, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/* stops the feeds of every spectator */
+func dropWatchers() {
+	watchersMutex.Lock()
+	dropped := []*watcher{}
+	for w := range watchers {
+		dropped = append(dropped, w)
+	}
+	watchersMutex.Unlock()
+	for _, w := range dropped {
+		dropWatcher(w)
+	}
+}
+
+/*
+ * the player of TestSpectatorGetsMulticasts runs in a process of its own,
+ * Watch takes the globals of this one. WATCH_HELPER_ENV carries its port.
+ */
+const WATCH_HELPER_ENV string = "MULTEGULA_WATCH_HELPER"
+
+func TestWatchHelper(t *testing.T) {
+	port, _ := strconv.Atoi(os.Getenv(WATCH_HELPER_ENV))
+	if port == 0 {
+		t.Skip("Only run by TestSpectatorGetsMulticasts.")
+	}
+	if _, err := SetLocalKey(os.Getenv(REJOIN_KEY_ENV)); err != nil {
+		t.Fatal(err)
+	}
+	LocalNode = Node{Name: "armin", IP: "127.0.0.1", Port: port}
+	PeerNodes = Nodes{LocalNode, {Name: "lunwen", IP: "127.0.0.1", Port: port + 1}}
+	AllowWatchers("secret")
+	ln, err := net.Listen("tcp", ListenAddress(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn)
+	go acceptConns(ln, accepted, nil)
+	go serveWatchers(accepted)
+	waitForWatchers(t, 1)
+
+	message := Message{Source: "armin", Destination: defs.MULTICAST_DEST, Kind: "MPL", Content: "paddle", ID: 7, Timestamp: []int{1}}
+	signMessage(&message)
+	forged := Message{Source: "armin", Destination: defs.MULTICAST_DEST, Kind: "MBB", Content: "forged", ID: 9, Timestamp: []int{2}}
+	ball := Message{Source: "armin", Destination: defs.MULTICAST_DEST, Kind: "MBB", Content: "ball", ID: 8, Timestamp: []int{2}}
+	signMessage(&ball)
+	feedWatchers(message)
+	feedWatchers(message)
+	feedWatchers(forged)
+	feedWatchers(ball)
+	// killed once the spectator has seen it all
+	waitForWatchers(t, 0)
+}
+
+func TestSpectatorGetsMulticasts(t *testing.T) {
+	peers, local, index, auth, key := PeerNodes, LocalNode, LocalIndex, authRequired, localPrivateKey
+	var feed <-chan Message
+	var cmd *exec.Cmd
+	var output bytes.Buffer
+	defer func() {
+		if cmd != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		if t.Failed() {
+			t.Logf("armin's output:\n%s", output.String())
+		}
+		// the feed is closed once no player is left to go on with
+		if feed != nil {
+			for range feed {
+			}
+		}
+		PeerNodes, LocalNode, LocalIndex, authRequired, localPrivateKey = peers, local, index, auth, key
+	}()
+	arminKey, _ := GenerateLocalKey()
+	arminPrivateKey := LocalKey()
+	lunwenKey, _ := GenerateLocalKey()
+	port := freePort(t)
+	helper := exec.Command(os.Args[0], "-test.run=^TestWatchHelper$")
+	helper.Env = append(os.Environ(), WATCH_HELPER_ENV+"="+strconv.Itoa(port), REJOIN_KEY_ENV+"="+arminPrivateKey)
+	helper.Stdout, helper.Stderr = &output, &output
+	if err := helper.Start(); err != nil {
+		t.Fatal(err)
+	}
+	cmd = helper
+
+	// the server only tells the names and keys, armin tells us where it is
+	players := Nodes{{Name: "armin", Key: arminKey}, {Name: "lunwen", Key: lunwenKey}}
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	var err error
+	feed, err = Watch(players, "spectator", "secret", address)
+	for retry := 0; err != nil && retry < 50; retry++ {
+		time.Sleep(100 * time.Millisecond)
+		feed, err = Watch(players, "spectator", "secret", address)
+	}
+	if err != nil {
+		t.Fatalf("Couldn't watch armin: %v", err)
+	}
+	if _, lunwen, _ := FindNodeByName(PeerNodes, "lunwen"); lunwen.Port != port+1 || lunwen.Key != lunwenKey {
+		t.Errorf("Expected lunwen's address from armin, got %+v", lunwen)
+	}
+
+	for _, expected := range []string{"paddle", "ball"} {
+		select {
+		case got := <-feed:
+			if got.Content != expected {
+				t.Errorf("Expected %s, got %+v", expected, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No %s on the feed.", expected)
+		}
+	}
+}
+
+func TestSpectatorNeedsTheToken(t *testing.T) {
+	defer AllowWatchers("")
+	AllowWatchers("secret")
+	dialSide, acceptSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		acceptWatcher(acceptSide)
+		close(done)
+	}()
+	link, err := dialHandshake(dialSide)
+	if err != nil {
+		t.Fatalf("Dial handshake failed: %v", err)
+	}
+	defer dialSide.Close()
+	link.writeMessage(&Message{Source: "spectator", Destination: "armin", Kind: WATCH_KIND, Content: "guess"})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("A spectator with the wrong token wasn't turned away.")
+	}
+	if _, err := link.readMessage(); err == nil {
+		t.Errorf("The connection should be closed.")
+	}
+	waitForWatchers(t, 0)
+}
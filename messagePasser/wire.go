@@ -0,0 +1,339 @@
+////////////////////////////////////////////////////////////
+//Multegula - wire.go
+//Framed, versioned wire protocol between peers
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package messagePasser
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Every peer connection starts with a handshake:
+ *
+ *   dialer   -> MAGIC(4) VERSION(1) COUNT(1) CODEC_ID(1)*COUNT FEATURES(1)
+ *   acceptor -> MAGIC(4) VERSION(1) CODEC_ID(1) FEATURES(1)
+ *
+ * The acceptor picks the first offered codec it knows, or answers with
+ * codec 0 if there is none or the versions differ. FEATURES are bits
+ * such as FEATURE_COMPRESSION; the acceptor answers with the features
+ * both sides offered, and only those are used. After that, each message
+ * travels as one frame:
+ *
+ *   FLAGS(1) LENGTH(4) [RAW_LENGTH(4) if compressed]
+ *       [FRAGMENT_HEADER(12) if a fragment] PAYLOAD(LENGTH)
+ *
+ * where the payload is the Message encoded with the negotiated codec,
+ * possibly compressed, or one fragment of it (see fragment.go). The first
+ * frame from the dialer is its signed ping.
+ */
+const WIRE_MAGIC uint32 = 0x4d554c54 // "MULT"
+const WIRE_VERSION uint8 = 4
+
+/* codec ID used by the acceptor to refuse a connection */
+const CODEC_NONE uint8 = 0
+
+/* upper bound for a single frame, anything bigger is a corrupt stream */
+const MAX_FRAME_SIZE uint32 = 1 << 20
+
+/* how long each side waits for the other's handshake */
+const HANDSHAKE_TIMEOUT = 5 * time.Second
+
+/* returned when the other side doesn't start with WIRE_MAGIC */
+var ErrNotMultegulaPeer = errors.New("Connection is not from a multegula peer, or the peer runs an older build")
+
+/* returned when the two sides speak different protocol versions */
+type VersionMismatchError struct {
+	Local  uint8
+	Remote uint8
+}
+
+func (err VersionMismatchError) Error() string {
+	return fmt.Sprintf("Wire protocol version mismatch: local %d, remote %d", err.Local, err.Remote)
+}
+
+/*
+ * a framed connection to a single peer, created by the handshake
+ */
+type peerLink struct {
+	name       string
+	conn       net.Conn
+	codec      Codec
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+	sent       LinkStats
+
+	/* stream compression, if both sides offered it */
+	compress      bool
+	deflater      *flate.Writer
+	deflateBuffer bytes.Buffer
+	inflater      io.ReadCloser
+	inflateBuffer bytes.Buffer
+
+	/* large messages, see fragment.go */
+	waitingWriters int32
+	transfers      map[uint32]*transfer
+	transfersMutex sync.Mutex
+	nextTransferID uint32
+	lastTransfer   chan struct{} // closed once the last transfer started is done
+	reassemblies   map[uint32]*reassembly
+}
+
+/*
+ * runs the dialer's half of the handshake on a fresh connection
+ * @param	conn – connection to the acceptor
+ *
+ * @return	the framed link, using the codec the acceptor picked
+ **/
+func dialHandshake(conn net.Conn) (*peerLink, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, 6, 7+len(preferredCodecs))
+	binary.BigEndian.PutUint32(hello, WIRE_MAGIC)
+	hello[4] = WIRE_VERSION
+	hello[5] = uint8(len(preferredCodecs))
+	hello = append(hello, preferredCodecs...)
+	hello = append(hello, localFeatures())
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	reply := make([]byte, 6)
+	if _, err := io.ReadFull(reader, reply); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(reply) != WIRE_MAGIC {
+		return nil, ErrNotMultegulaPeer
+	}
+	if reply[4] != WIRE_VERSION {
+		return nil, VersionMismatchError{WIRE_VERSION, reply[4]}
+	}
+	codec, exists := codecs[reply[5]]
+	if !exists {
+		return nil, fmt.Errorf("Peer refused all offered codecs %v", preferredCodecs)
+	}
+	features, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	return newPeerLink(conn, codec, reader, features), nil
+}
+
+/*
+ * runs the acceptor's half of the handshake on an accepted connection
+ * @param	conn – connection from the dialer
+ *
+ * @return	the framed link, using the codec we picked
+ **/
+func acceptHandshake(conn net.Conn) (*peerLink, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	hello := make([]byte, 6)
+	if _, err := io.ReadFull(reader, hello); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(hello) != WIRE_MAGIC {
+		return nil, ErrNotMultegulaPeer
+	}
+	offered := make([]byte, hello[5])
+	if _, err := io.ReadFull(reader, offered); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 7)
+	binary.BigEndian.PutUint32(reply, WIRE_MAGIC)
+	reply[4] = WIRE_VERSION
+	reply[5] = CODEC_NONE
+	if hello[4] != WIRE_VERSION {
+		conn.Write(reply)
+		return nil, VersionMismatchError{WIRE_VERSION, hello[4]}
+	}
+	features, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	codec, err := chooseCodec(offered)
+	if err != nil {
+		conn.Write(reply)
+		return nil, err
+	}
+	reply[5] = codec.ID()
+	reply[6] = localFeatures() & features
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+	return newPeerLink(conn, codec, reader, features), nil
+}
+
+/*
+ * creates a link once the handshake is done
+ * @param	remoteFeatures – the feature bits the other side offered
+ **/
+func newPeerLink(conn net.Conn, codec Codec, reader *bufio.Reader, remoteFeatures uint8) *peerLink {
+	link := &peerLink{conn: conn, codec: codec, reader: reader}
+	link.transfers = make(map[uint32]*transfer)
+	link.reassemblies = make(map[uint32]*reassembly)
+	link.compress = localFeatures()&remoteFeatures&FEATURE_COMPRESSION != 0
+	return link
+}
+
+/*
+ * encodes a message with the link's codec and writes it as one frame, or
+ * starts a background transfer if it is too large for one.
+ * Safe to call from several routines at once.
+ **/
+func (link *peerLink) writeMessage(message *Message) error {
+	payload, err := link.codec.Encode(message)
+	if err != nil {
+		return err
+	}
+	if len(payload) > MAX_MESSAGE_SIZE {
+		return fmt.Errorf("Message too large to send: %d bytes", len(payload))
+	}
+	if len(payload) > FRAGMENT_SIZE {
+		link.startTransfer(message, payload)
+		return nil
+	}
+
+	/* running transfers wait for us between fragments */
+	atomic.AddInt32(&link.waitingWriters, 1)
+	link.writeMutex.Lock()
+	atomic.AddInt32(&link.waitingWriters, -1)
+	defer link.writeMutex.Unlock()
+	return link.writeFrame(0, payload, nil)
+}
+
+/*
+ * writes a single frame, compressing the payload if worthwhile.
+ * Must be called with link.writeMutex held.
+ * @param	flags – FRAME_FRAGMENT or 0
+ * @param	payload – encoded message or fragment of one
+ * @param	fragment – fragment header, nil for whole messages
+ **/
+func (link *peerLink) writeFrame(flags uint8, payload []byte, fragment []byte) error {
+	body := payload
+	if link.compress && len(payload) >= compressionThreshold {
+		chunk, err := link.deflate(payload)
+		if err != nil {
+			return err
+		}
+		body = chunk
+		flags |= FRAME_COMPRESSED
+	}
+
+	frame := make([]byte, 5, 9+len(fragment)+len(body))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+	if flags&FRAME_COMPRESSED != 0 {
+		frame = frame[:9]
+		binary.BigEndian.PutUint32(frame[5:], uint32(len(payload)))
+	}
+	frame = append(frame, fragment...)
+	frame = append(frame, body...)
+
+	link.sent.EncodedBytes += uint64(len(payload))
+	link.sent.WireBytes += uint64(len(frame))
+	_, err := link.conn.Write(frame)
+	return err
+}
+
+/*
+ * reads frames until a whole message is in, and decodes it with the
+ * link's codec. Only one routine may read from a link.
+ **/
+func (link *peerLink) readMessage() (Message, error) {
+	for {
+		flags, fragment, payload, err := link.readFrame()
+		if err != nil {
+			return Message{}, err
+		}
+		if flags&FRAME_FRAGMENT != 0 {
+			if payload, err = link.addFragment(fragment, payload); err != nil {
+				return Message{}, err
+			}
+			if payload == nil {
+				continue
+			}
+		}
+		message := Message{}
+		if err := link.codec.Decode(payload, &message); err != nil {
+			return Message{}, decodeError{err}
+		}
+		return message, nil
+	}
+}
+
+/*
+ * reads one frame and undoes its compression
+ * @return	the frame's flags, fragment header (if any) and payload
+ **/
+func (link *peerLink) readFrame() (uint8, []byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(link.reader, header); err != nil {
+		return 0, nil, nil, err
+	}
+	flags := header[0]
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > MAX_FRAME_SIZE {
+		return 0, nil, nil, fmt.Errorf("Frame too large (%d bytes), stream is corrupt", length)
+	}
+	var rawLength uint32
+	if flags&FRAME_COMPRESSED != 0 {
+		if !link.compress {
+			return 0, nil, nil, errors.New("Compressed frame on an uncompressed link")
+		}
+		if _, err := io.ReadFull(link.reader, header[:4]); err != nil {
+			return 0, nil, nil, err
+		}
+		rawLength = binary.BigEndian.Uint32(header[:4])
+		if rawLength > MAX_FRAME_SIZE {
+			return 0, nil, nil, fmt.Errorf("Frame too large (%d bytes), stream is corrupt", rawLength)
+		}
+	}
+	var fragment []byte
+	if flags&FRAME_FRAGMENT != 0 {
+		fragment = make([]byte, 12)
+		if _, err := io.ReadFull(link.reader, fragment); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(link.reader, payload); err != nil {
+		return 0, nil, nil, err
+	}
+	if flags&FRAME_COMPRESSED != 0 {
+		var err error
+		if payload, err = link.inflate(payload, rawLength); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	return flags, fragment, payload, nil
+}
+
+/*
+ * a single frame that couldn't be decoded. The stream itself is still
+ * intact, so the reader can carry on with the next frame.
+ */
+type decodeError struct {
+	err error
+}
+
+func (err decodeError) Error() string {
+	return "Couldn't decode frame: " + err.err.Error()
+}
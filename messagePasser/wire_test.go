@@ -0,0 +1,88 @@
+package messagePasser
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	message := Message{Source: "armin", Destination: "EVR1", Content: "3|armin|daniel|lunwen", Kind: "MPL",
+		SeqNum: 42, Timestamp: []int{1, 0, 7, -2}, ID: 1 << 60, CorrelationID: 9, IsReply: true, Signature: []byte{1, 2, 3}}
+	for _, codec := range codecs {
+		payload, err := codec.Encode(&message)
+		if err != nil {
+			t.Fatalf("%s couldn't encode: %v", codec.Name(), err)
+		}
+		decoded := Message{}
+		if err := codec.Decode(payload, &decoded); err != nil {
+			t.Fatalf("%s couldn't decode: %v", codec.Name(), err)
+		}
+		if !reflect.DeepEqual(message, decoded) {
+			t.Errorf("%s round trip changed message.\nSent:%+v\nGot:%+v", codec.Name(), message, decoded)
+		}
+	}
+}
+
+func TestBinaryCodecRejectsTruncatedFrame(t *testing.T) {
+	message := Message{Source: "armin", Destination: "lunwen", Content: "hello", Kind: "MBB", Timestamp: []int{1, 2}}
+	codec := binaryCodec{}
+	payload, _ := codec.Encode(&message)
+	for i := 0; i < len(payload); i++ {
+		if codec.Decode(payload[:i], &Message{}) == nil {
+			t.Errorf("Truncated payload of %d bytes should not decode.", i)
+		}
+	}
+}
+
+func TestHandshakeNegotiatesCodec(t *testing.T) {
+	defer SetPreferredCodec("gob")
+	SetPreferredCodec("binary")
+	dialSide, acceptSide := net.Pipe()
+	accepted := make(chan *peerLink)
+	go func() {
+		link, err := acceptHandshake(acceptSide)
+		if err != nil {
+			t.Errorf("Accept handshake failed: %v", err)
+		}
+		accepted <- link
+	}()
+	dialLink, err := dialHandshake(dialSide)
+	if err != nil {
+		t.Fatalf("Dial handshake failed: %v", err)
+	}
+	acceptLink := <-accepted
+	if dialLink.codec.ID() != CODEC_BINARY || acceptLink.codec.ID() != CODEC_BINARY {
+		t.Errorf("Expected binary codec, got %s and %s", dialLink.codec.Name(), acceptLink.codec.Name())
+	}
+
+	message := Message{Source: "armin", Destination: "lunwen", Content: "ping", Kind: "ping", Timestamp: []int{0, 0}}
+	go dialLink.writeMessage(&message)
+	received, err := acceptLink.readMessage()
+	if err != nil || !reflect.DeepEqual(message, received) {
+		t.Errorf("Bad frame after handshake: %+v, %v", received, err)
+	}
+}
+
+func TestHandshakeRejectsOldPeer(t *testing.T) {
+	dialSide, acceptSide := net.Pipe()
+	go func() {
+		// an older build starts straight away with a gob stream
+		dialSide.Write([]byte{0x3b, 0xff, 0x81, 0x03, 0x01, 0x01, 0x07})
+	}()
+	if _, err := acceptHandshake(acceptSide); err != ErrNotMultegulaPeer {
+		t.Errorf("Expected ErrNotMultegulaPeer, got %v", err)
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	dialSide, acceptSide := net.Pipe()
+	go func() {
+		dialSide.Write([]byte{0x4d, 0x55, 0x4c, 0x54, WIRE_VERSION + 1, 1, CODEC_GOB})
+		dialSide.Read(make([]byte, 7))
+	}()
+	_, err := acceptHandshake(acceptSide)
+	if mismatch, ok := err.(VersionMismatchError); !ok || mismatch.Remote != WIRE_VERSION+1 {
+		t.Errorf("Expected VersionMismatchError, got %v", err)
+	}
+}
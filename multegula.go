@@ -7,20 +7,28 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/arminm/multegula/bootstrapClient"
 	"github.com/arminm/multegula/bridges"
 	"github.com/arminm/multegula/bullySelection"
 	"github.com/arminm/multegula/consensus"
 	"github.com/arminm/multegula/defs"
+	"github.com/arminm/multegula/lanDiscovery"
 	"github.com/arminm/multegula/messagePasser"
+	"github.com/arminm/multegula/payload"
+	"github.com/arminm/multegula/scoreKeeper"
+	"github.com/arminm/multegula/tlsTransport"
 )
 
 /*
@@ -48,6 +56,14 @@ var sendChannel chan messagePasser.Message = make(chan messagePasser.Message, de
  * keeping track of the proposal checks
  */
 
+/*
+ * the bootstrap server that started our game, it gets the game's report
+ */
+var reportServer bootstrapClient.Config
+var reportMutex = &sync.Mutex{} // quitting waits for a report being sent
+
+const REPORT_TIMEOUT = 10 * time.Second
+
 var propChecksMap map[string]*consensus.PropCheck = make(map[string]*consensus.PropCheck)
 var propCheckMutex = &sync.Mutex{}
 
@@ -175,14 +191,12 @@ func uiSetCompetitorLocation(myName string, peers *[]messagePasser.Node) {
 		nodeNames = append(nodeNames, node.Name)
 	}
 
-	// sort and get length
+	// sort and create content of message
 	sort.Strings(nodeNames)
-	length := len(nodeNames)
-
-	// create content of message
-	content := fmt.Sprintf("%d", length)
-	for _, name := range nodeNames {
-		content = fmt.Sprintf("%v%v%v", content, defs.PAYLOAD_DELIMITER, name)
+	content, err := payload.Encode(&payload.PlayerLocations{Players: nodeNames})
+	if err != nil {
+		fmt.Println("Couldn't send player locations:", err)
+		return
 	}
 
 	// create message and send message
@@ -199,18 +213,27 @@ func PyBridgeReceiver() {
 		message := bridges.ReceiveFromPyBridge()
 		switch message.Kind {
 		case defs.MSG_MYNAME:
-			localNameChannel <- message.Content
+			if name, ok := decodeFromUI(message).(*payload.Name); ok {
+				localNameChannel <- name.Name
+			}
 		case defs.MSG_GAME_TYPE:
-			gameTypeChannel <- message.Content
+			if gameType, ok := decodeFromUI(message).(*payload.GameType); ok {
+				gameTypeChannel <- gameType.Type
+			}
 		case defs.MSG_CON_REQ:
-			valueType := strings.Split(message.Content, "|")[0]
-			consensus.Propose(message.Content, valueType)
+			if value, ok := decodeFromUI(message).(*payload.ConsensusValue); ok {
+				consensus.Propose(value.Value, value.Type)
+			}
 		case defs.MSG_CON_REPLY:
-			valueType := strings.Split(message.Content, "|")[0]
+			value, ok := decodeFromUI(message).(*payload.ConsensusValue)
+			if !ok {
+				continue
+			}
 			propCheckMutex.Lock()
-			propCheck := propChecksMap[valueType]
-			(*propCheck.Callback)(message.Content)
-			delete(propChecksMap, valueType)
+			if propCheck, exists := propChecksMap[value.Type]; exists {
+				(*propCheck.Callback)(value.Value)
+				delete(propChecksMap, value.Type)
+			}
 			propCheckMutex.Unlock()
 		case defs.MSG_EXIT:
 			// echo back to UI
@@ -223,6 +246,19 @@ func PyBridgeReceiver() {
 	}
 }
 
+/*
+ * decodes the payload of a message from the UI that multegula acts on
+ * @return	the payload, or nil if it is malformed
+ */
+func decodeFromUI(message messagePasser.Message) payload.Payload {
+	value, err := payload.Decode(message.Kind, message.Content)
+	if err != nil {
+		fmt.Println("Dropping message from UI:", err)
+		return nil
+	}
+	return value
+}
+
 /* wait for incoming messages from the bully algorithm */
 func BullyReceiver() {
 	for {
@@ -259,11 +295,12 @@ func ConsensusCheckReceiverRoutine() {
 		propCheckMutex.Lock()
 		propChecksMap[propCheck.Prop.Type] = propCheck
 		propCheckMutex.Unlock()
+		content, _ := payload.Encode(&payload.ConsensusValue{Type: propCheck.Prop.Type, Value: propCheck.Prop.Value})
 		bridges.SendToPyBridge(messagePasser.Message{
 			Source:      messagePasser.LocalNode.Name,
 			Destination: messagePasser.LocalNode.Name,
 			Kind:        defs.MSG_CON_CHECK,
-			Content:     propCheck.Prop.Value,
+			Content:     content,
 		})
 	}
 }
@@ -274,11 +311,12 @@ func ConsensusCheckReceiverRoutine() {
 func ConsensusReachedRoutine() {
 	for {
 		proposal := consensus.ProposalToCommit()
+		content, _ := payload.Encode(&payload.ConsensusValue{Type: proposal.Type, Value: proposal.Value})
 		commitMessage := messagePasser.Message{
 			Source:      messagePasser.LocalNode.Name,
 			Destination: messagePasser.LocalNode.Name,
 			Kind:        defs.MSG_CON_COMMIT,
-			Content:     proposal.Value,
+			Content:     content,
 		}
 		bridges.SendToPyBridge(commitMessage)
 	}
@@ -289,6 +327,9 @@ func inboundDispatcher() {
 	for {
 		// get message from MessagePasser
 		message := messagePasser.Receive()
+		if scoreKeeper.Observe(message) {
+			go reportGame()
+		}
 
 		// Based on the type of message, determine where it needs routed
 		switch message.Kind {
@@ -325,29 +366,16 @@ func inboundDispatcher() {
 		case defs.MSG_SYNC_ERROR:
 			bridges.SendToPyBridge(message)
 		case defs.MSG_UNICORN:
-			initConsensus(message)
+			if unicorn, err := payload.Decode(message.Kind, message.Content); err == nil {
+				initConsensus(unicorn.(*payload.Name).Name)
+			}
 			bridges.SendToPyBridge(message)
 
-		// election messages
-		case defs.MSG_BULLY_ELECTION:
-			fallthrough
-		case defs.MSG_BULLY_ANSWER:
-			fallthrough
-		case defs.MSG_BULLY_ARE_YOU_ALIVE:
-			fallthrough
-		case defs.MSG_BULLY_IAM_ALIVE:
-			bullySelection.PutMessageToReceiveChannel(message)
+		// election messages, requests and replies are handled by messagePasser.Call
 		case defs.MSG_BULLY_UNICORN:
-			initConsensus(message)
 			bullySelection.PutMessageToReceiveChannel(message)
 
-		// consensus messages
-		case defs.CONSENSUS_ACCEPT_KIND:
-			fallthrough
-		case defs.CONSENSUS_REJECT_KIND:
-			fallthrough
-		case defs.CONSENSUS_PROPOSE_KIND:
-			fallthrough
+		// consensus commits, proposals and votes are handled by messagePasser.Call
 		case defs.CONSENSUS_COMMIT_KIND:
 			consensus.ReceiveMessage(message)
 		default:
@@ -387,9 +415,10 @@ func parseMainArguments(args []string) string {
 
 /*
  * Inits consensus when we receive a unicorn message
+ * @param	unicorn – the name of the new unicorn
  */
-func initConsensus(message messagePasser.Message) {
-	nodeIndex, node, err := messagePasser.FindNodeByName(messagePasser.PeerNodes, message.Content)
+func initConsensus(unicorn string) {
+	nodeIndex, node, err := messagePasser.FindNodeByName(messagePasser.PeerNodes, unicorn)
 	if err == nil {
 		peers := append(messagePasser.PeerNodes[:nodeIndex])
 		consensus.InitConsensus(node, peers, messagePasser.LocalNode.Name)
@@ -401,9 +430,160 @@ func initConsensus(message messagePasser.Message) {
 }
 
 /*
- *
+ * sends the report of our game to the bootstrap server, if we haven't yet
+ */
+func reportGame() {
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	report, ok := scoreKeeper.Report()
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), REPORT_TIMEOUT)
+	defer cancel()
+	config := reportServer
+	config.Backoff.MaxAttempts = 1
+	if err := bootstrapClient.SendReport(ctx, config, report); err != nil {
+		fmt.Println("Couldn't report the game:", err)
+		return
+	}
+	fmt.Println("Reported the game, the winner is", report.Winner)
+}
+
+/*
+ * prints the leaderboard of the bootstrap server, or a player's games
+ * @param	player – "" for the leaderboard
+ **/
+func printHistory(config bootstrapClient.Config, player string) {
+	if len(player) == 0 {
+		board, err := bootstrapClient.GetLeaderboard(context.Background(), config, 0)
+		if err != nil {
+			fmt.Println("Couldn't get the leaderboard:", err)
+			return
+		}
+		for i, stats := range board {
+			fmt.Printf("%2d. %-16s %3d wins %3d games %5d blocks %7d points (best %d)\n",
+				i+1, stats.Name, stats.Wins, stats.Games, stats.Blocks, stats.TotalScore, stats.BestScore)
+		}
+		return
+	}
+	games, err := bootstrapClient.GetHistory(context.Background(), config, player, 0)
+	if err != nil {
+		fmt.Println("Couldn't get the games of", player+":", err)
+		return
+	}
+	for _, game := range games {
+		fmt.Printf("%s  won by %-16s", game.Ended.Local().Format("2006-01-02 15:04"), game.Winner)
+		for _, result := range game.Players {
+			fmt.Printf("  %s %d (%d blocks)", result.Name, result.Score, result.Blocks)
+		}
+		fmt.Println()
+	}
+}
+
+/*
+ * watches a game as a spectator, printing its multicasts until no player
+ * can be reached
+ * @param	name – the spectator, for the players' logs
+ * @param	invitation – "CODE@HOST:PORT", the game's watch code and the
+ *			address of the player that shared it
+ **/
+func watchGame(config bootstrapClient.Config, name string, invitation string) {
+	code, through, found := strings.Cut(invitation, "@")
+	if !found {
+		fmt.Println("Couldn't watch the game: expected CODE@HOST:PORT from one of its players")
+		return
+	}
+	watched, err := bootstrapClient.WatchGame(context.Background(), config, name, code)
+	if err != nil {
+		fmt.Println("Couldn't watch the game:", err)
+		return
+	}
+	fmt.Printf("Watching game %s with %d players\n", watched.ID, len(watched.Players))
+	feed, err := messagePasser.Watch(watched.Players, name, watched.Token, through)
+	if err != nil {
+		fmt.Println("Couldn't watch the game:", err)
+		return
+	}
+	for message := range feed {
+		fmt.Printf("%-16s %-4s %s\n", message.Source, message.Kind, message.Content)
+	}
+	fmt.Println("The game is over, or its players are gone.")
+}
+
+/*
+ * shows progress or trouble joining a game on the UI's join screen
+ * @param	myName – the local player
+ * @param	code – one of the JOIN_STATUS_ codes
+ * @param	text – what to show, characters the UI can't take are replaced
+ **/
+func uiJoinStatus(myName string, code string, text string) {
+	for _, delimiter := range []string{defs.PAYLOAD_DELIMITER, defs.DELIMITER, "\n"} {
+		text = strings.Replace(text, delimiter, " ", -1)
+	}
+	content, err := payload.Encode(&payload.JoinStatus{Code: code, Text: text})
+	if err != nil {
+		fmt.Println("Couldn't send join status:", err)
+		return
+	}
+	bridges.SendToPyBridge(messagePasser.Message{Source: myName, Destination: myName,
+		Kind: defs.MSG_JOIN_STATUS, Content: content})
+}
+
+/*
+ * the join screen's line for the room we wait in, e.g.
+ * "Room K7QX2: 2/4 players, 1 ready, starting in 8s"
  */
-func runGame(gamePort int, uiPort int) {
+func lobbyText(progress bootstrapClient.LobbyProgress) string {
+	text := "Quick match"
+	if progress.Room != bootstrapClient.QUICK_MATCH {
+		text = "Room " + progress.Room
+	}
+	text += fmt.Sprintf(": %d/%d players", len(progress.Players), progress.MaxPlayers)
+	if progress.Ready > 0 {
+		text += fmt.Sprintf(", %d ready", progress.Ready)
+	}
+	if progress.Starting {
+		return text + ", starting..."
+	} else if progress.StartsIn > 0 {
+		return text + fmt.Sprintf(", starting in %v", progress.StartsIn.Round(time.Second))
+	} else if missing := progress.MinPlayers - len(progress.Players); missing > 0 {
+		return text + fmt.Sprintf(", waiting for %d more", missing)
+	}
+	return text
+}
+
+/*
+ * the join status code for an error from the bootstrap client
+ */
+func joinErrorCode(err error) string {
+	var unreachable *bootstrapClient.ServerUnreachableError
+	var rejected *bootstrapClient.NameRejectedError
+	var noRoom *bootstrapClient.RoomNotFoundError
+	var login *bootstrapClient.LoginError
+	var protocol *bootstrapClient.ProtocolError
+	var timeout *bootstrapClient.LobbyTimeoutError
+	if errors.As(err, &rejected) && rejected.Reason == bootstrapClient.REJECT_DUPLICATE_NAME {
+		return defs.JOIN_STATUS_NAME_TAKEN
+	} else if errors.As(err, &login) {
+		return defs.JOIN_STATUS_LOGIN
+	} else if errors.As(err, &protocol) {
+		return defs.JOIN_STATUS_VERSION
+	} else if errors.As(err, &noRoom) {
+		return defs.JOIN_STATUS_NO_ROOM
+	} else if errors.As(err, &timeout) {
+		return defs.JOIN_STATUS_TIMEOUT
+	} else if errors.As(err, &unreachable) {
+		return defs.JOIN_STATUS_UNREACHABLE
+	}
+	return defs.JOIN_STATUS_FAILED
+}
+
+/*
+ * plays a game with the players from the bootstrap server or the LAN
+ * @param	rejoin – come back to the game whose ticket we kept instead
+ **/
+func runGame(gamePort int, uiPort int, lan bool, rejoin bool, bootstrap bootstrapClient.Config) {
 	/**** THIS IS LIKE ACTUAL GAMEPLAY ***/
 	// initialize communication with the UI
 	fmt.Printf("Port is:%d\n", uiPort)
@@ -420,19 +600,94 @@ func runGame(gamePort int, uiPort int) {
 	if gameType == defs.GAME_TYPE_MULTI {
 		// get fellow players
 		localNode := messagePasser.Node{Name: localNodeName, IP: "127.0.0.1", Port: gamePort}
-		peers, err := bootstrapClient.GetNodes(localNode)
+		// peers on the same network or on IPv6 may reach us directly
+		localNode.Addrs = messagePasser.LocalAddresses(gamePort)
+		var key string
+		var err error
+		if rejoin && !lan {
+			// the other players know us by the key we played with
+			saved, err := bootstrapClient.LoadTicket(bootstrapClient.TicketPath(localNodeName))
+			if err == nil {
+				bootstrap.Rejoin = saved.Ticket
+				key, err = messagePasser.SetLocalKey(saved.Key)
+			}
+			if err != nil {
+				fmt.Println("Couldn't load the ticket of our game:", err)
+				uiJoinStatus(localNodeName, defs.JOIN_STATUS_FAILED, "No game to come back to")
+				return
+			}
+		} else {
+			key, err = messagePasser.GenerateLocalKey()
+			if err != nil {
+				fmt.Println("Couldn't generate signing key:", err)
+				panic(err)
+			}
+		}
+		localNode.Key = key
+		var peers *[]messagePasser.Node
+		if lan {
+			peers, err = lanDiscovery.GetNodes(localNode)
+		} else {
+			bootstrap.OnRetry = func(attempt int, wait time.Duration, err error) {
+				uiJoinStatus(localNodeName, defs.JOIN_STATUS_RETRYING,
+					fmt.Sprintf("Can't reach the server (attempt %d), retrying in %v", attempt, wait))
+			}
+			bootstrap.OnConnected = func() {
+				uiJoinStatus(localNodeName, defs.JOIN_STATUS_WAITING, "Connected, waiting for players...")
+			}
+			bootstrap.OnRoom = func(code string) {
+				if code != bootstrapClient.QUICK_MATCH {
+					fmt.Println("Waiting in room", code)
+					uiJoinStatus(localNodeName, defs.JOIN_STATUS_ROOM,
+						fmt.Sprintf("Room code %s, waiting for players...", code))
+				}
+			}
+			bootstrap.OnProgress = func(progress bootstrapClient.LobbyProgress) {
+				uiJoinStatus(localNodeName, defs.JOIN_STATUS_LOBBY, lobbyText(progress))
+			}
+			bootstrap.OnTicket = func(ticket bootstrapClient.Ticket) {
+				scoreKeeper.SetGameID(ticket.GameID)
+				messagePasser.AllowWatchers(ticket.Watch)
+				messagePasser.SetRelayGame(ticket.GameID)
+				fmt.Printf("Whoever may watch the game can with -watch=%s@HOST:%d, HOST being where we can be reached\n",
+					ticket.WatchCode, gamePort)
+				fmt.Println("Spectators learn where every player can be reached, share it only with those the players would tell that.")
+				// a client started again with -rejoin comes back with it
+				saved := bootstrapClient.SavedTicket{Name: localNodeName, Ticket: ticket, Key: messagePasser.LocalKey()}
+				if err := bootstrapClient.SaveTicket(bootstrapClient.TicketPath(localNodeName), saved); err != nil {
+					fmt.Println("Couldn't keep the ticket of our game:", err)
+				}
+			}
+			reportServer = bootstrap
+			peers, err = bootstrapClient.GetNodesContext(context.Background(), localNode, bootstrap)
+		}
 		if err != nil {
 			fmt.Println("Couldn't get peers:", err)
-			panic(err)
+			uiJoinStatus(localNodeName, joinErrorCode(err), err.Error())
+			return
+		}
+		for _, peer := range *peers {
+			if len(peer.Session) > 0 {
+				fmt.Println(peer.Name, "is logged in.")
+			}
 		}
 		*peers = append(*peers, localNode)
+		// every player signs its messages, one that can't is left out
+		*peers = messagePasser.SignedNodes(*peers)
 
 		// set competitor location
 		uiSetCompetitorLocation(localNode.Name, peers)
+		scoreKeeper.Init(*peers, localNodeName)
 
 		// initialize message passer
-		messagePasser.InitMessagePasser(*peers, localNodeName)
-		fmt.Println(localNodeName, "made message passer.")
+		rejoining := len(bootstrap.Rejoin.GameID) > 0
+		if rejoining {
+			messagePasser.RejoinMessagePasser(*peers, localNodeName)
+			fmt.Println(localNodeName, "is back in the game.")
+		} else {
+			messagePasser.InitMessagePasser(*peers, localNodeName)
+			fmt.Println(localNodeName, "made message passer.")
+		}
 
 		// initialize elections
 		go bullySelection.InitBullySelection(*peers, localNodeName)
@@ -442,6 +697,13 @@ func runGame(gamePort int, uiPort int) {
 		go BullyReceiver()
 		go inboundDispatcher()
 		go outboundDispatcher()
+
+		if rejoining {
+			// the unicorn's UI takes us back into the game
+			content, _ := payload.Encode(&payload.Name{Name: localNodeName})
+			go putMessageIntoSendChannel(messagePasser.Message{Source: localNodeName,
+				Destination: defs.MULTICAST_DEST, Kind: defs.MSG_REJOIN_REQ, Content: content})
+		}
 	}
 }
 
@@ -452,7 +714,38 @@ func main() {
 	consensusTestFlag := flag.Bool("ct", false, "Consensus Test Mode Flag")
 	uiPortFlag := flag.Int("uiport", defs.DEFAULT_UI_PORT, "Local port number for Python-Go bridge.")
 	gamePortFlag := flag.Int("gameport", defs.DEFAULT_GAME_PORT, "Local port number for MessagePasser.")
+	codecFlag := flag.String("codec", "gob", "Preferred wire codec for MessagePasser (gob, json or binary).")
+	compressFlag := flag.Bool("compress", false, "Offer stream compression on MessagePasser links.")
+	compressThresholdFlag := flag.Int("compressthreshold", messagePasser.DEFAULT_COMPRESSION_THRESHOLD, "Smallest encoded message, in bytes, worth compressing.")
+	causalFlag := flag.Bool("causal", false, "Deliver direct messages in causal order with multicasts.")
+	serverFlag := flag.String("server", defs.SERVER_DNS, "Bootstrap server address (host:port), or the addresses of a replicated service separated by commas.")
+	joinTimeoutFlag := flag.Duration("jointimeout", 0, "Give up joining a game after this long, e.g. 2m (default: never).")
+	roomFlag := flag.String("room", bootstrapClient.QUICK_MATCH, "Join code of a room on the bootstrap server (default: quick match).")
+	newRoomFlag := flag.Bool("newroom", false, "Create a room on the bootstrap server and wait there for friends.")
+	passwordFlag := flag.String("password", os.Getenv("MULTEGULA_PASSWORD"), "Log in to the account of our name on the bootstrap server (default: $MULTEGULA_PASSWORD).")
+	registerFlag := flag.Bool("register", false, "Create the account of our name with -password.")
+	leaderboardFlag := flag.Bool("leaderboard", false, "Print the leaderboard of the bootstrap server and quit.")
+	historyFlag := flag.String("history", "", "Print the last games of a player from the bootstrap server and quit.")
+	watchFlag := flag.String("watch", "", "Watch a game instead of playing, with the CODE@HOST:PORT one of its players shared, as the name given after the flags (default: spectator).")
+	readyFlag := flag.Bool("ready", false, "Tell the bootstrap server we are ready, rooms that start when everyone is ready don't wait for us.")
+	rejoinFlag := flag.Bool("rejoin", false, "Come back to the game we left, with the ticket kept when it started.")
+	lanFlag := flag.Bool("lan", false, "Find players on the local network instead of using the bootstrap server.")
+	relayFlag := flag.String("relay", "", "Relay for peers that can't be reached directly, \"none\" for none (default: the bootstrap server's).")
+	tlsFlags := tlsTransport.RegisterFlags()
 	flag.Parse()
+	if err := tlsTransport.Init(*tlsFlags); err != nil {
+		fmt.Println("Couldn't set up TLS:", err)
+		panic(err)
+	}
+	if err := messagePasser.SetPreferredCodec(*codecFlag); err != nil {
+		fmt.Println("Couldn't set codec:", err)
+		panic(err)
+	}
+	messagePasser.SetCompression(*compressFlag, *compressThresholdFlag)
+	messagePasser.SetCausalDirect(*causalFlag)
+	if *relayFlag != "none" {
+		messagePasser.SetRelay(*relayFlag)
+	}
 	// Read command-line arguments and prompt the user if not provided
 	args := flag.Args()
 
@@ -480,10 +773,40 @@ func main() {
 	}
 
 	// run actual game
-	runGame(*gamePortFlag, *uiPortFlag)
+	bootstrapConfig := bootstrapClient.DefaultConfig()
+	servers := strings.Split(*serverFlag, ",")
+	bootstrapConfig.Server = servers[0]
+	bootstrapConfig.Servers = servers[1:]
+	bootstrapConfig.Deadline = *joinTimeoutFlag
+	bootstrapConfig.Room = *roomFlag
+	bootstrapConfig.CreateRoom = *newRoomFlag
+	bootstrapConfig.Login = bootstrapClient.Login{Password: *passwordFlag, Register: *registerFlag}
+	if len(*relayFlag) == 0 {
+		// the bootstrap server tells us where its relay is
+		bootstrapConfig.OnRelay = messagePasser.SetRelay
+	}
+	if *leaderboardFlag || len(*historyFlag) > 0 {
+		printHistory(bootstrapConfig, *historyFlag)
+		return
+	}
+	if len(*watchFlag) > 0 {
+		name := "spectator"
+		if len(args) > 0 {
+			name = args[0]
+		}
+		watchGame(bootstrapConfig, name, *watchFlag)
+		return
+	}
+	if *readyFlag {
+		ready := make(chan struct{})
+		close(ready)
+		bootstrapConfig.Ready = ready
+	}
+	runGame(*gamePortFlag, *uiPortFlag, *lanFlag, *rejoinFlag, bootstrapConfig)
 
-	// Exit gracefully
+	// Exit gracefully, reporting the game if it ends early
 	<-exitChannel
+	reportGame()
 	fmt.Println("Quitting Multegula! Thank you for playing. :)")
 }
 
@@ -513,6 +836,12 @@ func testBootstrap(nodes messagePasser.Nodes) {
 }
 
 func testMessagePasser(localNode messagePasser.Node) {
+	key, err := messagePasser.GenerateLocalKey()
+	if err != nil {
+		fmt.Println("Couldn't generate signing key:", err)
+		panic(err)
+	}
+	localNode.Key = key
 	peers, err := bootstrapClient.GetNodes(localNode)
 	if err != nil {
 		fmt.Println("Couldn't get peers:", err)
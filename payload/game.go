@@ -0,0 +1,393 @@
+////////////////////////////////////////////////////////////
+//Multegula - game.go
+//Payloads of the messages exchanged with the Python UI
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package payload
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/*
+ * the field order of every legacy format below matches MsgIndex in
+ * UI/typedefs.py. Positions and speeds are fixed point values (FP_MULT)
+ * but the UI sometimes sends them as floats, so they are kept as float64.
+ */
+func init() {
+	for _, kind := range []string{defs.MSG_MYNAME, defs.MSG_DEAD_NODE, defs.MSG_KILL_NODE,
+		defs.MSG_REJOIN_REQ, defs.MSG_REJOIN_ACK, defs.MSG_UNICORN} {
+		Register(kind, func() Payload { return &Name{} })
+	}
+	for _, kind := range []string{defs.MSG_CON_REQ, defs.MSG_CON_REPLY, defs.MSG_CON_CHECK,
+		defs.MSG_CON_COMMIT, defs.MSG_FORCE_COMMIT} {
+		Register(kind, func() Payload { return &ConsensusValue{} })
+	}
+	Register(defs.MSG_GAME_TYPE, func() Payload { return &GameType{} })
+	Register(defs.MSG_JOIN_STATUS, func() Payload { return &JoinStatus{} })
+	Register(defs.MSG_PLAYER_LOC, func() Payload { return &PlayerLocations{} })
+	Register(defs.MSG_PADDLE_DIR, func() Payload { return &PaddleMove{} })
+	Register(defs.MSG_BALL_MISSED, func() Payload { return &BallMissed{} })
+	Register(defs.MSG_BALL_DEFLECTED, func() Payload { return &BallDeflected{} })
+	Register(defs.MSG_BLOCK_BROKEN, func() Payload { return &BlockBroken{} })
+	Register(defs.MSG_PAUSE_UPDATE, func() Payload { return &PauseUpdate{} })
+	Register(defs.MSG_START_PLAY, func() Payload { return &StartPlay{} })
+	Register(defs.MSG_SYNC_ERROR, func() Payload { return &SyncError{} })
+}
+
+/* a single player name: MSG_MYNAME, MSG_DEAD_NODE, MSG_UNICORN, ... */
+type Name struct {
+	Name string
+}
+
+func (value *Name) Validate() error {
+	return ValidateName(value.Name)
+}
+
+func (value *Name) LegacyFields() []string {
+	return []string{value.Name}
+}
+
+func (value *Name) SetLegacyFields(fields []string) error {
+	if err := expectFields(fields, 1); err != nil {
+		return err
+	}
+	value.Name = fields[0]
+	return nil
+}
+
+/* single or multi player, MSG_GAME_TYPE */
+type GameType struct {
+	Type string
+}
+
+func (value *GameType) Validate() error {
+	if value.Type != defs.GAME_TYPE_SINGLE && value.Type != defs.GAME_TYPE_MULTI {
+		return errors.New("Unknown game type: " + value.Type)
+	}
+	return nil
+}
+
+func (value *GameType) LegacyFields() []string {
+	return []string{value.Type}
+}
+
+func (value *GameType) SetLegacyFields(fields []string) error {
+	if err := expectFields(fields, 1); err != nil {
+		return err
+	}
+	value.Type = fields[0]
+	return nil
+}
+
+/* progress or trouble while joining a game, MSG_JOIN_STATUS */
+type JoinStatus struct {
+	Code string // one of the JOIN_STATUS_ codes
+	Text string // for the player to read
+}
+
+func (value *JoinStatus) Validate() error {
+	if len(value.Code) == 0 {
+		return errors.New("Join status without code")
+	}
+	return checkLegacyField(value.Text)
+}
+
+func (value *JoinStatus) LegacyFields() []string {
+	return []string{value.Code, value.Text}
+}
+
+func (value *JoinStatus) SetLegacyFields(fields []string) error {
+	if err := expectFields(fields, 2); err != nil {
+		return err
+	}
+	value.Code = fields[0]
+	value.Text = fields[1]
+	return nil
+}
+
+/* all players in alphabetical order, MSG_PLAYER_LOC */
+type PlayerLocations struct {
+	Players []string
+}
+
+func (value *PlayerLocations) Validate() error {
+	if len(value.Players) == 0 || len(value.Players) > defs.MAX_PLAYERS_PER_GAME {
+		return fmt.Errorf("Bad number of players: %d", len(value.Players))
+	}
+	seen := make(map[string]bool)
+	for _, name := range value.Players {
+		if err := ValidateName(name); err != nil {
+			return err
+		}
+		if seen[name] {
+			return errors.New("Player listed twice: " + name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+func (value *PlayerLocations) LegacyFields() []string {
+	return append([]string{strconv.Itoa(len(value.Players))}, value.Players...)
+}
+
+func (value *PlayerLocations) SetLegacyFields(fields []string) error {
+	count, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return err
+	}
+	if err := expectFields(fields, count+1); err != nil {
+		return err
+	}
+	value.Players = fields[1:]
+	return nil
+}
+
+/*
+ * a value being agreed on: MSG_CON_REQ, MSG_CON_CHECK, MSG_CON_COMMIT ...
+ * Value is opaque to Go, the UI reads it as more '|' separated fields.
+ */
+type ConsensusValue struct {
+	Type  string
+	Value string
+}
+
+func (value *ConsensusValue) Validate() error {
+	if len(value.Type) == 0 {
+		return errors.New("Consensus value without type")
+	}
+	return nil
+}
+
+func (value *ConsensusValue) LegacyFields() []string {
+	if len(value.Value) == 0 {
+		return []string{value.Type}
+	}
+	return append([]string{value.Type}, strings.Split(value.Value, defs.PAYLOAD_DELIMITER)...)
+}
+
+func (value *ConsensusValue) SetLegacyFields(fields []string) error {
+	value.Type = fields[0]
+	if len(fields) > 1 {
+		value.Value = strings.Join(fields[1:], defs.PAYLOAD_DELIMITER)
+	}
+	return nil
+}
+
+/* a paddle started or stopped moving, MSG_PADDLE_DIR */
+type PaddleMove struct {
+	Direction string
+	Center    float64
+	Width     float64
+}
+
+func (value *PaddleMove) Validate() error {
+	switch value.Direction {
+	case "L", "R", "S":
+		return nil
+	}
+	return errors.New("Unknown paddle direction: " + value.Direction)
+}
+
+func (value *PaddleMove) LegacyFields() []string {
+	return []string{value.Direction, formatFloat(value.Center), formatFloat(value.Width)}
+}
+
+func (value *PaddleMove) SetLegacyFields(fields []string) error {
+	if err := expectFields(fields, 3); err != nil {
+		return err
+	}
+	value.Direction = fields[0]
+	return parseFloats(fields[1:], &value.Center, &value.Width)
+}
+
+/* a player missed the ball, MSG_BALL_MISSED */
+type BallMissed struct {
+	Score int
+	Lives int
+}
+
+func (value *BallMissed) Validate() error {
+	return nil
+}
+
+func (value *BallMissed) LegacyFields() []string {
+	return []string{strconv.Itoa(value.Score), strconv.Itoa(value.Lives)}
+}
+
+func (value *BallMissed) SetLegacyFields(fields []string) error {
+	if err := expectFields(fields, 2); err != nil {
+		return err
+	}
+	return parseInts(fields, &value.Score, &value.Lives)
+}
+
+/* where the ball is headed after hitting something */
+type Ball struct {
+	XCenter float64
+	YCenter float64
+	Radius  float64
+	XSpeed  float64
+	YSpeed  float64
+}
+
+func (value *Ball) fields() []string {
+	return []string{formatFloat(value.XCenter), formatFloat(value.YCenter), formatFloat(value.Radius),
+		formatFloat(value.XSpeed), formatFloat(value.YSpeed)}
+}
+
+func (value *Ball) setFields(fields []string) error {
+	return parseFloats(fields, &value.XCenter, &value.YCenter, &value.Radius, &value.XSpeed, &value.YSpeed)
+}
+
+/* a paddle deflected the ball, MSG_BALL_DEFLECTED */
+type BallDeflected struct {
+	Ball
+	Score int
+}
+
+func (value *BallDeflected) Validate() error {
+	return nil
+}
+
+func (value *BallDeflected) LegacyFields() []string {
+	return append(value.Ball.fields(), strconv.Itoa(value.Score))
+}
+
+func (value *BallDeflected) SetLegacyFields(fields []string) error {
+	if err := expectFields(fields, 6); err != nil {
+		return err
+	}
+	if err := value.Ball.setFields(fields[:5]); err != nil {
+		return err
+	}
+	return parseInts(fields[5:], &value.Score)
+}
+
+/* the ball broke a block, MSG_BLOCK_BROKEN */
+type BlockBroken struct {
+	Ball
+	Score int
+	Lives int
+	Block int
+}
+
+func (value *BlockBroken) Validate() error {
+	if value.Block < 0 {
+		return fmt.Errorf("Bad block index: %d", value.Block)
+	}
+	return nil
+}
+
+func (value *BlockBroken) LegacyFields() []string {
+	return append(value.Ball.fields(), strconv.Itoa(value.Score), strconv.Itoa(value.Lives), strconv.Itoa(value.Block))
+}
+
+func (value *BlockBroken) SetLegacyFields(fields []string) error {
+	if err := expectFields(fields, 8); err != nil {
+		return err
+	}
+	if err := value.Ball.setFields(fields[:5]); err != nil {
+		return err
+	}
+	return parseInts(fields[5:], &value.Score, &value.Lives, &value.Block)
+}
+
+/* the countdown before a level, MSG_PAUSE_UPDATE */
+type PauseUpdate struct {
+	Countdown int
+	Level     int
+}
+
+func (value *PauseUpdate) Validate() error {
+	return nil
+}
+
+func (value *PauseUpdate) LegacyFields() []string {
+	return []string{strconv.Itoa(value.Countdown), strconv.Itoa(value.Level)}
+}
+
+func (value *PauseUpdate) SetLegacyFields(fields []string) error {
+	if err := expectFields(fields, 2); err != nil {
+		return err
+	}
+	return parseInts(fields, &value.Countdown, &value.Level)
+}
+
+/* the ball's first velocity, MSG_START_PLAY */
+type StartPlay struct {
+	XSpeed float64
+	YSpeed float64
+}
+
+func (value *StartPlay) Validate() error {
+	return nil
+}
+
+func (value *StartPlay) LegacyFields() []string {
+	return []string{formatFloat(value.XSpeed), formatFloat(value.YSpeed)}
+}
+
+func (value *StartPlay) SetLegacyFields(fields []string) error {
+	if err := expectFields(fields, 2); err != nil {
+		return err
+	}
+	return parseFloats(fields, &value.XSpeed, &value.YSpeed)
+}
+
+/* the UI noticed it is out of sync, MSG_SYNC_ERROR */
+type SyncError struct {
+	Code    string
+	Details []string
+}
+
+func (value *SyncError) Validate() error {
+	if len(value.Code) == 0 {
+		return errors.New("Sync error without code")
+	}
+	return nil
+}
+
+func (value *SyncError) LegacyFields() []string {
+	return append([]string{value.Code}, value.Details...)
+}
+
+func (value *SyncError) SetLegacyFields(fields []string) error {
+	value.Code = fields[0]
+	value.Details = fields[1:]
+	return nil
+}
+
+/* helpers for the legacy formats */
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func parseFloats(fields []string, values ...*float64) error {
+	for i, value := range values {
+		parsed, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return err
+		}
+		*value = parsed
+	}
+	return nil
+}
+
+func parseInts(fields []string, values ...*int) error {
+	for i, value := range values {
+		parsed, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return err
+		}
+		*value = parsed
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+////////////////////////////////////////////////////////////
+//Multegula - payload.go
+//Registry of typed message payloads
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package payload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/*
+ * Every Kind of message that carries data registers the Go struct of its
+ * payload here. Between nodes, Message.Content holds the payload as JSON,
+ * so a player name with a '|' in it no longer shifts every field after it.
+ * The Python UI still speaks the old pipe-delimited format; payloads it
+ * sends or receives implement LegacyPayload, and PyBridge converts them
+ * with FromLegacy and ToLegacy. Kinds nobody registered (e.g. MSG_EXIT)
+ * pass through untouched.
+ */
+
+/* the payload of one or more message Kinds */
+type Payload interface {
+	Validate() error
+}
+
+/* a payload that the Python UI reads and writes as '|' separated fields */
+type LegacyPayload interface {
+	Payload
+	LegacyFields() []string
+	SetLegacyFields(fields []string) error
+}
+
+/* creates an empty payload to decode into */
+type Factory func() Payload
+
+var registry map[string]Factory = make(map[string]Factory)
+var registryMutex = &sync.Mutex{}
+
+/*
+ * registers the payload of a Kind, usually from the init function of
+ * the package that handles that Kind
+ * @param	kind – the message Kind
+ * @param	factory – creates an empty payload
+ **/
+func Register(kind string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, exists := registry[kind]; exists {
+		panic("payload: Kind registered twice: " + kind)
+	}
+	registry[kind] = factory
+}
+
+/*
+ * finds the factory for a Kind
+ */
+func lookup(kind string) (Factory, bool) {
+	registryMutex.Lock()
+	factory, exists := registry[kind]
+	registryMutex.Unlock()
+	return factory, exists
+}
+
+/*
+ * validates a payload and encodes it for Message.Content
+ * @param	value – the payload
+ *
+ * @return	the encoded payload
+ **/
+func Encode(value Payload) (string, error) {
+	if err := value.Validate(); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+/*
+ * decodes and validates the payload of a message
+ * @param	kind – the message's Kind
+ * @param	content – the message's Content
+ *
+ * @return	a pointer to the Kind's payload struct
+ **/
+func Decode(kind string, content string) (Payload, error) {
+	factory, exists := lookup(kind)
+	if !exists {
+		return nil, errors.New("No payload registered for " + kind)
+	}
+	value := factory()
+	if err := json.Unmarshal([]byte(content), value); err != nil {
+		return nil, fmt.Errorf("Bad %s payload: %v", kind, err)
+	}
+	if err := value.Validate(); err != nil {
+		return nil, fmt.Errorf("Bad %s payload: %v", kind, err)
+	}
+	return value, nil
+}
+
+/*
+ * converts Content received from the Python UI to its encoded payload
+ * @param	kind – the message's Kind
+ * @param	content – the '|' separated fields
+ **/
+func FromLegacy(kind string, content string) (string, error) {
+	factory, exists := lookup(kind)
+	if !exists {
+		return content, nil
+	}
+	value, isLegacy := factory().(LegacyPayload)
+	if !isLegacy {
+		return "", errors.New("The UI can't send " + kind)
+	}
+	if err := value.SetLegacyFields(strings.Split(content, defs.PAYLOAD_DELIMITER)); err != nil {
+		return "", fmt.Errorf("Bad %s payload from UI: %v", kind, err)
+	}
+	return Encode(value)
+}
+
+/*
+ * converts encoded Content to the '|' separated fields the Python UI reads
+ * @param	kind – the message's Kind
+ * @param	content – the encoded payload
+ **/
+func ToLegacy(kind string, content string) (string, error) {
+	if _, exists := lookup(kind); !exists {
+		return content, nil
+	}
+	value, err := Decode(kind, content)
+	if err != nil {
+		return "", err
+	}
+	legacy, isLegacy := value.(LegacyPayload)
+	if !isLegacy {
+		return "", errors.New("The UI can't receive " + kind)
+	}
+	fields := legacy.LegacyFields()
+	for _, field := range fields {
+		if err := checkLegacyField(field); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(fields, defs.PAYLOAD_DELIMITER), nil
+}
+
+/*
+ * the UI splits on the delimiters and on newlines, so no field may
+ * contain them
+ */
+func checkLegacyField(field string) error {
+	if strings.Contains(field, defs.PAYLOAD_DELIMITER) || strings.Contains(field, defs.DELIMITER) || strings.Contains(field, "\n") {
+		return fmt.Errorf("%q can't be sent to the UI", field)
+	}
+	return nil
+}
+
+/*
+ * checks a player name. Names show up in the UI's messages, so they are
+ * held to the same rules as any field sent to it.
+ */
+func ValidateName(name string) error {
+	if len(name) == 0 {
+		return errors.New("Empty name")
+	}
+	return checkLegacyField(name)
+}
+
+/*
+ * checks the number of legacy fields
+ */
+func expectFields(fields []string, count int) error {
+	if len(fields) != count {
+		return fmt.Errorf("Expected %d fields, got %d", count, len(fields))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package payload
+
+import (
+	"testing"
+
+	"github.com/arminm/multegula/defs"
+)
+
+/* contents as the UI writes them, see UI/multegulaUI.py */
+var legacySamples = map[string]string{
+	defs.MSG_MYNAME:         "armin",
+	defs.MSG_GAME_TYPE:      "M",
+	defs.MSG_JOIN_STATUS:    "RETRY|Can't reach the server, retrying in 2s",
+	defs.MSG_PLAYER_LOC:     "3|armin|daniel|lunwen",
+	defs.MSG_PADDLE_DIR:     "L|250|83.5",
+	defs.MSG_BALL_MISSED:    "80|4",
+	defs.MSG_BALL_DEFLECTED: "2500|4570|50|30|-30|103",
+	defs.MSG_BLOCK_BROKEN:   "2500|4570|50|30|-30|108|5|17",
+	defs.MSG_PAUSE_UPDATE:   "3|2",
+	defs.MSG_START_PLAY:     "30.5|-20",
+	defs.MSG_SYNC_ERROR:     "CS|4|MBB|armin",
+	defs.MSG_CON_COMMIT:     "CGS|4|armin|23|3|daniel|53|5|lunwen|10|1|garrett|19|4|0|101110111101110111010",
+	defs.MSG_EXIT:           "MISFITS_RULE",
+}
+
+func TestLegacyRoundTrip(t *testing.T) {
+	for kind, legacy := range legacySamples {
+		content, err := FromLegacy(kind, legacy)
+		if err != nil {
+			t.Errorf("%s: couldn't convert %q: %v", kind, legacy, err)
+			continue
+		}
+		back, err := ToLegacy(kind, content)
+		if err != nil {
+			t.Errorf("%s: couldn't convert %q back: %v", kind, content, err)
+		} else if back != legacy {
+			t.Errorf("%s: round trip changed %q to %q", kind, legacy, back)
+		}
+	}
+}
+
+func TestDecodeTypedValues(t *testing.T) {
+	content, _ := FromLegacy(defs.MSG_BLOCK_BROKEN, legacySamples[defs.MSG_BLOCK_BROKEN])
+	value, err := Decode(defs.MSG_BLOCK_BROKEN, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, ok := value.(*BlockBroken)
+	if !ok || block.XCenter != 2500 || block.YSpeed != -30 || block.Lives != 5 || block.Block != 17 {
+		t.Errorf("Decoded the wrong values: %+v", value)
+	}
+
+	content, _ = Encode(&PlayerLocations{Players: []string{"armin", "lunwen"}})
+	value, err = Decode(defs.MSG_PLAYER_LOC, content)
+	if players, ok := value.(*PlayerLocations); err != nil || !ok || len(players.Players) != 2 {
+		t.Errorf("Couldn't decode player locations: %+v, %v", value, err)
+	}
+}
+
+func TestRejectsDelimitersInNames(t *testing.T) {
+	for _, name := range []string{"", "ar|min", "ar##min", "ar\nmin"} {
+		if _, err := Encode(&Name{Name: name}); err == nil {
+			t.Errorf("Name %q should be rejected.", name)
+		}
+		if _, err := Encode(&PlayerLocations{Players: []string{"lunwen", name}}); err == nil {
+			t.Errorf("Player %q should be rejected.", name)
+		}
+	}
+	/* a forged payload from a peer doesn't get through either */
+	if _, err := Decode(defs.MSG_UNICORN, `{"Name":"lun|wen"}`); err == nil {
+		t.Errorf("Decode should validate the payload.")
+	}
+}
+
+func TestRejectsMalformedLegacy(t *testing.T) {
+	malformed := map[string]string{
+		defs.MSG_PLAYER_LOC:   "3|armin|daniel",
+		defs.MSG_BLOCK_BROKEN: "2500|4570",
+		defs.MSG_PADDLE_DIR:   "UP|250|83",
+		defs.MSG_BALL_MISSED:  "eighty|4",
+		defs.MSG_GAME_TYPE:    "X",
+		defs.MSG_REJOIN_REQ:   "",
+		defs.MSG_PAUSE_UPDATE: "3",
+	}
+	for kind, legacy := range malformed {
+		if _, err := FromLegacy(kind, legacy); err == nil {
+			t.Errorf("%s: %q should be rejected.", kind, legacy)
+		}
+	}
+	if _, err := FromLegacy(defs.MSG_PLAYER_LOC, "-1"); err == nil {
+		t.Errorf("A negative player count should be rejected.")
+	}
+	if _, err := Decode(defs.MSG_BLOCK_BROKEN, "2500|4570"); err == nil {
+		t.Errorf("Legacy content should not decode as a payload.")
+	}
+	if _, err := Decode("NOPE", "{}"); err == nil {
+		t.Errorf("Unregistered kinds should not decode.")
+	}
+}
@@ -13,4 +13,4 @@ sleep 1
 
 #Start Bootstrap server.
 #Defaults to port 55555 if port isn't received.
-go run bootstrapServer/bootstrapServer.go -port=${1:-55555}
+go run ./bootstrapServer -port=${1:-55555}
@@ -0,0 +1,23 @@
+#!/bin/bash
+###########################################################
+#Multegula - run_replicas.sh                              #
+#Startup Script for a Replicated Bootstrap Service        #
+#Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He#
+###########################################################
+
+#Starts ${1:-3} bootstrap servers on localhost, on ports 55555, 55565, ...
+#replicating on 56555, 56565, ... Players join with
+#  go run multegula.go -server=localhost:55555,localhost:55565,localhost:55575
+#Stop one with Ctrl-C in its window or kill, the others take over.
+COUNT=${1:-3}
+REPLICAS=""
+for ((i = 0; i < COUNT; i++)); do
+    REPLICAS="$REPLICAS${REPLICAS:+,}localhost:$((56555 + 10 * i))"
+done
+
+for ((i = 0; i < COUNT; i++)); do
+    go run ./bootstrapServer -port=$((55555 + 10 * i)) -relayport=0 \
+        -admin=localhost:$((57555 + 10 * i)) \
+        -replicas=$REPLICAS -replica=localhost:$((56555 + 10 * i)) &
+done
+wait
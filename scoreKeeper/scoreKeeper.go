@@ -0,0 +1,154 @@
+////////////////////////////////////////////////////////////
+//Multegula - scoreKeeper.go
+//Keeping score of a game for the report its players send at its end
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package scoreKeeper
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/defs"
+	"github.com/arminm/multegula/messagePasser"
+	"github.com/arminm/multegula/payload"
+)
+
+/*
+ * Every player keeps score from the messages the players multicast, the
+ * way the UI does, and reports the game, or how far it got if the player
+ * leaves before the end: the bootstrap server keeps it once most of the
+ * players back its final results. A game is over once at most one player is still alive, and the
+ * winner is the one the UI's game over screen shows: the most points
+ * among the players alive, with EXTRA_LIFE_POINTS for every life left
+ * (see getWinner in UI/utility.py).
+ */
+const INIT_LIVES int = 5
+const EXTRA_LIFE_POINTS int = 50
+
+var mutex sync.Mutex
+var players = make(map[string]*bootstrapClient.PlayerResult)
+var localName string
+var gameID string
+var started bool // somebody scored
+var over bool
+var reported bool
+
+/*
+ * starts keeping score of a game
+ * @param	nodes – every player, us included
+ * @param	name – the local player
+ **/
+func Init(nodes []messagePasser.Node, name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	players = make(map[string]*bootstrapClient.PlayerResult)
+	for _, node := range nodes {
+		players[node.Name] = &bootstrapClient.PlayerResult{Name: node.Name, Lives: INIT_LIVES}
+	}
+	localName = name
+	started, over, reported = false, false, false
+}
+
+/*
+ * the bootstrap server's ID of the game, from our Ticket. Games without
+ * one, such as LAN games, aren't reported.
+ */
+func SetGameID(id string) {
+	mutex.Lock()
+	gameID = id
+	mutex.Unlock()
+}
+
+/*
+ * keeps score of a message the players sent each other
+ * @return	true if the game just ended
+ **/
+func Observe(message messagePasser.Message) bool {
+	switch message.Kind {
+	case defs.MSG_BALL_DEFLECTED, defs.MSG_BALL_MISSED, defs.MSG_BLOCK_BROKEN, defs.MSG_KILL_NODE:
+	default:
+		return false
+	}
+	value, err := payload.Decode(message.Kind, message.Content)
+	if err != nil {
+		return false
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	var player *bootstrapClient.PlayerResult
+	if name, ok := value.(*payload.Name); ok {
+		player = players[name.Name]
+	} else {
+		player = players[message.Source]
+	}
+	if player == nil {
+		return false
+	}
+	switch value := value.(type) {
+	case *payload.Name:
+		player.Left = true
+	case *payload.BallDeflected:
+		player.Score = value.Score
+	case *payload.BallMissed:
+		player.Score, player.Lives = value.Score, value.Lives
+	case *payload.BlockBroken:
+		player.Score, player.Lives = value.Score, value.Lives
+		player.Blocks++
+	}
+	started = started || message.Kind != defs.MSG_KILL_NODE
+	if over || len(players) < 2 || alive() > 1 {
+		return false
+	}
+	over = true
+	return true
+}
+
+/* the players still in the game, call with mutex held */
+func alive() int {
+	count := 0
+	for _, player := range players {
+		if !player.Left && player.Lives > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+/* call with mutex held */
+func winner() string {
+	winner, winningScore := "", 0
+	for _, player := range players {
+		if !player.Left && player.Lives > 0 {
+			if score := player.Score + player.Lives*EXTRA_LIFE_POINTS; score > winningScore {
+				winner, winningScore = player.Name, score
+			}
+		}
+	}
+	return winner
+}
+
+/*
+ * the signed report of the game, once. Only a game of the bootstrap
+ * server somebody scored in is reported.
+ * @return	the report, false if there is nothing for us to report
+ **/
+func Report() (bootstrapClient.GameReport, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if reported || !started || len(gameID) == 0 {
+		return bootstrapClient.GameReport{}, false
+	}
+	reported = true
+	report := bootstrapClient.GameReport{GameID: gameID, Reporter: localName, Winner: winner(),
+		Ended: time.Now().UTC().Truncate(time.Second), Final: over}
+	for _, player := range players {
+		report.Players = append(report.Players, *player)
+	}
+	sort.Slice(report.Players, func(i, j int) bool { return report.Players[i].Name < report.Players[j].Name })
+	bootstrapClient.SignReport(&report)
+	return report, true
+}
@@ -0,0 +1,60 @@
+package scoreKeeper
+
+import (
+	"testing"
+
+	"github.com/arminm/multegula/bootstrapClient"
+	"github.com/arminm/multegula/defs"
+	"github.com/arminm/multegula/messagePasser"
+	"github.com/arminm/multegula/payload"
+)
+
+func message(t *testing.T, source string, kind string, value payload.Payload) messagePasser.Message {
+	content, err := payload.Encode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messagePasser.Message{Source: source, Kind: kind, Content: content}
+}
+
+func TestGameIsReportedByEveryPlayer(t *testing.T) {
+	key, _ := messagePasser.GenerateLocalKey()
+	nodes := []messagePasser.Node{{Name: "armin", Key: key}, {Name: "lunwen"}, {Name: "daniel"}}
+	Init(nodes, "armin")
+	SetGameID("game1")
+	Observe(message(t, "lunwen", defs.MSG_BLOCK_BROKEN, &payload.BlockBroken{Score: 5, Lives: 5, Block: 1}))
+	Observe(message(t, "lunwen", defs.MSG_BLOCK_BROKEN, &payload.BlockBroken{Score: 10, Lives: 5, Block: 2}))
+	if Observe(message(t, "armin", defs.MSG_KILL_NODE, &payload.Name{Name: "daniel"})) {
+		t.Fatalf("Two players are still alive.")
+	}
+	if !Observe(message(t, "armin", defs.MSG_BALL_MISSED, &payload.BallMissed{Score: -20, Lives: 0})) {
+		t.Fatalf("Expected the game to be over.")
+	}
+	report, ok := Report()
+	if !ok || !report.Final || report.Winner != "lunwen" || report.GameID != "game1" || len(report.Players) != 3 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	expected := []bootstrapClient.PlayerResult{{Name: "armin", Score: -20}, {Name: "daniel", Lives: INIT_LIVES, Left: true},
+		{Name: "lunwen", Score: 10, Lives: 5, Blocks: 2}}
+	for i := range expected {
+		if report.Players[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], report.Players[i])
+		}
+	}
+	if err := bootstrapClient.VerifyReport(report, nodes[0]); err != nil {
+		t.Errorf("The report should be signed by armin: %v", err)
+	}
+	if _, ok := Report(); ok {
+		t.Errorf("A game is only reported once.")
+	}
+}
+
+func TestLeavingEarlyIsReportedAsNotFinal(t *testing.T) {
+	key, _ := messagePasser.GenerateLocalKey()
+	Init([]messagePasser.Node{{Name: "armin", Key: key}, {Name: "lunwen"}}, "armin")
+	SetGameID("game1")
+	Observe(message(t, "lunwen", defs.MSG_BLOCK_BROKEN, &payload.BlockBroken{Score: 5, Lives: 5, Block: 1}))
+	if report, ok := Report(); !ok || report.Final {
+		t.Errorf("Expected a report that isn't final, got %+v", report)
+	}
+}
@@ -0,0 +1,188 @@
+////////////////////////////////////////////////////////////
+//Multegula - selfSigned.go
+//Self-signed CA for local TLS games
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package tlsTransport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const CA_CERT_FILE string = "ca.pem"
+const CA_KEY_FILE string = "ca-key.pem"
+
+/* how long generated certificates stay valid */
+const CA_VALIDITY = 10 * 365 * 24 * time.Hour
+const LEAF_VALIDITY = 30 * 24 * time.Hour
+
+/*
+ * loads the CA in certDir (creating it the first time) and issues a fresh
+ * certificate for this instance signed by it.
+ * @param	certDir – directory shared by all local instances
+ *
+ * @return	the certificate for this instance and a pool holding the CA
+ **/
+func selfSignedCertificate(certDir string) (tls.Certificate, *x509.CertPool, error) {
+	caCert, caKey, err := loadOrCreateCA(certDir)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{Organization: []string{"Multegula"}, CommonName: hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(LEAF_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  localIPs(),
+	}
+	if len(hostname) > 0 {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	cert := tls.Certificate{
+		Certificate: [][]byte{der, caCert.Raw},
+		PrivateKey:  key,
+	}
+	return cert, pool, nil
+}
+
+/*
+ * reads the CA from certDir, or generates and stores a new one
+ */
+func loadOrCreateCA(certDir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(certDir, CA_CERT_FILE)
+	keyPath := filepath.Join(certDir, CA_KEY_FILE)
+	if _, err := os.Stat(certPath); err == nil {
+		return loadCA(certPath, keyPath)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{Organization: []string{"Multegula"}, CommonName: "Multegula Local CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.MkdirAll(certDir, 0700); err != nil {
+		return nil, nil, err
+	}
+	/*
+	 * several local instances may start at once. Whoever creates the key
+	 * file first wins, everyone else waits for and loads that CA.
+	 */
+	keyFile, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		time.Sleep(time.Second)
+		return loadCA(certPath, keyPath)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	pem.Encode(keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	keyFile.Close()
+	tmpPath := certPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Rename(tmpPath, certPath); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+/*
+ * reads a PEM CA certificate and key
+ */
+func loadCA(certPath string, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("Couldn't decode CA in " + filepath.Dir(certPath))
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+/*
+ * all IP addresses of this machine, so any of them can be dialed
+ */
+func localIPs() []net.IP {
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
@@ -0,0 +1,245 @@
+////////////////////////////////////////////////////////////
+//Multegula - tlsTransport.go
+//Optional TLS for peer, bootstrap and bridge connections
+//Armin Mahmoudi, Daniel Santoro, Garrett Miller, Lunwen He
+////////////////////////////////////////////////////////////
+
+package tlsTransport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+/*
+ * TLS settings, normally filled in from command-line flags.
+ * Certificates either come from files (CertFile, KeyFile and CAFile) or
+ * are issued at startup by a self-signed CA kept in CertDir, which is
+ * enough for local games where every instance shares the same directory.
+ */
+type Config struct {
+	Enabled    bool   // use TLS for peer and bootstrap connections
+	Bridge     bool   // also use TLS for the local PyBridge socket
+	CertFile   string // PEM certificate presented by this instance
+	KeyFile    string // PEM private key for CertFile
+	CAFile     string // PEM CA used to verify the other side
+	SelfSigned bool   // generate a local CA and certificate in CertDir
+	CertDir    string // where the self-signed CA is kept
+}
+
+/* the active configuration, set by Init */
+var config Config
+var serverConfig *tls.Config
+var clientConfig *tls.Config
+
+/*
+ * registers the TLS flags on the default command line.
+ * Must be called before flag.Parse().
+ */
+func RegisterFlags() *Config {
+	c := &Config{}
+	flag.BoolVar(&c.Enabled, "tls", false, "Use TLS for peer and bootstrap connections.")
+	flag.BoolVar(&c.Bridge, "uitls", false, "Also use TLS for the Python-Go bridge (requires -tls).")
+	flag.StringVar(&c.CertFile, "tlscert", "", "PEM certificate file.")
+	flag.StringVar(&c.KeyFile, "tlskey", "", "PEM private key file for -tlscert.")
+	flag.StringVar(&c.CAFile, "tlsca", "", "PEM CA file used to verify peers.")
+	flag.BoolVar(&c.SelfSigned, "tlsselfsigned", false, "Generate a self-signed CA and certificate for local games.")
+	flag.StringVar(&c.CertDir, "tlsdir", "certs", "Directory holding the self-signed CA.")
+	return c
+}
+
+/*
+ * builds the TLS configurations used by Listen and Dial
+ * @param	c – the TLS settings
+ *
+ * @return	an error if certificates couldn't be loaded or generated
+ **/
+func Init(c Config) error {
+	config = c
+	serverConfig = nil
+	clientConfig = nil
+	if !c.Enabled {
+		if c.Bridge {
+			return errors.New("-uitls requires -tls")
+		}
+		return nil
+	}
+
+	var cert tls.Certificate
+	var pool *x509.CertPool
+	var err error
+	if c.SelfSigned {
+		cert, pool, err = selfSignedCertificate(c.CertDir)
+		if err != nil {
+			return err
+		}
+	} else {
+		if len(c.CertFile) == 0 || len(c.KeyFile) == 0 || len(c.CAFile) == 0 {
+			return errors.New("TLS needs -tlscert, -tlskey and -tlsca, or -tlsselfsigned")
+		}
+		cert, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return err
+		}
+		pool, err = loadCAFile(c.CAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	serverConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	/*
+	 * players dial each other by whatever IP the bootstrap server saw, so the
+	 * certificate chain is verified against our CA but the host name isn't.
+	 * Peer identity is established by message signatures in messagePasser.
+	 */
+	clientConfig = &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, pool)
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+	return nil
+}
+
+/*
+ * returns if TLS is enabled for peer and bootstrap connections
+ */
+func Enabled() bool {
+	return config.Enabled
+}
+
+/*
+ * returns if TLS is enabled for the PyBridge socket
+ */
+func BridgeEnabled() bool {
+	return config.Enabled && config.Bridge
+}
+
+/*
+ * listens on a TCP address, wrapping accepted connections in TLS if enabled
+ * @param	address – the address to listen on, e.g. ":11111"
+ **/
+func Listen(address string) (net.Listener, error) {
+	if serverConfig == nil {
+		return net.Listen("tcp", address)
+	}
+	return tls.Listen("tcp", address, serverConfig)
+}
+
+/*
+ * dials a TCP address, using TLS if enabled
+ * @param	address – the address to dial, e.g. "localhost:55555"
+ **/
+func Dial(address string) (net.Conn, error) {
+	if clientConfig == nil {
+		return net.Dial("tcp", address)
+	}
+	return tls.Dial("tcp", address, clientConfig)
+}
+
+/*
+ * dials a TCP address like Dial, giving up after a timeout
+ * @param	address – the address to dial, e.g. "[::1]:55555"
+ * @param	timeout – how long to wait for the connection and TLS handshake
+ **/
+func DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if clientConfig == nil {
+		return dialer.Dial("tcp", address)
+	}
+	return tls.DialWithDialer(dialer, "tcp", address, clientConfig)
+}
+
+/*
+ * dials a TCP address like Dial, giving up when the context is done
+ * @param	ctx – cancels the dial and the TLS handshake
+ * @param	address – the address to dial
+ **/
+func DialContext(ctx context.Context, address string) (net.Conn, error) {
+	if clientConfig == nil {
+		dialer := &net.Dialer{}
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	dialer := &tls.Dialer{Config: clientConfig}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+/*
+ * runs TLS as the client over an existing connection if enabled, e.g.
+ * end to end through a relay
+ * @param	conn – the connection to wrap
+ **/
+func Client(conn net.Conn) net.Conn {
+	if clientConfig == nil {
+		return conn
+	}
+	return tls.Client(conn, clientConfig)
+}
+
+/*
+ * runs TLS as the server over an existing connection if enabled
+ * @param	conn – the connection to wrap
+ **/
+func Server(conn net.Conn) net.Conn {
+	if serverConfig == nil {
+		return conn
+	}
+	return tls.Server(conn, serverConfig)
+}
+
+/*
+ * loads a PEM file of CA certificates into a pool
+ */
+func loadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+/*
+ * verifies a presented certificate chain against our CA pool
+ */
+func verifyChain(rawCerts [][]byte, pool *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("Peer presented no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
@@ -0,0 +1,96 @@
+package tlsTransport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSelfSignedRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multegula-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Init(Config{})
+
+	if err := Init(Config{Enabled: true, SelfSigned: true, CertDir: dir}); err != nil {
+		t.Fatalf("Couldn't init self-signed TLS: %v", err)
+	}
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte(line))
+		conn.Close()
+	}()
+
+	conn, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't dial TLS listener: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("Expected a TLS connection, got %T", conn)
+	}
+	conn.Write([]byte("ping\n"))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || reply != "ping\n" {
+		t.Errorf("Bad echo over TLS: %q, %v", reply, err)
+	}
+
+	// a second instance must reuse the CA instead of making its own
+	if _, _, err := selfSignedCertificate(dir); err != nil {
+		t.Errorf("Couldn't reuse CA: %v", err)
+	}
+}
+
+func TestUntrustedCertificateRejected(t *testing.T) {
+	serverDir, _ := ioutil.TempDir("", "multegula-tls-server")
+	clientDir, _ := ioutil.TempDir("", "multegula-tls-client")
+	defer os.RemoveAll(serverDir)
+	defer os.RemoveAll(clientDir)
+	defer Init(Config{})
+
+	if err := Init(Config{Enabled: true, SelfSigned: true, CertDir: serverDir}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+	}()
+
+	// the client trusts a different CA
+	if err := Init(Config{Enabled: true, SelfSigned: true, CertDir: clientDir}); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := Dial(ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("Dial should fail against a server from another CA.")
+	}
+}
+
+func TestBridgeNeedsTLS(t *testing.T) {
+	defer Init(Config{})
+	if err := Init(Config{Bridge: true}); err == nil {
+		t.Errorf("-uitls without -tls should be rejected.")
+	}
+}